@@ -51,6 +51,7 @@ PRODUCT_RESPONSE=$(curl -s -X POST $BASE_URL/api/shop/add_product \
     "product_name": "宫保鸡丁",
     "description": "经典川菜，鸡肉花生搭配，香辣可口",
     "price": 28.80,
+    "packaging_fee": 1.00,
     "stock": 100
   }')
 
@@ -90,18 +91,75 @@ SHOP_PRODUCTS=$(curl -s -X GET "$BASE_URL/api/user/products?shop_id=$SHOP_ID" \
 
 echo "$SHOP_PRODUCTS" > test_data/shop_products.json
 
-# Step 3: 用户创建订单
-echo -e "${GREEN}步骤 3: 用户创建订单${NC}"
-ORDER_RESPONSE=$(curl -s -X POST $BASE_URL/api/user/order \
+# 下单前试算，返回商品小计、打包费、配送费、优惠、服务费和应付金额的明细
+QUOTE_RESPONSE=$(curl -s -X POST $BASE_URL/api/user/order/quote \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{
+    \"shop_id\": $SHOP_ID,
+    \"items\": [{\"product_id\": $PRODUCT_ID, \"quantity\": 2}],
+    \"delivery_latitude\": 39.9150,
+    \"delivery_longitude\": 116.4040
+  }")
+echo "订单试算响应: $QUOTE_RESPONSE"
+
+# 预约单：商家声明午餐预约时段，用户查询明天的可预约时段并按时段试算
+curl -s -X POST $BASE_URL/api/shop/delivery_slot \
+  -H "Authorization: Bearer $SHOP_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d '{"start_time": "12:00", "end_time": "13:00", "capacity": 20}' > test_data/delivery_slot.json
+echo "预约时段: $(cat test_data/delivery_slot.json)"
+TOMORROW=$(date -d tomorrow +%Y-%m-%d 2>/dev/null || date -v+1d +%Y-%m-%d)
+SLOTS_RESPONSE=$(curl -s -X GET "$BASE_URL/api/user/delivery_slots?shop_id=$SHOP_ID&date=$TOMORROW" \
+  -H "Authorization: Bearer $USER_TOKEN")
+echo "可预约时段: $SLOTS_RESPONSE"
+SCHEDULED_AT=$(echo $SLOTS_RESPONSE | jq -r '.data[0].scheduled_at' 2>/dev/null)
+SCHEDULED_QUOTE=$(curl -s -X POST $BASE_URL/api/user/order/quote \
   -H "Authorization: Bearer $USER_TOKEN" \
   -H "Content-Type: application/json" \
   -d "{
     \"shop_id\": $SHOP_ID,
-    \"product_id\": $PRODUCT_ID,
-    \"quantity\": 2,
+    \"items\": [{\"product_id\": $PRODUCT_ID, \"quantity\": 1}],
+    \"delivery_latitude\": 39.9150,
+    \"delivery_longitude\": 116.4040,
+    \"scheduled_at\": \"$SCHEDULED_AT\"
+  }")
+if echo "$SCHEDULED_QUOTE" | grep -q '"pricing"'; then
+    echo -e "${GREEN}✓ 预约单试算成功${NC}"
+else
+    echo -e "${RED}✗ 预约单试算失败: $SCHEDULED_QUOTE${NC}"
+fi
+
+# Step 3: 用户创建订单（携带 Idempotency-Key，网络重试不会重复下单）
+echo -e "${GREEN}步骤 3: 用户创建订单${NC}"
+IDEMPOTENCY_KEY="order-$(date +%s)-$RANDOM"
+ORDER_BODY="{
+    \"shop_id\": $SHOP_ID,
+    \"items\": [
+      {\"product_id\": $PRODUCT_ID, \"quantity\": 2}
+    ],
     \"delivery_address\": \"北京市海淀区中关村大街1号\",
+    \"delivery_latitude\": 39.9150,
+    \"delivery_longitude\": 116.4040,
     \"notes\": \"不要放香菜，少油\"
-  }")
+  }"
+ORDER_RESPONSE=$(curl -s -X POST $BASE_URL/api/user/order \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -H "Idempotency-Key: $IDEMPOTENCY_KEY" \
+  -d "$ORDER_BODY")
+
+# 使用相同的 Idempotency-Key 重试，应返回首次的响应
+REPLAY_RESPONSE=$(curl -s -X POST $BASE_URL/api/user/order \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -H "Idempotency-Key: $IDEMPOTENCY_KEY" \
+  -d "$ORDER_BODY")
+if [ "$REPLAY_RESPONSE" = "$ORDER_RESPONSE" ]; then
+    echo -e "${GREEN}✓ 重试请求返回了首次的响应，未重复下单${NC}"
+else
+    echo -e "${RED}✗ 重试请求的响应与首次不一致: $REPLAY_RESPONSE${NC}"
+fi
 
 echo "创建订单响应: $ORDER_RESPONSE"
 echo "$ORDER_RESPONSE" > test_data/order_response.json
@@ -121,19 +179,61 @@ fi
 
 echo "$ORDER_ID" > test_data/order_id.txt
 
+# 订单号：20 位数字，用户报给客服或商家时使用，订单接口可用 order_no 代替 order_id
+ORDER_NO=$(echo $ORDER_RESPONSE | jq -r '.data.order_no' 2>/dev/null)
+echo "订单号: $ORDER_NO"
+
+# 模拟支付渠道回调：签名为请求体的 HMAC-SHA256，密钥与服务端 PAYMENT_MOCK_SECRET 一致
+# 未设置时读取 config.env；服务端以开发模式使用公开密钥时为 mock_payment_secret
+PAYMENT_SECRET=${PAYMENT_MOCK_SECRET:-$(grep '^PAYMENT_MOCK_SECRET=' ../config.env 2>/dev/null | cut -d= -f2-)}
+PAYMENT_SECRET=${PAYMENT_SECRET:-mock_payment_secret}
+PROVIDER_REF=$(echo $ORDER_RESPONSE | jq -r '.data.payment.provider_ref' 2>/dev/null)
+PAYABLE_AMOUNT=$(echo $ORDER_RESPONSE | jq -r '.data.payment.amount' 2>/dev/null)
+CALLBACK_BODY="{\"provider_ref\": \"$PROVIDER_REF\", \"result\": \"paid\", \"amount\": $PAYABLE_AMOUNT}"
+CALLBACK_SIGNATURE=$(printf '%s' "$CALLBACK_BODY" | openssl dgst -sha256 -hmac "$PAYMENT_SECRET" | awk '{print $NF}')
+PAYMENT_RESPONSE=$(curl -s -X POST $BASE_URL/api/payment/callback \
+  -H "Content-Type: application/json" \
+  -H "X-Mock-Signature: $CALLBACK_SIGNATURE" \
+  -d "$CALLBACK_BODY")
+echo "支付回调响应: $PAYMENT_RESPONSE"
+if echo "$PAYMENT_RESPONSE" | grep -q '"status":"paid"'; then
+    echo -e "${GREEN}✓ 订单支付成功${NC}"
+else
+    echo -e "${RED}✗ 订单支付失败${NC}"
+fi
+
 # Step 4: 查询订单状态
 echo -e "${GREEN}步骤 4: 查询订单状态${NC}"
 curl -s -X GET "$BASE_URL/api/user/order/status?order_id=$ORDER_ID" \
   -H "Authorization: Bearer $USER_TOKEN" > test_data/order_status_new.json
 echo "订单状态(用户视角): $(cat test_data/order_status_new.json)"
 
+# 查询用户历史订单列表（游标分页）
+curl -s -X GET "$BASE_URL/api/user/orders?status=pending&limit=10" \
+  -H "Authorization: Bearer $USER_TOKEN" > test_data/user_orders.json
+echo "用户订单列表: $(cat test_data/user_orders.json)"
+
+# 商家查看订单看板中的新订单
+curl -s -X GET "$BASE_URL/api/shop/orders?group=new" \
+  -H "Authorization: Bearer $SHOP_TOKEN" > test_data/shop_orders_new.json
+echo "商家新订单看板: $(cat test_data/shop_orders_new.json)"
+
+# 商家按用户报出的订单号查找订单
+SHOP_SEARCH=$(curl -s -X GET "$BASE_URL/api/shop/orders?order_no=$ORDER_NO" \
+  -H "Authorization: Bearer $SHOP_TOKEN")
+if echo "$SHOP_SEARCH" | grep -q "\"order_no\":\"$ORDER_NO\""; then
+    echo -e "${GREEN}✓ 按订单号查找订单成功${NC}"
+else
+    echo -e "${RED}✗ 按订单号查找订单失败: $SHOP_SEARCH${NC}"
+fi
+
 # Step 5: 商家接单
 echo -e "${GREEN}步骤 5: 商家接单${NC}"
-ACCEPT_RESPONSE=$(curl -s -X PUT $BASE_URL/api/shop/accept_order \
+ACCEPT_RESPONSE=$(curl -s -X POST $BASE_URL/api/shop/accept_order \
   -H "Authorization: Bearer $SHOP_TOKEN" \
   -H "Content-Type: application/json" \
   -d "{
-    \"order_id\": $ORDER_ID,
+    \"order_no\": \"$ORDER_NO\",
     \"preparation_time\": 20,
     \"estimated_delivery_time\": 45
   }")
@@ -165,27 +265,84 @@ echo "$PUBLISH_RESPONSE" > test_data/delivery_published.json
 
 # Step 7: 骑手抢单
 echo -e "${GREEN}步骤 7: 骑手抢单${NC}"
+# 骑手需先上线才能接单，上线后定期发送心跳（上报定位也算心跳），超过 RIDER_HEARTBEAT_TIMEOUT 没有心跳自动离线
+ONLINE_RESPONSE=$(curl -s -X POST $BASE_URL/api/rider/online \
+  -H "Authorization: Bearer $RIDER_TOKEN")
+echo "骑手上线响应: $ONLINE_RESPONSE"
+HEARTBEAT_RESPONSE=$(curl -s -X POST $BASE_URL/api/rider/heartbeat \
+  -H "Authorization: Bearer $RIDER_TOKEN")
+echo "骑手心跳响应: $HEARTBEAT_RESPONSE"
+
+# 浏览附近的公共大厅订单（按位置查询，不会取走订单）；测试骑手尚未上报定位，按商家附近的坐标浏览
+HALL_RESPONSE=$(curl -s -X GET "$BASE_URL/api/rider/hall?latitude=31.2304&longitude=121.4737&radius_km=5" \
+  -H "Authorization: Bearer $RIDER_TOKEN")
+echo "公共大厅订单: $HALL_RESPONSE"
+
 GRAB_RESPONSE=$(curl -s -X POST $BASE_URL/api/rider/grab \
   -H "Authorization: Bearer $RIDER_TOKEN" \
   -H "Content-Type: application/json" \
-  -d "{
-    \"order_id\": $ORDER_ID,
-    \"expected_pickup_time\": 15,
-    \"delivery_notes\": \"已确认配送\"
-  }")
+  -d "{\"order_id\": $ORDER_ID}")
 
 echo "骑手抢单响应: $GRAB_RESPONSE"
 echo "$GRAB_RESPONSE" > test_data/rider_grab.json
 
+# 骑手身份取自 Token，订单已被抢走时再次抢单立即返回 409 ORDER_TAKEN
+REGRAB_RESPONSE=$(curl -s -o /dev/null -w "%{http_code}" -X POST $BASE_URL/api/rider/grab \
+  -H "Authorization: Bearer $RIDER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"order_id\": $ORDER_ID}")
+if [ "$REGRAB_RESPONSE" = "409" ]; then
+    echo -e "${GREEN}✓ 已被抢走的订单返回 409${NC}"
+else
+    echo -e "${RED}✗ 重复抢单返回 $REGRAB_RESPONSE${NC}"
+fi
+
+# 发布后系统按骑手得分派单，骑手通过 rider_<id> 频道收到派单后调用 /offer/respond 答复；
+# 测试骑手未上线时订单直接进入公共大厅，由上面的抢单接口接单。答复不存在的派单返回 404
+OFFER_RESPONSE=$(curl -s -o /dev/null -w "%{http_code}" -X POST $BASE_URL/api/rider/offer/respond \
+  -H "Authorization: Bearer $RIDER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d '{"offer_id": 999999999, "action": "accept"}')
+if [ "$OFFER_RESPONSE" = "404" ]; then
+    echo -e "${GREEN}✓ 不存在的派单返回 404${NC}"
+else
+    echo -e "${RED}✗ 答复不存在的派单返回 $OFFER_RESPONSE${NC}"
+fi
+
 # Step 8: 订单状态查询
 echo -e "${GREEN}步骤 8: 查询配送状态${NC}"
 curl -s -X GET "$BASE_URL/api/user/order/status?order_id=$ORDER_ID" \
   -H "Authorization: Bearer $USER_TOKEN" > test_data/order_status_delivery.json
 echo "订单状态(配送中): $(cat test_data/order_status_delivery.json)"
 
+# 骑手批量上报定位（写入 Redis GEO 索引和最近轨迹），用户查看配送中订单的骑手位置，商家查看附近骑手
+LOCATION_RESPONSE=$(curl -s -X POST $BASE_URL/api/rider/location \
+  -H "Authorization: Bearer $RIDER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d '{"points": [{"latitude": 31.2304, "longitude": 121.4737}, {"latitude": 31.2310, "longitude": 121.4741}]}')
+echo "骑手上报定位响应: $LOCATION_RESPONSE"
+
+INVALID_LOCATION=$(curl -s -o /dev/null -w "%{http_code}" -X POST $BASE_URL/api/rider/location \
+  -H "Authorization: Bearer $RIDER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d '{"latitude": 91, "longitude": 121.4737}')
+if [ "$INVALID_LOCATION" = "422" ]; then
+    echo -e "${GREEN}✓ 超出范围的经纬度返回 422${NC}"
+else
+    echo -e "${RED}✗ 上报超出范围的经纬度返回 $INVALID_LOCATION${NC}"
+fi
+
+curl -s -X GET "$BASE_URL/api/user/order/rider_location?order_id=$ORDER_ID" \
+  -H "Authorization: Bearer $USER_TOKEN" > test_data/order_rider_location.json
+echo "骑手位置: $(cat test_data/order_rider_location.json)"
+
+curl -s -X GET "$BASE_URL/api/shop/nearby_riders?radius_km=3" \
+  -H "Authorization: Bearer $SHOP_TOKEN" > test_data/nearby_riders.json
+echo "附近骑手: $(cat test_data/nearby_riders.json)"
+
 # Step 9: 骑手送达确认
 echo -e "${GREEN}步骤 9: 骑手确认送达${NC}"
-DELIVER_RESPONSE=$(curl -s -X PUT $BASE_URL/api/rider/complete \
+DELIVER_RESPONSE=$(curl -s -X POST $BASE_URL/api/rider/complete \
   -H "Authorization: Bearer $RIDER_TOKEN" \
   -H "Content-Type: application/json" \
   -d "{
@@ -198,6 +355,18 @@ DELIVER_RESPONSE=$(curl -s -X PUT $BASE_URL/api/rider/complete \
 echo "送达确认响应: $DELIVER_RESPONSE"
 echo "$DELIVER_RESPONSE" > test_data/delivery_complete.json
 
+# 订单送达后骑手下线；配送中的订单未送达时下线返回 409
+OFFLINE_RESPONSE=$(curl -s -X POST $BASE_URL/api/rider/offline \
+  -H "Authorization: Bearer $RIDER_TOKEN")
+echo "骑手下线响应: $OFFLINE_RESPONSE"
+STALE_HEARTBEAT=$(curl -s -o /dev/null -w "%{http_code}" -X POST $BASE_URL/api/rider/heartbeat \
+  -H "Authorization: Bearer $RIDER_TOKEN")
+if [ "$STALE_HEARTBEAT" = "409" ]; then
+    echo -e "${GREEN}✓ 离线骑手的心跳返回 409${NC}"
+else
+    echo -e "${RED}✗ 离线骑手的心跳返回 $STALE_HEARTBEAT${NC}"
+fi
+
 # Step 10: 最终订单状态
 echo -e "${GREEN}步骤 10: 查询最终订单状态${NC}"
 FINAL_STATUS=$(curl -s -X GET "$BASE_URL/api/user/order/status?order_id=$ORDER_ID" \
@@ -206,11 +375,233 @@ FINAL_STATUS=$(curl -s -X GET "$BASE_URL/api/user/order/status?order_id=$ORDER_I
 echo "$FINAL_STATUS" > test_data/order_status_final.json
 echo "最终订单状态: $FINAL_STATUS"
 
+# Step 11: 漏送商品部分退款（用户申请，商家审核后原路退回）
+echo -e "${GREEN}步骤 11: 部分退款${NC}"
+ORDER_ITEM_ID=$(echo $FINAL_STATUS | jq -r '.data.items[0].order_item_id' 2>/dev/null)
+REFUND_RESPONSE=$(curl -s -X POST $BASE_URL/api/user/refund/apply \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{
+    \"order_id\": $ORDER_ID,
+    \"items\": [{\"order_item_id\": $ORDER_ITEM_ID, \"quantity\": 1}],
+    \"reason_code\": \"missing_item\",
+    \"reason\": \"少送了一份宫保鸡丁\"
+  }")
+echo "退款申请响应: $REFUND_RESPONSE"
+REFUND_ID=$(echo $REFUND_RESPONSE | jq -r '.data.refund_id' 2>/dev/null)
+
+REVIEW_RESPONSE=$(curl -s -X POST $BASE_URL/api/shop/refund/review \
+  -H "Authorization: Bearer $SHOP_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"refund_id\": $REFUND_ID, \"approve\": true}")
+echo "$REVIEW_RESPONSE" > test_data/refund_reviewed.json
+if echo "$REVIEW_RESPONSE" | grep -q '"status":"succeeded"'; then
+    echo -e "${GREEN}✓ 部分退款成功${NC}"
+else
+    echo -e "${RED}✗ 部分退款失败: $REVIEW_RESPONSE${NC}"
+fi
+
+# Step 12: 到店自取订单（无配送费、不发布跑腿订单，商家核对取餐码后完成）
+echo -e "${GREEN}步骤 12: 到店自取订单${NC}"
+PICKUP_ORDER=$(curl -s -X POST $BASE_URL/api/user/order \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{
+    \"shop_id\": $SHOP_ID,
+    \"items\": [{\"product_id\": $PRODUCT_ID, \"quantity\": 1}],
+    \"fulfillment_type\": \"pickup\"
+  }")
+echo "自取订单响应: $PICKUP_ORDER"
+PICKUP_ORDER_NO=$(echo $PICKUP_ORDER | jq -r '.data.order_no' 2>/dev/null)
+PICKUP_CODE=$(echo $PICKUP_ORDER | jq -r '.data.pickup_code' 2>/dev/null)
+PICKUP_DELIVERY_FEE=$(echo $PICKUP_ORDER | jq -r '.data.pricing.delivery_fee' 2>/dev/null)
+if [ "$PICKUP_DELIVERY_FEE" = "0" ] && [ -n "$PICKUP_CODE" ] && [ "$PICKUP_CODE" != "null" ]; then
+    echo -e "${GREEN}✓ 自取订单无配送费，取餐码: $PICKUP_CODE${NC}"
+else
+    echo -e "${RED}✗ 自取订单创建异常: $PICKUP_ORDER${NC}"
+fi
+
+PICKUP_REF=$(echo $PICKUP_ORDER | jq -r '.data.payment.provider_ref' 2>/dev/null)
+PICKUP_AMOUNT=$(echo $PICKUP_ORDER | jq -r '.data.payment.amount' 2>/dev/null)
+PICKUP_CALLBACK="{\"provider_ref\": \"$PICKUP_REF\", \"result\": \"paid\", \"amount\": $PICKUP_AMOUNT}"
+PICKUP_SIGNATURE=$(printf '%s' "$PICKUP_CALLBACK" | openssl dgst -sha256 -hmac "$PAYMENT_SECRET" | awk '{print $NF}')
+curl -s -X POST $BASE_URL/api/payment/callback \
+  -H "Content-Type: application/json" \
+  -H "X-Mock-Signature: $PICKUP_SIGNATURE" \
+  -d "$PICKUP_CALLBACK" > /dev/null
+curl -s -X POST $BASE_URL/api/shop/accept_order \
+  -H "Authorization: Bearer $SHOP_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"order_no\": \"$PICKUP_ORDER_NO\"}" > /dev/null
+
+# 自取订单不能发布到跑腿大厅
+PICKUP_PUBLISH=$(curl -s -o /dev/null -w "%{http_code}" -X POST $BASE_URL/api/shop/publish_order \
+  -H "Authorization: Bearer $SHOP_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"order_no\": \"$PICKUP_ORDER_NO\"}")
+if [ "$PICKUP_PUBLISH" = "409" ]; then
+    echo -e "${GREEN}✓ 自取订单发布跑腿订单被拒绝${NC}"
+else
+    echo -e "${RED}✗ 自取订单发布跑腿订单返回 $PICKUP_PUBLISH${NC}"
+fi
+
+READY_RESPONSE=$(curl -s -X POST $BASE_URL/api/shop/order/ready \
+  -H "Authorization: Bearer $SHOP_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"order_no\": \"$PICKUP_ORDER_NO\"}")
+echo "备餐完成响应: $READY_RESPONSE"
+
+WRONG_CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST $BASE_URL/api/shop/order/picked_up \
+  -H "Authorization: Bearer $SHOP_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"order_no\": \"$PICKUP_ORDER_NO\", \"pickup_code\": \"000000x\"}")
+if [ "$WRONG_CODE" = "422" ]; then
+    echo -e "${GREEN}✓ 取餐码错误被拒绝${NC}"
+else
+    echo -e "${RED}✗ 取餐码错误返回 $WRONG_CODE${NC}"
+fi
+
+PICKED_UP_RESPONSE=$(curl -s -X POST $BASE_URL/api/shop/order/picked_up \
+  -H "Authorization: Bearer $SHOP_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"order_no\": \"$PICKUP_ORDER_NO\", \"pickup_code\": \"$PICKUP_CODE\"}")
+echo "$PICKED_UP_RESPONSE" > test_data/pickup_complete.json
+if echo "$PICKED_UP_RESPONSE" | grep -q '"status":"completed"'; then
+    echo -e "${GREEN}✓ 自取订单取餐完成${NC}"
+else
+    echo -e "${RED}✗ 自取订单取餐失败: $PICKED_UP_RESPONSE${NC}"
+fi
+
+# Step 13: 跨店合并下单（每个商家一个子订单，合并订单统一支付）
+echo -e "${GREEN}步骤 13: 跨店合并下单${NC}"
+# 同一商家只能出现在一个子订单中
+DUP_CHECKOUT=$(curl -s -o /dev/null -w "%{http_code}" -X POST $BASE_URL/api/user/checkout \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{
+    \"delivery_address\": \"北京市海淀区中关村大街1号\",
+    \"delivery_latitude\": 39.9150,
+    \"delivery_longitude\": 116.4040,
+    \"orders\": [
+      {\"shop_id\": $SHOP_ID, \"items\": [{\"product_id\": $PRODUCT_ID, \"quantity\": 1}]},
+      {\"shop_id\": $SHOP_ID, \"items\": [{\"product_id\": $PRODUCT_ID, \"quantity\": 1}]}
+    ]
+  }")
+if [ "$DUP_CHECKOUT" = "422" ]; then
+    echo -e "${GREEN}✓ 同一商家重复出现被拒绝${NC}"
+else
+    echo -e "${RED}✗ 同一商家重复出现返回 $DUP_CHECKOUT${NC}"
+fi
+
+# 测试数据只有一个商家，这里用单个子订单走通合并订单的支付和状态汇总
+CHECKOUT_RESPONSE=$(curl -s -X POST $BASE_URL/api/user/checkout \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -H "Idempotency-Key: checkout-$(date +%s)-$RANDOM" \
+  -d "{
+    \"delivery_address\": \"北京市海淀区中关村大街1号\",
+    \"delivery_latitude\": 39.9150,
+    \"delivery_longitude\": 116.4040,
+    \"orders\": [
+      {\"shop_id\": $SHOP_ID, \"items\": [{\"product_id\": $PRODUCT_ID, \"quantity\": 1}], \"notes\": \"合并订单\"}
+    ]
+  }")
+echo "合并下单响应: $CHECKOUT_RESPONSE"
+PARENT_NO=$(echo $CHECKOUT_RESPONSE | jq -r '.data.parent_no' 2>/dev/null)
+CHILD_ORDER_NO=$(echo $CHECKOUT_RESPONSE | jq -r '.data.orders[0].order_no' 2>/dev/null)
+
+# 子订单不能单独支付
+CHILD_PAY=$(curl -s -o /dev/null -w "%{http_code}" -X POST $BASE_URL/api/user/order/pay \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"order_no\": \"$CHILD_ORDER_NO\"}")
+if [ "$CHILD_PAY" = "409" ]; then
+    echo -e "${GREEN}✓ 子订单单独支付被拒绝${NC}"
+else
+    echo -e "${RED}✗ 子订单单独支付返回 $CHILD_PAY${NC}"
+fi
+
+CHECKOUT_REF=$(echo $CHECKOUT_RESPONSE | jq -r '.data.payment.provider_ref' 2>/dev/null)
+CHECKOUT_AMOUNT=$(echo $CHECKOUT_RESPONSE | jq -r '.data.payment.amount' 2>/dev/null)
+CHECKOUT_CALLBACK="{\"provider_ref\": \"$CHECKOUT_REF\", \"result\": \"paid\", \"amount\": $CHECKOUT_AMOUNT}"
+CHECKOUT_SIGNATURE=$(printf '%s' "$CHECKOUT_CALLBACK" | openssl dgst -sha256 -hmac "$PAYMENT_SECRET" | awk '{print $NF}')
+curl -s -X POST $BASE_URL/api/payment/callback \
+  -H "Content-Type: application/json" \
+  -H "X-Mock-Signature: $CHECKOUT_SIGNATURE" \
+  -d "$CHECKOUT_CALLBACK" > /dev/null
+
+PARENT_STATUS=$(curl -s -X GET "$BASE_URL/api/user/checkout/status?parent_no=$PARENT_NO" \
+  -H "Authorization: Bearer $USER_TOKEN")
+echo "$PARENT_STATUS" > test_data/parent_order.json
+if echo "$PARENT_STATUS" | grep -q '"status":"in_progress"'; then
+    echo -e "${GREEN}✓ 合并订单支付成功，汇总状态为进行中${NC}"
+else
+    echo -e "${RED}✗ 合并订单状态异常: $PARENT_STATUS${NC}"
+fi
+
+# 商家接单前取消合并订单，已支付的子订单自动退款
+PARENT_CANCEL=$(curl -s -X POST $BASE_URL/api/user/checkout/cancel \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"parent_no\": \"$PARENT_NO\", \"reason\": \"不想要了\"}")
+echo "取消合并订单响应: $PARENT_CANCEL"
+
+# Step 14: 办公室拼单（发起人创建拼单，参与者凭分享码加购，锁定后提交为一个订单并保存分账）
+echo -e "${GREEN}步骤 14: 办公室拼单${NC}"
+GROUP_CART=$(curl -s -X POST $BASE_URL/api/user/group_cart \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"shop_id\": $SHOP_ID}")
+echo "创建拼单响应: $GROUP_CART"
+SHARE_CODE=$(echo $GROUP_CART | jq -r '.data.share_code' 2>/dev/null)
+
+# 测试数据只有一个用户，这里由发起人自己加购；其他同事使用各自的 Token 调用同一接口
+curl -s -X POST $BASE_URL/api/user/group_cart/item \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"share_code\": \"$SHARE_CODE\", \"product_id\": $PRODUCT_ID, \"quantity\": 2}" > /dev/null
+curl -s -X POST $BASE_URL/api/user/group_cart/lock \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"share_code\": \"$SHARE_CODE\"}" > /dev/null
+
+# 锁定后不能再加购
+LOCKED_ADD=$(curl -s -o /dev/null -w "%{http_code}" -X POST $BASE_URL/api/user/group_cart/item \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -d "{\"share_code\": \"$SHARE_CODE\", \"product_id\": $PRODUCT_ID, \"quantity\": 3}")
+if [ "$LOCKED_ADD" = "409" ]; then
+    echo -e "${GREEN}✓ 拼单锁定后加购被拒绝${NC}"
+else
+    echo -e "${RED}✗ 拼单锁定后加购返回 $LOCKED_ADD${NC}"
+fi
+
+GROUP_SUBMIT=$(curl -s -X POST $BASE_URL/api/user/group_cart/submit \
+  -H "Authorization: Bearer $USER_TOKEN" \
+  -H "Content-Type: application/json" \
+  -H "Idempotency-Key: group-cart-$SHARE_CODE" \
+  -d "{
+    \"share_code\": \"$SHARE_CODE\",
+    \"delivery_address\": \"北京市海淀区中关村大街1号\",
+    \"delivery_latitude\": 39.9150,
+    \"delivery_longitude\": 116.4040
+  }")
+echo "提交拼单响应: $GROUP_SUBMIT"
+GROUP_PAYABLE=$(echo $GROUP_SUBMIT | jq -r '.data.pricing.payable' 2>/dev/null)
+GROUP_SHARES_TOTAL=$(echo $GROUP_SUBMIT | jq -r '[.data.shares[].payable] | add' 2>/dev/null)
+if [ -n "$GROUP_PAYABLE" ] && [ "$GROUP_PAYABLE" != "null" ] && [ "$GROUP_PAYABLE" = "$GROUP_SHARES_TOTAL" ]; then
+    echo "$GROUP_SUBMIT" > test_data/group_cart_submitted.json
+    echo -e "${GREEN}✓ 拼单已提交，分账合计与应付金额一致: $GROUP_PAYABLE${NC}"
+else
+    echo -e "${RED}✗ 拼单提交异常: $GROUP_SUBMIT${NC}"
+fi
+
 # 总结
 echo "======================================"
 echo "订单生命周期测试完成总结"
 echo "======================================"
 echo "订单ID: $ORDER_ID"
+echo "订单号: $ORDER_NO"
 echo "商品ID: $PRODUCT_ID"
 echo "商家ID: $SHOP_ID"
 echo "流程完成状态:"
@@ -235,6 +626,22 @@ if [ -f test_data/delivery_complete.json ]; then
     echo -e "${GREEN}✓ 订单完成送达${NC}"
 fi
 
+if [ -f test_data/refund_reviewed.json ]; then
+    echo -e "${GREEN}✓ 部分退款已审核${NC}"
+fi
+
+if [ -f test_data/pickup_complete.json ]; then
+    echo -e "${GREEN}✓ 自取订单取餐完成${NC}"
+fi
+
+if [ -f test_data/parent_order.json ]; then
+    echo -e "${GREEN}✓ 合并订单支付成功${NC}"
+fi
+
+if [ -f test_data/group_cart_submitted.json ]; then
+    echo -e "${GREEN}✓ 拼单提交成功${NC}"
+fi
+
 echo "所有测试数据已保存到 test_data/ 目录"
 echo "详细日志请查看 test_logs/order_flow.log"
 echo "======================================"
\ No newline at end of file
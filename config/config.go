@@ -0,0 +1,63 @@
+// 读取 config.env 和环境变量中的配置
+package config
+
+import (
+	"os"
+	"strconv"
+	"take-out/logging"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/sirupsen/logrus"
+)
+
+// Location 业务时区，固定为北京时间（没有夏令时）
+// 订单号中的时间、预约时段的钟点和自然日、按日期筛选订单、夜间配送费都按该时区计算，不受服务器或容器的时区配置影响
+var Location = time.FixedZone("CST", 8*3600)
+
+// Load 从 config.env 加载环境变量，已设置的环境变量（如 docker-compose 的 env_file）优先
+// 各模块的配置在 Load 之后读取，需在 main 中最先调用
+func Load() {
+	if err := godotenv.Load("config.env"); err != nil {
+		logging.Warn("加载 .env 文件失败", logrus.Fields{"error": err})
+	}
+}
+
+// Duration 读取时长配置（如 30s、15m），未配置或格式错误时使用默认值
+func Duration(key string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// Int 读取非负整数配置，未配置或格式错误时使用默认值
+func Int(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value >= 0 {
+		return value
+	}
+	return fallback
+}
+
+// IntBetween 读取取值在 [min, max] 内的整数配置，未配置时使用默认值；
+// 配置了但格式错误或超出范围时记录警告并使用默认值，避免错误配置导致业务规则失效
+func IntBetween(key string, fallback, min, max int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min || value > max {
+		logging.Warn("配置超出取值范围，使用默认值", logrus.Fields{"key": key, "value": raw, "min": min, "max": max, "default": fallback})
+		return fallback
+	}
+	return value
+}
+
+// Float 读取非负小数配置，未配置或格式错误时使用默认值
+func Float(key string, fallback float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil && value >= 0 {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,25 @@
+package config
+
+import "testing"
+
+func TestIntBetween(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 22},
+		{"0", 0},
+		{"23", 23},
+		{"6", 6},
+		{"24", 22},
+		{"-1", 22},
+		{"22.9", 22},
+		{"abc", 22},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_HOUR", tt.value)
+		if got := IntBetween("TEST_HOUR", 22, 0, 23); got != tt.want {
+			t.Errorf("IntBetween(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
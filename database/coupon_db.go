@@ -0,0 +1,244 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrCouponNotFound    = errors.New("优惠券不存在")
+	ErrCouponNotActive   = errors.New("优惠券不在领取有效期内")
+	ErrCouponSoldOut     = errors.New("优惠券已领完")
+	ErrCouponClaimLimit  = errors.New("已达到该优惠券的领取上限")
+	ErrCouponUnavailable = errors.New("优惠券已使用或不属于当前用户")
+)
+
+const couponColumns = `c.coupon_id, COALESCE(c.shop_id, 0), c.title, c.coupon_type, c.amount, c.percent_off, c.max_discount,
+	c.min_spend, c.product_ids, c.valid_from, c.valid_to, c.total_limit, c.per_user_limit, c.claimed_count, c.redeemed_count`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// 与 couponColumns 的列顺序一致
+func couponScanDest(c *models.Coupon) []interface{} {
+	return []interface{}{&c.CouponID, &c.ShopID, &c.Title, &c.CouponType, &c.Amount, &c.PercentOff, &c.MaxDiscount,
+		&c.MinSpend, pq.Array(&c.ProductIDs), &c.ValidFrom, &c.ValidTo, &c.TotalLimit, &c.PerUserLimit, &c.ClaimedCount, &c.RedeemedCount}
+}
+
+// CreateCoupon 创建优惠券模板，ShopID 为 0 时创建平台券
+func CreateCoupon(db *sql.DB, c *models.Coupon) error {
+	logging.Info("Creating coupon", logrus.Fields{"shopID": c.ShopID, "type": c.CouponType})
+	query := `INSERT INTO coupons (shop_id, title, coupon_type, amount, percent_off, max_discount, min_spend, product_ids,
+				 valid_from, valid_to, total_limit, per_user_limit)
+			 VALUES (NULLIF($1, 0), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING coupon_id`
+	err := monitoring.RecordDBTime("CreateCoupon", func() error {
+		return db.QueryRow(query, c.ShopID, c.Title, c.CouponType, c.Amount, c.PercentOff, c.MaxDiscount, c.MinSpend,
+			pq.Array(c.ProductIDs), c.ValidFrom, c.ValidTo, c.TotalLimit, c.PerUserLimit).Scan(&c.CouponID)
+	})
+	if err != nil {
+		logging.Error("Failed to create coupon", logrus.Fields{"error": err, "shopID": c.ShopID})
+		return fmt.Errorf("创建优惠券失败: %v", err)
+	}
+	return nil
+}
+
+// QueryClaimableCoupons 查询当前可领取的优惠券：平台券以及指定商家的店铺券
+func QueryClaimableCoupons(db *sql.DB, shopID int) ([]models.Coupon, error) {
+	query := `SELECT ` + couponColumns + ` FROM coupons c
+			 WHERE (c.shop_id IS NULL OR c.shop_id = $1)
+			   AND NOW() >= c.valid_from AND NOW() < c.valid_to
+			   AND (c.total_limit = 0 OR c.claimed_count < c.total_limit)
+			 ORDER BY c.valid_to, c.coupon_id`
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryClaimableCoupons", func() error {
+		rows, err = db.Query(query, shopID)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query claimable coupons", logrus.Fields{"error": err, "shopID": shopID})
+		return nil, fmt.Errorf("查询可领取优惠券失败: %v", err)
+	}
+	defer rows.Close()
+
+	coupons := []models.Coupon{}
+	for rows.Next() {
+		var c models.Coupon
+		if err := rows.Scan(couponScanDest(&c)...); err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历优惠券失败: %v", err)
+	}
+	return coupons, nil
+}
+
+// ClaimCoupon 用户领取优惠券
+// 先条件更新领取计数（同时锁住优惠券行，使同一优惠券的并发领取串行执行），再检查每人限领张数
+func ClaimCoupon(db *sql.DB, userID, couponID int) (*models.UserCoupon, error) {
+	logging.Info("Claiming coupon", logrus.Fields{"userID": userID, "couponID": couponID})
+	var userCoupon models.UserCoupon
+	err := monitoring.RecordDBTime("ClaimCoupon", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("开启事务失败: %v", err)
+		}
+		defer tx.Rollback()
+
+		var perUserLimit int
+		err = tx.QueryRow(`UPDATE coupons SET claimed_count = claimed_count + 1
+			WHERE coupon_id = $1 AND NOW() >= valid_from AND NOW() < valid_to
+			  AND (total_limit = 0 OR claimed_count < total_limit)
+			RETURNING per_user_limit`, couponID).Scan(&perUserLimit)
+		if err == sql.ErrNoRows {
+			return couponClaimFailure(tx, couponID)
+		}
+		if err != nil {
+			return fmt.Errorf("领取优惠券失败: %v", err)
+		}
+
+		var claimed int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM user_coupons WHERE coupon_id = $1 AND user_id = $2`, couponID, userID).Scan(&claimed); err != nil {
+			return fmt.Errorf("查询领取记录失败: %v", err)
+		}
+		if claimed >= perUserLimit {
+			return ErrCouponClaimLimit
+		}
+
+		err = tx.QueryRow(`INSERT INTO user_coupons (coupon_id, user_id) VALUES ($1, $2)
+			RETURNING user_coupon_id, status, claimed_at`, couponID, userID).Scan(&userCoupon.UserCouponID, &userCoupon.Status, &userCoupon.ClaimedAt)
+		if err != nil {
+			return fmt.Errorf("保存领取记录失败: %v", err)
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		logging.Warn("Failed to claim coupon", logrus.Fields{"error": err, "userID": userID, "couponID": couponID})
+		return nil, err
+	}
+	return QueryUserCoupon(db, userID, userCoupon.UserCouponID)
+}
+
+// 领取失败时区分优惠券不存在、不在有效期和已领完
+func couponClaimFailure(tx *sql.Tx, couponID int) error {
+	var active, soldOut bool
+	err := tx.QueryRow(`SELECT NOW() >= valid_from AND NOW() < valid_to, total_limit > 0 AND claimed_count >= total_limit
+		FROM coupons WHERE coupon_id = $1`, couponID).Scan(&active, &soldOut)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrCouponNotFound
+	case err != nil:
+		return fmt.Errorf("查询优惠券失败: %v", err)
+	case !active:
+		return ErrCouponNotActive
+	default:
+		return ErrCouponSoldOut
+	}
+}
+
+// QueryUserCoupons 查询用户领取的优惠券，status 为空时返回全部
+func QueryUserCoupons(db *sql.DB, userID int, status string) ([]models.UserCoupon, error) {
+	query := `SELECT uc.user_coupon_id, uc.user_id, uc.status, COALESCE(uc.order_id, 0), uc.claimed_at, uc.used_at, ` + couponColumns + `
+			 FROM user_coupons uc JOIN coupons c ON c.coupon_id = uc.coupon_id
+			 WHERE uc.user_id = $1 AND ($2 = '' OR uc.status = $2)
+			 ORDER BY uc.user_coupon_id DESC`
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryUserCoupons", func() error {
+		rows, err = db.Query(query, userID, status)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query user coupons", logrus.Fields{"error": err, "userID": userID})
+		return nil, fmt.Errorf("查询用户优惠券失败: %v", err)
+	}
+	defer rows.Close()
+
+	coupons := []models.UserCoupon{}
+	for rows.Next() {
+		var uc models.UserCoupon
+		if err := scanUserCoupon(rows, &uc); err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, uc)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历用户优惠券失败: %v", err)
+	}
+	return coupons, nil
+}
+
+// QueryUserCoupon 查询用户的一张优惠券，不属于该用户时返回 ErrCouponNotFound
+func QueryUserCoupon(db *sql.DB, userID, userCouponID int) (*models.UserCoupon, error) {
+	query := `SELECT uc.user_coupon_id, uc.user_id, uc.status, COALESCE(uc.order_id, 0), uc.claimed_at, uc.used_at, ` + couponColumns + `
+			 FROM user_coupons uc JOIN coupons c ON c.coupon_id = uc.coupon_id
+			 WHERE uc.user_coupon_id = $1 AND uc.user_id = $2`
+	var uc models.UserCoupon
+	err := monitoring.RecordDBTime("QueryUserCoupon", func() error {
+		return scanUserCoupon(db.QueryRow(query, userCouponID, userID), &uc)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrCouponNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to query user coupon", logrus.Fields{"error": err, "userCouponID": userCouponID})
+		return nil, fmt.Errorf("查询用户优惠券失败: %v", err)
+	}
+	return &uc, nil
+}
+
+func scanUserCoupon(row rowScanner, uc *models.UserCoupon) error {
+	var usedAt sql.NullTime
+	dest := []interface{}{&uc.UserCouponID, &uc.UserID, &uc.Status, &uc.OrderID, &uc.ClaimedAt, &usedAt}
+	err := row.Scan(append(dest, couponScanDest(&uc.Coupon)...)...)
+	if err == nil && usedAt.Valid {
+		uc.UsedAt = &usedAt.Time
+	}
+	return err
+}
+
+// 在订单事务中核销优惠券，条件更新保证一张券只能被一个订单使用
+func redeemCouponTx(tx *sql.Tx, userCouponID, userID, orderID int) error {
+	var couponID int
+	err := tx.QueryRow(`UPDATE user_coupons SET status = 'used', order_id = $1, used_at = NOW()
+		WHERE user_coupon_id = $2 AND user_id = $3 AND status = 'available'
+		RETURNING coupon_id`, orderID, userCouponID, userID).Scan(&couponID)
+	if err == sql.ErrNoRows {
+		return ErrCouponUnavailable
+	}
+	if err != nil {
+		return fmt.Errorf("核销优惠券失败: %v", err)
+	}
+	if _, err := tx.Exec(`UPDATE coupons SET redeemed_count = redeemed_count + 1 WHERE coupon_id = $1`, couponID); err != nil {
+		return fmt.Errorf("更新优惠券核销数失败: %v", err)
+	}
+	return nil
+}
+
+// 在取消订单的事务中退回订单使用的优惠券
+func releaseCouponTx(tx *sql.Tx, orderID int) error {
+	var couponID int
+	err := tx.QueryRow(`UPDATE user_coupons SET status = 'available', order_id = NULL, used_at = NULL
+		WHERE order_id = $1 AND status = 'used'
+		RETURNING coupon_id`, orderID).Scan(&couponID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("退回优惠券失败: %v", err)
+	}
+	if _, err := tx.Exec(`UPDATE coupons SET redeemed_count = redeemed_count - 1 WHERE coupon_id = $1`, couponID); err != nil {
+		return fmt.Errorf("更新优惠券核销数失败: %v", err)
+	}
+	return nil
+}
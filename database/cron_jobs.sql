@@ -10,7 +10,8 @@ BEGIN
         o.orderid,
         o.userid,
         o.shopid,
-        o.riderid,
+        -- 自取订单没有骑手，不评价骑手维度
+        CASE WHEN o.fulfillment_type = 'pickup' THEN NULL ELSE o.riderid END,
         5,
         '系统自动好评',
         TRUE
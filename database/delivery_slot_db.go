@@ -0,0 +1,226 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"take-out/config"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrDeliverySlotNotFound = errors.New("预约配送时段不存在")
+	ErrDeliverySlotOverlap  = errors.New("预约配送时段与本店已有时段重叠")
+	ErrDeliverySlotFull     = errors.New("该预约时段已约满，请选择其他时段")
+)
+
+const deliverySlotColumns = `slot_id, shop_id, to_char(start_time, 'HH24:MI'), to_char(end_time, 'HH24:MI'), capacity, is_active`
+
+func scanDeliverySlot(row rowScanner, s *models.DeliverySlot) error {
+	return row.Scan(&s.SlotID, &s.ShopID, &s.StartTime, &s.EndTime, &s.Capacity, &s.IsActive)
+}
+
+// 预约时段按业务时区的自然日计算名额
+func slotDay(t time.Time) (time.Time, time.Time) {
+	t = t.In(config.Location)
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, config.Location)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// SaveDeliverySlot 新增（SlotID 为 0）或修改商家的预约配送时段，启用的时段之间不能重叠
+func SaveDeliverySlot(db *sql.DB, s *models.DeliverySlot) error {
+	logging.Info("Saving delivery slot", logrus.Fields{"shopID": s.ShopID, "slotID": s.SlotID})
+	err := monitoring.RecordDBTime("SaveDeliverySlot", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("开启事务失败: %v", err)
+		}
+		defer tx.Rollback()
+
+		// 锁定商家，避免并发保存的两个时段互相重叠
+		if _, err := tx.Exec(`SELECT shopid FROM shops WHERE shopid = $1 FOR UPDATE`, s.ShopID); err != nil {
+			return fmt.Errorf("锁定商家失败: %v", err)
+		}
+		if s.IsActive {
+			var overlap bool
+			err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM shop_delivery_slots
+				WHERE shop_id = $1 AND slot_id <> $2 AND is_active AND start_time < $4::time AND end_time > $3::time)`,
+				s.ShopID, s.SlotID, s.StartTime, s.EndTime).Scan(&overlap)
+			if err != nil {
+				return fmt.Errorf("检查预约时段失败: %v", err)
+			}
+			if overlap {
+				return ErrDeliverySlotOverlap
+			}
+		}
+
+		if s.SlotID == 0 {
+			err = tx.QueryRow(`INSERT INTO shop_delivery_slots (shop_id, start_time, end_time, capacity, is_active)
+				VALUES ($1, $2, $3, $4, $5) RETURNING slot_id`, s.ShopID, s.StartTime, s.EndTime, s.Capacity, s.IsActive).Scan(&s.SlotID)
+		} else {
+			err = tx.QueryRow(`UPDATE shop_delivery_slots SET start_time = $3, end_time = $4, capacity = $5, is_active = $6
+				WHERE slot_id = $1 AND shop_id = $2 RETURNING slot_id`, s.SlotID, s.ShopID, s.StartTime, s.EndTime, s.Capacity, s.IsActive).Scan(&s.SlotID)
+		}
+		if err == sql.ErrNoRows {
+			return ErrDeliverySlotNotFound
+		}
+		// 与已停用的时段开始时间相同
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			return ErrDeliverySlotOverlap
+		}
+		if err != nil {
+			return fmt.Errorf("保存预约时段失败: %v", err)
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		logging.Error("Failed to save delivery slot", logrus.Fields{"error": err, "shopID": s.ShopID})
+		return err
+	}
+	return nil
+}
+
+// QueryShopDeliverySlots 查询商家的全部预约配送时段，包括已停用的
+func QueryShopDeliverySlots(db *sql.DB, shopID int) ([]models.DeliverySlot, error) {
+	query := `SELECT ` + deliverySlotColumns + ` FROM shop_delivery_slots WHERE shop_id = $1 ORDER BY start_time`
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryShopDeliverySlots", func() error {
+		rows, err = db.Query(query, shopID)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query delivery slots", logrus.Fields{"error": err, "shopID": shopID})
+		return nil, fmt.Errorf("查询预约时段失败: %v", err)
+	}
+	defer rows.Close()
+
+	slots := []models.DeliverySlot{}
+	for rows.Next() {
+		var s models.DeliverySlot
+		if err := scanDeliverySlot(rows, &s); err != nil {
+			return nil, err
+		}
+		slots = append(slots, s)
+	}
+	return slots, rows.Err()
+}
+
+// QueryDeliverySlotAt 查询预约送达时间所在的启用时段，时段的钟点按业务时区解释
+func QueryDeliverySlotAt(db *sql.DB, shopID int, at time.Time) (*models.DeliverySlot, error) {
+	query := `SELECT ` + deliverySlotColumns + ` FROM shop_delivery_slots
+			 WHERE shop_id = $1 AND is_active AND start_time <= $2::time AND end_time > $2::time`
+	var s models.DeliverySlot
+	err := monitoring.RecordDBTime("QueryDeliverySlotAt", func() error {
+		return scanDeliverySlot(db.QueryRow(query, shopID, at.In(config.Location).Format("15:04:05")), &s)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrDeliverySlotNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to query delivery slot", logrus.Fields{"error": err, "shopID": shopID})
+		return nil, fmt.Errorf("查询预约时段失败: %v", err)
+	}
+	return &s, nil
+}
+
+// QueryAvailableDeliverySlots 查询商家某一天启用的预约时段及已预约数量，未取消的预约单都占用名额
+func QueryAvailableDeliverySlots(db *sql.DB, shopID int, day time.Time) ([]models.AvailableSlot, error) {
+	dayStart, dayEnd := slotDay(day)
+	query := `SELECT s.slot_id, s.shop_id, to_char(s.start_time, 'HH24:MI'), to_char(s.end_time, 'HH24:MI'), s.capacity, s.is_active,
+				 COUNT(o.orderid)
+			 FROM shop_delivery_slots s
+			 LEFT JOIN orders o ON o.delivery_slot_id = s.slot_id AND o.scheduled_at >= $2 AND o.scheduled_at < $3
+				 AND o.orderstatus <> 'cancelled'
+			 WHERE s.shop_id = $1 AND s.is_active
+			 GROUP BY s.slot_id
+			 ORDER BY s.start_time`
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryAvailableDeliverySlots", func() error {
+		rows, err = db.Query(query, shopID, dayStart, dayEnd)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query available delivery slots", logrus.Fields{"error": err, "shopID": shopID})
+		return nil, fmt.Errorf("查询预约时段失败: %v", err)
+	}
+	defer rows.Close()
+
+	slots := []models.AvailableSlot{}
+	for rows.Next() {
+		var s models.AvailableSlot
+		if err := rows.Scan(&s.SlotID, &s.ShopID, &s.StartTime, &s.EndTime, &s.Capacity, &s.IsActive, &s.Booked); err != nil {
+			return nil, err
+		}
+		start, err := time.ParseInLocation("15:04", s.StartTime, config.Location)
+		if err != nil {
+			return nil, fmt.Errorf("预约时段开始时间格式错误: %v", err)
+		}
+		s.Date = dayStart.Format("2006-01-02")
+		s.ScheduledAt = dayStart.Add(time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute)
+		if s.Remaining = s.Capacity - s.Booked; s.Remaining < 0 {
+			s.Remaining = 0
+		}
+		slots = append(slots, s)
+	}
+	return slots, rows.Err()
+}
+
+// 在下单事务中占用预约时段名额：锁定时段后统计当天未取消的预约单，名额已满时整个订单回滚
+// 取消订单后自然释放名额，无需单独归还
+func reserveDeliverySlotTx(tx *sql.Tx, slotID int, scheduledAt time.Time) error {
+	var capacity int
+	err := tx.QueryRow(`SELECT capacity FROM shop_delivery_slots WHERE slot_id = $1 AND is_active FOR UPDATE`, slotID).Scan(&capacity)
+	if err == sql.ErrNoRows {
+		return ErrDeliverySlotNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("锁定预约时段失败: %v", err)
+	}
+
+	dayStart, dayEnd := slotDay(scheduledAt)
+	var booked int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM orders
+		WHERE delivery_slot_id = $1 AND scheduled_at >= $2 AND scheduled_at < $3 AND orderstatus <> 'cancelled'`,
+		slotID, dayStart, dayEnd).Scan(&booked)
+	if err != nil {
+		return fmt.Errorf("统计预约时段名额失败: %v", err)
+	}
+	if booked >= capacity {
+		return ErrDeliverySlotFull
+	}
+	return nil
+}
+
+// QueryScheduledOrderReleases 查询所有等待通知商家的预约单及其通知时间，用于重建 Redis 中的调度任务
+func QueryScheduledOrderReleases(db *sql.DB) (map[int]time.Time, error) {
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryScheduledOrderReleases", func() error {
+		rows, err = db.Query(`SELECT orderid, release_at FROM orders WHERE orderstatus = 'scheduled' AND release_at IS NOT NULL`)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query scheduled orders", logrus.Fields{"error": err})
+		return nil, fmt.Errorf("查询预约单失败: %v", err)
+	}
+	defer rows.Close()
+
+	releases := make(map[int]time.Time)
+	for rows.Next() {
+		var orderID int
+		var releaseAt time.Time
+		if err := rows.Scan(&orderID, &releaseAt); err != nil {
+			return nil, err
+		}
+		releases[orderID] = releaseAt
+	}
+	return releases, rows.Err()
+}
@@ -0,0 +1,255 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"take-out/dispatch"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrOfferNotFound = errors.New("派单不存在")
+	ErrOfferClosed   = errors.New("派单已失效")
+	// ErrOfferConflict 订单已有待答复的派单，或该骑手已收到过该订单的派单
+	ErrOfferConflict = errors.New("派单冲突")
+)
+
+const dispatchOfferColumns = `offer_id, order_id, rider_id, score, distance_km, status, offered_at, expires_at, responded_at`
+
+func scanDispatchOffer(row rowScanner, o *models.DispatchOffer) error {
+	return row.Scan(&o.OfferID, &o.OrderID, &o.RiderID, &o.Score, &o.DistanceKm, &o.Status, &o.OfferedAt, &o.ExpiresAt, &o.RespondedAt)
+}
+
+// QueryDispatchCandidates 从附近有实时位置的骑手中筛选可派单的在线骑手，附带当前负载和 since 之后的派单答复情况
+// 已收到过该订单派单的骑手、手上还有待答复派单的骑手不在候选之列；候选骑手的位置取自 nearby
+func QueryDispatchCandidates(db *sql.DB, orderID int, nearby []models.RiderLocation, since time.Time) ([]dispatch.Candidate, error) {
+	if len(nearby) == 0 {
+		return nil, nil
+	}
+	locations := make(map[int]models.RiderLocation, len(nearby))
+	riderIDs := make([]int64, len(nearby))
+	for i, loc := range nearby {
+		locations[loc.RiderID] = loc
+		riderIDs[i] = int64(loc.RiderID)
+	}
+
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryDispatchCandidates", func() error {
+		rows, err = db.Query(`SELECT r.riderid, COALESCE(r.rating, 5),
+			(SELECT COUNT(*) FROM orders o WHERE o.riderid = r.riderid AND o.orderstatus = 'delivering'),
+			COUNT(d.offer_id) FILTER (WHERE d.status = 'accepted'),
+			COUNT(d.offer_id) FILTER (WHERE d.status IN ('accepted', 'declined', 'expired'))
+			FROM riders r
+			LEFT JOIN dispatch_offers d ON d.rider_id = r.riderid AND d.offered_at >= $3
+			WHERE r.riderid = ANY($2) AND r.riderstatus = 'online'
+			AND NOT EXISTS (SELECT 1 FROM dispatch_offers x WHERE x.order_id = $1 AND x.rider_id = r.riderid)
+			AND NOT EXISTS (SELECT 1 FROM dispatch_offers y WHERE y.rider_id = r.riderid AND y.status = 'offered')
+			GROUP BY r.riderid`, orderID, pq.Array(riderIDs), since)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query dispatch candidates", logrus.Fields{"error": err, "orderID": orderID})
+		return nil, fmt.Errorf("查询候选骑手失败: %v", err)
+	}
+	defer rows.Close()
+
+	var candidates []dispatch.Candidate
+	for rows.Next() {
+		var c dispatch.Candidate
+		if err := rows.Scan(&c.RiderID, &c.Rating, &c.ActiveOrders, &c.OffersAccepted, &c.OffersAnswered); err != nil {
+			return nil, err
+		}
+		loc := locations[c.RiderID]
+		c.Latitude, c.Longitude = loc.Latitude, loc.Longitude
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// CreateDispatchOffer 记录派给骑手的订单；订单已有待答复的派单或该骑手已收到过该订单时返回 ErrOfferConflict
+func CreateDispatchOffer(db *sql.DB, offer *models.DispatchOffer) error {
+	err := monitoring.RecordDBTime("CreateDispatchOffer", func() error {
+		return scanDispatchOffer(db.QueryRow(`INSERT INTO dispatch_offers (order_id, rider_id, score, distance_km, expires_at)
+			VALUES ($1, $2, ROUND($3::numeric, 4), ROUND($4::numeric, 2), $5) RETURNING `+dispatchOfferColumns,
+			offer.OrderID, offer.RiderID, offer.Score, offer.DistanceKm, offer.ExpiresAt), offer)
+	})
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return ErrOfferConflict
+	}
+	if err != nil {
+		logging.Error("Failed to create dispatch offer", logrus.Fields{"error": err, "orderID": offer.OrderID, "riderID": offer.RiderID})
+		return fmt.Errorf("创建派单失败: %v", err)
+	}
+	return nil
+}
+
+// QueryOpenDispatchOffer 查询订单待答复的派单，没有时返回 nil
+func QueryOpenDispatchOffer(db *sql.DB, orderID int) (*models.DispatchOffer, error) {
+	var offer models.DispatchOffer
+	err := monitoring.RecordDBTime("QueryOpenDispatchOffer", func() error {
+		return scanDispatchOffer(db.QueryRow(`SELECT `+dispatchOfferColumns+` FROM dispatch_offers
+			WHERE order_id = $1 AND status = 'offered'`, orderID), &offer)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询派单失败: %v", err)
+	}
+	return &offer, nil
+}
+
+// CountDispatchOffers 统计订单已派出的次数
+func CountDispatchOffers(db *sql.DB, orderID int) (int, error) {
+	var count int
+	err := monitoring.RecordDBTime("CountDispatchOffers", func() error {
+		return db.QueryRow(`SELECT COUNT(*) FROM dispatch_offers WHERE order_id = $1`, orderID).Scan(&count)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("统计派单次数失败: %v", err)
+	}
+	return count, nil
+}
+
+// 关闭订单待答复的派单并返回被关闭的派单，onlyDue 为 true 时只关闭已过答复截止时间的派单
+func closeDispatchOffers(db *sql.DB, orderID int, status string, onlyDue bool) ([]models.DispatchOffer, error) {
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("CloseDispatchOffers", func() error {
+		rows, err = db.Query(`UPDATE dispatch_offers SET status = $2, responded_at = CURRENT_TIMESTAMP
+			WHERE order_id = $1 AND status = 'offered' AND (NOT $3 OR expires_at <= CURRENT_TIMESTAMP)
+			RETURNING `+dispatchOfferColumns, orderID, status, onlyDue)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to close dispatch offers", logrus.Fields{"error": err, "orderID": orderID, "status": status})
+		return nil, fmt.Errorf("关闭派单失败: %v", err)
+	}
+	return scanDispatchOfferRows(rows)
+}
+
+func scanDispatchOfferRows(rows *sql.Rows) ([]models.DispatchOffer, error) {
+	defer rows.Close()
+	var offers []models.DispatchOffer
+	for rows.Next() {
+		var offer models.DispatchOffer
+		if err := scanDispatchOffer(rows, &offer); err != nil {
+			return nil, err
+		}
+		offers = append(offers, offer)
+	}
+	return offers, rows.Err()
+}
+
+// ExpireDispatchOffers 将订单已过答复截止时间的派单标记为超时，返回被标记的派单
+func ExpireDispatchOffers(db *sql.DB, orderID int) ([]models.DispatchOffer, error) {
+	return closeDispatchOffers(db, orderID, models.OfferExpired, true)
+}
+
+// WithdrawDispatchOffers 订单已被其他骑手抢走或已取消时撤回待答复的派单，返回被撤回的派单
+func WithdrawDispatchOffers(db *sql.DB, orderID int) ([]models.DispatchOffer, error) {
+	return closeDispatchOffers(db, orderID, models.OfferWithdrawn, false)
+}
+
+// WithdrawRiderDispatchOffers 骑手下线时撤回其待答复的派单，返回被撤回的派单，以便把订单派给下一位骑手
+func WithdrawRiderDispatchOffers(db *sql.DB, riderID int) ([]models.DispatchOffer, error) {
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("WithdrawRiderDispatchOffers", func() error {
+		rows, err = db.Query(`UPDATE dispatch_offers SET status = 'withdrawn', responded_at = CURRENT_TIMESTAMP
+			WHERE rider_id = $1 AND status = 'offered' RETURNING `+dispatchOfferColumns, riderID)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to withdraw rider dispatch offers", logrus.Fields{"error": err, "riderID": riderID})
+		return nil, fmt.Errorf("撤回骑手派单失败: %v", err)
+	}
+	return scanDispatchOfferRows(rows)
+}
+
+// 在事务中锁定骑手的派单，派单不属于该骑手时视为不存在，不是待答复状态或已过截止时间时返回 ErrOfferClosed
+func lockOpenOfferTx(tx *sql.Tx, offerID, riderID int) (*models.DispatchOffer, error) {
+	var offer models.DispatchOffer
+	err := scanDispatchOffer(tx.QueryRow(`SELECT `+dispatchOfferColumns+` FROM dispatch_offers
+		WHERE offer_id = $1 AND rider_id = $2 FOR UPDATE`, offerID, riderID), &offer)
+	if err == sql.ErrNoRows {
+		return nil, ErrOfferNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询派单失败: %v", err)
+	}
+	if offer.Status != models.OfferOffered || !time.Now().Before(offer.ExpiresAt) {
+		return nil, ErrOfferClosed
+	}
+	return &offer, nil
+}
+
+// AcceptDispatchOfferTx 骑手接受派单：在同一事务中标记派单已接受并把订单交给该骑手（已发布 -> 配送中）
+// 骑手已下线或配送中的订单已达上限 maxActive 时返回 ErrRiderUnavailable
+func AcceptDispatchOfferTx(db *sql.DB, offerID, riderID, maxActive int) (*models.DispatchOffer, error) {
+	var offer *models.DispatchOffer
+	err := monitoring.RecordDBTime("AcceptDispatchOfferTx", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("开启事务失败: %v", err)
+		}
+		defer tx.Rollback()
+
+		offer, err = lockOpenOfferTx(tx, offerID, riderID)
+		if err != nil {
+			return err
+		}
+		if err := scanDispatchOffer(tx.QueryRow(`UPDATE dispatch_offers SET status = 'accepted', responded_at = CURRENT_TIMESTAMP
+			WHERE offer_id = $1 RETURNING `+dispatchOfferColumns, offerID), offer); err != nil {
+			return fmt.Errorf("更新派单失败: %v", err)
+		}
+		if err := acceptOrderTx(tx, offer.OrderID, riderID, maxActive); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("提交事务失败: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Error("Failed to accept dispatch offer", logrus.Fields{"error": err, "offerID": offerID, "riderID": riderID})
+		return nil, err
+	}
+	logging.Info("Dispatch offer accepted", logrus.Fields{"offerID": offerID, "orderID": offer.OrderID, "riderID": riderID})
+	return offer, nil
+}
+
+// DeclineDispatchOffer 骑手拒绝派单
+func DeclineDispatchOffer(db *sql.DB, offerID, riderID int) (*models.DispatchOffer, error) {
+	var offer *models.DispatchOffer
+	err := monitoring.RecordDBTime("DeclineDispatchOffer", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("开启事务失败: %v", err)
+		}
+		defer tx.Rollback()
+
+		offer, err = lockOpenOfferTx(tx, offerID, riderID)
+		if err != nil {
+			return err
+		}
+		if err := scanDispatchOffer(tx.QueryRow(`UPDATE dispatch_offers SET status = 'declined', responded_at = CURRENT_TIMESTAMP
+			WHERE offer_id = $1 RETURNING `+dispatchOfferColumns, offerID), offer); err != nil {
+			return fmt.Errorf("更新派单失败: %v", err)
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		logging.Error("Failed to decline dispatch offer", logrus.Fields{"error": err, "offerID": offerID, "riderID": riderID})
+		return nil, err
+	}
+	return offer, nil
+}
@@ -0,0 +1,328 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrGroupCartNotFound     = errors.New("拼单不存在")
+	ErrGroupCartClosed       = errors.New("拼单已锁定、提交或取消，不能再修改")
+	ErrGroupCartNotLocked    = errors.New("拼单需要先锁定才能提交")
+	ErrGroupCartEmpty        = errors.New("拼单中还没有商品")
+	ErrGroupCartChanged      = errors.New("拼单在提交前被重新开放过，请刷新后重新提交")
+	ErrGroupCartCodeConflict = errors.New("拼单分享码重复")
+)
+
+const groupCartColumns = `cart_id, share_code, host_user_id, shop_id, status, COALESCE(order_id, 0), created_at, locked_at, submitted_at`
+
+func scanGroupCart(row rowScanner, c *models.GroupCart) error {
+	return row.Scan(&c.CartID, &c.ShareCode, &c.HostUserID, &c.ShopID, &c.Status, &c.OrderID, &c.CreatedAt, &c.LockedAt, &c.SubmittedAt)
+}
+
+// CreateGroupCart 创建拼单，分享码重复时返回 ErrGroupCartCodeConflict，调用方重新生成后重试
+func CreateGroupCart(db *sql.DB, cart *models.GroupCart) error {
+	err := monitoring.RecordDBTime("CreateGroupCart", func() error {
+		return db.QueryRow(`INSERT INTO group_carts (share_code, host_user_id, shop_id) VALUES ($1, $2, $3)
+			RETURNING `+groupCartColumns, cart.ShareCode, cart.HostUserID, cart.ShopID).Scan(
+			&cart.CartID, &cart.ShareCode, &cart.HostUserID, &cart.ShopID, &cart.Status, &cart.OrderID, &cart.CreatedAt, &cart.LockedAt, &cart.SubmittedAt)
+	})
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && pqErr.Constraint == "group_carts_share_code_key" {
+		return ErrGroupCartCodeConflict
+	}
+	if err != nil {
+		logging.Error("Failed to create group cart", logrus.Fields{"error": err, "userID": cart.HostUserID})
+		return fmt.Errorf("创建拼单失败: %v", err)
+	}
+	logging.Info("Group cart created", logrus.Fields{"cartID": cart.CartID, "shopID": cart.ShopID})
+	return nil
+}
+
+// QueryGroupCartByCode 按分享码查询拼单及全部参与者的商品
+// 提交前商品按当前价格展示，分账只含商品金额；提交后返回下单时的快照和保存的分账
+func QueryGroupCartByCode(db *sql.DB, shareCode string) (*models.GroupCart, error) {
+	var cart models.GroupCart
+	err := monitoring.RecordDBTime("QueryGroupCartByCode", func() error {
+		return scanGroupCart(db.QueryRow(`SELECT `+groupCartColumns+` FROM group_carts WHERE share_code = $1`, shareCode), &cart)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrGroupCartNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to query group cart", logrus.Fields{"error": err, "shareCode": shareCode})
+		return nil, fmt.Errorf("查询拼单失败: %v", err)
+	}
+
+	if cart.Items, err = queryGroupCartItems(db, cart.CartID); err != nil {
+		return nil, err
+	}
+	if cart.Status == models.GroupCartSubmitted {
+		cart.Shares, err = queryGroupCartShares(db, cart.CartID)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var subtotal, packaging models.Money
+		for _, item := range cart.Items {
+			subtotal = subtotal.Add(item.Subtotal)
+			packaging = packaging.Add(item.PackagingFee.Mul(item.Quantity))
+		}
+		cart.Shares = models.SplitBill(cart.Items, models.PriceBreakdown{
+			ItemSubtotal: subtotal,
+			PackagingFee: packaging,
+			Payable:      subtotal.Add(packaging),
+		})
+	}
+	return &cart, nil
+}
+
+func queryGroupCartItems(db *sql.DB, cartID int) ([]models.GroupCartItem, error) {
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryGroupCartItems", func() error {
+		rows, err = db.Query(`SELECT i.item_id, i.user_id, u.username, i.product_id, p.productname, i.quantity,
+			COALESCE(i.unit_price, p.productprice), COALESCE(i.packaging_fee, p.packaging_fee)
+			FROM group_cart_items i
+			JOIN users u ON u.userid = i.user_id
+			JOIN products p ON p.productid = i.product_id
+			WHERE i.cart_id = $1 ORDER BY i.item_id`, cartID)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query group cart items", logrus.Fields{"error": err, "cartID": cartID})
+		return nil, fmt.Errorf("查询拼单商品失败: %v", err)
+	}
+	defer rows.Close()
+
+	items := []models.GroupCartItem{}
+	for rows.Next() {
+		var item models.GroupCartItem
+		if err := rows.Scan(&item.ItemID, &item.UserID, &item.Username, &item.ProductID, &item.ProductName,
+			&item.Quantity, &item.UnitPrice, &item.PackagingFee); err != nil {
+			return nil, err
+		}
+		item.Subtotal = item.UnitPrice.Mul(item.Quantity)
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func queryGroupCartShares(db *sql.DB, cartID int) ([]models.GroupCartShare, error) {
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryGroupCartShares", func() error {
+		rows, err = db.Query(`SELECT s.user_id, u.username, s.item_subtotal, s.packaging_fee, s.fee_share, s.payable
+			FROM group_cart_shares s JOIN users u ON u.userid = s.user_id
+			WHERE s.cart_id = $1
+			ORDER BY (SELECT MIN(item_id) FROM group_cart_items i WHERE i.cart_id = s.cart_id AND i.user_id = s.user_id)`, cartID)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query group cart shares", logrus.Fields{"error": err, "cartID": cartID})
+		return nil, fmt.Errorf("查询拼单分账失败: %v", err)
+	}
+	defer rows.Close()
+
+	shares := []models.GroupCartShare{}
+	for rows.Next() {
+		var share models.GroupCartShare
+		if err := rows.Scan(&share.UserID, &share.Username, &share.ItemSubtotal, &share.PackagingFee, &share.FeeShare, &share.Payable); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// 锁定拼单行并检查状态，加购、锁定和提交都先锁定拼单，保证锁定后商品不再变化
+func lockGroupCartTx(tx *sql.Tx, cartID int) (string, int, error) {
+	var status string
+	var shopID int
+	err := tx.QueryRow(`SELECT status, shop_id FROM group_carts WHERE cart_id = $1 FOR UPDATE`, cartID).Scan(&status, &shopID)
+	if err == sql.ErrNoRows {
+		return "", 0, ErrGroupCartNotFound
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("锁定拼单失败: %v", err)
+	}
+	return status, shopID, nil
+}
+
+// SetGroupCartItem 设置参与者在拼单中某件商品的数量，数量为 0 时移出；只有加购中的拼单可以修改
+// 商品必须属于拼单的商家
+func SetGroupCartItem(db *sql.DB, cartID, userID, productID, quantity int) error {
+	err := monitoring.RecordDBTime("SetGroupCartItem", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("无法开始事务: %v", err)
+		}
+		defer tx.Rollback()
+
+		status, shopID, err := lockGroupCartTx(tx, cartID)
+		if err != nil {
+			return err
+		}
+		if status != models.GroupCartOpen {
+			return ErrGroupCartClosed
+		}
+
+		var productShopID int
+		err = tx.QueryRow(`SELECT shopid FROM products WHERE productid = $1`, productID).Scan(&productShopID)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: %d", ErrProductNotFound, productID)
+		}
+		if err != nil {
+			return fmt.Errorf("查询商品失败: %v", err)
+		}
+		if productShopID != shopID {
+			return ErrMixedShopItems
+		}
+
+		if quantity == 0 {
+			_, err = tx.Exec(`DELETE FROM group_cart_items WHERE cart_id = $1 AND user_id = $2 AND product_id = $3`, cartID, userID, productID)
+		} else {
+			_, err = tx.Exec(`INSERT INTO group_cart_items (cart_id, user_id, product_id, quantity) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (cart_id, user_id, product_id) DO UPDATE SET quantity = EXCLUDED.quantity, updated_at = CURRENT_TIMESTAMP`,
+				cartID, userID, productID, quantity)
+		}
+		if err != nil {
+			return fmt.Errorf("更新拼单商品失败: %v", err)
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		logging.Error("Failed to set group cart item", logrus.Fields{"error": err, "cartID": cartID, "userID": userID, "productID": productID})
+		return err
+	}
+	return nil
+}
+
+// SetGroupCartLocked 锁定或重新开放拼单，已提交或已取消的拼单不能再修改
+func SetGroupCartLocked(db *sql.DB, cartID int, locked bool) error {
+	from, to := models.GroupCartOpen, models.GroupCartLocked
+	if !locked {
+		from, to = models.GroupCartLocked, models.GroupCartOpen
+	}
+	err := monitoring.RecordDBTime("SetGroupCartLocked", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("无法开始事务: %v", err)
+		}
+		defer tx.Rollback()
+
+		status, _, err := lockGroupCartTx(tx, cartID)
+		if err != nil {
+			return err
+		}
+		if status == to {
+			return nil
+		}
+		if status != from {
+			return ErrGroupCartClosed
+		}
+		if _, err := tx.Exec(`UPDATE group_carts SET status = $2,
+			locked_at = CASE WHEN $2 = 'locked' THEN CURRENT_TIMESTAMP END WHERE cart_id = $1`, cartID, to); err != nil {
+			return fmt.Errorf("更新拼单状态失败: %v", err)
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		logging.Error("Failed to lock group cart", logrus.Fields{"error": err, "cartID": cartID, "locked": locked})
+		return err
+	}
+	return nil
+}
+
+// CancelGroupCart 取消尚未提交的拼单
+func CancelGroupCart(db *sql.DB, cartID int) error {
+	var result sql.Result
+	err := monitoring.RecordDBTime("CancelGroupCart", func() error {
+		var err error
+		result, err = db.Exec(`UPDATE group_carts SET status = 'cancelled' WHERE cart_id = $1 AND status IN ('open', 'locked')`, cartID)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to cancel group cart", logrus.Fields{"error": err, "cartID": cartID})
+		return fmt.Errorf("取消拼单失败: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrGroupCartClosed
+	}
+	return nil
+}
+
+// SubmitGroupCart 在同一事务中把已锁定的拼单提交为订单：写入订单（预占库存、核销优惠券）、
+// 保存参与者商品的价格快照和分账，并把拼单标记为已提交
+// cart.Items 须为锁定后读取的商品，并已按订单明细填好价格和分账；订单号重复时返回 ErrOrderNoConflict
+func SubmitGroupCart(db *sql.DB, cart *models.GroupCart, order *models.Order) error {
+	logging.Info("Submitting group cart", logrus.Fields{"cartID": cart.CartID, "userID": order.UserID})
+	err := monitoring.RecordDBTime("SubmitGroupCart", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("无法开始事务: %v", err)
+		}
+		defer tx.Rollback()
+
+		status, _, err := lockGroupCartTx(tx, cart.CartID)
+		if err != nil {
+			return err
+		}
+		if status != models.GroupCartLocked {
+			if status == models.GroupCartOpen {
+				return ErrGroupCartNotLocked
+			}
+			return ErrGroupCartClosed
+		}
+		// 读取商品后拼单被重新开放再锁定时，商品可能已经变化
+		var lockedAt sql.NullTime
+		if err := tx.QueryRow(`SELECT locked_at FROM group_carts WHERE cart_id = $1`, cart.CartID).Scan(&lockedAt); err != nil {
+			return fmt.Errorf("查询拼单失败: %v", err)
+		}
+		if cart.LockedAt == nil || !lockedAt.Valid || !lockedAt.Time.Equal(*cart.LockedAt) {
+			return ErrGroupCartChanged
+		}
+
+		orderID, err := insertOrderTx(tx, order)
+		if err != nil {
+			return err
+		}
+		order.OrderID = int(orderID)
+
+		for _, item := range cart.Items {
+			if _, err := tx.Exec(`UPDATE group_cart_items SET unit_price = $2, packaging_fee = $3, subtotal = $4 WHERE item_id = $1`,
+				item.ItemID, item.UnitPrice, item.PackagingFee, item.Subtotal); err != nil {
+				return fmt.Errorf("保存拼单商品快照失败: %v", err)
+			}
+		}
+		for _, share := range cart.Shares {
+			if _, err := tx.Exec(`INSERT INTO group_cart_shares (cart_id, user_id, item_subtotal, packaging_fee, fee_share, payable)
+				VALUES ($1, $2, $3, $4, $5, $6)`, cart.CartID, share.UserID, share.ItemSubtotal, share.PackagingFee, share.FeeShare, share.Payable); err != nil {
+				return fmt.Errorf("保存拼单分账失败: %v", err)
+			}
+		}
+
+		err = tx.QueryRow(`UPDATE group_carts SET status = 'submitted', order_id = $2, submitted_at = CURRENT_TIMESTAMP
+			WHERE cart_id = $1 RETURNING status, submitted_at`, cart.CartID, order.OrderID).Scan(&cart.Status, &cart.SubmittedAt)
+		if err != nil {
+			return fmt.Errorf("更新拼单状态失败: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("事务提交失败: %v", err)
+		}
+		cart.OrderID = order.OrderID
+		return nil
+	})
+	if err != nil {
+		logging.Error("Failed to submit group cart", logrus.Fields{"error": err, "cartID": cart.CartID})
+		return err
+	}
+	logging.Info("Group cart submitted", logrus.Fields{"cartID": cart.CartID, "orderID": order.OrderID})
+	return nil
+}
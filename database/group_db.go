@@ -12,13 +12,13 @@ import (
 )
 
 // CreateGroup 创建与订单关联的新聊天群组
-func CreateGroup(order map[string]interface{}, rp *RedisPool, db *sql.DB, tx *sql.Tx) error {
-	logging.Info("Creating group", logrus.Fields{"order": order})
+func CreateGroup(order *models.Order, rp *RedisPool, db *sql.DB, tx *sql.Tx) error {
+	logging.Info("Creating group", logrus.Fields{"orderID": order.OrderID})
 	group := &models.Group{
-		OrderID: int(order["order_id"].(float64)), // JSON 反序列化时数字会被转换为 float64
-		UserID:  int(order["user_id"].(float64)),
-		ShopID:  int(order["shop_id"].(float64)),
-		RiderID: int(order["rider_id"].(float64)),
+		OrderID: order.OrderID,
+		UserID:  order.UserID,
+		ShopID:  order.ShopID,
+		RiderID: order.RiderID,
 	}
 
 	groupID, err := InsertGroup(tx, rp, group) // 使用传入的事务对象
@@ -36,8 +36,13 @@ func InsertGroup(tx *sql.Tx, rp *RedisPool, group *models.Group) (int64, error)
 	var groupID int64
 	err := monitoring.RecordDBTime("InsertGroup", func() error {
 		// 使用提供的事务对象将群组插入PostgreSQL
-		query := "INSERT INTO `groups` (orderid, userid, shopid, riderid) VALUES ($1, $2, $3, $4) RETURNING groupid"
-		err := tx.QueryRow(query, group.OrderID, group.UserID, group.ShopID, group.RiderID).Scan(&groupID)
+		// 建群时订单通常还没有骑手，riderid 写入 NULL 以满足外键约束
+		var riderID sql.NullInt64
+		if group.RiderID != 0 {
+			riderID = sql.NullInt64{Int64: int64(group.RiderID), Valid: true}
+		}
+		query := "INSERT INTO groups (orderid, userid, shopid, riderid) VALUES ($1, $2, $3, $4) RETURNING groupid"
+		err := tx.QueryRow(query, group.OrderID, group.UserID, group.ShopID, riderID).Scan(&groupID)
 		if err != nil {
 			return fmt.Errorf("PostgreSQL群组插入失败: %v", err)
 		}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"take-out/logging"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// IdempotencyRecord 保存在 Redis 中的幂等请求记录
+// Completed 为 false 表示首个请求仍在处理中
+type IdempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Completed   bool   `json:"completed"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body,omitempty"`
+}
+
+// ReserveIdempotencyKey 以 SETNX 占用幂等键，占用成功返回 nil；
+// 键已存在时返回已有记录，由调用方根据指纹和处理状态决定重放还是拒绝
+func ReserveIdempotencyKey(rp *RedisPool, key, fingerprint string, lockTTL time.Duration) (*IdempotencyRecord, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+
+	pending, _ := json.Marshal(IdempotencyRecord{Fingerprint: fingerprint})
+	var reserved bool
+	err := monitoring.RecordRedisTime("ReserveIdempotencyKey", func() error {
+		var err error
+		reserved, err = rdb.SetNX(ctx, key, pending, lockTTL).Result()
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to reserve idempotency key", logrus.Fields{"error": err, "key": key})
+		return nil, fmt.Errorf("占用幂等键失败: %v", err)
+	}
+	if reserved {
+		return nil, nil
+	}
+
+	var data string
+	err = monitoring.RecordRedisTime("GetIdempotencyRecord", func() error {
+		var err error
+		data, err = rdb.Get(ctx, key).Result()
+		return err
+	})
+	if err == redis.Nil {
+		// 记录恰好过期，重新占用
+		return ReserveIdempotencyKey(rp, key, fingerprint, lockTTL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取幂等记录失败: %v", err)
+	}
+
+	var record IdempotencyRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, fmt.Errorf("幂等记录解析失败: %v", err)
+	}
+	return &record, nil
+}
+
+// SaveIdempotencyRecord 保存请求处理结果，供相同幂等键的重试请求重放
+func SaveIdempotencyRecord(rp *RedisPool, key string, record *IdempotencyRecord, ttl time.Duration) error {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("幂等记录序列化失败: %v", err)
+	}
+	err = monitoring.RecordRedisTime("SaveIdempotencyRecord", func() error {
+		return rdb.Set(ctx, key, data, ttl).Err()
+	})
+	if err != nil {
+		logging.Error("Failed to save idempotency record", logrus.Fields{"error": err, "key": key})
+		return fmt.Errorf("保存幂等记录失败: %v", err)
+	}
+	return nil
+}
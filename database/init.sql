@@ -48,6 +48,7 @@ CREATE TABLE shops (
     shopdescription TEXT,
     shoplatitude DECIMAL(10, 8),
     shoplongitude DECIMAL(11, 8),
+    delivery_radius_km DECIMAL(5, 2) DEFAULT 5.00,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
@@ -60,6 +61,7 @@ COMMENT ON COLUMN shops.shopaddress IS '商家地址';
 COMMENT ON COLUMN shops.shopdescription IS '商家描述';
 COMMENT ON COLUMN shops.shoplatitude IS '商家纬度';
 COMMENT ON COLUMN shops.shoplongitude IS '商家经度';
+COMMENT ON COLUMN shops.delivery_radius_km IS '最大配送半径（公里）';
 COMMENT ON COLUMN shops.created_at IS '创建时间';
 COMMENT ON COLUMN shops.updated_at IS '更新时间';
 
@@ -79,6 +81,7 @@ CREATE TABLE riders (
     rating DECIMAL(3, 2) DEFAULT 5.00,
     riderlatitude DECIMAL(10, 8),
     riderlongitude DECIMAL(11, 8),
+    location_updated_at TIMESTAMP WITH TIME ZONE,
     delivery_fee DECIMAL(10,2) DEFAULT 0,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
@@ -91,8 +94,9 @@ COMMENT ON COLUMN riders.riderphone IS '骑手手机号';
 COMMENT ON COLUMN riders.vehicletype IS '交通工具类型';
 COMMENT ON COLUMN riders.riderstatus IS '骑手状态：在线/离线/忙碌';
 COMMENT ON COLUMN riders.rating IS '骑手评分';
-COMMENT ON COLUMN riders.riderlatitude IS '骑手当前纬度';
-COMMENT ON COLUMN riders.riderlongitude IS '骑手当前经度';
+COMMENT ON COLUMN riders.riderlatitude IS '骑手当前纬度（定期快照）';
+COMMENT ON COLUMN riders.riderlongitude IS '骑手当前经度（定期快照）';
+COMMENT ON COLUMN riders.location_updated_at IS '位置快照对应的定位时间，实时位置以 Redis 为准';
 COMMENT ON COLUMN riders.delivery_fee IS '配送费';
 COMMENT ON COLUMN riders.created_at IS '创建时间';
 COMMENT ON COLUMN riders.updated_at IS '更新时间';
@@ -115,7 +119,8 @@ CREATE TABLE products (
     productname VARCHAR(100) NOT NULL,
     productprice DECIMAL(10, 2) NOT NULL,
     prodescription TEXT,
-    stock INT DEFAULT 0,
+    packaging_fee DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    stock INT DEFAULT 0 CHECK (stock >= 0),
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (shopid) REFERENCES shops(shopid) ON DELETE CASCADE
@@ -125,6 +130,7 @@ COMMENT ON TABLE products IS '商品表';
 COMMENT ON COLUMN products.shopid IS '所属商家ID';
 COMMENT ON COLUMN products.productname IS '商品名称';
 COMMENT ON COLUMN products.productprice IS '商品价格';
+COMMENT ON COLUMN products.packaging_fee IS '单件打包费';
 COMMENT ON COLUMN products.prodescription IS '商品描述';
 COMMENT ON COLUMN products.stock IS '库存数量';
 COMMENT ON COLUMN products.created_at IS '创建时间';
@@ -135,42 +141,103 @@ BEFORE UPDATE ON products
 FOR EACH ROW
 EXECUTE FUNCTION update_updated_at_column();
 
+-- 4.1 商家预约配送时段表
+CREATE TABLE shop_delivery_slots (
+    slot_id SERIAL PRIMARY KEY,
+    shop_id INT NOT NULL REFERENCES shops(shopid) ON DELETE CASCADE,
+    start_time TIME NOT NULL,
+    end_time TIME NOT NULL,
+    capacity INT NOT NULL CHECK (capacity > 0),
+    is_active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (end_time > start_time),
+    UNIQUE (shop_id, start_time)
+);
+
+COMMENT ON TABLE shop_delivery_slots IS '商家预约配送时段，每天重复';
+COMMENT ON COLUMN shop_delivery_slots.start_time IS '时段开始时间';
+COMMENT ON COLUMN shop_delivery_slots.end_time IS '时段结束时间（不含）';
+COMMENT ON COLUMN shop_delivery_slots.capacity IS '每天该时段最多接收的预约单数量，未取消的预约单都占用名额';
+COMMENT ON COLUMN shop_delivery_slots.is_active IS '停用后不再接收新的预约单';
+
+-- 4.2 合并订单表
+CREATE TABLE parent_orders (
+    parent_id SERIAL PRIMARY KEY,
+    parent_no VARCHAR(20) NOT NULL UNIQUE,
+    user_id INT NOT NULL REFERENCES users(userid) ON DELETE CASCADE,
+    payable_amount DECIMAL(10, 2) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE parent_orders IS '跨店合并下单：一次结算生成一个合并订单，每个商家一个子订单（orders.parent_id），合并订单统一支付';
+COMMENT ON COLUMN parent_orders.parent_no IS '合并订单号，规则与订单号相同';
+COMMENT ON COLUMN parent_orders.payable_amount IS '应付金额 = 各子订单应付金额之和';
+
 -- 5. 订单表
 CREATE TABLE orders (
     orderid SERIAL PRIMARY KEY,
+    order_no VARCHAR(20) NOT NULL UNIQUE,
     userid INT NOT NULL,
     shopid INT NOT NULL,
     riderid INT DEFAULT NULL,
-    productid INT NOT NULL,
-    orderstatus VARCHAR(20) DEFAULT 'pending' CHECK (orderstatus IN ('pending', 'confirmed', 'preparing', 'delivering', 'completed', 'cancelled')),
+    orderstatus VARCHAR(20) DEFAULT 'pending' CHECK (orderstatus IN ('awaiting_payment', 'scheduled', 'pending', 'confirmed', 'published', 'delivering', 'ready_for_pickup', 'completed', 'cancelled')),
+    fulfillment_type VARCHAR(10) NOT NULL DEFAULT 'delivery' CHECK (fulfillment_type IN ('delivery', 'pickup')),
+    pickup_code VARCHAR(6) DEFAULT NULL,
     username VARCHAR(50),
     shopname VARCHAR(100),
     ordertime TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    productname VARCHAR(100),
     totalprice DECIMAL(10, 2) NOT NULL,
     delivery_fee DECIMAL(10,2) DEFAULT 0,
+    notes TEXT,
+    delivery_address TEXT,
+    delivery_latitude DECIMAL(10, 8),
+    delivery_longitude DECIMAL(11, 8),
+    distance_km DECIMAL(6, 2),
+    user_coupon_id INT DEFAULT NULL,
+    discount_amount DECIMAL(10, 2) DEFAULT 0,
+    packaging_fee DECIMAL(10, 2) DEFAULT 0,
+    service_fee DECIMAL(10, 2) DEFAULT 0,
+    payable_amount DECIMAL(10, 2) DEFAULT 0,
+    scheduled_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+    delivery_slot_id INT DEFAULT NULL REFERENCES shop_delivery_slots(slot_id),
+    release_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
     groupid INT DEFAULT NULL,
+    parent_id INT DEFAULT NULL REFERENCES parent_orders(parent_id) ON DELETE CASCADE,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (userid) REFERENCES users(userid) ON DELETE CASCADE,
     FOREIGN KEY (shopid) REFERENCES shops(shopid) ON DELETE CASCADE,
-    FOREIGN KEY (riderid) REFERENCES riders(riderid) ON DELETE SET NULL,
-    FOREIGN KEY (productid) REFERENCES products(productid) ON DELETE CASCADE
+    FOREIGN KEY (riderid) REFERENCES riders(riderid) ON DELETE SET NULL
 );
 
 COMMENT ON TABLE orders IS '订单表';
+COMMENT ON COLUMN orders.order_no IS '订单号：下单时间 + 实例编号 + 秒内序号 + 校验位，规则见 orderno/orderno.go';
 COMMENT ON COLUMN orders.userid IS '用户ID';
 COMMENT ON COLUMN orders.shopid IS '商家ID';
 COMMENT ON COLUMN orders.riderid IS '骑手ID';
-COMMENT ON COLUMN orders.productid IS '商品ID';
-COMMENT ON COLUMN orders.orderstatus IS '订单状态';
+COMMENT ON COLUMN orders.orderstatus IS '订单状态，流转规则见 models/order_state.go';
+COMMENT ON COLUMN orders.fulfillment_type IS '履约方式：delivery 骑手配送，pickup 顾客到店自取（不收配送费、不发布跑腿订单）';
+COMMENT ON COLUMN orders.pickup_code IS '自取订单的取餐码，商家核对后确认取餐';
 COMMENT ON COLUMN orders.username IS '用户名（冗余字段）';
 COMMENT ON COLUMN orders.shopname IS '商家名（冗余字段）';
 COMMENT ON COLUMN orders.ordertime IS '下单时间';
-COMMENT ON COLUMN orders.productname IS '商品名（冗余字段）';
-COMMENT ON COLUMN orders.totalprice IS '订单总价';
+COMMENT ON COLUMN orders.totalprice IS '商品小计（各明细小计之和）';
 COMMENT ON COLUMN orders.delivery_fee IS '配送费';
+COMMENT ON COLUMN orders.notes IS '用户备注';
+COMMENT ON COLUMN orders.delivery_address IS '收货地址';
+COMMENT ON COLUMN orders.delivery_latitude IS '收货纬度';
+COMMENT ON COLUMN orders.delivery_longitude IS '收货经度';
+COMMENT ON COLUMN orders.distance_km IS '商家到收货地址的距离（公里），用于计算配送费';
+COMMENT ON COLUMN orders.user_coupon_id IS '使用的用户优惠券ID';
+COMMENT ON COLUMN orders.discount_amount IS '优惠券减免金额';
+COMMENT ON COLUMN orders.packaging_fee IS '打包费';
+COMMENT ON COLUMN orders.service_fee IS '平台服务费';
+COMMENT ON COLUMN orders.payable_amount IS '应付金额 = 商品小计 + 打包费 + 配送费 + 服务费 - 优惠减免';
+COMMENT ON COLUMN orders.scheduled_at IS '预约送达时间，为空表示立即配送';
+COMMENT ON COLUMN orders.delivery_slot_id IS '预约送达时间所在的商家配送时段';
+COMMENT ON COLUMN orders.release_at IS '预约单通知商家备餐的时间 = 预约送达时间 - 提前量，到达前订单保持 scheduled 状态';
 COMMENT ON COLUMN orders.groupid IS '聊天群组ID';
+COMMENT ON COLUMN orders.parent_id IS '所属合并订单，为空表示单独下单；子订单各自接单、配送，由合并订单统一支付';
 COMMENT ON COLUMN orders.created_at IS '创建时间';
 COMMENT ON COLUMN orders.updated_at IS '更新时间';
 
@@ -179,6 +246,276 @@ BEFORE UPDATE ON orders
 FOR EACH ROW
 EXECUTE FUNCTION update_updated_at_column();
 
+-- 5.1 订单明细表
+CREATE TABLE order_items (
+    item_id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL REFERENCES orders(orderid) ON DELETE CASCADE,
+    product_id INT NOT NULL REFERENCES products(productid),
+    product_name VARCHAR(100) NOT NULL,
+    quantity INT NOT NULL CHECK (quantity > 0),
+    unit_price DECIMAL(10, 2) NOT NULL,
+    packaging_fee DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    subtotal DECIMAL(10, 2) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE order_items IS '订单明细表';
+COMMENT ON COLUMN order_items.order_id IS '所属订单ID';
+COMMENT ON COLUMN order_items.product_id IS '商品ID';
+COMMENT ON COLUMN order_items.product_name IS '商品名（下单时快照）';
+COMMENT ON COLUMN order_items.quantity IS '购买数量';
+COMMENT ON COLUMN order_items.unit_price IS '单价（下单时快照）';
+COMMENT ON COLUMN order_items.packaging_fee IS '单件打包费（下单时快照）';
+COMMENT ON COLUMN order_items.subtotal IS '小计';
+
+-- 5.2 订单状态变更记录表
+CREATE TABLE order_events (
+    event_id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL REFERENCES orders(orderid) ON DELETE CASCADE,
+    from_status VARCHAR(20),
+    to_status VARCHAR(20) NOT NULL,
+    actor_role VARCHAR(10) NOT NULL CHECK (actor_role IN ('user', 'shop', 'rider', 'system')),
+    actor_id INT NOT NULL DEFAULT 0,
+    reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+COMMENT ON TABLE order_events IS '订单状态变更记录表，与状态变更在同一事务中写入';
+COMMENT ON COLUMN order_events.order_id IS '订单ID';
+COMMENT ON COLUMN order_events.from_status IS '变更前状态，订单创建事件为空';
+COMMENT ON COLUMN order_events.to_status IS '变更后状态';
+COMMENT ON COLUMN order_events.actor_role IS '操作者角色';
+COMMENT ON COLUMN order_events.actor_id IS '操作者ID，系统操作为0';
+COMMENT ON COLUMN order_events.reason IS '变更原因';
+COMMENT ON COLUMN order_events.created_at IS '变更时间';
+
+-- 5.3 优惠券表
+CREATE TABLE coupons (
+    coupon_id SERIAL PRIMARY KEY,
+    shop_id INT REFERENCES shops(shopid) ON DELETE CASCADE,
+    title VARCHAR(100) NOT NULL,
+    coupon_type VARCHAR(20) NOT NULL CHECK (coupon_type IN ('fixed', 'percent', 'threshold')),
+    amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    percent_off DECIMAL(5, 2) NOT NULL DEFAULT 0,
+    max_discount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    min_spend DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    product_ids INT[],
+    valid_from TIMESTAMP WITH TIME ZONE NOT NULL,
+    valid_to TIMESTAMP WITH TIME ZONE NOT NULL,
+    total_limit INT NOT NULL DEFAULT 0,
+    per_user_limit INT NOT NULL DEFAULT 1,
+    claimed_count INT NOT NULL DEFAULT 0,
+    redeemed_count INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (valid_to > valid_from),
+    CHECK (total_limit = 0 OR claimed_count <= total_limit)
+);
+
+COMMENT ON TABLE coupons IS '优惠券模板表';
+COMMENT ON COLUMN coupons.shop_id IS '发券商家ID，为空表示平台券';
+COMMENT ON COLUMN coupons.coupon_type IS '类型：fixed 无门槛立减/percent 折扣/threshold 满减';
+COMMENT ON COLUMN coupons.amount IS '减免金额（立减券、满减券）';
+COMMENT ON COLUMN coupons.percent_off IS '减免百分比（折扣券），15 表示减 15%';
+COMMENT ON COLUMN coupons.max_discount IS '折扣券最高减免金额，0 表示不限';
+COMMENT ON COLUMN coupons.min_spend IS '适用商品金额门槛';
+COMMENT ON COLUMN coupons.product_ids IS '限定商品ID，为空表示全部商品';
+COMMENT ON COLUMN coupons.total_limit IS '发放总量，0 表示不限';
+COMMENT ON COLUMN coupons.per_user_limit IS '每个用户最多领取张数';
+COMMENT ON COLUMN coupons.claimed_count IS '已领取张数';
+COMMENT ON COLUMN coupons.redeemed_count IS '已核销张数';
+
+-- 5.4 用户优惠券表
+CREATE TABLE user_coupons (
+    user_coupon_id SERIAL PRIMARY KEY,
+    coupon_id INT NOT NULL REFERENCES coupons(coupon_id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(userid) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'available' CHECK (status IN ('available', 'used')),
+    order_id INT REFERENCES orders(orderid) ON DELETE SET NULL,
+    claimed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+COMMENT ON TABLE user_coupons IS '用户领取的优惠券';
+COMMENT ON COLUMN user_coupons.status IS '状态：available 可用/used 已使用，订单取消后退回为可用';
+COMMENT ON COLUMN user_coupons.order_id IS '核销的订单ID';
+
+-- 5.5 支付表
+CREATE TABLE payments (
+    payment_id SERIAL PRIMARY KEY,
+    order_id INT REFERENCES orders(orderid) ON DELETE CASCADE,
+    parent_id INT REFERENCES parent_orders(parent_id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(userid) ON DELETE CASCADE,
+    provider VARCHAR(20) NOT NULL,
+    provider_ref VARCHAR(64) NOT NULL UNIQUE,
+    pay_url TEXT,
+    amount DECIMAL(10, 2) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'paid', 'failed', 'refunded')),
+    refunded_amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    fail_reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    paid_at TIMESTAMP WITH TIME ZONE,
+    CHECK (refunded_amount <= amount),
+    CHECK ((order_id IS NULL) <> (parent_id IS NULL))
+);
+
+CREATE INDEX idx_payments_order ON payments(order_id);
+CREATE INDEX idx_payments_parent ON payments(parent_id);
+
+COMMENT ON TABLE payments IS '订单支付记录，一个订单可以有多次支付尝试，重复支付的款项需要退回';
+COMMENT ON COLUMN payments.order_id IS '支付的订单，合并订单的支付记录为空';
+COMMENT ON COLUMN payments.parent_id IS '支付的合并订单，与 order_id 二选一';
+COMMENT ON COLUMN payments.provider IS '支付渠道，见 payment 包';
+COMMENT ON COLUMN payments.provider_ref IS '渠道支付单号';
+COMMENT ON COLUMN payments.pay_url IS '客户端拉起支付所需的地址或参数';
+COMMENT ON COLUMN payments.amount IS '支付金额，等于订单（或合并订单）应付金额';
+COMMENT ON COLUMN payments.status IS '状态：pending 待支付/paid 已支付/failed 失败或已关闭/refunded 已退款';
+COMMENT ON COLUMN payments.fail_reason IS '失败或关闭原因';
+COMMENT ON COLUMN payments.refunded_amount IS '已退款金额，全部退完后状态变为 refunded';
+COMMENT ON COLUMN payments.paid_at IS '支付成功时间';
+
+-- 5.6 退款表
+CREATE TABLE refunds (
+    refund_id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL REFERENCES orders(orderid) ON DELETE CASCADE,
+    payment_id INT NOT NULL REFERENCES payments(payment_id),
+    amount DECIMAL(10, 2) NOT NULL CHECK (amount > 0),
+    reason_code VARCHAR(30) NOT NULL CHECK (reason_code IN ('order_cancelled', 'missing_item', 'quality_issue', 'duplicate_payment', 'other')),
+    reason TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'succeeded', 'failed', 'rejected')),
+    requested_role VARCHAR(10) NOT NULL CHECK (requested_role IN ('user', 'shop', 'rider', 'system')),
+    requested_id INT NOT NULL DEFAULT 0,
+    reviewed_role VARCHAR(10) CHECK (reviewed_role IN ('user', 'shop', 'rider', 'system')),
+    reviewed_id INT,
+    review_note TEXT,
+    provider_refund_ref VARCHAR(64),
+    fail_reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    attempted_at TIMESTAMP WITH TIME ZONE,
+    completed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_refunds_order ON refunds(order_id);
+CREATE INDEX idx_refunds_payment ON refunds(payment_id);
+CREATE INDEX idx_refunds_approved ON refunds(attempted_at) WHERE status = 'approved';
+
+COMMENT ON TABLE refunds IS '退款单，支付后取消的订单全额退款，漏送等情况按商品明细部分退款';
+COMMENT ON COLUMN refunds.payment_id IS '原路退回的支付记录，子订单的退款退回合并订单的支付记录，每个子订单最多退回其应付金额';
+COMMENT ON COLUMN refunds.reason_code IS '退款原因，见 models/refund.go';
+COMMENT ON COLUMN refunds.status IS '状态：pending 待审核/approved 退款中/succeeded 成功/failed 渠道失败/rejected 已拒绝';
+COMMENT ON COLUMN refunds.requested_role IS '发起方角色';
+COMMENT ON COLUMN refunds.reviewed_role IS '审核方角色，商家接单前取消的退款由 system 自动批准';
+COMMENT ON COLUMN refunds.provider_refund_ref IS '渠道退款单号';
+COMMENT ON COLUMN refunds.attempted_at IS '最近一次发起渠道退款的时间，批准时写入，退款重试任务据此重试长时间未完成的退款';
+COMMENT ON COLUMN refunds.completed_at IS '退款成功时间';
+
+-- 5.7 退款明细表
+CREATE TABLE refund_items (
+    refund_id INT NOT NULL REFERENCES refunds(refund_id) ON DELETE CASCADE,
+    order_item_id INT NOT NULL REFERENCES order_items(item_id) ON DELETE CASCADE,
+    quantity INT NOT NULL CHECK (quantity > 0),
+    amount DECIMAL(10, 2) NOT NULL,
+    PRIMARY KEY (refund_id, order_item_id)
+);
+
+COMMENT ON TABLE refund_items IS '部分退款的商品明细';
+COMMENT ON COLUMN refund_items.quantity IS '退款数量，同一明细累计退款数量不超过购买数量';
+COMMENT ON COLUMN refund_items.amount IS '退款金额 = (下单单价 + 单件打包费) * 数量';
+
+-- 5.8 资金流水表
+CREATE TABLE payment_ledger (
+    entry_id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL REFERENCES orders(orderid) ON DELETE CASCADE,
+    payment_id INT NOT NULL REFERENCES payments(payment_id),
+    refund_id INT REFERENCES refunds(refund_id),
+    entry_type VARCHAR(10) NOT NULL CHECK (entry_type IN ('payment', 'refund')),
+    amount DECIMAL(10, 2) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_payment_ledger_order ON payment_ledger(order_id);
+
+COMMENT ON TABLE payment_ledger IS '资金流水，只追加不修改：支付成功记收入，退款成功记支出';
+COMMENT ON COLUMN payment_ledger.entry_type IS '流水类型：payment 收款/refund 退款';
+COMMENT ON COLUMN payment_ledger.amount IS '金额，收款为正、退款为负';
+
+-- 5.9 拼单购物车表
+CREATE TABLE group_carts (
+    cart_id SERIAL PRIMARY KEY,
+    share_code VARCHAR(8) NOT NULL UNIQUE,
+    host_user_id INT NOT NULL REFERENCES users(userid) ON DELETE CASCADE,
+    shop_id INT NOT NULL REFERENCES shops(shopid) ON DELETE CASCADE,
+    status VARCHAR(10) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'locked', 'submitted', 'cancelled')),
+    order_id INT REFERENCES orders(orderid) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    locked_at TIMESTAMP WITH TIME ZONE,
+    submitted_at TIMESTAMP WITH TIME ZONE
+);
+
+COMMENT ON TABLE group_carts IS '拼单购物车：发起人为一个商家创建，参与者凭分享码各自加购，发起人锁定后提交为一个订单、一次配送';
+COMMENT ON COLUMN group_carts.share_code IS '分享码，参与者凭分享码查看和加购';
+COMMENT ON COLUMN group_carts.host_user_id IS '发起人，负责锁定、提交和支付';
+COMMENT ON COLUMN group_carts.status IS '拼单状态：open 加购中/locked 已锁定/submitted 已提交/cancelled 已取消';
+COMMENT ON COLUMN group_carts.order_id IS '提交后生成的订单';
+
+-- 5.10 拼单商品表
+CREATE TABLE group_cart_items (
+    item_id SERIAL PRIMARY KEY,
+    cart_id INT NOT NULL REFERENCES group_carts(cart_id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(userid) ON DELETE CASCADE,
+    product_id INT NOT NULL REFERENCES products(productid),
+    quantity INT NOT NULL CHECK (quantity > 0),
+    unit_price DECIMAL(10, 2),
+    packaging_fee DECIMAL(10, 2),
+    subtotal DECIMAL(10, 2),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (cart_id, user_id, product_id)
+);
+
+COMMENT ON TABLE group_cart_items IS '拼单商品，每个参与者各自的加购记录';
+COMMENT ON COLUMN group_cart_items.user_id IS '加购的参与者';
+COMMENT ON COLUMN group_cart_items.unit_price IS '单价，提交时按订单明细快照，提交前为空';
+COMMENT ON COLUMN group_cart_items.packaging_fee IS '单件打包费，提交时快照';
+COMMENT ON COLUMN group_cart_items.subtotal IS '小计，提交时快照';
+
+-- 5.11 拼单分账表
+CREATE TABLE group_cart_shares (
+    cart_id INT NOT NULL REFERENCES group_carts(cart_id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(userid) ON DELETE CASCADE,
+    item_subtotal DECIMAL(10, 2) NOT NULL,
+    packaging_fee DECIMAL(10, 2) NOT NULL,
+    fee_share DECIMAL(10, 2) NOT NULL,
+    payable DECIMAL(10, 2) NOT NULL,
+    PRIMARY KEY (cart_id, user_id)
+);
+
+COMMENT ON TABLE group_cart_shares IS '拼单分账：提交时按参与者拆分订单金额，供线下分摊';
+COMMENT ON COLUMN group_cart_shares.fee_share IS '分摊的配送费、服务费减去优惠券减免，按参与者商品金额比例分摊';
+COMMENT ON COLUMN group_cart_shares.payable IS '应分摊金额 = 商品小计 + 打包费 + 分摊费用，各参与者之和等于订单应付金额';
+
+-- 5.12 派单记录表
+CREATE TABLE dispatch_offers (
+    offer_id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL REFERENCES orders(orderid) ON DELETE CASCADE,
+    rider_id INT NOT NULL REFERENCES riders(riderid) ON DELETE CASCADE,
+    score DECIMAL(6, 4) NOT NULL,
+    distance_km DECIMAL(8, 2) NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'offered' CHECK (status IN ('offered', 'accepted', 'declined', 'expired', 'withdrawn')),
+    offered_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    responded_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (order_id, rider_id)
+);
+
+-- 同一订单同一时间只有一个待答复的派单
+CREATE UNIQUE INDEX idx_dispatch_offers_open ON dispatch_offers(order_id) WHERE status = 'offered';
+CREATE INDEX idx_dispatch_offers_rider ON dispatch_offers(rider_id, offered_at);
+
+COMMENT ON TABLE dispatch_offers IS '派单记录：跑腿订单发布后按骑手得分依次派给单个骑手，超时或拒绝后派给下一位，均未接单时进入公共大厅';
+COMMENT ON COLUMN dispatch_offers.score IS '派单时骑手的综合得分（距离、负载、评分、接单率）';
+COMMENT ON COLUMN dispatch_offers.distance_km IS '派单时骑手到商家的距离';
+COMMENT ON COLUMN dispatch_offers.status IS '派单状态：offered 待答复/accepted 已接受/declined 已拒绝/expired 超时/withdrawn 订单已被他人抢走或取消';
+COMMENT ON COLUMN dispatch_offers.expires_at IS '骑手答复截止时间';
+
 -- 6. 聊天群组表
 CREATE TABLE groups (
     groupid SERIAL PRIMARY KEY,
@@ -237,6 +574,15 @@ CREATE INDEX idx_orders_shopid ON orders(shopid);
 CREATE INDEX idx_orders_riderid ON orders(riderid);
 CREATE INDEX idx_orders_status ON orders(orderstatus);
 CREATE INDEX idx_orders_time ON orders(ordertime);
+CREATE INDEX idx_orders_delivery_slot ON orders(delivery_slot_id, scheduled_at) WHERE delivery_slot_id IS NOT NULL;
+CREATE INDEX idx_orders_release ON orders(release_at) WHERE orderstatus = 'scheduled';
+CREATE INDEX idx_orders_parent ON orders(parent_id) WHERE parent_id IS NOT NULL;
+
+CREATE INDEX idx_order_items_order_id ON order_items(order_id);
+CREATE INDEX idx_order_events_order_id ON order_events(order_id, created_at);
+CREATE INDEX idx_coupons_shop_id ON coupons(shop_id, valid_to);
+CREATE INDEX idx_user_coupons_user_id ON user_coupons(user_id, status);
+CREATE INDEX idx_user_coupons_order_id ON user_coupons(order_id);
 
 CREATE INDEX idx_messages_groupid ON messages(groupid);
 CREATE INDEX idx_messages_timestamp ON messages(timestamp);
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"take-out/logging"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// 实例编号租约：每个服务实例启动时在 Redis 中占用一个编号（instance_lease:<id>，值为实例标识），
+// 运行期间定期续期，实例退出或崩溃后租约到期自动释放，保证同时运行的实例编号互不相同
+const (
+	instanceLeaseKeyPrefix = "instance_lease:"
+	instanceLeaseCursorKey = "instance_lease:cursor"
+)
+
+var ErrNoInstanceID = errors.New("没有可用的实例编号")
+
+// 租约仍属于本实例时续期，已过期但未被占用时重新占用；已被其他实例占用时返回 0，不覆盖对方的租约
+var renewInstanceLeaseScript = redis.NewScript(`
+local owner = redis.call('GET', KEYS[1])
+if owner == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if not owner then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0
+`)
+
+func instanceLeaseKey(id int) string {
+	return fmt.Sprintf("%s%d", instanceLeaseKeyPrefix, id)
+}
+
+// ClaimInstanceID 在 0 到 maxID 之间申请一个未被占用的实例编号
+// 从一个递增游标开始依次尝试，避免多个实例同时启动时都从 0 开始争抢
+func ClaimInstanceID(rp *RedisPool, owner string, maxID int, ttl time.Duration) (int, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	claimed := -1
+	err := monitoring.RecordRedisTime("ClaimInstanceID", func() error {
+		start, err := rdb.Incr(ctx, instanceLeaseCursorKey).Result()
+		if err != nil {
+			return err
+		}
+		for i := 0; i <= maxID; i++ {
+			id := int((start + int64(i)) % int64(maxID+1))
+			ok, err := rdb.SetNX(ctx, instanceLeaseKey(id), owner, ttl).Result()
+			if err != nil {
+				return err
+			}
+			if ok {
+				claimed = id
+				return nil
+			}
+		}
+		return ErrNoInstanceID
+	})
+	if err != nil {
+		logging.Error("Failed to claim instance id", logrus.Fields{"error": err, "owner": owner})
+		if errors.Is(err, ErrNoInstanceID) {
+			return -1, err
+		}
+		return -1, fmt.Errorf("申请实例编号失败: %v", err)
+	}
+	logging.Info("Instance id claimed", logrus.Fields{"instanceID": claimed, "owner": owner})
+	return claimed, nil
+}
+
+// RenewInstanceID 续期实例编号租约，返回 false 表示租约已过期并被其他实例占用，需要重新申请
+func RenewInstanceID(rp *RedisPool, id int, owner string, ttl time.Duration) (bool, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	var renewed int64
+	err := monitoring.RecordRedisTime("RenewInstanceID", func() error {
+		var err error
+		renewed, err = renewInstanceLeaseScript.Run(ctx, rdb, []string{instanceLeaseKey(id)}, owner, ttl.Milliseconds()).Int64()
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("续期实例编号失败: %v", err)
+	}
+	return renewed == 1, nil
+}
@@ -4,18 +4,30 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"take-out/logging"
 	"take-out/models"
 	"take-out/monitoring"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	ErrOrderNotFound    = errors.New("订单不存在")
+	ErrOrderNotAssigned = errors.New("该订单不属于当前骑手")
+	ErrOrderTaken       = errors.New("订单已被其他骑手抢走")
+	// ErrOrderNoConflict 订单号与已有订单重复，调用方重新生成订单号后重试
+	ErrOrderNoConflict = errors.New("订单号重复")
+	// ErrPickupCodeMismatch 商家确认自取订单取餐时输入的取餐码与订单不一致
+	ErrPickupCodeMismatch = errors.New("取餐码不正确")
+)
+
 // todo 加上登陆状态
 //下单：通过连接Redis连接池的客户端，创建一个消息队列在redis中，将订单信息以json格式存储到消息队列中
-func UserPlaceOrder(orderID, userID, shopID, riderID int, products []models.Product, rp *RedisPool) error {
+func UserPlaceOrder(orderID, userID, shopID, riderID int, items []models.OrderItem, rp *RedisPool) error {
 	logging.Info("Placing order", logrus.Fields{"orderID": orderID, "userID": userID, "shopID": shopID})
 	err := monitoring.RecordRedisTime("UserPlaceOrder", func() error {
 		rdb := rp.GetClient()
@@ -27,7 +39,7 @@ func UserPlaceOrder(orderID, userID, shopID, riderID int, products []models.Prod
 			"user_id":  userID,
 			"shop_id":  shopID,
 			"rider_id": riderID,
-			"products": products, // 将商品信息添加到订单
+			"items":    items, // 将订单明细添加到订单
 		}
 
 		// 将订单信息转化为 JSON 格式
@@ -49,8 +61,8 @@ func UserPlaceOrder(orderID, userID, shopID, riderID int, products []models.Prod
 	return nil
 }
 
-// 新增函数：通知商家有新订单（需添加到 handlers 包）
-func notifyShop(db *sql.DB, rp *RedisPool, orderID int) error {
+// NotifyShop 通知商家有新订单，订单支付成功后调用
+func NotifyShop(db *sql.DB, rp *RedisPool, orderID int) error {
 	logging.Info("Notifying shop", logrus.Fields{"orderID": orderID})
 	// 1. 获取订单详情（参考 handleOrderStatus 逻辑）
 	order, err := QueryOrderStatus(db, orderID)
@@ -83,16 +95,13 @@ func notifyShop(db *sql.DB, rp *RedisPool, orderID int) error {
 		return fmt.Errorf("通知发送失败")
 	}
 
-	// 5. 更新订单系统状态（可选）
-	_ = UpdateOrderStatus(db, orderID, "等待商家确认") // 忽略错误继续流程
-
 	logging.Info("Shop notified successfully", logrus.Fields{"shopID": order.ShopID, "orderID": orderID})
 	return nil
 }
 
 // 插入订单到数据库，使用事务
 func InsertOrder(db *sql.DB, order *models.Order) (int64, error) {
-	logging.Info("Inserting order", logrus.Fields{"userID": order.UserID, "shopID": order.ShopID})
+	logging.Info("Inserting order", logrus.Fields{"userID": order.UserID, "shopID": order.ShopID, "items": len(order.Items)})
 	var orderID int64
 	err := monitoring.RecordDBTime("InsertOrder", func() error {
 		tx, err := db.Begin()
@@ -101,12 +110,9 @@ func InsertOrder(db *sql.DB, order *models.Order) (int64, error) {
 		}
 		defer tx.Rollback()
 
-		query := "INSERT INTO orders (user_id, shop_id, orderstatus, totalprice, delivery_fee) VALUES ($1, $2, $3, $4, $5) RETURNING orderid"
-		err = tx.QueryRow(query, order.UserID, order.ShopID, order.OrderStatus, order.TotalPrice, order.DeliveryFee).Scan(&orderID)
-		if err != nil {
-			return fmt.Errorf("订单插入失败: %v", err)
+		if orderID, err = insertOrderTx(tx, order); err != nil {
+			return err
 		}
-
 		if err := tx.Commit(); err != nil {
 			return fmt.Errorf("事务提交失败: %v", err)
 		}
@@ -120,9 +126,85 @@ func InsertOrder(db *sql.DB, order *models.Order) (int64, error) {
 	return orderID, nil
 }
 
+// 在事务中写入订单：预占库存和预约时段名额、写入订单及明细、核销优惠券并记录创建事件，任一步失败时由调用方回滚整个事务
+func insertOrderTx(tx *sql.Tx, order *models.Order) (int64, error) {
+	// 先预占库存，库存不足时整个订单回滚
+	if err := reserveStockTx(tx, order.Items); err != nil {
+		return 0, err
+	}
+	// 预约单占用预约时段名额
+	if order.DeliverySlotID != 0 && order.ScheduledAt != nil {
+		if err := reserveDeliverySlotTx(tx, order.DeliverySlotID, *order.ScheduledAt); err != nil {
+			return 0, err
+		}
+	}
+
+	var orderID int64
+	query := `INSERT INTO orders (order_no, userid, shopid, orderstatus, totalprice, delivery_fee, notes,
+			 delivery_address, delivery_latitude, delivery_longitude, distance_km, user_coupon_id, discount_amount,
+			 packaging_fee, service_fee, payable_amount, scheduled_at, delivery_slot_id, release_at, fulfillment_type, pickup_code, parent_id)
+			 VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9, $10, $11, NULLIF($12, 0), $13, $14, $15, $16,
+			 $17, NULLIF($18, 0), $19, $20, NULLIF($21, ''), NULLIF($22, 0)) RETURNING orderid, ordertime`
+	err := tx.QueryRow(query, order.OrderNo, order.UserID, order.ShopID, order.OrderStatus, order.TotalPrice, order.DeliveryFee, order.Notes,
+		order.DeliveryAddress, order.DeliveryLatitude, order.DeliveryLongitude, order.DistanceKm,
+		order.UserCouponID, order.DiscountAmount, order.PackagingFee, order.ServiceFee, order.PayableAmount,
+		order.ScheduledAt, order.DeliverySlotID, order.ReleaseAt, order.FulfillmentType, order.PickupCode, order.ParentID).Scan(&orderID, &order.OrderTime)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && pqErr.Constraint == "orders_order_no_key" {
+		return 0, ErrOrderNoConflict
+	}
+	if err != nil {
+		return 0, fmt.Errorf("订单插入失败: %v", err)
+	}
+
+	// 订单明细与订单在同一事务中写入
+	if err := insertOrderItemsTx(tx, int(orderID), order.Items); err != nil {
+		return 0, err
+	}
+
+	// 核销优惠券，券已被其他订单使用时整个订单回滚
+	if order.UserCouponID != 0 {
+		if err := redeemCouponTx(tx, order.UserCouponID, order.UserID, int(orderID)); err != nil {
+			return 0, err
+		}
+	}
+
+	// 记录订单创建事件，作为时间线的起点
+	creator := models.OrderActor{Role: models.RoleUser, ID: order.UserID}
+	if err := insertOrderEventTx(tx, int(orderID), "", order.OrderStatus, creator, ""); err != nil {
+		return 0, err
+	}
+	return orderID, nil
+}
+
+// 在事务中锁定订单并按订单生命周期变更状态，同时记录状态变更事件，返回变更前的状态
+// 所有订单状态的写入都必须经过这里，非法流转返回 *models.TransitionError，履约方式不支持目标状态时返回 *models.FulfillmentError
+func transitionOrderTx(tx *sql.Tx, orderID int, to string, actor models.OrderActor, reason string) (string, error) {
+	var from, fulfillmentType string
+	err := tx.QueryRow(`SELECT orderstatus, fulfillment_type FROM orders WHERE orderid = $1 FOR UPDATE`, orderID).Scan(&from, &fulfillmentType)
+	if err == sql.ErrNoRows {
+		return "", ErrOrderNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("获取订单状态失败: %v", err)
+	}
+	if err := models.ValidateTransition(from, to, actor.Role); err != nil {
+		return from, err
+	}
+	if err := models.ValidateFulfillment(fulfillmentType, to); err != nil {
+		return from, err
+	}
+	if _, err := tx.Exec(`UPDATE orders SET orderstatus = $1 WHERE orderid = $2`, to, orderID); err != nil {
+		return from, fmt.Errorf("订单状态更新失败: %v", err)
+	}
+	if err := insertOrderEventTx(tx, orderID, from, to, actor, reason); err != nil {
+		return from, err
+	}
+	return from, nil
+}
+
 // 更新订单状态，使用事务
-func UpdateOrderStatus(db *sql.DB, OrderID int, OrderStatus string) error {
-	logging.Info("Updating order status", logrus.Fields{"orderID": OrderID, "status": OrderStatus})
+func UpdateOrderStatus(db *sql.DB, OrderID int, OrderStatus string, actor models.OrderActor, reason string) error {
+	logging.Info("Updating order status", logrus.Fields{"orderID": OrderID, "status": OrderStatus, "role": actor.Role, "actorID": actor.ID})
 	err := monitoring.RecordDBTime("UpdateOrderStatus", func() error {
 		// 开始一个事务
 		tx, err := db.Begin()
@@ -130,11 +212,8 @@ func UpdateOrderStatus(db *sql.DB, OrderID int, OrderStatus string) error {
 			return fmt.Errorf("无法开始事务: %v", err)
 		}
 		defer tx.Rollback()
-		// 执行更新订单状态的 SQL 查询
-		query := "UPDATE orders SET orderstatus = $1 WHERE order_id = $2"
-		_, err = tx.Exec(query, OrderStatus, OrderID)
-		if err != nil {
-			return fmt.Errorf("订单状态更新失败: %v", err)
+		if _, err := transitionOrderTx(tx, OrderID, OrderStatus, actor, reason); err != nil {
+			return err
 		}
 		if err := tx.Commit(); err != nil {
 			return fmt.Errorf("事务提交失败: %v", err)
@@ -153,22 +232,94 @@ func UpdateOrderStatus(db *sql.DB, OrderID int, OrderStatus string) error {
 func QueryOrderStatus(db *sql.DB, orderID int) (*models.Order, error) {
 	logging.Info("Querying order status", logrus.Fields{"orderID": orderID})
 	var order models.Order
+	var riderID sql.NullInt64
+	var scheduledAt, releaseAt sql.NullTime
 	err := monitoring.RecordDBTime("QueryOrderStatus", func() error {
-		query := `SELECT orderid, riderid, shopid, productid, ordertime, totalprice, orderstatus FROM orders WHERE orderid = $1`
+		query := `SELECT orderid, order_no, userid, riderid, shopid, ordertime, totalprice, delivery_fee, COALESCE(notes, ''),
+				 COALESCE(delivery_address, ''), COALESCE(delivery_latitude, 0), COALESCE(delivery_longitude, 0), COALESCE(distance_km, 0),
+				 COALESCE(user_coupon_id, 0), discount_amount, packaging_fee, service_fee, payable_amount, orderstatus,
+				 scheduled_at, COALESCE(delivery_slot_id, 0), release_at, fulfillment_type, COALESCE(pickup_code, ''), COALESCE(parent_id, 0)
+				 FROM orders WHERE orderid = $1`
 		row := db.QueryRow(query, orderID)
-		err := row.Scan(&order.OrderID, &order.RiderID, &order.ShopID, &order.ProductID, &order.OrderTime, &order.TotalPrice, &order.OrderStatus)
+		err := row.Scan(&order.OrderID, &order.OrderNo, &order.UserID, &riderID, &order.ShopID, &order.OrderTime, &order.TotalPrice, &order.DeliveryFee, &order.Notes,
+			&order.DeliveryAddress, &order.DeliveryLatitude, &order.DeliveryLongitude, &order.DistanceKm,
+			&order.UserCouponID, &order.DiscountAmount, &order.PackagingFee, &order.ServiceFee, &order.PayableAmount, &order.OrderStatus,
+			&scheduledAt, &order.DeliverySlotID, &releaseAt, &order.FulfillmentType, &order.PickupCode, &order.ParentID)
 		return err
 	})
 
+	if err == sql.ErrNoRows {
+		return nil, ErrOrderNotFound
+	}
 	if err != nil {
 		logging.Error("Failed to query order status", logrus.Fields{"error": err, "orderID": orderID})
 		return nil, err
 	}
+	order.RiderID = int(riderID.Int64)
+	if scheduledAt.Valid {
+		order.ScheduledAt = &scheduledAt.Time
+	}
+	if releaseAt.Valid {
+		order.ReleaseAt = &releaseAt.Time
+	}
+
+	order.Items, err = QueryOrderItems(db, orderID)
+	if err != nil {
+		return nil, err
+	}
 	return &order, nil
 }
 
-//骑手接单
-func AcceptOrderTx(db *sql.DB, OrderID int, RiderID int) error {
+// QueryOrderIDByNo 按订单号查询订单ID
+func QueryOrderIDByNo(db *sql.DB, orderNo string) (int, error) {
+	var orderID int
+	err := monitoring.RecordDBTime("QueryOrderIDByNo", func() error {
+		return db.QueryRow(`SELECT orderid FROM orders WHERE order_no = $1`, orderNo).Scan(&orderID)
+	})
+	if err == sql.ErrNoRows {
+		return 0, ErrOrderNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to query order by order no", logrus.Fields{"error": err, "orderNo": orderNo})
+		return 0, fmt.Errorf("按订单号查询订单失败: %v", err)
+	}
+	return orderID, nil
+}
+
+// QueryGrabbableOrderIDs 从 orderIDs 中筛选仍可抢单（已发布且没有骑手）的订单，用于核对公共大厅
+func QueryGrabbableOrderIDs(db *sql.DB, orderIDs []int) (map[int]bool, error) {
+	open := make(map[int]bool, len(orderIDs))
+	if len(orderIDs) == 0 {
+		return open, nil
+	}
+	ids := make([]int64, len(orderIDs))
+	for i, id := range orderIDs {
+		ids[i] = int64(id)
+	}
+
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryGrabbableOrderIDs", func() error {
+		rows, err = db.Query(`SELECT orderid FROM orders WHERE orderid = ANY($1) AND orderstatus = 'published' AND riderid IS NULL`, pq.Array(ids))
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query grabbable orders", logrus.Fields{"error": err})
+		return nil, fmt.Errorf("查询可抢订单失败: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		open[id] = true
+	}
+	return open, rows.Err()
+}
+
+//骑手接单，maxActive 为骑手同时配送的订单上限
+func AcceptOrderTx(db *sql.DB, OrderID int, RiderID int, maxActive int) error {
 	logging.Info("Accepting order", logrus.Fields{"orderID": OrderID, "riderID": RiderID})
 	err := monitoring.RecordDBTime("AcceptOrderTx", func() error {
 		tx, err := db.Begin()
@@ -176,31 +327,8 @@ func AcceptOrderTx(db *sql.DB, OrderID int, RiderID int) error {
 			return fmt.Errorf("开启事务失败: %v", err)
 		}
 		defer tx.Rollback()
-		//检查订单状态
-		var currentStatus string
-		var currentRiderID sql.NullInt64                                          //不直接用int，是因为NULL 值会导致扫描错误，无法区分 0 和 NULL
-		statusQuery := `SELECT orderstatus, riderid FROM orders WHERE orderid=$1 FOR UPDATE` //FOR UPDATA作用：行级锁定，事务隔离，避免并发问题
-		err = tx.QueryRow(statusQuery, OrderID).Scan(&currentStatus, &currentRiderID)       //          优点：数据一致性，并发控制，业务安全
-		if err != nil {
-			return fmt.Errorf("获取订单出错：%v", err)
-		}
-		if currentStatus == "confirmed" { //已出餐
-
-			return fmt.Errorf("订单已出餐，不允许接单")
-		}
-		if currentRiderID.Valid { //valid表示是否为NULL
-			return fmt.Errorf("订单已被其他骑手接单")
-		}
-		//更新订单状态
-		_, err = tx.Exec(`UPDATE orders SET riderid = $1,orderstatus = "delivering" WHERE orderid = $2 `, RiderID, OrderID)
-		if err != nil {
-			return fmt.Errorf("更新订单状态失败: %v", err)
-		}
-
-		//更新聊天群组，添加骑手
-		_, err = tx.Exec(`UPDATE groups SET riderid = $1 WHERE orderid = $2`, RiderID, OrderID)
-		if err != nil {
-			return fmt.Errorf("更新聊天群组失败: %v", err)
+		if err := acceptOrderTx(tx, OrderID, RiderID, maxActive); err != nil {
+			return err
 		}
 		if err := tx.Commit(); err != nil {
 			return fmt.Errorf("提交事务失败: %v", err)
@@ -215,8 +343,44 @@ func AcceptOrderTx(db *sql.DB, OrderID int, RiderID int) error {
 	return nil
 }
 
-//完成订单
-func CompleteOrderTx(db *sql.DB, OrderID int, RiderID int) error {
+// 在事务中把已发布的跑腿订单交给骑手：已发布 -> 配送中，并把骑手加入订单聊天群组
+// 骑手需在线且配送中的订单少于 maxActive，接单后达到上限时骑手自动变为忙碌；抢单和接受派单共用
+func acceptOrderTx(tx *sql.Tx, orderID, riderID, maxActive int) error {
+	if err := lockAvailableRiderTx(tx, riderID, maxActive); err != nil {
+		return err
+	}
+	//按订单生命周期变更状态：已发布 -> 配送中，transitionOrderTx 锁定订单行，并发接单按订单串行
+	rider := models.OrderActor{Role: models.RoleRider, ID: riderID}
+	if _, err := transitionOrderTx(tx, orderID, models.OrderStatusDelivering, rider, ""); err != nil {
+		var transitionErr *models.TransitionError
+		if errors.As(err, &transitionErr) && (transitionErr.From == models.OrderStatusDelivering || transitionErr.From == models.OrderStatusCompleted) {
+			return ErrOrderTaken
+		}
+		return err
+	}
+	var currentRiderID sql.NullInt64 //不直接用int，是因为NULL 值会导致扫描错误，无法区分 0 和 NULL
+	err := tx.QueryRow(`SELECT riderid FROM orders WHERE orderid = $1`, orderID).Scan(&currentRiderID)
+	if err != nil {
+		return fmt.Errorf("获取订单出错：%v", err)
+	}
+	if currentRiderID.Valid { //valid表示是否为NULL
+		return ErrOrderTaken
+	}
+	_, err = tx.Exec(`UPDATE orders SET riderid = $1 WHERE orderid = $2`, riderID, orderID)
+	if err != nil {
+		return fmt.Errorf("更新订单骑手失败: %v", err)
+	}
+
+	//更新聊天群组，添加骑手
+	_, err = tx.Exec(`UPDATE groups SET riderid = $1 WHERE orderid = $2`, riderID, orderID)
+	if err != nil {
+		return fmt.Errorf("更新聊天群组失败: %v", err)
+	}
+	return refreshRiderLoadTx(tx, riderID, maxActive)
+}
+
+//完成订单，骑手配送中的订单降到上限 maxActive 以下时由忙碌恢复为在线
+func CompleteOrderTx(db *sql.DB, OrderID int, RiderID int, maxActive int) error {
 	logging.Info("Completing order", logrus.Fields{"orderID": OrderID, "riderID": RiderID})
 	err := monitoring.RecordDBTime("CompleteOrderTx", func() error {
 		tx, err := db.Begin()
@@ -224,20 +388,29 @@ func CompleteOrderTx(db *sql.DB, OrderID int, RiderID int) error {
 			return fmt.Errorf("开启事务失败: %v", err)
 		}
 		defer tx.Rollback()
-		var currentStatus string
-		statusQuery := `SELECT orderstatus FROM orders WHERE orderid=$1 FOR UPDATE`
-		err = tx.QueryRow(statusQuery, OrderID).Scan(&currentStatus)
+		var currentRiderID sql.NullInt64
+		err = tx.QueryRow(`SELECT riderid FROM orders WHERE orderid = $1 FOR UPDATE`, OrderID).Scan(&currentRiderID)
+		if err == sql.ErrNoRows {
+			return ErrOrderNotFound
+		}
 		if err != nil {
 			return fmt.Errorf("查询订单状态失败：%v", err)
 		}
-		if currentStatus != "completed" {
-			return fmt.Errorf("订单还未送达...")
+		if !currentRiderID.Valid || int(currentRiderID.Int64) != RiderID {
+			return ErrOrderNotAssigned
 		}
 
-		//更新订单状态
-		_, err = tx.Exec(`UPDATE orders SET orderstatus = "completed" WHERE orderid = $1`, OrderID)
+		//按订单生命周期变更状态：配送中 -> 已完成
+		rider := models.OrderActor{Role: models.RoleRider, ID: RiderID}
+		if _, err := transitionOrderTx(tx, OrderID, models.OrderStatusCompleted, rider, ""); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE orders SET deliveryconfirmed_at = NOW() WHERE orderid = $1`, OrderID)
 		if err != nil {
-			return fmt.Errorf("更新订单状态失败：%v", err)
+			return fmt.Errorf("更新送达时间失败：%v", err)
+		}
+		if err := refreshRiderLoadTx(tx, RiderID, maxActive); err != nil {
+			return err
 		}
 		if err := tx.Commit(); err != nil {
 			return fmt.Errorf("提交事务失败: %v", err)
@@ -252,44 +425,141 @@ func CompleteOrderTx(db *sql.DB, OrderID int, RiderID int) error {
 	return nil
 }
 
-// 取消订单
-func DeleteOrder(db *sql.DB, OrderID int, ProductID int) error {
-	logging.Info("Deleting order", logrus.Fields{"orderID": OrderID, "productID": ProductID})
-	err := monitoring.RecordDBTime("DeleteOrder", func() error {
+// CompletePickupTx 商家核对取餐码后确认自取订单已取餐：待取餐 -> 已完成，取餐时间记为送达时间
+func CompletePickupTx(db *sql.DB, orderID int, shopID int, pickupCode string) error {
+	logging.Info("Completing pickup order", logrus.Fields{"orderID": orderID, "shopID": shopID})
+	err := monitoring.RecordDBTime("CompletePickupTx", func() error {
 		tx, err := db.Begin()
 		if err != nil {
 			return fmt.Errorf("开启事务失败: %v", err)
 		}
 		defer tx.Rollback()
-		//检查订单状态
-		var currentStatus string
-		statusQuery := `SELECT orderstatus FROM orders WHERE orderid = $1 FOR UPDATE`
-		err = tx.QueryRow(statusQuery, OrderID).Scan(&currentStatus)
+		var code sql.NullString
+		err = tx.QueryRow(`SELECT pickup_code FROM orders WHERE orderid = $1 FOR UPDATE`, orderID).Scan(&code)
+		if err == sql.ErrNoRows {
+			return ErrOrderNotFound
+		}
 		if err != nil {
-			return fmt.Errorf("获取订单状态失败：%v", err)
+			return fmt.Errorf("查询取餐码失败：%v", err)
 		}
-
-		if currentStatus == "completed" || currentStatus == "canceled" {
-			return fmt.Errorf("订单已完成，无法取消")
+		if !code.Valid || code.String != pickupCode {
+			return ErrPickupCodeMismatch
 		}
 
-		//恢复商品库存
-		_, err = tx.Exec(`UPDATE products SET stock = stock + 1 WHERE productid = (SELECT productid FROM orders WHERE orderid = $1)`, OrderID)
-		if err != nil {
-			return fmt.Errorf("恢复商品库存失败：%v", err)
+		shop := models.OrderActor{Role: models.RoleShop, ID: shopID}
+		if _, err := transitionOrderTx(tx, orderID, models.OrderStatusCompleted, shop, "顾客到店取餐"); err != nil {
+			return err
 		}
-
-		//直接更新订购单状态
-		_, err = tx.Exec(`UPDATE orders SET orderstatus = "canceled" WHERE orderid = $1`, OrderID)
+		_, err = tx.Exec(`UPDATE orders SET deliveryconfirmed_at = NOW() WHERE orderid = $1`, orderID)
 		if err != nil {
-			return fmt.Errorf("更新订单状态失败：%v", err)
+			return fmt.Errorf("更新取餐时间失败：%v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("提交事务失败: %v", err)
 		}
 		return nil
 	})
 	if err != nil {
-		logging.Error("Failed to delete order", logrus.Fields{"error": err, "orderID": OrderID, "productID": ProductID})
+		logging.Error("Failed to complete pickup order", logrus.Fields{"error": err, "orderID": orderID, "shopID": shopID})
 		return err
 	}
-	logging.Info("Order deleted successfully", logrus.Fields{"orderID": OrderID, "productID": ProductID})
+	logging.Info("Pickup order completed successfully", logrus.Fields{"orderID": orderID, "shopID": shopID})
 	return nil
 }
+
+// CancelOrderIfStatus 取消订单：按订单生命周期变更为已取消，并按每一行订单明细恢复商品库存，已支付的订单同时创建全额退款单
+// 骑手取货后（配送中）订单不允许取消，由状态机返回 *models.TransitionError
+// status 不为空时仅当订单仍处于该状态才取消，超时任务据此避免在查询和取消之间订单已推进（如刚支付成功）时误取消
+func CancelOrderIfStatus(db *sql.DB, orderID int, status string, actor models.OrderActor, reason string) (*models.Order, error) {
+	logging.Info("Cancelling order", logrus.Fields{"orderID": orderID, "role": actor.Role, "actorID": actor.ID})
+	err := monitoring.RecordDBTime("CancelOrder", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("开启事务失败: %v", err)
+		}
+		defer tx.Rollback()
+		if status != "" {
+			var current string
+			err := tx.QueryRow(`SELECT orderstatus FROM orders WHERE orderid = $1 FOR UPDATE`, orderID).Scan(&current)
+			if err == sql.ErrNoRows {
+				return ErrOrderNotFound
+			}
+			if err != nil {
+				return fmt.Errorf("获取订单状态失败: %v", err)
+			}
+			if current != status {
+				return &models.TransitionError{From: current, To: models.OrderStatusCancelled, Role: actor.Role}
+			}
+		}
+		//按订单生命周期检查并变更为已取消
+		from, err := transitionOrderTx(tx, orderID, models.OrderStatusCancelled, actor, reason)
+		if err != nil {
+			return err
+		}
+
+		//释放订单预占的商品库存
+		if err := releaseStockTx(tx, orderID); err != nil {
+			return err
+		}
+		//退回订单使用的优惠券
+		if err := releaseCouponTx(tx, orderID); err != nil {
+			return err
+		}
+		//关闭尚未支付的支付单
+		if err := closePendingPaymentsTx(tx, orderID, "订单已取消"); err != nil {
+			return err
+		}
+		//已支付的订单全额退款：商家接单前（含尚未通知商家的预约单）取消由系统自动批准；
+		//商家或系统取消的订单同样自动批准，商家不能再拒绝自己取消的订单的退款；只有用户在商家接单后取消才需商家审核
+		refund := &models.Refund{
+			OrderID:     orderID,
+			ReasonCode:  models.RefundReasonOrderCancelled,
+			Reason:      reason,
+			RequestedBy: actor,
+		}
+		switch {
+		case from == models.OrderStatusPending || from == models.OrderStatusScheduled:
+			refund.Status = models.RefundApproved
+			refund.ReviewedBy = &models.OrderActor{Role: models.RoleSystem}
+		case actor.Role == models.RoleShop || actor.Role == models.RoleSystem:
+			// 审核方即发起方
+			refund.Status = models.RefundApproved
+		}
+		if err := createRefundTx(tx, refund); err != nil && !errors.Is(err, ErrRefundNotPaid) {
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("提交事务失败: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Error("Failed to cancel order", logrus.Fields{"error": err, "orderID": orderID})
+		return nil, err
+	}
+	logging.Info("Order cancelled successfully", logrus.Fields{"orderID": orderID, "role": actor.Role})
+	return QueryOrderStatus(db, orderID)
+}
+
+// NotifyOrderCancelled 通知订单相关的用户、商家和骑手订单已取消
+func NotifyOrderCancelled(rp *RedisPool, order *models.Order, actor models.OrderActor, reason string) {
+	notification := map[string]interface{}{
+		"type":       "order_cancelled",
+		"order_id":   order.OrderID,
+		"actor_role": actor.Role,
+		"reason":     reason,
+		"timestamp":  time.Now().Unix(),
+	}
+	notifJSON, _ := json.Marshal(notification)
+
+	channels := []string{fmt.Sprintf("user_%d", order.UserID), fmt.Sprintf("shop_%d", order.ShopID)}
+	if order.RiderID != 0 {
+		channels = append(channels, fmt.Sprintf("rider_%d", order.RiderID))
+	}
+	for _, channel := range channels {
+		if err := PublishMessage(rp, channel, string(notifJSON)); err != nil {
+			logging.Warn("Failed to notify order cancellation", logrus.Fields{"error": err, "channel": channel, "orderID": order.OrderID})
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"take-out/logging"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// 订单超时类型，每种类型对应 Redis 中的一个有序集合 order_deadlines:<kind>
+// 成员为订单ID，分值为到期时间的 Unix 秒，服务重启后截止时间依然保留
+const (
+	DeadlinePayment    = "payment"     // 用户支付超时
+	DeadlineShopAccept = "shop_accept" // 商家接单超时
+	DeadlineRiderGrab  = "rider_grab"  // 跑腿订单无人抢单超时
+	// DeadlineDispatchOffer 派给骑手的订单答复超时，到期后派给下一位骑手或进入公共大厅
+	DeadlineDispatchOffer = "dispatch_offer"
+	// DeadlineScheduledRelease 预约单到达备餐时间，通知商家接单
+	DeadlineScheduledRelease = "scheduled_release"
+)
+
+// 领取到期任务：取出到期的订单并把分值推迟一个租约时间，多个实例同时轮询时同一订单只会被一个实例领取；
+// 处理实例若中途崩溃，租约到期后任务会被重新领取
+var claimDeadlinesScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call('ZADD', KEYS[1], ARGV[3], id)
+end
+return ids
+`)
+
+func deadlineKey(kind string) string {
+	return fmt.Sprintf("order_deadlines:%s", kind)
+}
+
+// ScheduleOrderDeadline 设置（或覆盖）订单的超时截止时间
+func ScheduleOrderDeadline(rp *RedisPool, kind string, orderID int, at time.Time) error {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	err := monitoring.RecordRedisTime("ScheduleOrderDeadline", func() error {
+		return rdb.ZAdd(ctx, deadlineKey(kind), &redis.Z{Score: float64(at.Unix()), Member: orderID}).Err()
+	})
+	if err != nil {
+		logging.Error("Failed to schedule order deadline", logrus.Fields{"error": err, "kind": kind, "orderID": orderID})
+		return fmt.Errorf("设置订单超时失败: %v", err)
+	}
+	return nil
+}
+
+// EnsureOrderDeadline 订单没有该类超时任务时添加，已有任务（包括已被领取、处于租约中的任务）保持不变
+func EnsureOrderDeadline(rp *RedisPool, kind string, orderID int, at time.Time) error {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	return monitoring.RecordRedisTime("EnsureOrderDeadline", func() error {
+		return rdb.ZAddNX(ctx, deadlineKey(kind), &redis.Z{Score: float64(at.Unix()), Member: orderID}).Err()
+	})
+}
+
+// RemoveOrderDeadline 移除订单的超时任务，订单已推进或处理完成时调用
+func RemoveOrderDeadline(rp *RedisPool, kind string, orderID int) error {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	return monitoring.RecordRedisTime("RemoveOrderDeadline", func() error {
+		return rdb.ZRem(ctx, deadlineKey(kind), orderID).Err()
+	})
+}
+
+// ClaimDueOrderDeadlines 领取已到期的订单超时任务，领取后在 lease 时间内不会被其他实例重复领取
+func ClaimDueOrderDeadlines(rp *RedisPool, kind string, now time.Time, lease time.Duration, limit int) ([]int, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	var members []string
+	err := monitoring.RecordRedisTime("ClaimDueOrderDeadlines", func() error {
+		var err error
+		members, err = claimDeadlinesScript.Run(ctx, rdb, []string{deadlineKey(kind)},
+			now.Unix(), limit, now.Add(lease).Unix()).StringSlice()
+		return err
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("领取订单超时任务失败: %v", err)
+	}
+
+	orderIDs := make([]int, 0, len(members))
+	for _, member := range members {
+		orderID, err := strconv.Atoi(member)
+		if err != nil {
+			continue
+		}
+		orderIDs = append(orderIDs, orderID)
+	}
+	return orderIDs, nil
+}
+
+// IncrDeadlineAttempts 累加订单某类超时的处理次数，用于控制重新广播的上限
+func IncrDeadlineAttempts(rp *RedisPool, kind string, orderID int) (int64, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	var attempts int64
+	err := monitoring.RecordRedisTime("IncrDeadlineAttempts", func() error {
+		var err error
+		attempts, err = rdb.HIncrBy(ctx, deadlineKey(kind)+":attempts", strconv.Itoa(orderID), 1).Result()
+		return err
+	})
+	return attempts, err
+}
+
+// ClearDeadlineAttempts 清除订单某类超时的处理次数
+func ClearDeadlineAttempts(rp *RedisPool, kind string, orderID int) error {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	return monitoring.RecordRedisTime("ClearDeadlineAttempts", func() error {
+		return rdb.HDel(ctx, deadlineKey(kind)+":attempts", strconv.Itoa(orderID)).Err()
+	})
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 在订单状态变更的同一事务中写入状态变更记录
+func insertOrderEventTx(tx *sql.Tx, orderID int, from, to string, actor models.OrderActor, reason string) error {
+	query := `INSERT INTO order_events (order_id, from_status, to_status, actor_role, actor_id, reason)
+			 VALUES ($1, NULLIF($2, ''), $3, $4, $5, NULLIF($6, ''))`
+	if _, err := tx.Exec(query, orderID, from, to, actor.Role, actor.ID, reason); err != nil {
+		return fmt.Errorf("写入订单状态记录失败: %v", err)
+	}
+	return nil
+}
+
+// QueryOrderEvents 按时间顺序查询订单状态变更时间线
+func QueryOrderEvents(db *sql.DB, orderID int) ([]models.OrderEvent, error) {
+	query := `SELECT event_id, order_id, COALESCE(from_status, ''), to_status, actor_role, actor_id, COALESCE(reason, ''), created_at
+			 FROM order_events WHERE order_id = $1 ORDER BY created_at, event_id`
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryOrderEvents", func() error {
+		rows, err = db.Query(query, orderID)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query order events", logrus.Fields{"error": err, "orderID": orderID})
+		return nil, fmt.Errorf("查询订单时间线失败: %v", err)
+	}
+	defer rows.Close()
+
+	events := []models.OrderEvent{}
+	for rows.Next() {
+		var event models.OrderEvent
+		if err := rows.Scan(&event.EventID, &event.OrderID, &event.FromStatus, &event.ToStatus, &event.ActorRole, &event.ActorID, &event.Reason, &event.CreatedAt); err != nil {
+			logging.Error("Failed to scan order event row", logrus.Fields{"error": err})
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历订单时间线失败: %v", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"fmt"
+	"take-out/logging"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// 抢单锁：同一订单同一时间只有一位骑手进入接单事务，其余骑手无需访问数据库即可得知订单已被抢走
+// 锁只用于快速裁决，最终以接单事务中的订单行锁为准
+func orderGrabLockKey(orderID int) string {
+	return fmt.Sprintf("order_grab_lock:%d", orderID)
+}
+
+// 只释放自己持有的锁
+var unlockOrderGrabScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// TryLockOrderGrab 尝试为 owner 占用订单的抢单锁，锁已被他人占用时返回 false
+func TryLockOrderGrab(rp *RedisPool, orderID int, owner string, ttl time.Duration) (bool, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	var locked bool
+	err := monitoring.RecordRedisTime("TryLockOrderGrab", func() error {
+		var err error
+		locked, err = rdb.SetNX(ctx, orderGrabLockKey(orderID), owner, ttl).Result()
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to lock order grab", logrus.Fields{"error": err, "orderID": orderID})
+		return false, fmt.Errorf("占用抢单锁失败: %v", err)
+	}
+	return locked, nil
+}
+
+// UnlockOrderGrab 释放 owner 持有的抢单锁
+func UnlockOrderGrab(rp *RedisPool, orderID int, owner string) error {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	return monitoring.RecordRedisTime("UnlockOrderGrab", func() error {
+		return unlockOrderGrabScript.Run(ctx, rdb, []string{orderGrabLockKey(orderID)}, owner).Err()
+	})
+}
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// 公共大厅保存在 Redis 中，骑手浏览时不会取走订单：
+// order_hall 为 GEO 集合（成员为订单ID，位置为商家位置），用于按骑手位置查询附近的订单；
+// order_hall:orders 为哈希表，保存订单摘要 JSON；
+// order_hall:expiry 为有序集合，分值为订单移出大厅的 Unix 秒
+const (
+	orderHallKey       = "order_hall"
+	orderHallOrdersKey = "order_hall:orders"
+	orderHallExpiryKey = "order_hall:expiry"
+)
+
+// 领取已过期的大厅订单并移出大厅，每次最多 ARGV[2] 个，返回订单ID；同一订单只会被一个实例领取
+var claimExpiredHallOrdersScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+if #ids > 0 then
+	redis.call('ZREM', KEYS[1], unpack(ids))
+	redis.call('HDEL', KEYS[2], unpack(ids))
+	redis.call('ZREM', KEYS[3], unpack(ids))
+end
+return ids
+`)
+
+// AddToOrderHall 把订单放入公共大厅，订单已在大厅中时更新摘要和过期时间
+func AddToOrderHall(rp *RedisPool, order *models.HallOrder) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("序列化大厅订单失败: %v", err)
+	}
+	member := strconv.Itoa(order.OrderID)
+
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	err = monitoring.RecordRedisTime("AddToOrderHall", func() error {
+		_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.GeoAdd(ctx, orderHallKey, &redis.GeoLocation{Name: member, Latitude: order.ShopLatitude, Longitude: order.ShopLongitude})
+			pipe.HSet(ctx, orderHallOrdersKey, member, string(data))
+			pipe.ZAdd(ctx, orderHallExpiryKey, &redis.Z{Score: float64(order.ExpiresAt.Unix()), Member: member})
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to add order to hall", logrus.Fields{"error": err, "orderID": order.OrderID})
+		return fmt.Errorf("订单进入公共大厅失败: %v", err)
+	}
+	return nil
+}
+
+// RemoveFromOrderHall 把订单移出公共大厅，订单不在大厅中时不做任何事
+func RemoveFromOrderHall(rp *RedisPool, orderIDs ...int) error {
+	if len(orderIDs) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(orderIDs))
+	fields := make([]string, len(orderIDs))
+	for i, id := range orderIDs {
+		fields[i] = strconv.Itoa(id)
+		members[i] = fields[i]
+	}
+
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	err := monitoring.RecordRedisTime("RemoveFromOrderHall", func() error {
+		_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZRem(ctx, orderHallKey, members...)
+			pipe.HDel(ctx, orderHallOrdersKey, fields...)
+			pipe.ZRem(ctx, orderHallExpiryKey, members...)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to remove orders from hall", logrus.Fields{"error": err, "orderIDs": orderIDs})
+		return fmt.Errorf("订单移出公共大厅失败: %v", err)
+	}
+	return nil
+}
+
+// SearchOrderHall 查询 (lat, lon) 周围 radiusKm 内商家的大厅订单，按骑手到商家的距离从近到远最多返回 limit 个，已过期的订单不返回
+func SearchOrderHall(rp *RedisPool, lat, lon, radiusKm float64, limit int) ([]models.HallOrder, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+
+	var found []redis.GeoLocation
+	err := monitoring.RecordRedisTime("SearchOrderHall", func() error {
+		var err error
+		found, err = rdb.GeoSearchLocation(ctx, orderHallKey, &redis.GeoSearchLocationQuery{
+			GeoSearchQuery: redis.GeoSearchQuery{
+				Latitude:   lat,
+				Longitude:  lon,
+				Radius:     radiusKm,
+				RadiusUnit: "km",
+				Sort:       "ASC",
+				Count:      limit,
+			},
+			WithDist: true,
+		}).Result()
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to search order hall", logrus.Fields{"error": err})
+		return nil, fmt.Errorf("查询公共大厅失败: %v", err)
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	fields := make([]string, len(found))
+	for i, loc := range found {
+		fields[i] = loc.Name
+	}
+	var values []interface{}
+	err = monitoring.RecordRedisTime("HMGet", func() error {
+		var err error
+		values, err = rdb.HMGet(ctx, orderHallOrdersKey, fields...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("查询大厅订单失败: %v", err)
+	}
+
+	now := time.Now()
+	orders := make([]models.HallOrder, 0, len(found))
+	for i, loc := range found {
+		data, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+		var order models.HallOrder
+		if err := json.Unmarshal([]byte(data), &order); err != nil || !now.Before(order.ExpiresAt) {
+			continue
+		}
+		order.PickupDistanceKm = loc.Dist
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+// ClaimExpiredHallOrders 领取过期时间早于 now 的大厅订单并移出大厅
+func ClaimExpiredHallOrders(rp *RedisPool, now time.Time, limit int) ([]int, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	var members []string
+	err := monitoring.RecordRedisTime("ClaimExpiredHallOrders", func() error {
+		var err error
+		members, err = claimExpiredHallOrdersScript.Run(ctx, rdb, []string{orderHallKey, orderHallOrdersKey, orderHallExpiryKey}, now.Unix(), limit).StringSlice()
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to claim expired hall orders", logrus.Fields{"error": err})
+		return nil, fmt.Errorf("领取过期的大厅订单失败: %v", err)
+	}
+
+	orderIDs := make([]int, 0, len(members))
+	for _, member := range members {
+		if orderID, err := strconv.Atoi(member); err == nil {
+			orderIDs = append(orderIDs, orderID)
+		}
+	}
+	return orderIDs, nil
+}
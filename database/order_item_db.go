@@ -0,0 +1,96 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrProductNotFound = errors.New("商品不存在")
+	ErrMixedShopItems  = errors.New("订单中的商品必须属于同一商家")
+)
+
+// PriceOrderItems 校验订单明细，按当前商品价格生成单价、打包费快照和小计
+// 订单未指定商家时以第一件商品所属商家为准
+func PriceOrderItems(db *sql.DB, order *models.Order) error {
+	logging.Info("Pricing order items", logrus.Fields{"userID": order.UserID, "items": len(order.Items)})
+	var total models.Money
+	for i := range order.Items {
+		item := &order.Items[i]
+		var shopID int
+		err := monitoring.RecordDBTime("PriceOrderItems", func() error {
+			query := `SELECT shopid, productname, productprice, packaging_fee FROM products WHERE productid = $1`
+			return db.QueryRow(query, item.ProductID).Scan(&shopID, &item.ProductName, &item.UnitPrice, &item.PackagingFee)
+		})
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: %d", ErrProductNotFound, item.ProductID)
+		}
+		if err != nil {
+			logging.Error("Failed to query product", logrus.Fields{"error": err, "productID": item.ProductID})
+			return fmt.Errorf("查询商品失败: %v", err)
+		}
+
+		if order.ShopID == 0 {
+			order.ShopID = shopID
+		} else if order.ShopID != shopID {
+			return ErrMixedShopItems
+		}
+
+		item.Subtotal = item.UnitPrice.Mul(item.Quantity)
+		total = total.Add(item.Subtotal)
+	}
+	order.TotalPrice = total
+	return nil
+}
+
+// 在订单事务中写入订单明细
+func insertOrderItemsTx(tx *sql.Tx, orderID int, items []models.OrderItem) error {
+	query := `INSERT INTO order_items (order_id, product_id, product_name, quantity, unit_price, packaging_fee, subtotal)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING item_id`
+	for i := range items {
+		item := &items[i]
+		item.OrderID = orderID
+		err := tx.QueryRow(query, orderID, item.ProductID, item.ProductName, item.Quantity, item.UnitPrice, item.PackagingFee, item.Subtotal).Scan(&item.OrderItemID)
+		if err != nil {
+			return fmt.Errorf("订单明细插入失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// QueryOrderItems 查询订单明细
+func QueryOrderItems(db *sql.DB, orderID int) ([]models.OrderItem, error) {
+	query := `SELECT item_id, order_id, product_id, product_name, quantity, unit_price, packaging_fee, subtotal
+			 FROM order_items WHERE order_id = $1 ORDER BY item_id`
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryOrderItems", func() error {
+		rows, err = db.Query(query, orderID)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query order items", logrus.Fields{"error": err, "orderID": orderID})
+		return nil, fmt.Errorf("查询订单明细失败: %v", err)
+	}
+	defer rows.Close()
+
+	items := []models.OrderItem{}
+	for rows.Next() {
+		var item models.OrderItem
+		if err := rows.Scan(&item.OrderItemID, &item.OrderID, &item.ProductID, &item.ProductName, &item.Quantity, &item.UnitPrice, &item.PackagingFee, &item.Subtotal); err != nil {
+			logging.Error("Failed to scan order item row", logrus.Fields{"error": err})
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历订单明细失败: %v", err)
+	}
+	return items, nil
+}
@@ -0,0 +1,135 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// QueryOrderSummaries 按条件查询订单摘要，按订单ID倒序（即最新的在前）
+// 使用订单ID作为游标分页：下一页传入上一页最后一条的订单ID
+func QueryOrderSummaries(db *sql.DB, filter models.OrderFilter) ([]models.OrderSummary, error) {
+	logging.Info("Querying order summaries", logrus.Fields{"userID": filter.UserID, "shopID": filter.ShopID, "cursor": filter.Cursor})
+
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.UserID != 0 {
+		addCondition("o.userid = $%d", filter.UserID)
+	}
+	if filter.ShopID != 0 {
+		addCondition("o.shopid = $%d", filter.ShopID)
+		// 支付成功前商家看不到订单
+		addCondition("o.orderstatus <> $%d", models.OrderStatusAwaitingPayment)
+	}
+	if filter.OrderNo != "" {
+		addCondition("o.order_no = $%d", filter.OrderNo)
+	}
+	if len(filter.Statuses) > 0 {
+		addCondition("o.orderstatus = ANY($%d)", pq.Array(filter.Statuses))
+	}
+	if !filter.From.IsZero() {
+		addCondition("o.ordertime >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("o.ordertime < $%d", filter.To)
+	}
+	if filter.Cursor > 0 {
+		addCondition("o.orderid < $%d", filter.Cursor)
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+
+	query := fmt.Sprintf(`
+        SELECT o.orderid, o.order_no, o.userid, o.shopid, s.shopname, o.orderstatus, o.fulfillment_type, COALESCE(o.parent_id, 0), o.ordertime, o.totalprice, o.packaging_fee, o.delivery_fee, o.service_fee, o.discount_amount, o.payable_amount, COALESCE(o.notes, ''),
+               COALESCE(string_agg(i.product_name || ' x' || i.quantity, ', ' ORDER BY i.item_id), ''),
+               COALESCE(SUM(i.quantity), 0)
+        FROM orders o
+        JOIN shops s ON s.shopid = o.shopid
+        LEFT JOIN order_items i ON i.order_id = o.orderid
+        %s
+        GROUP BY o.orderid, s.shopname
+        ORDER BY o.orderid DESC
+        LIMIT $%d
+    `, where, len(args))
+
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryOrderSummaries", func() error {
+		rows, err = db.Query(query, args...)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query order summaries", logrus.Fields{"error": err})
+		return nil, fmt.Errorf("查询订单列表失败: %v", err)
+	}
+	defer rows.Close()
+
+	orders := []models.OrderSummary{}
+	for rows.Next() {
+		var order models.OrderSummary
+		if err := rows.Scan(&order.OrderID, &order.OrderNo, &order.UserID, &order.ShopID, &order.ShopName, &order.OrderStatus, &order.FulfillmentType, &order.ParentID, &order.OrderTime,
+			&order.TotalPrice, &order.PackagingFee, &order.DeliveryFee, &order.ServiceFee, &order.DiscountAmount, &order.PayableAmount, &order.Notes, &order.ItemSummary, &order.ItemCount); err != nil {
+			logging.Error("Failed to scan order summary row", logrus.Fields{"error": err})
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历订单列表失败: %v", err)
+	}
+	return orders, nil
+}
+
+// CountShopOrdersByStatus 统计商家在下单时间范围内各状态的订单数量，用于看板分组计数，不含待支付的订单
+func CountShopOrdersByStatus(db *sql.DB, shopID int, from, to time.Time) (map[string]int, error) {
+	query := `SELECT orderstatus, COUNT(*) FROM orders
+			 WHERE shopid = $1
+			   AND orderstatus <> $4
+			   AND ($2::timestamptz IS NULL OR ordertime >= $2)
+			   AND ($3::timestamptz IS NULL OR ordertime < $3)
+			 GROUP BY orderstatus`
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("CountShopOrdersByStatus", func() error {
+		rows, err = db.Query(query, shopID, nullTime(from), nullTime(to), models.OrderStatusAwaitingPayment)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to count shop orders", logrus.Fields{"error": err, "shopID": shopID})
+		return nil, fmt.Errorf("统计商家订单失败: %v", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历订单统计失败: %v", err)
+	}
+	return counts, nil
+}
+
+// 零值时间作为 SQL NULL 传入
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
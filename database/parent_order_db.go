@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrParentOrderNotFound = errors.New("合并订单不存在")
+
+// InsertParentOrder 在同一事务中写入合并订单和全部子订单，任一子订单库存不足、优惠券不可用或时段已满时整体回滚
+// 合并订单号或子订单号重复时返回 ErrOrderNoConflict，调用方重新生成后重试
+func InsertParentOrder(db *sql.DB, parent *models.ParentOrder, children []*models.Order) error {
+	logging.Info("Inserting parent order", logrus.Fields{"userID": parent.UserID, "orders": len(children)})
+	err := monitoring.RecordDBTime("InsertParentOrder", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("无法开始事务: %v", err)
+		}
+		defer tx.Rollback()
+
+		err = tx.QueryRow(`INSERT INTO parent_orders (parent_no, user_id, payable_amount) VALUES ($1, $2, $3)
+			RETURNING parent_id, created_at`, parent.ParentNo, parent.UserID, parent.PayableAmount).Scan(&parent.ParentID, &parent.CreatedAt)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && pqErr.Constraint == "parent_orders_parent_no_key" {
+			return ErrOrderNoConflict
+		}
+		if err != nil {
+			return fmt.Errorf("合并订单插入失败: %v", err)
+		}
+
+		for _, child := range children {
+			child.ParentID = parent.ParentID
+			orderID, err := insertOrderTx(tx, child)
+			if err != nil {
+				return err
+			}
+			child.OrderID = int(orderID)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("事务提交失败: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Error("Failed to insert parent order", logrus.Fields{"error": err, "userID": parent.UserID})
+		return err
+	}
+	logging.Info("Parent order inserted successfully", logrus.Fields{"parentID": parent.ParentID})
+	return nil
+}
+
+// QueryParentOrder 查询合并订单及其全部子订单，并按子订单状态计算汇总状态
+func QueryParentOrder(db *sql.DB, parentID int) (*models.ParentOrder, error) {
+	var parent models.ParentOrder
+	err := monitoring.RecordDBTime("QueryParentOrder", func() error {
+		return db.QueryRow(`SELECT parent_id, parent_no, user_id, payable_amount, created_at FROM parent_orders WHERE parent_id = $1`, parentID).
+			Scan(&parent.ParentID, &parent.ParentNo, &parent.UserID, &parent.PayableAmount, &parent.CreatedAt)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrParentOrderNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to query parent order", logrus.Fields{"error": err, "parentID": parentID})
+		return nil, fmt.Errorf("查询合并订单失败: %v", err)
+	}
+
+	orderIDs, err := QueryChildOrderIDs(db, parentID)
+	if err != nil {
+		return nil, err
+	}
+	parent.Orders = make([]models.Order, 0, len(orderIDs))
+	for _, orderID := range orderIDs {
+		order, err := QueryOrderStatus(db, orderID)
+		if err != nil {
+			return nil, err
+		}
+		parent.Orders = append(parent.Orders, *order)
+	}
+	parent.RollUp()
+	return &parent, nil
+}
+
+// QueryChildOrderIDs 查询合并订单的子订单ID，按下单顺序返回
+func QueryChildOrderIDs(db *sql.DB, parentID int) ([]int, error) {
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryChildOrderIDs", func() error {
+		rows, err = db.Query(`SELECT orderid FROM orders WHERE parent_id = $1 ORDER BY orderid`, parentID)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query child orders", logrus.Fields{"error": err, "parentID": parentID})
+		return nil, fmt.Errorf("查询子订单失败: %v", err)
+	}
+	defer rows.Close()
+
+	var orderIDs []int
+	for rows.Next() {
+		var orderID int
+		if err := rows.Scan(&orderID); err != nil {
+			return nil, err
+		}
+		orderIDs = append(orderIDs, orderID)
+	}
+	return orderIDs, rows.Err()
+}
+
+// QueryParentIDByNo 按合并订单号查询合并订单ID
+func QueryParentIDByNo(db *sql.DB, parentNo string) (int, error) {
+	var parentID int
+	err := monitoring.RecordDBTime("QueryParentIDByNo", func() error {
+		return db.QueryRow(`SELECT parent_id FROM parent_orders WHERE parent_no = $1`, parentNo).Scan(&parentID)
+	})
+	if err == sql.ErrNoRows {
+		return 0, ErrParentOrderNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to query parent order by number", logrus.Fields{"error": err, "parentNo": parentNo})
+		return 0, fmt.Errorf("查询合并订单失败: %v", err)
+	}
+	return parentID, nil
+}
@@ -0,0 +1,293 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrPaymentNotFound       = errors.New("支付记录不存在")
+	ErrPaymentAmountMismatch = errors.New("回调金额与支付单金额不一致")
+	ErrPaymentClosed         = errors.New("支付单已关闭")
+	// ErrPaymentOrderClosed 支付成功时订单已取消（如超时关闭后才付款）或已由其他支付单付过款，款项需要退回
+	ErrPaymentOrderClosed = errors.New("订单已关闭或已支付，本次支付款项需要退回")
+)
+
+const paymentColumns = `payment_id, COALESCE(order_id, 0), COALESCE(parent_id, 0), user_id, provider, provider_ref, COALESCE(pay_url, ''), amount, refunded_amount, status,
+	COALESCE(fail_reason, ''), created_at, paid_at`
+
+func scanPayment(row rowScanner, p *models.Payment) error {
+	var paidAt sql.NullTime
+	err := row.Scan(&p.PaymentID, &p.OrderID, &p.ParentID, &p.UserID, &p.Provider, &p.ProviderRef, &p.PayURL, &p.Amount, &p.RefundedAmount, &p.Status,
+		&p.FailReason, &p.CreatedAt, &paidAt)
+	if err == nil && paidAt.Valid {
+		p.PaidAt = &paidAt.Time
+	}
+	return err
+}
+
+// CreatePayment 保存渠道创建的支付单，OrderID 和 ParentID 二选一
+func CreatePayment(db *sql.DB, p *models.Payment) error {
+	logging.Info("Creating payment", logrus.Fields{"orderID": p.OrderID, "parentID": p.ParentID, "provider": p.Provider})
+	query := `INSERT INTO payments (order_id, parent_id, user_id, provider, provider_ref, pay_url, amount)
+			 VALUES (NULLIF($1, 0), NULLIF($2, 0), $3, $4, $5, NULLIF($6, ''), $7) RETURNING payment_id, status, created_at`
+	err := monitoring.RecordDBTime("CreatePayment", func() error {
+		return db.QueryRow(query, p.OrderID, p.ParentID, p.UserID, p.Provider, p.ProviderRef, p.PayURL, p.Amount).
+			Scan(&p.PaymentID, &p.Status, &p.CreatedAt)
+	})
+	if err != nil {
+		logging.Error("Failed to create payment", logrus.Fields{"error": err, "orderID": p.OrderID, "parentID": p.ParentID})
+		return fmt.Errorf("创建支付单失败: %v", err)
+	}
+	return nil
+}
+
+// QueryLatestPayment 查询订单最近一次支付尝试
+func QueryLatestPayment(db *sql.DB, orderID int) (*models.Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE order_id = $1 ORDER BY payment_id DESC LIMIT 1`
+	var p models.Payment
+	err := monitoring.RecordDBTime("QueryLatestPayment", func() error {
+		return scanPayment(db.QueryRow(query, orderID), &p)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to query payment", logrus.Fields{"error": err, "orderID": orderID})
+		return nil, fmt.Errorf("查询支付记录失败: %v", err)
+	}
+	return &p, nil
+}
+
+// QueryLatestParentPayment 查询合并订单最近一次支付尝试
+func QueryLatestParentPayment(db *sql.DB, parentID int) (*models.Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE parent_id = $1 ORDER BY payment_id DESC LIMIT 1`
+	var p models.Payment
+	err := monitoring.RecordDBTime("QueryLatestParentPayment", func() error {
+		return scanPayment(db.QueryRow(query, parentID), &p)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to query payment", logrus.Fields{"error": err, "parentID": parentID})
+		return nil, fmt.Errorf("查询支付记录失败: %v", err)
+	}
+	return &p, nil
+}
+
+// 一笔支付覆盖的订单：普通订单为订单本身，合并订单为全部子订单
+type paidOrder struct {
+	orderID   int
+	status    string
+	scheduled bool
+	amount    models.Money // 该订单在本次支付中的金额
+}
+
+// 按订单ID顺序锁定支付覆盖的订单
+func lockPaidOrdersTx(tx *sql.Tx, orderID, parentID int, amount models.Money) ([]paidOrder, error) {
+	query := `SELECT orderid, orderstatus, COALESCE(release_at > NOW(), FALSE), payable_amount FROM orders
+		WHERE orderid = $1 ORDER BY orderid FOR UPDATE`
+	key := orderID
+	if parentID != 0 {
+		query = `SELECT orderid, orderstatus, COALESCE(release_at > NOW(), FALSE), payable_amount FROM orders
+			WHERE parent_id = $1 ORDER BY orderid FOR UPDATE`
+		key = parentID
+	}
+	rows, err := tx.Query(query, key)
+	if err != nil {
+		return nil, fmt.Errorf("获取订单状态失败: %v", err)
+	}
+	defer rows.Close()
+
+	var orders []paidOrder
+	for rows.Next() {
+		var o paidOrder
+		if err := rows.Scan(&o.orderID, &o.status, &o.scheduled, &o.amount); err != nil {
+			return nil, fmt.Errorf("获取订单状态失败: %v", err)
+		}
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("获取订单状态失败: %v", err)
+	}
+	if len(orders) == 0 {
+		return nil, ErrOrderNotFound
+	}
+	// 普通订单按实际支付金额记账
+	if parentID == 0 {
+		orders[0].amount = amount
+	}
+	return orders, nil
+}
+
+// ConfirmPayment 处理渠道的支付成功回调：支付单标记为已支付，订单由待支付进入商家待确认（未到备餐时间的预约单进入 scheduled）
+// 合并订单的支付成功时全部子订单一起进入商家待确认，资金流水按子订单应付金额分别记录
+// 返回的 bool 表示本次回调是否改变了支付状态，重复回调返回 false，调用方据此只通知商家一次
+// 订单（或任一子订单）已不在待支付状态时仍记录支付成功（款项已实际到账），同时创建自动批准的全额退款，并返回 ErrPaymentOrderClosed
+func ConfirmPayment(db *sql.DB, providerRef string, amount models.Money) (*models.Payment, bool, error) {
+	logging.Info("Confirming payment", logrus.Fields{"providerRef": providerRef})
+	var p models.Payment
+	var changed bool
+	var orderClosed bool
+	err := monitoring.RecordDBTime("ConfirmPayment", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("开启事务失败: %v", err)
+		}
+		defer tx.Rollback()
+
+		// 先锁订单再锁支付单，与取消订单的加锁顺序一致，避免死锁
+		var orderID, parentID int
+		var paidAmount models.Money
+		err = tx.QueryRow(`SELECT COALESCE(order_id, 0), COALESCE(parent_id, 0), amount FROM payments WHERE provider_ref = $1`,
+			providerRef).Scan(&orderID, &parentID, &paidAmount)
+		if err == sql.ErrNoRows {
+			return ErrPaymentNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("查询支付记录失败: %v", err)
+		}
+		orders, err := lockPaidOrdersTx(tx, orderID, parentID, paidAmount)
+		if err != nil {
+			return err
+		}
+		if err := scanPayment(tx.QueryRow(`SELECT `+paymentColumns+` FROM payments WHERE provider_ref = $1 FOR UPDATE`, providerRef), &p); err != nil {
+			return fmt.Errorf("查询支付记录失败: %v", err)
+		}
+
+		if p.Status == models.PaymentPaid || p.Status == models.PaymentRefunded {
+			return nil
+		}
+		if p.Amount.Cmp(amount) != 0 {
+			return ErrPaymentAmountMismatch
+		}
+
+		err = tx.QueryRow(`UPDATE payments SET status = 'paid', paid_at = NOW(), fail_reason = NULL
+			WHERE payment_id = $1 RETURNING status, paid_at`, p.PaymentID).Scan(&p.Status, &p.PaidAt)
+		if err != nil {
+			return fmt.Errorf("更新支付状态失败: %v", err)
+		}
+		changed = true
+		awaiting := true
+		for _, o := range orders {
+			if o.amount.IsPositive() {
+				if err := insertLedgerTx(tx, o.orderID, p.PaymentID, 0, "payment", o.amount); err != nil {
+					return err
+				}
+			}
+			awaiting = awaiting && o.status == models.OrderStatusAwaitingPayment
+		}
+
+		if awaiting {
+			system := models.OrderActor{Role: models.RoleSystem}
+			for _, o := range orders {
+				// 预约单未到备餐时间时先进入 scheduled，到时间后再通知商家
+				next := models.OrderStatusPending
+				if o.scheduled {
+					next = models.OrderStatusScheduled
+				}
+				if _, err := transitionOrderTx(tx, o.orderID, next, system, "支付成功"); err != nil {
+					return err
+				}
+			}
+			// 同一订单的其他支付尝试不再有效
+			if err := closePendingPaymentsTx(tx, orders[0].orderID, "订单已支付"); err != nil {
+				return err
+			}
+		} else {
+			// 订单已关闭或已由其他支付单付款，本次款项按订单自动全额退回
+			orderClosed = true
+			for _, o := range orders {
+				if !o.amount.IsPositive() {
+					continue
+				}
+				refund := &models.Refund{
+					OrderID:     o.orderID,
+					PaymentID:   p.PaymentID,
+					Amount:      o.amount,
+					ReasonCode:  models.RefundReasonDuplicatePayment,
+					Status:      models.RefundApproved,
+					RequestedBy: models.OrderActor{Role: models.RoleSystem},
+				}
+				if err := createRefundTx(tx, refund); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		logging.Error("Failed to confirm payment", logrus.Fields{"error": err, "providerRef": providerRef})
+		return nil, false, err
+	}
+	if orderClosed {
+		logging.Warn("Payment succeeded after order was closed", logrus.Fields{"orderID": p.OrderID, "parentID": p.ParentID, "paymentID": p.PaymentID})
+		return &p, changed, ErrPaymentOrderClosed
+	}
+	return &p, changed, nil
+}
+
+// QueryPayment 按支付ID查询支付记录
+func QueryPayment(db *sql.DB, paymentID int) (*models.Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE payment_id = $1`
+	var p models.Payment
+	err := monitoring.RecordDBTime("QueryPayment", func() error {
+		return scanPayment(db.QueryRow(query, paymentID), &p)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to query payment", logrus.Fields{"error": err, "paymentID": paymentID})
+		return nil, fmt.Errorf("查询支付记录失败: %v", err)
+	}
+	return &p, nil
+}
+
+// FailPayment 处理渠道的支付失败回调，订单保持待支付，用户可以重新发起支付
+func FailPayment(db *sql.DB, providerRef, reason string) (*models.Payment, error) {
+	logging.Info("Failing payment", logrus.Fields{"providerRef": providerRef, "reason": reason})
+	var p models.Payment
+	err := monitoring.RecordDBTime("FailPayment", func() error {
+		return scanPayment(db.QueryRow(`UPDATE payments SET status = 'failed', fail_reason = NULLIF($2, '')
+			WHERE provider_ref = $1 AND status = 'pending'
+			RETURNING `+paymentColumns, providerRef, reason), &p)
+	})
+	if err == sql.ErrNoRows {
+		// 支付单不存在，或已支付、已关闭，失败回调不再改变状态
+		return nil, ErrPaymentClosed
+	}
+	if err != nil {
+		logging.Error("Failed to mark payment failed", logrus.Fields{"error": err, "providerRef": providerRef})
+		return nil, fmt.Errorf("更新支付状态失败: %v", err)
+	}
+	return &p, nil
+}
+
+// 在取消订单的事务中关闭尚未支付的支付单，关闭后渠道的支付成功回调会被识别为需要退款
+// 子订单同时关闭所属合并订单的支付单
+func closePendingPaymentsTx(tx *sql.Tx, orderID int, reason string) error {
+	_, err := tx.Exec(`UPDATE payments SET status = 'failed', fail_reason = NULLIF($2, '')
+		WHERE (order_id = $1 OR parent_id = (SELECT parent_id FROM orders WHERE orderid = $1)) AND status = 'pending'`, orderID, reason)
+	if err != nil {
+		return fmt.Errorf("关闭支付单失败: %v", err)
+	}
+	return nil
+}
+
+// 记录一条资金流水，收款金额为正、退款金额为负
+func insertLedgerTx(tx *sql.Tx, orderID, paymentID, refundID int, entryType string, amount models.Money) error {
+	_, err := tx.Exec(`INSERT INTO payment_ledger (order_id, payment_id, refund_id, entry_type, amount)
+		VALUES ($1, $2, NULLIF($3, 0), $4, $5)`, orderID, paymentID, refundID, entryType, amount)
+	if err != nil {
+		return fmt.Errorf("记录资金流水失败: %v", err)
+	}
+	return nil
+}
@@ -10,7 +10,6 @@ import (
 	"time"
 
 	_ "github.com/lib/pq"
-	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,13 +22,7 @@ const (
 var DB *sql.DB
 
 func InitDB() (*sql.DB, error) {
-	// 从 .env 文件加载环境变量
-	err := godotenv.Load("config.env")
-	if err != nil {
-		logging.Warn("加载 .env 文件失败", logrus.Fields{"error": err})
-	}
-
-	// 从环境变量获取数据库配置
+	// 从环境变量获取数据库配置（config.env 已在 main 中加载）
 	dbUser := os.Getenv("DB_USER")
 	dbPassword := os.Getenv("DB_PASSWORD")
 	dbHost := os.Getenv("DB_HOST")
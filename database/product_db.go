@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"sort"
 	"take-out/models"
 	"take-out/monitoring"
 )
@@ -18,11 +19,11 @@ func AddProductForShop(rp *RedisPool, db *sql.DB, ShopID int, product *models.Pr
 	// }
 
 	//添加商品到商店
-	query := `INSERT INTO products (shopid, productname, price, description, stock)
-			 VALUES ($1, $2, $3, $4, $5) RETURNING productid`
+	query := `INSERT INTO products (shopid, productname, productprice, prodescription, packaging_fee, stock)
+			 VALUES ($1, $2, $3, $4, $5, $6) RETURNING productid`
 	var productID int64
 	err := monitoring.RecordDBTime("AddProductForShop", func() error {
-		return db.QueryRow(query, product.ShopID, product.ProductName, product.Price, product.Description, product.Stock).Scan(&productID)
+		return db.QueryRow(query, product.ShopID, product.ProductName, product.Price, product.Description, product.PackagingFee, product.Stock).Scan(&productID)
 	})
 	if err != nil {
 		return 0, fmt.Errorf("添加商品失败: %v", err)
@@ -37,8 +38,9 @@ func AddProductForShop(rp *RedisPool, db *sql.DB, ShopID int, product *models.Pr
 		"product_id", productID,
 		"shop_id", product.ShopID,
 		"product_name", product.ProductName,
-		"price", product.Price,
+		"price", product.Price.String(),
 		"description", product.Description,
+		"packaging_fee", product.PackagingFee.String(),
 		"stock", product.Stock,
 	).Err()
 	if err != nil {
@@ -47,14 +49,14 @@ func AddProductForShop(rp *RedisPool, db *sql.DB, ShopID int, product *models.Pr
 	return productID, nil
 }
 
-//商店更新库存
-func UpdateProductStock(rp *RedisPool, db *sql.DB, productID int, newStock int) error {
+//商店更新库存，只能修改本店商品
+func UpdateProductStock(rp *RedisPool, db *sql.DB, shopID int, productID int, newStock int) error {
 	// 更新数据库中的库存
-	query := `UPDATE products SET stock = $1 WHERE productid = $2`
+	query := `UPDATE products SET stock = $1, updated_at = NOW() WHERE productid = $2 AND shopid = $3`
 	var result sql.Result
 	err := monitoring.RecordDBTime("UpdateProductStock", func() error {
 		var err error
-		result, err = db.Exec(query, newStock, productID)
+		result, err = db.Exec(query, newStock, productID, shopID)
 		return err
 	})
 	if err != nil {
@@ -67,7 +69,7 @@ func UpdateProductStock(rp *RedisPool, db *sql.DB, productID int, newStock int)
 		return fmt.Errorf("检查更新结果失败: %v", err)
 	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("商品不存在")
+		return fmt.Errorf("%w: %d", ErrProductNotFound, productID)
 	}
 
 	// 同步更新Redis缓存
@@ -83,3 +85,113 @@ func UpdateProductStock(rp *RedisPool, db *sql.DB, productID int, newStock int)
 
 	return nil
 }
+
+// OutOfStockError 商品库存不足，下单时由库存预占返回
+type OutOfStockError struct {
+	ProductID int
+	Requested int
+	Available int
+}
+
+func (e *OutOfStockError) Error() string {
+	return fmt.Sprintf("商品 %d 库存不足: 需要 %d, 剩余 %d", e.ProductID, e.Requested, e.Available)
+}
+
+// 按商品汇总订单明细中的数量，并按商品ID排序，保证并发下单时按相同顺序加行锁，避免死锁
+func aggregateItemQuantities(items []models.OrderItem) ([]int, map[int]int) {
+	quantities := make(map[int]int)
+	var productIDs []int
+	for _, item := range items {
+		if _, ok := quantities[item.ProductID]; !ok {
+			productIDs = append(productIDs, item.ProductID)
+		}
+		quantities[item.ProductID] += item.Quantity
+	}
+	sort.Ints(productIDs)
+	return productIDs, quantities
+}
+
+// 在订单事务中预占库存：条件更新保证库存不会被扣成负数，任一商品不足时整个订单回滚
+func reserveStockTx(tx *sql.Tx, items []models.OrderItem) error {
+	productIDs, quantities := aggregateItemQuantities(items)
+	for _, productID := range productIDs {
+		var remaining int
+		err := tx.QueryRow(`UPDATE products SET stock = stock - $1, updated_at = NOW()
+			WHERE productid = $2 AND stock >= $1 RETURNING stock`, quantities[productID], productID).Scan(&remaining)
+		if err == sql.ErrNoRows {
+			var available int
+			if err := tx.QueryRow(`SELECT COALESCE(stock, 0) FROM products WHERE productid = $1`, productID).Scan(&available); err != nil {
+				return fmt.Errorf("%w: %d", ErrProductNotFound, productID)
+			}
+			return &OutOfStockError{ProductID: productID, Requested: quantities[productID], Available: available}
+		}
+		if err != nil {
+			return fmt.Errorf("预占库存失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// 在订单事务中释放订单预占的库存，同一商品出现在多行明细时先汇总数量
+func releaseStockTx(tx *sql.Tx, orderID int) error {
+	_, err := tx.Exec(`UPDATE products p SET stock = p.stock + i.quantity, updated_at = NOW()
+		FROM (SELECT product_id, SUM(quantity) AS quantity FROM order_items WHERE order_id = $1 GROUP BY product_id) i
+		WHERE p.productid = i.product_id`, orderID)
+	if err != nil {
+		return fmt.Errorf("恢复商品库存失败：%v", err)
+	}
+	return nil
+}
+
+// SyncProductStockCache 将数据库中的最新库存同步到 Redis 的 product:%d 哈希
+// 库存以数据库为准，Redis 仅作展示缓存，同步失败只记录警告
+func SyncProductStockCache(rp *RedisPool, db *sql.DB, items []models.OrderItem) {
+	productIDs, _ := aggregateItemQuantities(items)
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	for _, productID := range productIDs {
+		var stock int
+		err := monitoring.RecordDBTime("QueryProductStock", func() error {
+			return db.QueryRow(`SELECT COALESCE(stock, 0) FROM products WHERE productid = $1`, productID).Scan(&stock)
+		})
+		if err != nil {
+			log.Printf("警告: 查询商品库存失败: %v", err)
+			continue
+		}
+		err = monitoring.RecordRedisTime("SyncProductStockCache", func() error {
+			return rdb.HSet(context.Background(), fmt.Sprintf("product:%d", productID), "stock", stock).Err()
+		})
+		if err != nil {
+			log.Printf("警告: 更新Redis缓存失败: %v", err)
+		}
+	}
+}
+
+// AdjustProductStock 按增量调整库存（补货为正、报损为负），与下单预占并发执行时不会覆盖对方的修改
+func AdjustProductStock(rp *RedisPool, db *sql.DB, shopID, productID, delta int) (int, error) {
+	var stock int
+	err := monitoring.RecordDBTime("AdjustProductStock", func() error {
+		query := `UPDATE products SET stock = stock + $1, updated_at = NOW()
+				 WHERE productid = $2 AND shopid = $3 AND stock + $1 >= 0 RETURNING stock`
+		return db.QueryRow(query, delta, productID, shopID).Scan(&stock)
+	})
+	if err == sql.ErrNoRows {
+		var available int
+		err := db.QueryRow(`SELECT COALESCE(stock, 0) FROM products WHERE productid = $1 AND shopid = $2`, productID, shopID).Scan(&available)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %d", ErrProductNotFound, productID)
+		}
+		return 0, &OutOfStockError{ProductID: productID, Requested: -delta, Available: available}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("调整库存失败: %v", err)
+	}
+
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	err = rdb.HSet(context.Background(), fmt.Sprintf("product:%d", productID), "stock", stock).Err()
+	if err != nil {
+		log.Printf("警告: 更新Redis缓存失败: %v", err)
+	}
+	return stock, nil
+}
@@ -0,0 +1,391 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrRefundNotFound      = errors.New("退款单不存在")
+	ErrRefundNotPaid       = errors.New("订单没有可退款的支付记录")
+	ErrRefundExceedsPaid   = errors.New("退款金额超过可退金额")
+	ErrRefundItemNotFound  = errors.New("退款商品不属于该订单")
+	ErrRefundItemExceeds   = errors.New("退款数量超过可退数量")
+	ErrRefundNotReviewable = errors.New("退款单当前状态不能审核")
+)
+
+// 占用可退金额的退款状态：除已拒绝外都计入已退金额，防止超额退款；渠道失败的退款在重试或拒绝前继续占用
+const refundHoldingStatuses = `('pending', 'approved', 'succeeded', 'failed')`
+
+const refundColumns = `f.refund_id, f.order_id, f.payment_id, f.amount, f.reason_code, COALESCE(f.reason, ''), f.status,
+	f.requested_role, f.requested_id, f.reviewed_role, f.reviewed_id, COALESCE(f.review_note, ''),
+	COALESCE(f.provider_refund_ref, ''), COALESCE(f.fail_reason, ''), f.created_at, f.completed_at`
+
+func scanRefund(row rowScanner, r *models.Refund) error {
+	var reviewedRole sql.NullString
+	var reviewedID sql.NullInt64
+	var completedAt sql.NullTime
+	err := row.Scan(&r.RefundID, &r.OrderID, &r.PaymentID, &r.Amount, &r.ReasonCode, &r.Reason, &r.Status,
+		&r.RequestedBy.Role, &r.RequestedBy.ID, &reviewedRole, &reviewedID, &r.ReviewNote,
+		&r.ProviderRefundRef, &r.FailReason, &r.CreatedAt, &completedAt)
+	if err != nil {
+		return err
+	}
+	if reviewedRole.Valid {
+		r.ReviewedBy = &models.OrderActor{Role: reviewedRole.String, ID: int(reviewedID.Int64)}
+	}
+	if completedAt.Valid {
+		r.CompletedAt = &completedAt.Time
+	}
+	return nil
+}
+
+// CreateRefund 创建退款单
+// Items 不为空时按商品明细计算退款金额；Items 为空且 Amount 为 0 时退回全部可退金额
+// Status 为 approved 时表示发起方即审核方（如商家主动退款），由调用方随后执行退款
+func CreateRefund(db *sql.DB, r *models.Refund) error {
+	logging.Info("Creating refund", logrus.Fields{"orderID": r.OrderID, "reason": r.ReasonCode, "role": r.RequestedBy.Role})
+	err := monitoring.RecordDBTime("CreateRefund", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("开启事务失败: %v", err)
+		}
+		defer tx.Rollback()
+		if err := createRefundTx(tx, r); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		logging.Warn("Failed to create refund", logrus.Fields{"error": err, "orderID": r.OrderID})
+		return err
+	}
+	return nil
+}
+
+// 在事务中创建退款单，锁住原支付记录使同一笔支付的退款串行计算可退金额
+// 子订单的退款退回合并订单的支付记录，可退金额同时不超过该子订单应付金额减去其已占用的退款
+func createRefundTx(tx *sql.Tx, r *models.Refund) error {
+	rows, err := tx.Query(`SELECT p.payment_id, LEAST(
+			p.amount - COALESCE((SELECT SUM(f.amount) FROM refunds f
+				WHERE f.payment_id = p.payment_id AND f.status IN `+refundHoldingStatuses+`), 0),
+			CASE WHEN p.parent_id IS NULL THEN p.amount
+				ELSE o.payable_amount - COALESCE((SELECT SUM(f.amount) FROM refunds f
+					WHERE f.payment_id = p.payment_id AND f.order_id = o.orderid AND f.status IN `+refundHoldingStatuses+`), 0) END)
+		FROM orders o
+		JOIN payments p ON p.order_id = o.orderid OR p.parent_id = o.parent_id
+		WHERE o.orderid = $1 AND p.status = 'paid' AND ($2 = 0 OR p.payment_id = $2)
+		ORDER BY p.payment_id
+		FOR UPDATE OF p`, r.OrderID, r.PaymentID)
+	if err != nil {
+		return fmt.Errorf("查询支付记录失败: %v", err)
+	}
+	var remaining models.Money
+	r.PaymentID = 0
+	for rows.Next() {
+		var paymentID int
+		var left models.Money
+		if err := rows.Scan(&paymentID, &left); err != nil {
+			rows.Close()
+			return fmt.Errorf("查询支付记录失败: %v", err)
+		}
+		if r.PaymentID == 0 && left.IsPositive() {
+			r.PaymentID, remaining = paymentID, left
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("查询支付记录失败: %v", err)
+	}
+	if r.PaymentID == 0 {
+		return ErrRefundNotPaid
+	}
+
+	if len(r.Items) > 0 {
+		var itemsTotal models.Money
+		for i := range r.Items {
+			if err := priceRefundItemTx(tx, r.OrderID, &r.Items[i]); err != nil {
+				return err
+			}
+			itemsTotal = itemsTotal.Add(r.Items[i].Amount)
+		}
+		// 订单使用了优惠时商品原价之和可能超过实付金额，最多退回实付金额
+		r.Amount = itemsTotal.Min(remaining)
+	} else if r.Amount.IsZero() {
+		r.Amount = remaining
+	}
+	if !r.Amount.IsPositive() || r.Amount.Cmp(remaining) > 0 {
+		return ErrRefundExceedsPaid
+	}
+
+	var reviewedRole interface{}
+	var reviewedID interface{}
+	var attemptedAt interface{}
+	if r.Status == models.RefundApproved {
+		// 自动批准或发起方即审核方
+		reviewer := r.RequestedBy
+		if r.ReviewedBy != nil {
+			reviewer = *r.ReviewedBy
+		}
+		r.ReviewedBy = &reviewer
+		reviewedRole, reviewedID = reviewer.Role, reviewer.ID
+		attemptedAt = time.Now()
+	} else {
+		r.Status = models.RefundPending
+	}
+
+	err = tx.QueryRow(`INSERT INTO refunds (order_id, payment_id, amount, reason_code, reason, status,
+			requested_role, requested_id, reviewed_role, reviewed_id, attempted_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, $9, $10, $11) RETURNING refund_id, created_at`,
+		r.OrderID, r.PaymentID, r.Amount, r.ReasonCode, r.Reason, r.Status,
+		r.RequestedBy.Role, r.RequestedBy.ID, reviewedRole, reviewedID, attemptedAt).Scan(&r.RefundID, &r.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("保存退款单失败: %v", err)
+	}
+	for _, item := range r.Items {
+		if _, err := tx.Exec(`INSERT INTO refund_items (refund_id, order_item_id, quantity, amount) VALUES ($1, $2, $3, $4)`,
+			r.RefundID, item.OrderItemID, item.Quantity, item.Amount); err != nil {
+			return fmt.Errorf("保存退款明细失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// 校验退款数量并按下单时的单价和单件打包费计算明细退款金额
+func priceRefundItemTx(tx *sql.Tx, orderID int, item *models.RefundItem) error {
+	if item.Quantity <= 0 {
+		return ErrRefundItemExceeds
+	}
+	var quantity, refunded int
+	var unitAmount models.Money
+	err := tx.QueryRow(`SELECT oi.product_name, oi.quantity, oi.unit_price + oi.packaging_fee,
+			COALESCE((SELECT SUM(ri.quantity) FROM refund_items ri JOIN refunds f ON f.refund_id = ri.refund_id
+				WHERE ri.order_item_id = oi.item_id AND f.status IN `+refundHoldingStatuses+`), 0)
+		FROM order_items oi WHERE oi.item_id = $1 AND oi.order_id = $2`, item.OrderItemID, orderID).
+		Scan(&item.ProductName, &quantity, &unitAmount, &refunded)
+	if err == sql.ErrNoRows {
+		return ErrRefundItemNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("查询订单明细失败: %v", err)
+	}
+	if refunded+item.Quantity > quantity {
+		return ErrRefundItemExceeds
+	}
+	item.Amount = unitAmount.Mul(item.Quantity)
+	return nil
+}
+
+// QueryRefund 查询退款单及其明细
+func QueryRefund(db *sql.DB, refundID int) (*models.Refund, error) {
+	var r models.Refund
+	err := monitoring.RecordDBTime("QueryRefund", func() error {
+		return scanRefund(db.QueryRow(`SELECT `+refundColumns+` FROM refunds f WHERE f.refund_id = $1`, refundID), &r)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrRefundNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to query refund", logrus.Fields{"error": err, "refundID": refundID})
+		return nil, fmt.Errorf("查询退款单失败: %v", err)
+	}
+	if err := attachRefundItems(db, []*models.Refund{&r}); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// QueryOrderRefunds 查询订单的全部退款单，按创建顺序返回
+func QueryOrderRefunds(db *sql.DB, orderID int) ([]models.Refund, error) {
+	return queryRefunds(db, "QueryOrderRefunds", `WHERE f.order_id = $1 ORDER BY f.refund_id`, orderID)
+}
+
+// QueryShopRefunds 查询商家订单的退款单，status 为空时返回全部，最新在前
+func QueryShopRefunds(db *sql.DB, shopID int, status string) ([]models.Refund, error) {
+	return queryRefunds(db, "QueryShopRefunds", `JOIN orders o ON o.orderid = f.order_id
+		WHERE o.shopid = $1 AND ($2 = '' OR f.status = $2) ORDER BY f.refund_id DESC LIMIT 200`, shopID, status)
+}
+
+func queryRefunds(db *sql.DB, operation, where string, args ...interface{}) ([]models.Refund, error) {
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime(operation, func() error {
+		rows, err = db.Query(`SELECT `+refundColumns+` FROM refunds f `+where, args...)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to query refunds", logrus.Fields{"error": err, "operation": operation})
+		return nil, fmt.Errorf("查询退款单失败: %v", err)
+	}
+	defer rows.Close()
+
+	refunds := []models.Refund{}
+	for rows.Next() {
+		var r models.Refund
+		if err := scanRefund(rows, &r); err != nil {
+			return nil, fmt.Errorf("读取退款单失败: %v", err)
+		}
+		refunds = append(refunds, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历退款单失败: %v", err)
+	}
+
+	ptrs := make([]*models.Refund, len(refunds))
+	for i := range refunds {
+		ptrs[i] = &refunds[i]
+	}
+	if err := attachRefundItems(db, ptrs); err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+// 批量查询退款明细并挂到对应的退款单上
+func attachRefundItems(db *sql.DB, refunds []*models.Refund) error {
+	if len(refunds) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(refunds))
+	byID := make(map[int]*models.Refund, len(refunds))
+	for i, r := range refunds {
+		ids[i] = int64(r.RefundID)
+		byID[r.RefundID] = r
+	}
+
+	rows, err := db.Query(`SELECT ri.refund_id, ri.order_item_id, oi.product_name, ri.quantity, ri.amount
+		FROM refund_items ri JOIN order_items oi ON oi.item_id = ri.order_item_id
+		WHERE ri.refund_id = ANY($1) ORDER BY ri.order_item_id`, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("查询退款明细失败: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var refundID int
+		var item models.RefundItem
+		if err := rows.Scan(&refundID, &item.OrderItemID, &item.ProductName, &item.Quantity, &item.Amount); err != nil {
+			return fmt.Errorf("读取退款明细失败: %v", err)
+		}
+		byID[refundID].Items = append(byID[refundID].Items, item)
+	}
+	return rows.Err()
+}
+
+// ReviewRefund 商家审核本店订单的退款单：批准或拒绝待审核的退款单，渠道失败的退款单可以重新批准重试，也可以拒绝
+func ReviewRefund(db *sql.DB, refundID int, reviewer models.OrderActor, approve bool, note string) (*models.Refund, error) {
+	logging.Info("Reviewing refund", logrus.Fields{"refundID": refundID, "approve": approve, "role": reviewer.Role})
+	status := models.RefundRejected
+	if approve {
+		status = models.RefundApproved
+	}
+	var result sql.Result
+	err := monitoring.RecordDBTime("ReviewRefund", func() error {
+		var err error
+		result, err = db.Exec(`UPDATE refunds f SET status = $1, reviewed_role = $2, reviewed_id = $3, review_note = NULLIF($4, ''), fail_reason = NULL,
+				attempted_at = CASE WHEN $6 THEN NOW() ELSE f.attempted_at END
+			FROM orders o
+			WHERE f.refund_id = $5 AND o.orderid = f.order_id AND o.shopid = $3 AND f.status IN ('pending', 'failed')`,
+			status, reviewer.Role, reviewer.ID, note, refundID, approve)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to review refund", logrus.Fields{"error": err, "refundID": refundID})
+		return nil, fmt.Errorf("审核退款单失败: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil, ErrRefundNotReviewable
+	}
+	return QueryRefund(db, refundID)
+}
+
+// CompleteRefund 渠道退款成功：更新退款单和支付记录的已退金额，并记录退款流水
+func CompleteRefund(db *sql.DB, refundID int, providerRefundRef string) error {
+	err := monitoring.RecordDBTime("CompleteRefund", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("开启事务失败: %v", err)
+		}
+		defer tx.Rollback()
+
+		var orderID, paymentID int
+		var amount models.Money
+		err = tx.QueryRow(`UPDATE refunds SET status = 'succeeded', provider_refund_ref = $1, completed_at = NOW(), fail_reason = NULL
+			WHERE refund_id = $2 AND status = 'approved'
+			RETURNING order_id, payment_id, amount`, providerRefundRef, refundID).Scan(&orderID, &paymentID, &amount)
+		if err == sql.ErrNoRows {
+			// 已被其他实例处理
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("更新退款状态失败: %v", err)
+		}
+		if _, err := tx.Exec(`UPDATE payments SET refunded_amount = refunded_amount + $1,
+				status = CASE WHEN refunded_amount + $1 >= amount THEN 'refunded' ELSE status END
+			WHERE payment_id = $2`, amount, paymentID); err != nil {
+			return fmt.Errorf("更新支付退款金额失败: %v", err)
+		}
+		if err := insertLedgerTx(tx, orderID, paymentID, refundID, "refund", amount.Neg()); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		logging.Error("Failed to complete refund", logrus.Fields{"error": err, "refundID": refundID})
+		return err
+	}
+	return nil
+}
+
+// FailRefund 渠道退款失败，商家可以重新批准重试或拒绝
+func FailRefund(db *sql.DB, refundID int, reason string) error {
+	err := monitoring.RecordDBTime("FailRefund", func() error {
+		_, err := db.Exec(`UPDATE refunds SET status = 'failed', fail_reason = $1 WHERE refund_id = $2 AND status = 'approved'`, reason, refundID)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to mark refund failed", logrus.Fields{"error": err, "refundID": refundID})
+		return fmt.Errorf("更新退款状态失败: %v", err)
+	}
+	return nil
+}
+
+// ClaimStaleRefunds 领取批准后超过 before 仍未完成的退款单（如批准后进程崩溃、渠道已退款但更新状态失败），返回退款单ID
+// 领取时把 attempted_at 顺延到当前时间作为租约，多实例同时运行时同一退款单只会被一个实例领取
+func ClaimStaleRefunds(db *sql.DB, before time.Time, limit int) ([]int, error) {
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("ClaimStaleRefunds", func() error {
+		rows, err = db.Query(`UPDATE refunds SET attempted_at = NOW()
+			WHERE refund_id IN (
+				SELECT refund_id FROM refunds
+				WHERE status = 'approved' AND COALESCE(attempted_at, created_at) < $1
+				ORDER BY refund_id
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED)
+			RETURNING refund_id`, before, limit)
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to claim stale refunds", logrus.Fields{"error": err})
+		return nil, fmt.Errorf("领取待重试的退款单失败: %v", err)
+	}
+	defer rows.Close()
+
+	var refundIDs []int
+	for rows.Next() {
+		var refundID int
+		if err := rows.Scan(&refundID); err != nil {
+			return nil, fmt.Errorf("读取退款单失败: %v", err)
+		}
+		refundIDs = append(refundIDs, refundID)
+	}
+	return refundIDs, rows.Err()
+}
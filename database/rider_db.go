@@ -2,14 +2,28 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"take-out/logging"
 	"take-out/models"
 	"take-out/monitoring"
 
+	"github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	ErrRiderNotFound = errors.New("骑手不存在")
+	// ErrRiderUnavailable 骑手未上线，或配送中的订单已达上限
+	ErrRiderUnavailable = errors.New("骑手未上线或配送中的订单已达上限")
+	// ErrRiderHasActiveOrders 骑手还有配送中的订单，不能下线
+	ErrRiderHasActiveOrders = errors.New("还有配送中的订单，送达后才能下线")
+)
+
+// 按配送中的订单数计算在线骑手的状态：达到上限 $2 时为忙碌，否则为在线
+const riderLoadStatusSQL = `CASE WHEN (SELECT COUNT(*) FROM orders o WHERE o.riderid = riders.riderid AND o.orderstatus = 'delivering') >= $2
+	THEN 'busy' ELSE 'online' END`
+
 // InsertRider adds a new rider to the database
 func InsertRider(db *sql.DB, rider *models.Rider) (int64, error) {
 	logging.Info("InsertRider called", logrus.Fields{"ridername": rider.RiderName})
@@ -58,4 +72,216 @@ func InsertRider(db *sql.DB, rider *models.Rider) (int64, error) {
 
 	logging.Info("Successfully inserted new rider", logrus.Fields{"riderID": riderID})
 	return riderID, nil
-}
\ No newline at end of file
+}
+// SaveRiderLocationSnapshots 批量把骑手的实时位置快照写入数据库，只覆盖比已有快照更新的位置
+func SaveRiderLocationSnapshots(db *sql.DB, locations []models.RiderLocation) (int64, error) {
+	if len(locations) == 0 {
+		return 0, nil
+	}
+	ids := make([]int64, len(locations))
+	lats := make([]float64, len(locations))
+	lons := make([]float64, len(locations))
+	times := make([]int64, len(locations))
+	for i, loc := range locations {
+		ids[i] = int64(loc.RiderID)
+		lats[i] = loc.Latitude
+		lons[i] = loc.Longitude
+		times[i] = loc.UpdatedAt.Unix()
+	}
+
+	var updated int64
+	err := monitoring.RecordDBTime("SaveRiderLocationSnapshots", func() error {
+		result, err := db.Exec(`UPDATE riders r SET riderlatitude = s.lat, riderlongitude = s.lon, location_updated_at = to_timestamp(s.ts)
+			FROM unnest($1::int[], $2::float8[], $3::float8[], $4::bigint[]) AS s(id, lat, lon, ts)
+			WHERE r.riderid = s.id AND (r.location_updated_at IS NULL OR r.location_updated_at < to_timestamp(s.ts))`,
+			pq.Array(ids), pq.Array(lats), pq.Array(lons), pq.Array(times))
+		if err != nil {
+			return err
+		}
+		updated, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to save rider location snapshots", logrus.Fields{"error": err, "count": len(locations)})
+		return 0, fmt.Errorf("保存骑手位置快照失败: %v", err)
+	}
+	return updated, nil
+}
+
+// QueryRiderAvailability 查询骑手的状态和配送中的订单数
+func QueryRiderAvailability(db *sql.DB, riderID int) (*models.RiderAvailability, error) {
+	a := models.RiderAvailability{RiderID: riderID}
+	err := monitoring.RecordDBTime("QueryRiderAvailability", func() error {
+		return db.QueryRow(`SELECT riderstatus, (SELECT COUNT(*) FROM orders WHERE riderid = $1 AND orderstatus = 'delivering')
+			FROM riders WHERE riderid = $1`, riderID).Scan(&a.Status, &a.ActiveOrders)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrRiderNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询骑手状态失败: %v", err)
+	}
+	return &a, nil
+}
+
+// SetRiderOnline 骑手上线：配送中的订单已达上限 maxActive 时直接进入忙碌，返回上线后的状态
+func SetRiderOnline(db *sql.DB, riderID, maxActive int) (string, error) {
+	var status string
+	err := monitoring.RecordDBTime("SetRiderOnline", func() error {
+		return db.QueryRow(`UPDATE riders SET riderstatus = `+riderLoadStatusSQL+`
+			WHERE riderid = $1 RETURNING riderstatus`, riderID, maxActive).Scan(&status)
+	})
+	if err == sql.ErrNoRows {
+		return "", ErrRiderNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to set rider online", logrus.Fields{"error": err, "riderID": riderID})
+		return "", fmt.Errorf("骑手上线失败: %v", err)
+	}
+	return status, nil
+}
+
+// SetRiderOffline 骑手主动下线，还有配送中的订单时返回 ErrRiderHasActiveOrders
+func SetRiderOffline(db *sql.DB, riderID int) error {
+	err := monitoring.RecordDBTime("SetRiderOffline", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("开启事务失败: %v", err)
+		}
+		defer tx.Rollback()
+
+		// 锁定骑手，避免下线的同时接单
+		var active int
+		err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM orders WHERE riderid = $1 AND orderstatus = 'delivering')
+			FROM riders WHERE riderid = $1 FOR UPDATE`, riderID).Scan(&active)
+		if err == sql.ErrNoRows {
+			return ErrRiderNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("查询骑手状态失败: %v", err)
+		}
+		if active > 0 {
+			return ErrRiderHasActiveOrders
+		}
+		if _, err := tx.Exec(`UPDATE riders SET riderstatus = 'offline' WHERE riderid = $1`, riderID); err != nil {
+			return fmt.Errorf("骑手下线失败: %v", err)
+		}
+		return tx.Commit()
+	})
+	if err != nil && !errors.Is(err, ErrRiderHasActiveOrders) && !errors.Is(err, ErrRiderNotFound) {
+		logging.Error("Failed to set rider offline", logrus.Fields{"error": err, "riderID": riderID})
+	}
+	return err
+}
+
+// MarkRidersOffline 把心跳超时的骑手标记为离线（不论是否有配送中的订单），返回状态实际发生变化的骑手
+func MarkRidersOffline(db *sql.DB, riderIDs []int) ([]int, error) {
+	if len(riderIDs) == 0 {
+		return nil, nil
+	}
+	ids := make([]int64, len(riderIDs))
+	for i, id := range riderIDs {
+		ids[i] = int64(id)
+	}
+
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("MarkRidersOffline", func() error {
+		rows, err = db.Query(`UPDATE riders SET riderstatus = 'offline'
+			WHERE riderid = ANY($1) AND riderstatus <> 'offline' RETURNING riderid`, pq.Array(ids))
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to mark riders offline", logrus.Fields{"error": err, "count": len(riderIDs)})
+		return nil, fmt.Errorf("标记骑手离线失败: %v", err)
+	}
+	defer rows.Close()
+
+	var changed []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		changed = append(changed, id)
+	}
+	return changed, rows.Err()
+}
+
+// QueryAvailableRiderIDs 查询在线或忙碌的骑手，用于核对心跳记录
+func QueryAvailableRiderIDs(db *sql.DB) ([]int, error) {
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("QueryAvailableRiderIDs", func() error {
+		rows, err = db.Query(`SELECT riderid FROM riders WHERE riderstatus IN ('online', 'busy')`)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("查询在线骑手失败: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// CountRidersByStatus 按状态统计骑手数量
+func CountRidersByStatus(db *sql.DB) (map[string]int, error) {
+	var rows *sql.Rows
+	var err error
+	err = monitoring.RecordDBTime("CountRidersByStatus", func() error {
+		rows, err = db.Query(`SELECT riderstatus, COUNT(*) FROM riders GROUP BY riderstatus`)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("统计骑手状态失败: %v", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
+// 在事务中锁定接单的骑手，骑手未上线或配送中的订单已达上限 maxActive 时返回 ErrRiderUnavailable
+// 同一骑手并发接单时按骑手串行，保证不超过上限
+func lockAvailableRiderTx(tx *sql.Tx, riderID, maxActive int) error {
+	var status string
+	var active int
+	err := tx.QueryRow(`SELECT riderstatus, (SELECT COUNT(*) FROM orders WHERE riderid = $1 AND orderstatus = 'delivering')
+		FROM riders WHERE riderid = $1 FOR UPDATE`, riderID).Scan(&status, &active)
+	if err == sql.ErrNoRows {
+		return ErrRiderNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("查询骑手状态失败: %v", err)
+	}
+	if status != models.RiderStatusOnline || active >= maxActive {
+		return ErrRiderUnavailable
+	}
+	return nil
+}
+
+// 在事务中按配送中的订单数刷新骑手的在线/忙碌状态，离线的骑手保持离线
+func refreshRiderLoadTx(tx *sql.Tx, riderID, maxActive int) error {
+	_, err := tx.Exec(`UPDATE riders SET riderstatus = `+riderLoadStatusSQL+`
+		WHERE riderid = $1 AND riderstatus IN ('online', 'busy')`, riderID, maxActive)
+	if err != nil {
+		return fmt.Errorf("更新骑手状态失败: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// 骑手实时位置保存在 Redis 中：
+// rider_geo 为 GEO 集合（成员为骑手ID），用于按位置查询附近骑手；
+// rider_geo:seen 为有序集合，分值为骑手最近一次定位的 Unix 秒，用于剔除长时间未上报的骑手；
+// rider_track:<id> 为列表，保存骑手最近的定位点（最新的在前）
+const (
+	riderGeoKey  = "rider_geo"
+	riderSeenKey = "rider_geo:seen"
+)
+
+func riderTrackKey(riderID int) string {
+	return fmt.Sprintf("rider_track:%d", riderID)
+}
+
+// 剔除最近一次定位早于 ARGV[1] 的骑手，每次最多 ARGV[2] 个，返回剔除的数量
+var sweepRiderLocationsScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+if #ids > 0 then
+	redis.call('ZREM', KEYS[1], unpack(ids))
+	redis.call('ZREM', KEYS[2], unpack(ids))
+end
+return #ids
+`)
+
+// 写入骑手的一批定位点：ARGV[1] 为骑手ID，ARGV[2]、ARGV[3] 为最新点的经纬度，ARGV[4] 为最新点的定位时间，
+// ARGV[5] 为轨迹长度，ARGV[6] 为轨迹有效期（毫秒），其余参数为要追加到轨迹的定位点
+// 只有最新点不早于已记录的定位时间时才更新当前位置，避免延迟到达的旧批次把骑手拉回旧位置；轨迹总是追加
+// 返回 1 表示更新了当前位置
+var updateRiderLocationScript = redis.NewScript(`
+local seen = redis.call('ZSCORE', KEYS[2], ARGV[1])
+local updated = 0
+if not seen or tonumber(seen) <= tonumber(ARGV[4]) then
+	redis.call('GEOADD', KEYS[1], ARGV[2], ARGV[3], ARGV[1])
+	redis.call('ZADD', KEYS[2], ARGV[4], ARGV[1])
+	updated = 1
+end
+redis.call('LPUSH', KEYS[3], unpack(ARGV, 7))
+redis.call('LTRIM', KEYS[3], 0, tonumber(ARGV[5]) - 1)
+redis.call('PEXPIRE', KEYS[3], ARGV[6])
+return updated
+`)
+
+// UpdateRiderLocation 写入骑手上报的一批定位点（按定位时间升序）：最后一个点的定位时间不早于已记录的当前位置时，
+// 作为骑手的当前位置写入 GEO 集合，返回 true；否则当前位置保持不变，返回 false
+// 全部点都追加到骑手的轨迹，轨迹只保留最近 trackLength 个点，trackTTL 内没有新定位时整条轨迹过期
+func UpdateRiderLocation(rp *RedisPool, riderID int, points []models.LocationPoint, trackLength int, trackTTL time.Duration) (bool, error) {
+	if len(points) == 0 {
+		return false, nil
+	}
+	latest := points[len(points)-1]
+	member := strconv.Itoa(riderID)
+	args := []interface{}{member, latest.Longitude, latest.Latitude, latest.RecordedAt.Unix(), trackLength, trackTTL.Milliseconds()}
+	for _, point := range points {
+		data, _ := json.Marshal(point)
+		args = append(args, string(data))
+	}
+
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	var updated int
+	err := monitoring.RecordRedisTime("UpdateRiderLocation", func() error {
+		var err error
+		updated, err = updateRiderLocationScript.Run(ctx, rdb, []string{riderGeoKey, riderSeenKey, riderTrackKey(riderID)}, args...).Int()
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to update rider location", logrus.Fields{"error": err, "riderID": riderID})
+		return false, fmt.Errorf("更新骑手位置失败: %v", err)
+	}
+	return updated == 1, nil
+}
+
+// NearbyRiders 查询 (lat, lon) 周围 radiusKm 内、freshSince 之后上报过定位的骑手，按距离从近到远最多返回 limit 个
+func NearbyRiders(rp *RedisPool, lat, lon, radiusKm float64, limit int, freshSince time.Time) ([]models.RiderLocation, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+
+	var found []redis.GeoLocation
+	err := monitoring.RecordRedisTime("NearbyRiders", func() error {
+		var err error
+		found, err = rdb.GeoSearchLocation(ctx, riderGeoKey, &redis.GeoSearchLocationQuery{
+			GeoSearchQuery: redis.GeoSearchQuery{
+				Latitude:   lat,
+				Longitude:  lon,
+				Radius:     radiusKm,
+				RadiusUnit: "km",
+				Sort:       "ASC",
+				Count:      limit,
+			},
+			WithCoord: true,
+			WithDist:  true,
+		}).Result()
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to search nearby riders", logrus.Fields{"error": err})
+		return nil, fmt.Errorf("查询附近骑手失败: %v", err)
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	// 剔除任务运行前，未及时上报的骑手可能还在 GEO 集合中，按最近一次定位时间再过滤一次
+	members := make([]string, len(found))
+	for i, loc := range found {
+		members[i] = loc.Name
+	}
+	var seen []float64
+	err = monitoring.RecordRedisTime("ZMScore", func() error {
+		var err error
+		seen, err = rdb.ZMScore(ctx, riderSeenKey, members...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("查询骑手定位时间失败: %v", err)
+	}
+
+	riders := make([]models.RiderLocation, 0, len(found))
+	for i, loc := range found {
+		riderID, err := strconv.Atoi(loc.Name)
+		if err != nil || seen[i] < float64(freshSince.Unix()) {
+			continue
+		}
+		riders = append(riders, models.RiderLocation{
+			RiderID:    riderID,
+			Latitude:   loc.Latitude,
+			Longitude:  loc.Longitude,
+			DistanceKm: loc.Dist,
+			UpdatedAt:  time.Unix(int64(seen[i]), 0),
+		})
+	}
+	return riders, nil
+}
+
+// QueryRiderLocation 查询骑手的当前位置，骑手没有位置（未上报或已被剔除）时返回 nil
+func QueryRiderLocation(rp *RedisPool, riderID int) (*models.RiderLocation, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	member := strconv.Itoa(riderID)
+
+	var positions []*redis.GeoPos
+	var seen float64
+	err := monitoring.RecordRedisTime("QueryRiderLocation", func() error {
+		var err error
+		if positions, err = rdb.GeoPos(ctx, riderGeoKey, member).Result(); err != nil {
+			return err
+		}
+		seen, err = rdb.ZScore(ctx, riderSeenKey, member).Result()
+		return err
+	})
+	if err == redis.Nil || (err == nil && (len(positions) == 0 || positions[0] == nil)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询骑手位置失败: %v", err)
+	}
+	return &models.RiderLocation{
+		RiderID:   riderID,
+		Latitude:  positions[0].Latitude,
+		Longitude: positions[0].Longitude,
+		UpdatedAt: time.Unix(int64(seen), 0),
+	}, nil
+}
+
+// QueryRiderTrack 查询骑手最近的定位点，按定位时间升序返回
+// 延迟到达的旧批次也会追加在列表头部，因此读取后按定位时间重新排序
+func QueryRiderTrack(rp *RedisPool, riderID int) ([]models.LocationPoint, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	var values []string
+	err := monitoring.RecordRedisTime("QueryRiderTrack", func() error {
+		var err error
+		values, err = rdb.LRange(ctx, riderTrackKey(riderID), 0, -1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("查询骑手轨迹失败: %v", err)
+	}
+
+	points := make([]models.LocationPoint, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		var point models.LocationPoint
+		if err := json.Unmarshal([]byte(values[i]), &point); err != nil {
+			continue
+		}
+		points = append(points, point)
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].RecordedAt.Before(points[j].RecordedAt) })
+	return points, nil
+}
+
+// RiderLocationsSince 查询 since 之后上报过定位的骑手及其当前位置，用于把位置快照写入数据库
+func RiderLocationsSince(rp *RedisPool, since time.Time) ([]models.RiderLocation, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+
+	var seen []redis.Z
+	err := monitoring.RecordRedisTime("RiderLocationsSince", func() error {
+		var err error
+		seen, err = rdb.ZRangeByScoreWithScores(ctx, riderSeenKey, &redis.ZRangeBy{
+			Min: strconv.FormatInt(since.Unix(), 10),
+			Max: "+inf",
+		}).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("查询骑手定位时间失败: %v", err)
+	}
+	if len(seen) == 0 {
+		return nil, nil
+	}
+
+	members := make([]string, len(seen))
+	for i, z := range seen {
+		members[i], _ = z.Member.(string)
+	}
+	var positions []*redis.GeoPos
+	err = monitoring.RecordRedisTime("GeoPos", func() error {
+		var err error
+		positions, err = rdb.GeoPos(ctx, riderGeoKey, members...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("查询骑手位置失败: %v", err)
+	}
+
+	locations := make([]models.RiderLocation, 0, len(seen))
+	for i, z := range seen {
+		riderID, err := strconv.Atoi(members[i])
+		if err != nil || positions[i] == nil {
+			continue
+		}
+		locations = append(locations, models.RiderLocation{
+			RiderID:   riderID,
+			Latitude:  positions[i].Latitude,
+			Longitude: positions[i].Longitude,
+			UpdatedAt: time.Unix(int64(z.Score), 0),
+		})
+	}
+	return locations, nil
+}
+
+// SweepStaleRiderLocations 把最近一次定位早于 before 的骑手移出位置索引，返回移出的数量
+func SweepStaleRiderLocations(rp *RedisPool, before time.Time, limit int) (int, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	var removed int
+	err := monitoring.RecordRedisTime("SweepStaleRiderLocations", func() error {
+		var err error
+		removed, err = sweepRiderLocationsScript.Run(ctx, rdb, []string{riderGeoKey, riderSeenKey}, before.Unix(), limit).Int()
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to sweep stale rider locations", logrus.Fields{"error": err})
+		return 0, fmt.Errorf("剔除过期骑手位置失败: %v", err)
+	}
+	return removed, nil
+}
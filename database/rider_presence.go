@@ -0,0 +1,142 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"take-out/logging"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// 在线骑手的心跳保存在有序集合 rider_heartbeats 中，成员为骑手ID，分值为最近一次心跳的 Unix 秒
+// 只有在线（含忙碌）的骑手在集合中：上线时加入，下线或心跳超时后移出
+const riderHeartbeatKey = "rider_heartbeats"
+
+// 骑手仍在集合中时刷新心跳时间，返回 1；已离线时返回 0
+var touchRiderHeartbeatScript = redis.NewScript(`
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// 领取心跳早于 ARGV[1] 的骑手并移出集合，每次最多 ARGV[2] 个；同一骑手只会被一个实例领取
+var claimSilentRidersScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+if #ids > 0 then
+	redis.call('ZREM', KEYS[1], unpack(ids))
+end
+return ids
+`)
+
+// RegisterRiderHeartbeat 骑手上线时记录心跳
+func RegisterRiderHeartbeat(rp *RedisPool, riderID int, now time.Time) error {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	err := monitoring.RecordRedisTime("RegisterRiderHeartbeat", func() error {
+		return rdb.ZAdd(ctx, riderHeartbeatKey, &redis.Z{Score: float64(now.Unix()), Member: strconv.Itoa(riderID)}).Err()
+	})
+	if err != nil {
+		logging.Error("Failed to register rider heartbeat", logrus.Fields{"error": err, "riderID": riderID})
+		return fmt.Errorf("记录骑手心跳失败: %v", err)
+	}
+	return nil
+}
+
+// TouchRiderHeartbeat 刷新在线骑手的心跳，骑手已离线（未上线或心跳超时）时返回 false
+func TouchRiderHeartbeat(rp *RedisPool, riderID int, now time.Time) (bool, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	var touched int
+	err := monitoring.RecordRedisTime("TouchRiderHeartbeat", func() error {
+		var err error
+		touched, err = touchRiderHeartbeatScript.Run(ctx, rdb, []string{riderHeartbeatKey}, strconv.Itoa(riderID), now.Unix()).Int()
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to touch rider heartbeat", logrus.Fields{"error": err, "riderID": riderID})
+		return false, fmt.Errorf("刷新骑手心跳失败: %v", err)
+	}
+	return touched == 1, nil
+}
+
+// RemoveRiderHeartbeat 骑手下线时移出心跳集合和位置索引
+func RemoveRiderHeartbeat(rp *RedisPool, riderID int) error {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	member := strconv.Itoa(riderID)
+	err := monitoring.RecordRedisTime("RemoveRiderHeartbeat", func() error {
+		_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZRem(ctx, riderHeartbeatKey, member)
+			pipe.ZRem(ctx, riderGeoKey, member)
+			pipe.ZRem(ctx, riderSeenKey, member)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to remove rider heartbeat", logrus.Fields{"error": err, "riderID": riderID})
+		return fmt.Errorf("移除骑手心跳失败: %v", err)
+	}
+	return nil
+}
+
+// ClaimSilentRiders 领取最近一次心跳早于 before 的骑手并移出心跳集合，调用方负责把他们标记为离线
+func ClaimSilentRiders(rp *RedisPool, before time.Time, limit int) ([]int, error) {
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	var members []string
+	err := monitoring.RecordRedisTime("ClaimSilentRiders", func() error {
+		var err error
+		members, err = claimSilentRidersScript.Run(ctx, rdb, []string{riderHeartbeatKey}, before.Unix(), limit).StringSlice()
+		return err
+	})
+	if err != nil {
+		logging.Error("Failed to claim silent riders", logrus.Fields{"error": err})
+		return nil, fmt.Errorf("领取心跳超时骑手失败: %v", err)
+	}
+
+	riderIDs := make([]int, 0, len(members))
+	for _, member := range members {
+		if riderID, err := strconv.Atoi(member); err == nil {
+			riderIDs = append(riderIDs, riderID)
+		}
+	}
+	return riderIDs, nil
+}
+
+// RidersWithoutHeartbeat 从 riderIDs 中找出不在心跳集合中的骑手，如 Redis 数据丢失后数据库中仍为在线的骑手
+func RidersWithoutHeartbeat(rp *RedisPool, riderIDs []int) ([]int, error) {
+	if len(riderIDs) == 0 {
+		return nil, nil
+	}
+	members := make([]string, len(riderIDs))
+	for i, id := range riderIDs {
+		members[i] = strconv.Itoa(id)
+	}
+
+	rdb := rp.GetClient()
+	defer rp.PutClient(rdb)
+	var scores []float64
+	err := monitoring.RecordRedisTime("RidersWithoutHeartbeat", func() error {
+		var err error
+		scores, err = rdb.ZMScore(ctx, riderHeartbeatKey, members...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("查询骑手心跳失败: %v", err)
+	}
+
+	var missing []int
+	for i, score := range scores {
+		// 不在集合中的成员分值为 0
+		if score == 0 {
+			missing = append(missing, riderIDs[i])
+		}
+	}
+	return missing, nil
+}
@@ -4,6 +4,7 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"take-out/logging"
 	"take-out/models"
@@ -159,7 +160,7 @@ func QueryNearbyShops(db *sql.DB, longitude, latitude float64) ([]models.Shop, e
 //查询商家的商品列表
 func QueryProductsByShopID(db *sql.DB, shopID int) ([]models.Product, error) {
 	logging.Info("Querying products by shop ID", logrus.Fields{"shopID": shopID})
-	query := "SELECT productid, productname, description, price, stock FROM products WHERE shopid = $1 ORDER BY productid"
+	query := "SELECT productid, productname, COALESCE(prodescription, ''), productprice, packaging_fee, stock FROM products WHERE shopid = $1 ORDER BY productid"
 	var rows *sql.Rows
 	var err error
 	err = monitoring.RecordDBTime("QueryProductsByShopID", func() error {
@@ -175,7 +176,7 @@ func QueryProductsByShopID(db *sql.DB, shopID int) ([]models.Product, error) {
 	var products []models.Product
 	for rows.Next() { //遍历每一行
 		var product models.Product
-		if err := rows.Scan(&product.ProductID, &product.ProductName, &product.Description, &product.Price, &product.Stock); err != nil {
+		if err := rows.Scan(&product.ProductID, &product.ProductName, &product.Description, &product.Price, &product.PackagingFee, &product.Stock); err != nil {
 			logging.Error("Failed to scan product row", logrus.Fields{"error": err})
 			return nil, err
 		}
@@ -215,3 +216,29 @@ func ValidateShop(db *sql.DB, shopphone, password string) (*models.Shop, error)
 	logging.Info("Successfully validated shop", logrus.Fields{"shopID": shop.ShopID})
 	return &shop, nil
 }
+
+var ErrShopNotFound = errors.New("商家不存在")
+
+// QueryShopDeliveryInfo 查询商家位置和配送半径，用于计算配送费
+func QueryShopDeliveryInfo(db *sql.DB, shopID int) (*models.Shop, error) {
+	var shop models.Shop
+	var latitude, longitude, radius sql.NullFloat64
+	err := monitoring.RecordDBTime("QueryShopDeliveryInfo", func() error {
+		query := `SELECT shopid, shopname, shoplatitude, shoplongitude, delivery_radius_km FROM shops WHERE shopid = $1`
+		return db.QueryRow(query, shopID).Scan(&shop.ShopID, &shop.ShopName, &latitude, &longitude, &radius)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrShopNotFound
+	}
+	if err != nil {
+		logging.Error("Failed to query shop delivery info", logrus.Fields{"error": err, "shopID": shopID})
+		return nil, fmt.Errorf("查询商家配送信息失败: %v", err)
+	}
+	if !latitude.Valid || !longitude.Valid {
+		return nil, fmt.Errorf("商家 %d 未设置位置", shopID)
+	}
+	shop.ShopLatitude = latitude.Float64
+	shop.ShopLongitude = longitude.Float64
+	shop.DeliveryRadiusKm = radius.Float64
+	return &shop, nil
+}
@@ -329,3 +329,18 @@ func ValidateRider(db *sql.DB, riderphone, password string) (*models.Rider, erro
 	logging.Info("Successfully validated rider", logrus.Fields{"riderID": rider.RiderID})
 	return &rider, nil
 }
+
+// QueryUserLocation 查询用户默认收货地址和坐标，ok 为 false 表示用户未设置坐标
+func QueryUserLocation(db *sql.DB, userID int) (address string, latitude, longitude float64, ok bool, err error) {
+	var addr sql.NullString
+	var lat, lon sql.NullFloat64
+	err = monitoring.RecordDBTime("QueryUserLocation", func() error {
+		query := `SELECT useraddress, userlatitude, userlongitude FROM users WHERE userid = $1`
+		return db.QueryRow(query, userID).Scan(&addr, &lat, &lon)
+	})
+	if err != nil {
+		logging.Error("Failed to query user location", logrus.Fields{"error": err, "userID": userID})
+		return "", 0, 0, false, fmt.Errorf("查询用户地址失败: %v", err)
+	}
+	return addr.String, lat.Float64, lon.Float64, lat.Valid && lon.Valid, nil
+}
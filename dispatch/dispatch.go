@@ -0,0 +1,114 @@
+// Package dispatch 负责骑手派单的打分排序：按到店距离、当前负载、评分和接单率为候选骑手打分，不依赖数据库和 Redis
+package dispatch
+
+import (
+	"math"
+	"sort"
+	"take-out/config"
+	"take-out/pricing"
+)
+
+// Weights 各项得分的权重，得分均归一化到 [0, 1]，总分为加权平均
+type Weights struct {
+	Distance   float64 // 距离商家越近得分越高
+	Load       float64 // 手上配送中的订单越少得分越高
+	Rating     float64 // 骑手评分（满分 5 分）
+	Acceptance float64 // 派单接单率
+}
+
+// Engine 派单打分引擎
+type Engine struct {
+	Weights  Weights
+	RadiusKm float64 // 只考虑距离商家该半径内的骑手
+	// 接单率的先验：新骑手按 PriorAccepted / PriorOffers 计算，派单次数越多越接近真实接单率
+	PriorAccepted float64
+	PriorOffers   float64
+}
+
+// LoadEngine 从环境变量读取派单规则，未配置的项使用默认值
+func LoadEngine() Engine {
+	return Engine{
+		Weights: Weights{
+			Distance:   config.Float("DISPATCH_WEIGHT_DISTANCE", 0.4),
+			Load:       config.Float("DISPATCH_WEIGHT_LOAD", 0.25),
+			Rating:     config.Float("DISPATCH_WEIGHT_RATING", 0.15),
+			Acceptance: config.Float("DISPATCH_WEIGHT_ACCEPTANCE", 0.2),
+		},
+		RadiusKm:      config.Float("DISPATCH_RADIUS_KM", 5),
+		PriorAccepted: 4,
+		PriorOffers:   5,
+	}
+}
+
+// Candidate 候选骑手
+type Candidate struct {
+	RiderID        int     `json:"rider_id"`
+	Latitude       float64 `json:"latitude"`
+	Longitude      float64 `json:"longitude"`
+	Rating         float64 `json:"rating"`          // 0-5
+	ActiveOrders   int     `json:"active_orders"`   // 配送中的订单数
+	OffersAccepted int     `json:"offers_accepted"` // 近期接受的派单数
+	OffersAnswered int     `json:"offers_answered"` // 近期已接受、拒绝或超时的派单数
+}
+
+// Scored 打分结果
+type Scored struct {
+	Candidate
+	DistanceKm     float64 `json:"distance_km"`
+	AcceptanceRate float64 `json:"acceptance_rate"`
+	Score          float64 `json:"score"`
+}
+
+// AcceptanceRate 带先验平滑的接单率，避免新骑手或派单次数很少的骑手得到 0 或 1 这样的极端值
+func (e Engine) AcceptanceRate(c Candidate) float64 {
+	offers := float64(c.OffersAnswered) + e.PriorOffers
+	if offers <= 0 {
+		return 1
+	}
+	return (float64(c.OffersAccepted) + e.PriorAccepted) / offers
+}
+
+// Score 计算候选骑手到商家的距离和总分，超出派单半径时 ok 为 false
+func (e Engine) Score(c Candidate, shopLat, shopLon float64) (Scored, bool) {
+	s := Scored{Candidate: c, DistanceKm: pricing.DistanceKm(shopLat, shopLon, c.Latitude, c.Longitude)}
+	if e.RadiusKm > 0 && s.DistanceKm > e.RadiusKm {
+		return s, false
+	}
+	s.AcceptanceRate = e.AcceptanceRate(c)
+
+	distance := 1.0
+	if e.RadiusKm > 0 {
+		distance = 1 - s.DistanceKm/e.RadiusKm
+	}
+	load := 1 / float64(1+c.ActiveOrders)
+	rating := clamp(c.Rating/5, 0, 1)
+
+	w := e.Weights
+	total := w.Distance + w.Load + w.Rating + w.Acceptance
+	if total <= 0 {
+		return s, true
+	}
+	s.Score = (w.Distance*distance + w.Load*load + w.Rating*rating + w.Acceptance*s.AcceptanceRate) / total
+	return s, true
+}
+
+// Rank 为候选骑手打分并按总分从高到低排序，超出派单半径的骑手被剔除；总分相同时距离近的优先
+func (e Engine) Rank(candidates []Candidate, shopLat, shopLon float64) []Scored {
+	ranked := make([]Scored, 0, len(candidates))
+	for _, c := range candidates {
+		if s, ok := e.Score(c, shopLat, shopLon); ok {
+			ranked = append(ranked, s)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].DistanceKm < ranked[j].DistanceKm
+	})
+	return ranked
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
@@ -0,0 +1,158 @@
+package dispatch
+
+import (
+	"math"
+	"testing"
+)
+
+const shopLat, shopLon = 31.23, 121.47
+
+// 纬度每 0.01 度约 1.11 公里
+func riderAt(riderID int, northKm float64) Candidate {
+	return Candidate{RiderID: riderID, Latitude: shopLat + northKm/111.195, Longitude: shopLon, Rating: 5}
+}
+
+func testEngine() Engine {
+	return Engine{
+		Weights:       Weights{Distance: 0.4, Load: 0.25, Rating: 0.15, Acceptance: 0.2},
+		RadiusKm:      5,
+		PriorAccepted: 4,
+		PriorOffers:   5,
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-3
+}
+
+func TestScoreRadius(t *testing.T) {
+	tests := []struct {
+		name     string
+		radiusKm float64
+		northKm  float64
+		ok       bool
+		distance float64 // 距离得分
+	}{
+		{"at the shop", 5, 0, true, 1},
+		{"half radius", 5, 2.5, true, 0.5},
+		{"just inside", 5, 4.99, true, 0.002},
+		{"just outside", 5, 5.01, false, 0},
+		{"far away", 5, 30, false, 0},
+		{"no radius limit", 0, 30, true, 1},
+	}
+	for _, tt := range tests {
+		e := testEngine()
+		e.RadiusKm = tt.radiusKm
+		// 只看距离得分
+		e.Weights = Weights{Distance: 1}
+		s, ok := e.Score(riderAt(1, tt.northKm), shopLat, shopLon)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v (distance %.3f km)", tt.name, ok, tt.ok, s.DistanceKm)
+			continue
+		}
+		if !near(s.DistanceKm, tt.northKm) {
+			t.Errorf("%s: DistanceKm = %.3f, want %.3f", tt.name, s.DistanceKm, tt.northKm)
+		}
+		if ok && !near(s.Score, tt.distance) {
+			t.Errorf("%s: Score = %.4f, want %.4f", tt.name, s.Score, tt.distance)
+		}
+	}
+}
+
+func TestAcceptanceRate(t *testing.T) {
+	tests := []struct {
+		name              string
+		prior             [2]float64 // PriorAccepted, PriorOffers
+		accepted, offered int
+		want              float64
+	}{
+		{"new rider gets the prior", [2]float64{4, 5}, 0, 0, 0.8},
+		{"one decline barely moves the rate", [2]float64{4, 5}, 0, 1, 4.0 / 6},
+		{"always accepts", [2]float64{4, 5}, 10, 10, 14.0 / 15},
+		{"never accepts", [2]float64{4, 5}, 0, 10, 4.0 / 15},
+		{"many offers approach the real rate", [2]float64{4, 5}, 500, 1000, 504.0 / 1005},
+		{"no prior and no offers", [2]float64{0, 0}, 0, 0, 1},
+		{"no prior", [2]float64{0, 0}, 3, 4, 0.75},
+	}
+	for _, tt := range tests {
+		e := testEngine()
+		e.PriorAccepted, e.PriorOffers = tt.prior[0], tt.prior[1]
+		c := Candidate{OffersAccepted: tt.accepted, OffersAnswered: tt.offered}
+		if got := e.AcceptanceRate(c); !near(got, tt.want) {
+			t.Errorf("%s: AcceptanceRate = %.4f, want %.4f", tt.name, got, tt.want)
+		}
+	}
+
+	// 新骑手的接单率得分高于从不接单的骑手，低于一直接单的骑手
+	e := testEngine()
+	newRider, _ := e.Score(riderAt(1, 1), shopLat, shopLon)
+	never := riderAt(2, 1)
+	never.OffersAnswered = 10
+	neverScored, _ := e.Score(never, shopLat, shopLon)
+	always := riderAt(3, 1)
+	always.OffersAccepted, always.OffersAnswered = 10, 10
+	alwaysScored, _ := e.Score(always, shopLat, shopLon)
+	if !(neverScored.Score < newRider.Score && newRider.Score < alwaysScored.Score) {
+		t.Errorf("scores never/new/always = %.4f/%.4f/%.4f, want increasing", neverScored.Score, newRider.Score, alwaysScored.Score)
+	}
+}
+
+func TestRank(t *testing.T) {
+	e := testEngine()
+	busy := riderAt(1, 0.5)
+	busy.ActiveOrders = 2
+	lowRated := riderAt(2, 1)
+	lowRated.Rating = 2
+	best := riderAt(3, 1)
+	outside := riderAt(4, 6)
+
+	ranked := e.Rank([]Candidate{busy, lowRated, best, outside}, shopLat, shopLon)
+	want := []int{3, 2, 1}
+	if len(ranked) != len(want) {
+		t.Fatalf("Rank returned %d riders, want %d", len(ranked), len(want))
+	}
+	for i, id := range want {
+		if ranked[i].RiderID != id {
+			t.Errorf("rank %d = rider %d, want rider %d", i, ranked[i].RiderID, id)
+		}
+	}
+	for i := 1; i < len(ranked); i++ {
+		if ranked[i].Score > ranked[i-1].Score {
+			t.Errorf("rank %d score %.4f > rank %d score %.4f", i, ranked[i].Score, i-1, ranked[i-1].Score)
+		}
+	}
+}
+
+func TestRankTieBreakOnDistance(t *testing.T) {
+	e := testEngine()
+	// 不计距离得分时，条件相同的骑手总分相同，距离近的排在前面
+	e.Weights.Distance = 0
+	ranked := e.Rank([]Candidate{riderAt(1, 3), riderAt(2, 1), riderAt(3, 2)}, shopLat, shopLon)
+	want := []int{2, 3, 1}
+	for i, id := range want {
+		if ranked[i].RiderID != id {
+			t.Errorf("rank %d = rider %d, want rider %d", i, ranked[i].RiderID, id)
+		}
+	}
+	if ranked[0].Score != ranked[2].Score {
+		t.Errorf("scores %.6f and %.6f should tie", ranked[0].Score, ranked[2].Score)
+	}
+}
+
+func TestZeroWeights(t *testing.T) {
+	e := testEngine()
+	e.Weights = Weights{}
+	s, ok := e.Score(riderAt(1, 2), shopLat, shopLon)
+	if !ok || s.Score != 0 || math.IsNaN(s.Score) {
+		t.Errorf("Score with zero weights = %v (ok %v), want 0", s.Score, ok)
+	}
+	if !near(s.AcceptanceRate, 0.8) {
+		t.Errorf("AcceptanceRate with zero weights = %.4f, want 0.8", s.AcceptanceRate)
+	}
+
+	// 总分都为 0 时按距离排序，超出半径的骑手仍被剔除
+	ranked := e.Rank([]Candidate{riderAt(1, 4), riderAt(2, 7), riderAt(3, 1)}, shopLat, shopLon)
+	if len(ranked) != 2 || ranked[0].RiderID != 3 || ranked[1].RiderID != 1 {
+		t.Errorf("Rank with zero weights = %+v, want riders 3, 1", ranked)
+	}
+}
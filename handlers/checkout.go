@@ -0,0 +1,406 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"take-out/database"
+	"take-out/models"
+	"take-out/orderno"
+	"take-out/response"
+	"time"
+)
+
+// 一次跨店结算最多包含的商家数量
+const maxCheckoutShops = 10
+
+// 合并订单标识，合并订单接口可以传合并订单ID或合并订单号，二者传其一即可
+type parentRef struct {
+	ParentID int    `json:"parent_id"`
+	ParentNo string `json:"parent_no"`
+}
+
+// 把合并订单号解析为合并订单ID并写回 ParentID，参数错误或合并订单不存在时直接写入错误响应
+func resolveParentRef(w http.ResponseWriter, db *sql.DB, ref *parentRef) bool {
+	ref.ParentNo = strings.TrimSpace(ref.ParentNo)
+	if ref.ParentNo == "" {
+		if ref.ParentID <= 0 {
+			response.ValidationError(w, "合并订单ID或合并订单号不能为空", "parent_id")
+			return false
+		}
+		return true
+	}
+	if err := orderno.Valid(ref.ParentNo); err != nil {
+		response.ValidationError(w, "合并订单号格式错误，请核对后重新输入", "parent_no")
+		return false
+	}
+	parentID, err := database.QueryParentIDByNo(db, ref.ParentNo)
+	if err != nil {
+		writeParentOrderError(w, err)
+		return false
+	}
+	if ref.ParentID != 0 && ref.ParentID != parentID {
+		response.ValidationError(w, "合并订单ID与合并订单号不是同一订单", "parent_no")
+		return false
+	}
+	ref.ParentID = parentID
+	return true
+}
+
+// 查询当前用户的合并订单，不存在或不属于该用户时直接写入错误响应
+func loadUserParentOrder(w http.ResponseWriter, db *sql.DB, parentID, userID int) (*models.ParentOrder, bool) {
+	parent, err := database.QueryParentOrder(db, parentID)
+	if err != nil {
+		writeParentOrderError(w, err)
+		return nil, false
+	}
+	if parent.UserID != userID {
+		response.Forbidden(w, "无权操作该合并订单")
+		return nil, false
+	}
+	return parent, true
+}
+
+// 跨店合并下单：一次结算为每个商家生成一个子订单，子订单各自接单、建群和配送，合并订单统一支付
+// POST /api/user/checkout {"delivery_address": "...", "delivery_latitude": 39.9, "delivery_longitude": 116.4,
+// "orders": [{"shop_id": 1, "items": [...], "notes": "少冰"}, {"shop_id": 2, "items": [...], "user_coupon_id": 3}]}
+func HandleCheckout(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var req struct {
+			DeliveryAddress   string         `json:"delivery_address"`
+			DeliveryLatitude  float64        `json:"delivery_latitude"`
+			DeliveryLongitude float64        `json:"delivery_longitude"`
+			Orders            []models.Order `json:"orders"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if len(req.Orders) == 0 {
+			response.ValidationError(w, "结算的商家订单不能为空", "orders")
+			return
+		}
+		if len(req.Orders) > maxCheckoutShops {
+			response.ValidationError(w, fmt.Sprintf("一次最多结算 %d 个商家的订单", maxCheckoutShops), "orders")
+			return
+		}
+
+		// 每个子订单按各自商家单独计价：配送费、打包费、服务费和店铺券互不影响
+		parent := &models.ParentOrder{UserID: userID}
+		children := make([]*models.Order, len(req.Orders))
+		breakdowns := make([]*models.PriceBreakdown, len(req.Orders))
+		shops := make(map[int]bool)
+		for i := range req.Orders {
+			child := &req.Orders[i]
+			child.UserID = userID
+			child.OrderStatus = models.OrderStatusAwaitingPayment
+			child.ParentID = 0
+			if child.DeliveryLatitude == 0 && child.DeliveryLongitude == 0 {
+				child.DeliveryLatitude, child.DeliveryLongitude = req.DeliveryLatitude, req.DeliveryLongitude
+			}
+			if child.DeliveryAddress == "" {
+				child.DeliveryAddress = req.DeliveryAddress
+			}
+
+			breakdown, ok := quoteOrder(w, db, child)
+			if !ok {
+				return
+			}
+			if shops[child.ShopID] {
+				response.ValidationError(w, "同一商家的商品请放在同一个子订单中", "orders.shop_id")
+				return
+			}
+			shops[child.ShopID] = true
+
+			child.PickupCode = ""
+			if child.FulfillmentType == models.FulfillmentPickup {
+				code, err := newPickupCode()
+				if err != nil {
+					response.ServerError(w, err)
+					return
+				}
+				child.PickupCode = code
+			}
+			children[i], breakdowns[i] = child, breakdown
+			parent.PayableAmount = parent.PayableAmount.Add(child.PayableAmount)
+		}
+
+		// 合并订单和子订单在同一事务中写入，任一子订单失败时整体回滚；订单号极少数情况下重复时重新生成
+		var err error
+		for attempt := 0; attempt < maxOrderNoAttempts; attempt++ {
+			if parent.ParentNo, err = orderNumbers.Next(); err != nil {
+				break
+			}
+			for _, child := range children {
+				if child.OrderNo, err = orderNumbers.Next(); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+			err = database.InsertParentOrder(db, parent, children)
+			if !errors.Is(err, database.ErrOrderNoConflict) {
+				break
+			}
+			log.Printf("订单号重复，重新生成: %s", parent.ParentNo)
+		}
+		if err != nil {
+			writeInsertOrderError(w, err)
+			return
+		}
+
+		// 子订单共用一个支付时限，超时未支付时由超时任务逐个取消
+		deadline := time.Now().Add(paymentTimeout)
+		summaries := make([]map[string]interface{}, len(children))
+		for i, child := range children {
+			database.SyncProductStockCache(rp, db, child.Items)
+			database.ScheduleOrderDeadline(rp, database.DeadlinePayment, child.OrderID, deadline)
+			summaries[i] = map[string]interface{}{
+				"order_id":         child.OrderID,
+				"order_no":         child.OrderNo,
+				"shop_id":          child.ShopID,
+				"fulfillment_type": child.FulfillmentType,
+				"pickup_code":      child.PickupCode,
+				"scheduled_at":     child.ScheduledAt,
+				"items":            child.Items,
+				"pricing":          breakdowns[i],
+			}
+		}
+
+		// 创建支付单失败不影响订单，用户可以通过 /checkout/pay 重新发起支付
+		p, err := createParentPayment(db, parent)
+		if err != nil {
+			log.Printf("创建合并订单支付单失败: %v", err)
+		}
+
+		response.Created(w, map[string]interface{}{
+			"parent_id":      parent.ParentID,
+			"parent_no":      parent.ParentNo,
+			"payable_amount": parent.PayableAmount,
+			"status":         models.ParentStatusAwaitingPayment,
+			"orders":         summaries,
+			"payment":        p,
+		}, "合并订单创建成功")
+	}
+}
+
+// 用户为待支付的合并订单发起支付：已有未完成的支付单时直接返回，上一次支付失败时创建新的支付单
+func HandleParentOrderPay(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var payRequest struct {
+			parentRef
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payRequest); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if !resolveParentRef(w, db, &payRequest.parentRef) {
+			return
+		}
+
+		parent, ok := loadUserParentOrder(w, db, payRequest.ParentID, userID)
+		if !ok {
+			return
+		}
+		// 子订单统一支付，只要有子订单已取消（如支付超时）就不能再支付
+		if parent.StatusCounts[models.OrderStatusAwaitingPayment] != len(parent.Orders) {
+			response.Conflict(w, "合并订单当前状态无需支付")
+			return
+		}
+
+		latest, err := database.QueryLatestParentPayment(db, parent.ParentID)
+		if err != nil && !errors.Is(err, database.ErrPaymentNotFound) {
+			response.ServerError(w, err)
+			return
+		}
+		if latest != nil && latest.Status == models.PaymentPending {
+			response.Success(w, latest, "支付单已创建")
+			return
+		}
+
+		p, err := createParentPayment(db, parent)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		response.Created(w, p, "支付单已创建")
+	}
+}
+
+// 查询合并订单：汇总状态、各子订单的状态和退款进度，以及合并订单的支付记录
+// GET /api/user/checkout/status?parent_id=1 或 ?parent_no=...
+func HandleParentOrderStatus(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		query := r.URL.Query()
+		ref := parentRef{ParentNo: query.Get("parent_no")}
+		if value := query.Get("parent_id"); value != "" {
+			parentID, err := strconv.Atoi(value)
+			if err != nil {
+				response.ValidationError(w, "合并订单ID格式错误", "parent_id")
+				return
+			}
+			ref.ParentID = parentID
+		}
+		if !resolveParentRef(w, db, &ref) {
+			return
+		}
+
+		parent, ok := loadUserParentOrder(w, db, ref.ParentID, userID)
+		if !ok {
+			return
+		}
+
+		var refunded models.Money
+		for i := range parent.Orders {
+			refunds, err := database.QueryOrderRefunds(db, parent.Orders[i].OrderID)
+			if err != nil {
+				response.ServerError(w, err)
+				return
+			}
+			parent.Orders[i].Refunds = refunds
+			for _, refund := range refunds {
+				if refund.Status == models.RefundSucceeded {
+					refunded = refunded.Add(refund.Amount)
+				}
+			}
+		}
+
+		p, err := database.QueryLatestParentPayment(db, parent.ParentID)
+		if err != nil && !errors.Is(err, database.ErrPaymentNotFound) {
+			response.ServerError(w, err)
+			return
+		}
+
+		response.Success(w, map[string]interface{}{
+			"parent":          parent,
+			"payment":         p,
+			"refunded_amount": refunded,
+		}, "获取合并订单成功")
+	}
+}
+
+// 取消合并订单：逐个取消尚未结束的子订单，已支付的子订单按各自状态退款（接单前自动退款，接单后需对应商家审核）
+// 已在配送中等不可取消的子订单保持不变，并在响应中返回原因
+func HandleCancelParentOrder(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var cancelRequest struct {
+			parentRef
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&cancelRequest); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if !resolveParentRef(w, db, &cancelRequest.parentRef) {
+			return
+		}
+
+		parent, ok := loadUserParentOrder(w, db, cancelRequest.ParentID, userID)
+		if !ok {
+			return
+		}
+
+		user := models.OrderActor{Role: models.RoleUser, ID: userID}
+		failures := make(map[string]string)
+		for _, child := range parent.Orders {
+			if child.OrderStatus == models.OrderStatusCompleted || child.OrderStatus == models.OrderStatusCancelled {
+				continue
+			}
+			if _, err := cancelOneOrder(db, rp, child.OrderID, "", user, cancelRequest.Reason); err != nil {
+				failures[child.OrderNo] = err.Error()
+			}
+		}
+
+		parent, err := database.QueryParentOrder(db, parent.ParentID)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		message := "合并订单已取消"
+		if len(failures) > 0 {
+			message = "部分子订单无法取消"
+		}
+		response.Success(w, map[string]interface{}{
+			"parent_id": parent.ParentID,
+			"parent_no": parent.ParentNo,
+			"status":    parent.Status,
+			"failures":  failures,
+		}, message)
+	}
+}
+
+// 合并订单统一支付，未支付的子订单被取消后，其余未支付的子订单也一起取消，避免合并订单只剩部分子订单可付
+// 已支付的子订单不在待支付状态，不受影响
+func cancelUnpaidSiblings(db *sql.DB, rp *database.RedisPool, order *models.Order, actor models.OrderActor, reason string) {
+	if order.ParentID == 0 {
+		return
+	}
+	orderIDs, err := database.QueryChildOrderIDs(db, order.ParentID)
+	if err != nil {
+		log.Printf("查询合并订单的子订单失败: %v", err)
+		return
+	}
+	for _, orderID := range orderIDs {
+		if orderID == order.OrderID {
+			continue
+		}
+		var transitionErr *models.TransitionError
+		if _, err := cancelOneOrder(db, rp, orderID, models.OrderStatusAwaitingPayment, actor, reason); err != nil && !errors.As(err, &transitionErr) {
+			log.Printf("取消合并订单的子订单 %d 失败: %v", orderID, err)
+		}
+	}
+}
+
+// 将合并订单相关错误映射为统一响应
+func writeParentOrderError(w http.ResponseWriter, err error) {
+	if errors.Is(err, database.ErrParentOrderNotFound) {
+		response.NotFound(w, err.Error())
+		return
+	}
+	writeOrderError(w, err)
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"math"
+	"take-out/config"
+	"take-out/dispatch"
+	"take-out/pricing"
+	"time"
+)
+
+// LoadConfig 从环境变量读取各接口和后台任务的配置，未配置的项使用默认值
+// 需在 config.Load 之后、注册路由和启动后台任务之前调用
+func LoadConfig() {
+	paymentTimeout = config.Duration("PAYMENT_TIMEOUT", 15*time.Minute)
+	orderAcceptTimeout = config.Duration("ORDER_ACCEPT_TIMEOUT", 10*time.Minute)
+	orderGrabTimeout = config.Duration("ORDER_GRAB_TIMEOUT", 5*time.Minute)
+	orderGrabMaxRebroadcasts = config.Int("ORDER_GRAB_MAX_REBROADCASTS", 3)
+	orderTimeoutPollInterval = config.Duration("ORDER_TIMEOUT_POLL_INTERVAL", 5*time.Second)
+
+	scheduledOrderLeadTime = config.Duration("SCHEDULED_ORDER_LEAD_TIME", 45*time.Minute)
+	scheduledOrderMaxDays = config.Int("SCHEDULED_ORDER_MAX_DAYS", 7)
+	scheduledOrderReconcileInterval = config.Duration("SCHEDULED_ORDER_RECONCILE_INTERVAL", time.Minute)
+
+	refundRetryAfter = config.Duration("REFUND_RETRY_AFTER", time.Minute)
+	refundRetryPollInterval = config.Duration("REFUND_RETRY_POLL_INTERVAL", 30*time.Second)
+
+	idempotencyTTL = config.Duration("IDEMPOTENCY_TTL", 24*time.Hour)
+	instanceLeaseTTL = config.Duration("ORDER_NO_INSTANCE_LEASE", 30*time.Second)
+	pricingEngine = pricing.LoadEngine()
+
+	dispatchEngine = dispatch.LoadEngine()
+	dispatchOfferTimeout = config.Duration("DISPATCH_OFFER_TIMEOUT", 30*time.Second)
+	dispatchMaxOffers = config.Int("DISPATCH_MAX_OFFERS", 3)
+	orderHallTTL = config.Duration("ORDER_HALL_TTL", time.Hour)
+
+	riderLocationStaleAfter = config.Duration("RIDER_LOCATION_STALE_AFTER", 2*time.Minute)
+	riderLocationSnapshotInterval = config.Duration("RIDER_LOCATION_SNAPSHOT_INTERVAL", 30*time.Second)
+	// 轨迹长度为 0 时 LTRIM 不再截断，配送上限为 0 时所有骑手都无法接单，两者至少为 1
+	riderTrackLength = config.IntBetween("RIDER_TRACK_LENGTH", 60, 1, math.MaxInt32)
+	riderMaxActiveOrders = config.IntBetween("RIDER_MAX_ACTIVE_ORDERS", 3, 1, math.MaxInt32)
+	riderHeartbeatTimeout = config.Duration("RIDER_HEARTBEAT_TIMEOUT", 90*time.Second)
+	riderPresencePollInterval = config.Duration("RIDER_PRESENCE_POLL_INTERVAL", 10*time.Second)
+}
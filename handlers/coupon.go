@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"take-out/database"
+	"take-out/models"
+	"take-out/pricing"
+	"take-out/response"
+)
+
+// 商家创建店铺优惠券；平台券没有对应的管理角色，直接写入 coupons 表（shop_id 为空）
+func HandleCreateCoupon(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
+			return
+		}
+
+		var coupon models.Coupon
+		if err := json.NewDecoder(r.Body).Decode(&coupon); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if coupon.Title == "" {
+			response.ValidationError(w, "优惠券名称不能为空", "title")
+			return
+		}
+		if coupon.PerUserLimit == 0 {
+			coupon.PerUserLimit = 1
+		}
+		if err := pricing.ValidateCoupon(coupon); err != nil {
+			response.ValidationError(w, err.Error(), "coupon_type")
+			return
+		}
+
+		// 店铺券只能限定本店商品
+		coupon.ShopID = shopID
+		for _, productID := range coupon.ProductIDs {
+			if !checkProductShop(db, int(productID), shopID) {
+				response.ValidationError(w, "限定商品必须属于本店", "product_ids")
+				return
+			}
+		}
+
+		if err := database.CreateCoupon(db, &coupon); err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		response.Created(w, coupon, "优惠券创建成功")
+	}
+}
+
+// 查询可领取的优惠券：平台券，以及指定 shop_id 时该商家的店铺券
+func HandleClaimableCoupons(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var shopID int
+		if shopIDStr := r.URL.Query().Get("shop_id"); shopIDStr != "" {
+			var err error
+			if shopID, err = strconv.Atoi(shopIDStr); err != nil {
+				response.ValidationError(w, "商家ID格式错误", "shop_id")
+				return
+			}
+		}
+
+		coupons, err := database.QueryClaimableCoupons(db, shopID)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		response.Success(w, coupons, "获取可领取优惠券成功")
+	}
+}
+
+// 用户领取优惠券
+func HandleClaimCoupon(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var claimRequest struct {
+			CouponID int `json:"coupon_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&claimRequest); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if claimRequest.CouponID == 0 {
+			response.ValidationError(w, "优惠券ID不能为空", "coupon_id")
+			return
+		}
+
+		userCoupon, err := database.ClaimCoupon(db, userID, claimRequest.CouponID)
+		if err != nil {
+			writeCouponError(w, err)
+			return
+		}
+		response.Created(w, userCoupon, "优惠券领取成功")
+	}
+}
+
+// 查询用户已领取的优惠券，可按 status=available/used 过滤
+func HandleUserCoupons(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		status := r.URL.Query().Get("status")
+		if status != "" && status != models.UserCouponAvailable && status != models.UserCouponUsed {
+			response.ValidationError(w, "优惠券状态无效", "status")
+			return
+		}
+
+		coupons, err := database.QueryUserCoupons(db, userID, status)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		response.Success(w, coupons, "获取我的优惠券成功")
+	}
+}
+
+// 检查商品是否属于该店铺
+func checkProductShop(db *sql.DB, productID, shopID int) bool {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE productid = $1 AND shopid = $2)", productID, shopID).Scan(&exists)
+	return err == nil && exists
+}
+
+// 将优惠券相关错误映射为统一响应
+func writeCouponError(w http.ResponseWriter, err error) {
+	var couponErr *pricing.CouponError
+	switch {
+	case errors.As(err, &couponErr):
+		response.ErrorWithDetails(w, couponErr.Error(), http.StatusUnprocessableEntity, couponErr.Reason, "COUPON_NOT_APPLICABLE")
+	case errors.Is(err, database.ErrCouponNotFound):
+		response.NotFound(w, err.Error())
+	case errors.Is(err, database.ErrCouponNotActive),
+		errors.Is(err, database.ErrCouponSoldOut),
+		errors.Is(err, database.ErrCouponClaimLimit),
+		errors.Is(err, database.ErrCouponUnavailable):
+		response.Conflict(w, err.Error())
+	default:
+		response.ServerError(w, err)
+	}
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"take-out/config"
+	"take-out/database"
+	"take-out/models"
+	"take-out/response"
+	"time"
+)
+
+// 商家新增或修改预约配送时段，slot_id 为空时新增
+// POST /api/shop/delivery_slot {"slot_id": 0, "start_time": "11:30", "end_time": "12:00", "capacity": 20, "is_active": true}
+func HandleSaveDeliverySlot(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
+			return
+		}
+
+		var req struct {
+			models.DeliverySlot
+			IsActive *bool `json:"is_active"` // 未传时默认启用
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		slot := req.DeliverySlot
+		slot.ShopID = shopID
+		slot.IsActive = req.IsActive == nil || *req.IsActive
+
+		start, err := time.Parse("15:04", slot.StartTime)
+		if err != nil {
+			response.ValidationError(w, "开始时间格式错误，应为 HH:MM", "start_time")
+			return
+		}
+		end, err := time.Parse("15:04", slot.EndTime)
+		if err != nil {
+			response.ValidationError(w, "结束时间格式错误，应为 HH:MM", "end_time")
+			return
+		}
+		if !end.After(start) {
+			response.ValidationError(w, "结束时间必须晚于开始时间", "end_time")
+			return
+		}
+		if slot.Capacity <= 0 {
+			response.ValidationError(w, "时段容量必须大于0", "capacity")
+			return
+		}
+
+		if err := database.SaveDeliverySlot(db, &slot); err != nil {
+			switch {
+			case errors.Is(err, database.ErrDeliverySlotNotFound):
+				response.NotFound(w, err.Error())
+			case errors.Is(err, database.ErrDeliverySlotOverlap):
+				response.Conflict(w, err.Error())
+			default:
+				response.ServerError(w, err)
+			}
+			return
+		}
+		response.Success(w, slot, "预约时段已保存")
+	}
+}
+
+// 商家查询本店的全部预约配送时段
+func HandleShopDeliverySlots(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.Error(w, "只支持 GET 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
+			return
+		}
+
+		slots, err := database.QueryShopDeliverySlots(db, shopID)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		response.Success(w, slots, "获取预约时段成功")
+	}
+}
+
+// 用户查询商家某一天可预约的时段及剩余名额，下单时把时段的 scheduled_at 原样传回
+// GET /api/user/delivery_slots?shop_id=1&date=2024-10-18
+func HandleAvailableDeliverySlots(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.Error(w, "只支持 GET 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		shopID, err := strconv.Atoi(r.URL.Query().Get("shop_id"))
+		if err != nil || shopID <= 0 {
+			response.ValidationError(w, "商家ID格式错误", "shop_id")
+			return
+		}
+		day := time.Now()
+		if date := r.URL.Query().Get("date"); date != "" {
+			if day, err = time.ParseInLocation("2006-01-02", date, config.Location); err != nil {
+				response.ValidationError(w, "日期格式错误，应为 YYYY-MM-DD", "date")
+				return
+			}
+		}
+
+		slots, err := database.QueryAvailableDeliverySlots(db, shopID, day)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		// 已来不及备餐的时段不再返回
+		earliest := time.Now().Add(scheduledOrderLeadTime)
+		available := make([]models.AvailableSlot, 0, len(slots))
+		for _, slot := range slots {
+			if slot.ScheduledAt.After(earliest) {
+				available = append(available, slot)
+			}
+		}
+		response.Success(w, available, "获取可预约时段成功")
+	}
+}
+
+// 校验预约送达时间：需晚于当前时间加备餐提前量、不超过最多可提前预约的天数，并落在商家启用的配送时段内
+// 通过后写入订单的配送时段和通知商家的时间；未预约的订单清空这些字段。出错时直接写入错误响应
+func resolveScheduledDelivery(w http.ResponseWriter, db *sql.DB, order *models.Order) bool {
+	order.DeliverySlotID = 0
+	order.ReleaseAt = nil
+	if order.ScheduledAt == nil || order.ScheduledAt.IsZero() {
+		order.ScheduledAt = nil
+		return true
+	}
+
+	scheduledAt := *order.ScheduledAt
+	now := time.Now()
+	if !scheduledAt.After(now.Add(scheduledOrderLeadTime)) {
+		response.ValidationError(w, fmt.Sprintf("预约送达时间至少需要在 %d 分钟之后", int(scheduledOrderLeadTime.Minutes())), "scheduled_at")
+		return false
+	}
+	if scheduledAt.After(now.AddDate(0, 0, scheduledOrderMaxDays)) {
+		response.ValidationError(w, fmt.Sprintf("最多只能提前 %d 天预约", scheduledOrderMaxDays), "scheduled_at")
+		return false
+	}
+
+	slot, err := database.QueryDeliverySlotAt(db, order.ShopID, scheduledAt)
+	if err != nil {
+		if errors.Is(err, database.ErrDeliverySlotNotFound) {
+			response.ValidationError(w, "商家在该时间不接受预约", "scheduled_at")
+		} else {
+			response.ServerError(w, err)
+		}
+		return false
+	}
+
+	releaseAt := scheduledAt.Add(-scheduledOrderLeadTime)
+	order.DeliverySlotID = slot.SlotID
+	order.ReleaseAt = &releaseAt
+	return true
+}
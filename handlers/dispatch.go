@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"take-out/database"
+	"take-out/dispatch"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"take-out/response"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 派单配置，由 LoadConfig 从环境变量读取
+var (
+	dispatchEngine       dispatch.Engine
+	dispatchOfferTimeout time.Duration // 骑手答复派单的时限
+	dispatchMaxOffers    int           // 每个订单最多派给几位骑手，之后进入公共大厅
+)
+
+const (
+	// 计算骑手接单率时统计的派单时间范围
+	dispatchAcceptanceWindow = 30 * 24 * time.Hour
+	// 每次派单最多从离商家最近的多少位骑手中挑选
+	dispatchNearbyLimit = 50
+)
+
+// 跑腿订单发布后开始派单：先设置答复超时任务作为兜底（服务在派单前重启时由超时任务继续派单），再异步派给得分最高的骑手
+func startDispatch(db *sql.DB, rp *database.RedisPool, orderID int) {
+	database.ScheduleOrderDeadline(rp, database.DeadlineDispatchOffer, orderID, time.Now().Add(dispatchOfferTimeout))
+	go advanceDispatch(db, rp, orderID)
+}
+
+// 推进订单的派单：关闭已超时的派单，派给下一位得分最高的骑手；没有合适的骑手或派单次数用完时进入公共大厅
+// 由发布订单、骑手拒绝和答复超时触发，重复调用是安全的：订单已有未超时的派单时只顺延超时任务
+func advanceDispatch(db *sql.DB, rp *database.RedisPool, orderID int) {
+	order, err := database.QueryOrderStatus(db, orderID)
+	if err != nil {
+		if errors.Is(err, database.ErrOrderNotFound) {
+			database.RemoveOrderDeadline(rp, database.DeadlineDispatchOffer, orderID)
+		}
+		logging.Error("Failed to query order for dispatch", logrus.Fields{"error": err, "orderID": orderID})
+		return
+	}
+	if order.OrderStatus != models.OrderStatusPublished {
+		// 已有骑手接单或订单已取消
+		withdrawDispatch(db, rp, orderID)
+		return
+	}
+
+	expired, err := database.ExpireDispatchOffers(db, orderID)
+	if err != nil {
+		return
+	}
+	for _, offer := range expired {
+		notifyRiderOffer(rp, "dispatch_offer_expired", &offer)
+		monitoring.DispatchOffersTotal.WithLabelValues(models.OfferExpired).Inc()
+	}
+
+	open, err := database.QueryOpenDispatchOffer(db, orderID)
+	if err != nil {
+		logging.Error("Failed to query open dispatch offer", logrus.Fields{"error": err, "orderID": orderID})
+		return
+	}
+	if open != nil {
+		database.ScheduleOrderDeadline(rp, database.DeadlineDispatchOffer, orderID, open.ExpiresAt)
+		return
+	}
+
+	offers, err := database.CountDispatchOffers(db, orderID)
+	if err != nil {
+		logging.Error("Failed to count dispatch offers", logrus.Fields{"error": err, "orderID": orderID})
+		return
+	}
+	if offers >= dispatchMaxOffers {
+		dispatchToHall(db, rp, order)
+		return
+	}
+
+	shop, err := database.QueryShopDeliveryInfo(db, order.ShopID)
+	if err != nil {
+		logging.Error("Failed to query shop for dispatch", logrus.Fields{"error": err, "orderID": orderID})
+		return
+	}
+	nearby, err := database.NearbyRiders(rp, shop.ShopLatitude, shop.ShopLongitude, dispatchEngine.RadiusKm, dispatchNearbyLimit, time.Now().Add(-riderLocationStaleAfter))
+	if err != nil {
+		return
+	}
+	candidates, err := database.QueryDispatchCandidates(db, orderID, nearby, time.Now().Add(-dispatchAcceptanceWindow))
+	if err != nil {
+		return
+	}
+	ranked := dispatchEngine.Rank(candidates, shop.ShopLatitude, shop.ShopLongitude)
+	if len(ranked) == 0 {
+		dispatchToHall(db, rp, order)
+		return
+	}
+
+	best := ranked[0]
+	offer := &models.DispatchOffer{
+		OrderID:    orderID,
+		RiderID:    best.RiderID,
+		Score:      best.Score,
+		DistanceKm: best.DistanceKm,
+		ExpiresAt:  time.Now().Add(dispatchOfferTimeout),
+	}
+	if err := database.CreateDispatchOffer(db, offer); err != nil {
+		// 并发的派单已为该订单派出，由超时任务继续跟进
+		if !errors.Is(err, database.ErrOfferConflict) {
+			logging.Error("Failed to create dispatch offer", logrus.Fields{"error": err, "orderID": orderID})
+		}
+		return
+	}
+	database.ScheduleOrderDeadline(rp, database.DeadlineDispatchOffer, orderID, offer.ExpiresAt)
+	notifyRiderOffer(rp, "dispatch_offer", offer)
+	monitoring.DispatchOffersTotal.WithLabelValues(models.OfferOffered).Inc()
+	logging.Info("Order offered to rider", logrus.Fields{"orderID": orderID, "riderID": offer.RiderID, "score": offer.Score})
+}
+
+// 派单未成功，订单进入公共大厅供附近骑手抢单，无人抢单时由超时任务重新广播
+func dispatchToHall(db *sql.DB, rp *database.RedisPool, order *models.Order) {
+	orderID := order.OrderID
+	database.RemoveOrderDeadline(rp, database.DeadlineDispatchOffer, orderID)
+	if err := publishToHall(db, rp, order); err != nil {
+		logging.Error("Failed to publish order to public hall", logrus.Fields{"error": err, "orderID": orderID})
+	}
+	database.ScheduleOrderDeadline(rp, database.DeadlineRiderGrab, orderID, time.Now().Add(orderGrabTimeout))
+	monitoring.DispatchOffersTotal.WithLabelValues("hall").Inc()
+	logging.Info("Order dispatched to public hall", logrus.Fields{"orderID": orderID})
+}
+
+// 订单已被抢走或已取消时撤回待答复的派单并通知骑手，同时移除派单超时任务
+func withdrawDispatch(db *sql.DB, rp *database.RedisPool, orderID int) {
+	database.RemoveOrderDeadline(rp, database.DeadlineDispatchOffer, orderID)
+	offers, err := database.WithdrawDispatchOffers(db, orderID)
+	if err != nil {
+		return
+	}
+	for _, offer := range offers {
+		notifyRiderOffer(rp, "dispatch_offer_withdrawn", &offer)
+		monitoring.DispatchOffersTotal.WithLabelValues(models.OfferWithdrawn).Inc()
+	}
+}
+
+// 通过骑手频道推送派单及其变化
+func notifyRiderOffer(rp *database.RedisPool, kind string, offer *models.DispatchOffer) {
+	notification := map[string]interface{}{
+		"type":        kind,
+		"offer_id":    offer.OfferID,
+		"order_id":    offer.OrderID,
+		"distance_km": offer.DistanceKm,
+		"expires_at":  offer.ExpiresAt.Unix(),
+		"timestamp":   time.Now().Unix(),
+	}
+	notifJSON, _ := json.Marshal(notification)
+	if err := database.PublishMessage(rp, fmt.Sprintf("rider_%d", offer.RiderID), string(notifJSON)); err != nil {
+		logging.Warn("Failed to notify rider of dispatch offer", logrus.Fields{"error": err, "riderID": offer.RiderID, "offerID": offer.OfferID})
+	}
+}
+
+// 派单答复超时：派给下一位骑手或进入公共大厅
+func handleDispatchTimeouts(db *sql.DB, rp *database.RedisPool) {
+	orderIDs, err := database.ClaimDueOrderDeadlines(rp, database.DeadlineDispatchOffer, time.Now(), orderTimeoutLease, orderTimeoutBatchLimit)
+	if err != nil {
+		logging.Error("Failed to claim dispatch timeouts", logrus.Fields{"error": err})
+		return
+	}
+	for _, orderID := range orderIDs {
+		advanceDispatch(db, rp, orderID)
+	}
+}
+
+// 骑手答复派单：accept 接受后订单进入配送中，decline 拒绝后立即派给下一位骑手
+// 派单通过骑手频道 rider_<id> 推送，超时未答复视为拒绝
+// POST /api/rider/offer/respond {"offer_id": 1, "action": "accept"}
+func HandleRespondDispatchOffer(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		riderID, ok := r.Context().Value("riderID").(int)
+		if !ok || riderID == 0 {
+			response.Unauthorized(w, "无效的骑手身份")
+			return
+		}
+
+		var req struct {
+			OfferID int    `json:"offer_id"`
+			Action  string `json:"action"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if req.OfferID == 0 {
+			response.ValidationError(w, "派单ID不能为空", "offer_id")
+			return
+		}
+
+		switch req.Action {
+		case "accept":
+			offer, err := database.AcceptDispatchOfferTx(db, req.OfferID, riderID, riderMaxActiveOrders)
+			if err != nil {
+				writeDispatchOfferError(w, err)
+				return
+			}
+			invalidateOrderCache(rp, offer.OrderID)
+			database.RemoveOrderDeadline(rp, database.DeadlineDispatchOffer, offer.OrderID)
+			removeFromHall(rp, offer.OrderID)
+			monitoring.DispatchOffersTotal.WithLabelValues(models.OfferAccepted).Inc()
+			response.Success(w, map[string]interface{}{
+				"offer_id": offer.OfferID,
+				"order_id": offer.OrderID,
+				"status":   models.OrderStatusDelivering,
+			}, "已接单")
+		case "decline":
+			offer, err := database.DeclineDispatchOffer(db, req.OfferID, riderID)
+			if err != nil {
+				writeDispatchOfferError(w, err)
+				return
+			}
+			monitoring.DispatchOffersTotal.WithLabelValues(models.OfferDeclined).Inc()
+			go advanceDispatch(db, rp, offer.OrderID)
+			response.Success(w, map[string]interface{}{
+				"offer_id": offer.OfferID,
+				"order_id": offer.OrderID,
+				"status":   offer.Status,
+			}, "已拒绝派单")
+		default:
+			response.ValidationError(w, "action 只能是 accept 或 decline", "action")
+		}
+	}
+}
+
+// 将派单相关错误映射为统一响应，订单已被他人接单或已取消时返回 409
+func writeDispatchOfferError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrOfferNotFound):
+		response.NotFound(w, err.Error())
+	case errors.Is(err, database.ErrOfferClosed):
+		response.Conflict(w, err.Error())
+	default:
+		writeOrderError(w, err)
+	}
+}
@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"take-out/database"
+	"take-out/models"
+	"take-out/response"
+	"time"
+)
+
+// 分享码字符集，去掉了容易混淆的 0/O、1/I/L
+const shareCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+const (
+	shareCodeLength          = 8
+	maxShareCodeAttempts     = 3
+	maxGroupCartItemQuantity = 99
+)
+
+// 生成拼单分享码，使用 crypto/rand 避免被他人猜中后加入拼单
+func newShareCode() (string, error) {
+	var b strings.Builder
+	size := big.NewInt(int64(len(shareCodeAlphabet)))
+	for i := 0; i < shareCodeLength; i++ {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", fmt.Errorf("生成分享码失败: %v", err)
+		}
+		b.WriteByte(shareCodeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// 拼单的分享链接，参与者打开后即可查看拼单并加购
+func groupCartShareLink(shareCode string) string {
+	return "/api/user/group_cart/detail?share_code=" + shareCode
+}
+
+// 按分享码查询拼单，分享码为空或拼单不存在时直接写入错误响应；分享码不区分大小写
+func loadGroupCart(w http.ResponseWriter, db *sql.DB, shareCode string) (*models.GroupCart, bool) {
+	shareCode = strings.ToUpper(strings.TrimSpace(shareCode))
+	if shareCode == "" {
+		response.ValidationError(w, "分享码不能为空", "share_code")
+		return nil, false
+	}
+	cart, err := database.QueryGroupCartByCode(db, shareCode)
+	if err != nil {
+		writeGroupCartError(w, err)
+		return nil, false
+	}
+	return cart, true
+}
+
+// 发起拼单：为一个商家创建拼单购物车，返回分享码和分享链接，发起人自己也可以加购
+// POST /api/user/group_cart {"shop_id": 1}
+func HandleCreateGroupCart(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var req struct {
+			ShopID int `json:"shop_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if req.ShopID == 0 {
+			response.ValidationError(w, "商家ID不能为空", "shop_id")
+			return
+		}
+		if _, err := database.QueryShopDeliveryInfo(db, req.ShopID); err != nil {
+			if errors.Is(err, database.ErrShopNotFound) {
+				response.NotFound(w, err.Error())
+			} else {
+				response.ServerError(w, err)
+			}
+			return
+		}
+
+		cart := &models.GroupCart{HostUserID: userID, ShopID: req.ShopID}
+		var err error
+		for attempt := 0; attempt < maxShareCodeAttempts; attempt++ {
+			if cart.ShareCode, err = newShareCode(); err != nil {
+				break
+			}
+			err = database.CreateGroupCart(db, cart)
+			if !errors.Is(err, database.ErrGroupCartCodeConflict) {
+				break
+			}
+		}
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		cart.Items, cart.Shares = []models.GroupCartItem{}, []models.GroupCartShare{}
+
+		response.Created(w, map[string]interface{}{
+			"cart":       cart,
+			"share_code": cart.ShareCode,
+			"share_link": groupCartShareLink(cart.ShareCode),
+		}, "拼单创建成功，请把分享码发给同事")
+	}
+}
+
+// 查看拼单：全部参与者的商品和每个人的金额，提交后返回订单和分账明细
+// GET /api/user/group_cart/detail?share_code=...
+func HandleGroupCartDetail(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.Error(w, "只支持 GET 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		cart, ok := loadGroupCart(w, db, r.URL.Query().Get("share_code"))
+		if !ok {
+			return
+		}
+		response.Success(w, map[string]interface{}{
+			"cart":    cart,
+			"is_host": cart.HostUserID == userID,
+		}, "查询成功")
+	}
+}
+
+// 参与者用自己的账号加购：设置本人某件商品的数量，数量为 0 时移出；拼单锁定后不能再修改
+// POST /api/user/group_cart/item {"share_code": "...", "product_id": 1, "quantity": 2}
+func HandleSetGroupCartItem(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var req struct {
+			ShareCode string `json:"share_code"`
+			ProductID int    `json:"product_id"`
+			Quantity  int    `json:"quantity"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if req.ProductID == 0 {
+			response.ValidationError(w, "商品ID不能为空", "product_id")
+			return
+		}
+		if req.Quantity < 0 || req.Quantity > maxGroupCartItemQuantity {
+			response.ValidationError(w, fmt.Sprintf("商品数量须在 0 到 %d 之间", maxGroupCartItemQuantity), "quantity")
+			return
+		}
+
+		cart, ok := loadGroupCart(w, db, req.ShareCode)
+		if !ok {
+			return
+		}
+		if err := database.SetGroupCartItem(db, cart.CartID, userID, req.ProductID, req.Quantity); err != nil {
+			writeGroupCartError(w, err)
+			return
+		}
+
+		cart, ok = loadGroupCart(w, db, cart.ShareCode)
+		if !ok {
+			return
+		}
+		response.Success(w, map[string]interface{}{"cart": cart}, "拼单已更新")
+	}
+}
+
+// 发起人锁定拼单，锁定后参与者不能再加购；{"locked": false} 重新开放
+// POST /api/user/group_cart/lock {"share_code": "..."}
+func HandleLockGroupCart(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var req struct {
+			ShareCode string `json:"share_code"`
+			Locked    *bool  `json:"locked"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		locked := req.Locked == nil || *req.Locked
+
+		cart, ok := loadGroupCart(w, db, req.ShareCode)
+		if !ok {
+			return
+		}
+		if cart.HostUserID != userID {
+			response.Forbidden(w, "只有发起人可以锁定拼单")
+			return
+		}
+		if locked && len(cart.Items) == 0 {
+			writeGroupCartError(w, database.ErrGroupCartEmpty)
+			return
+		}
+		if err := database.SetGroupCartLocked(db, cart.CartID, locked); err != nil {
+			writeGroupCartError(w, err)
+			return
+		}
+
+		cart, ok = loadGroupCart(w, db, cart.ShareCode)
+		if !ok {
+			return
+		}
+		message := "拼单已锁定"
+		if !locked {
+			message = "拼单已重新开放"
+		}
+		response.Success(w, map[string]interface{}{"cart": cart}, message)
+	}
+}
+
+// 发起人取消尚未提交的拼单
+// POST /api/user/group_cart/cancel {"share_code": "..."}
+func HandleCancelGroupCart(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var req struct {
+			ShareCode string `json:"share_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+
+		cart, ok := loadGroupCart(w, db, req.ShareCode)
+		if !ok {
+			return
+		}
+		if cart.HostUserID != userID {
+			response.Forbidden(w, "只有发起人可以取消拼单")
+			return
+		}
+		if err := database.CancelGroupCart(db, cart.CartID); err != nil {
+			writeGroupCartError(w, err)
+			return
+		}
+
+		response.Success(w, map[string]interface{}{
+			"share_code": cart.ShareCode,
+			"status":     models.GroupCartCancelled,
+		}, "拼单已取消")
+	}
+}
+
+// 发起人提交已锁定的拼单：全部参与者的商品合并为一个订单、一次配送，由发起人支付
+// 订单按普通下单流程计价（配送地址、优惠券、预约、自取与 /order 相同），同时按参与者保存分账明细
+// POST /api/user/group_cart/submit {"share_code": "...", "delivery_address": "...", "delivery_latitude": 39.9, "delivery_longitude": 116.4}
+func HandleSubmitGroupCart(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var req struct {
+			ShareCode string `json:"share_code"`
+			models.Order
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+
+		cart, ok := loadGroupCart(w, db, req.ShareCode)
+		if !ok {
+			return
+		}
+		if cart.HostUserID != userID {
+			response.Forbidden(w, "只有发起人可以提交拼单")
+			return
+		}
+		switch {
+		case cart.Status == models.GroupCartOpen:
+			writeGroupCartError(w, database.ErrGroupCartNotLocked)
+			return
+		case cart.Status != models.GroupCartLocked:
+			writeGroupCartError(w, database.ErrGroupCartClosed)
+			return
+		case len(cart.Items) == 0:
+			writeGroupCartError(w, database.ErrGroupCartEmpty)
+			return
+		}
+
+		// 拼单的商品合并为订单明细，商家以拼单为准
+		order := req.Order
+		order.UserID = userID
+		order.ShopID = cart.ShopID
+		order.ParentID = 0
+		order.OrderStatus = models.OrderStatusAwaitingPayment
+		order.Items = cart.OrderItems()
+
+		breakdown, ok := quoteOrder(w, db, &order)
+		if !ok {
+			return
+		}
+
+		// 参与者的商品按订单明细的价格快照计价，再按订单价格明细拆分每个人的金额
+		prices := make(map[int]models.OrderItem, len(order.Items))
+		for _, item := range order.Items {
+			prices[item.ProductID] = item
+		}
+		for i := range cart.Items {
+			item := &cart.Items[i]
+			price := prices[item.ProductID]
+			item.ProductName = price.ProductName
+			item.UnitPrice = price.UnitPrice
+			item.PackagingFee = price.PackagingFee
+			item.Subtotal = price.UnitPrice.Mul(item.Quantity)
+		}
+		cart.Shares = models.SplitBill(cart.Items, *breakdown)
+
+		order.PickupCode = ""
+		if order.FulfillmentType == models.FulfillmentPickup {
+			code, err := newPickupCode()
+			if err != nil {
+				response.ServerError(w, err)
+				return
+			}
+			order.PickupCode = code
+		}
+
+		// 订单和拼单状态在同一事务中写入，拼单不会被重复提交；订单号极少数情况下重复时重新生成
+		var err error
+		for attempt := 0; attempt < maxOrderNoAttempts; attempt++ {
+			if order.OrderNo, err = orderNumbers.Next(); err != nil {
+				break
+			}
+			err = database.SubmitGroupCart(db, cart, &order)
+			if !errors.Is(err, database.ErrOrderNoConflict) {
+				break
+			}
+			log.Printf("订单号重复，重新生成: %s", order.OrderNo)
+		}
+		if err != nil {
+			writeGroupCartError(w, err)
+			return
+		}
+
+		database.SyncProductStockCache(rp, db, order.Items)
+		database.ScheduleOrderDeadline(rp, database.DeadlinePayment, order.OrderID, time.Now().Add(paymentTimeout))
+
+		// 创建支付单失败不影响订单，发起人可以通过 /order/pay 重新发起支付
+		p, err := createPayment(db, &order)
+		if err != nil {
+			log.Printf("创建支付单失败: %v", err)
+		}
+
+		response.Created(w, map[string]interface{}{
+			"share_code":       cart.ShareCode,
+			"order_id":         order.OrderID,
+			"order_no":         order.OrderNo,
+			"fulfillment_type": order.FulfillmentType,
+			"pickup_code":      order.PickupCode,
+			"items":            order.Items,
+			"pricing":          breakdown,
+			"status":           order.OrderStatus,
+			"scheduled_at":     order.ScheduledAt,
+			"shares":           cart.Shares,
+			"payment":          p,
+		}, "拼单已提交")
+	}
+}
+
+// 将拼单相关错误映射为统一响应，提交时的下单错误沿用下单接口的响应
+func writeGroupCartError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrGroupCartNotFound), errors.Is(err, database.ErrProductNotFound):
+		response.NotFound(w, err.Error())
+	case errors.Is(err, database.ErrMixedShopItems):
+		response.ValidationError(w, "只能加购拼单商家的商品", "product_id")
+	case errors.Is(err, database.ErrGroupCartClosed),
+		errors.Is(err, database.ErrGroupCartNotLocked),
+		errors.Is(err, database.ErrGroupCartEmpty),
+		errors.Is(err, database.ErrGroupCartChanged):
+		response.Conflict(w, err.Error())
+	default:
+		writeInsertOrderError(w, err)
+	}
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"take-out/database"
+	"take-out/logging"
+	"take-out/response"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	idempotencyHeader    = "Idempotency-Key"
+	idempotencyMaxKeyLen = 128
+	idempotencyLockTTL   = time.Minute // 首个请求处理期间占用幂等键的时长，进程崩溃后可重试
+)
+
+var idempotencyTTL time.Duration // 幂等键保存时长，由 LoadConfig 读取
+
+// IdempotencyMiddleware 为改变状态的 POST 接口提供 Idempotency-Key 支持
+// 相同身份、相同接口、相同幂等键的重试请求直接重放首次的响应；幂等键相同但请求体不同时拒绝
+// 未携带 Idempotency-Key 的请求不受影响
+func IdempotencyMiddleware(rp *database.RedisPool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			idempotencyKey := r.Header.Get(idempotencyHeader)
+			if idempotencyKey == "" || r.Method != http.MethodPost {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(idempotencyKey) > idempotencyMaxKeyLen {
+				response.ValidationError(w, "Idempotency-Key 过长", idempotencyHeader)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				response.BadRequest(w, "请求格式错误", "无法读取请求体")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			// 幂等键按调用方身份和接口隔离，不同用户使用相同的键互不影响
+			key := fmt.Sprintf("idempotency:%s:%s:%s", requestActor(r), r.URL.Path, idempotencyKey)
+			fingerprint := requestFingerprint(r, body)
+
+			record, err := database.ReserveIdempotencyKey(rp, key, fingerprint, idempotencyLockTTL)
+			if err != nil {
+				response.ServerError(w, err)
+				return
+			}
+			if record != nil {
+				switch {
+				case record.Fingerprint != fingerprint:
+					response.ErrorWithDetails(w, "Idempotency-Key 已被用于不同的请求", http.StatusUnprocessableEntity, idempotencyHeader, "IDEMPOTENCY_KEY_REUSED")
+				case !record.Completed:
+					response.Conflict(w, "相同 Idempotency-Key 的请求正在处理中")
+				default:
+					replayIdempotentResponse(w, record)
+				}
+				return
+			}
+
+			recorder := &idempotencyRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+
+			// 服务端错误不保存结果，释放幂等键让客户端可以重试
+			if recorder.statusCode >= http.StatusInternalServerError {
+				if err := database.DeleteFromCache(rp, key); err != nil {
+					logging.Warn("Failed to release idempotency key", logrus.Fields{"error": err, "key": key})
+				}
+				return
+			}
+			database.SaveIdempotencyRecord(rp, key, &database.IdempotencyRecord{
+				Fingerprint: fingerprint,
+				Completed:   true,
+				StatusCode:  recorder.statusCode,
+				ContentType: recorder.Header().Get("Content-Type"),
+				Body:        recorder.body.String(),
+			}, idempotencyTTL)
+		})
+	}
+}
+
+// 重放首次请求的响应
+func replayIdempotentResponse(w http.ResponseWriter, record *database.IdempotencyRecord) {
+	if record.ContentType != "" {
+		w.Header().Set("Content-Type", record.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write([]byte(record.Body))
+}
+
+// 从认证中间件写入的上下文中取出调用方身份
+func requestActor(r *http.Request) string {
+	if userID, ok := r.Context().Value("userID").(int); ok && userID != 0 {
+		return fmt.Sprintf("user_%d", userID)
+	}
+	if shopID, ok := r.Context().Value("shopID").(int); ok && shopID != 0 {
+		return fmt.Sprintf("shop_%d", shopID)
+	}
+	if riderID, ok := r.Context().Value("riderID").(int); ok && riderID != 0 {
+		return fmt.Sprintf("rider_%d", riderID)
+	}
+	return "anonymous"
+}
+
+// 请求指纹：请求方法、路径和请求体的 SHA-256
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyRecorder 在写出响应的同时记录状态码和响应体
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(statusCode int) {
+	rec.statusCode = statusCode
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
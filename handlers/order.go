@@ -4,18 +4,17 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"strconv"
 	"take-out/database"
 	"take-out/models"
+	"take-out/orderno"
 	"take-out/monitoring"
 	"take-out/response"
 	"time"
-
-	"github.com/redis/go-redis/v9"
 )
 
 //在服务启动时初始化消费者
@@ -57,99 +56,197 @@ func HandleOrder(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 			return
 		}
 
-		// 参数验证
-		if order.ProductID == 0 {
-			response.ValidationError(w, "商品ID不能为空", "product_id")
-			return
-		}
-		if order.Quantity <= 0 {
-			response.ValidationError(w, "商品数量必须大于0", "quantity")
-			return
-		}
+		// 设置订单基本属性，订单支付成功后才进入商家待确认
+		order.UserID = userID
+		order.ParentID = 0
+		order.OrderStatus = models.OrderStatusAwaitingPayment
 
-		// 查询商品价格
-		var productPrice float64
-		if err := db.QueryRow("SELECT price FROM products WHERE productid = ?", order.ProductID).Scan(&productPrice); err != nil {
-			response.NotFound(w, "商品不存在")
+		// 与试算接口使用同一计价引擎，超出配送范围或优惠券不可用时拒绝下单
+		breakdown, ok := quoteOrder(w, db, &order)
+		if !ok {
 			return
 		}
 
-		// 查询商品所属店铺
-		var shopID int
-		if err := db.QueryRow("SELECT shop_id FROM products WHERE productid = ?", order.ProductID).Scan(&shopID); err != nil {
-			response.ServerError(w, err)
-			return
+		// 自取订单生成取餐码，顾客在订单详情中查看
+		order.PickupCode = ""
+		if order.FulfillmentType == models.FulfillmentPickup {
+			code, err := newPickupCode()
+			if err != nil {
+				response.ServerError(w, err)
+				return
+			}
+			order.PickupCode = code
 		}
 
-		// 设置订单基本属性
-		order.UserID = userID
-		order.ShopID = shopID
-		order.TotalPrice = productPrice * float64(order.Quantity)
-		order.DeliveryFee = 5.0 // 默认快递费5元
-		order.OrderStatus = "商家待确认"
-
-		// 插入订单到数据库
-		orderID, err := database.InsertOrder(db, &order)
+		// 插入订单到数据库，同一事务中预占库存；订单号极少数情况下重复时重新生成
+		var orderID int64
+		var err error
+		for attempt := 0; attempt < maxOrderNoAttempts; attempt++ {
+			if order.OrderNo, err = orderNumbers.Next(); err != nil {
+				break
+			}
+			orderID, err = database.InsertOrder(db, &order)
+			if !errors.Is(err, database.ErrOrderNoConflict) {
+				break
+			}
+			log.Printf("订单号重复，重新生成: %s", order.OrderNo)
+		}
 		if err != nil {
-			response.ServerError(w, err)
+			writeInsertOrderError(w, err)
 			return
 		}
 
 		order.OrderID = int(orderID)
+		database.SyncProductStockCache(rp, db, order.Items)
+
+		// 用户需在时限内完成支付，否则由超时任务自动取消；支付成功后才通知商家
+		database.ScheduleOrderDeadline(rp, database.DeadlinePayment, order.OrderID, time.Now().Add(paymentTimeout))
 
 		// 更新 Redis 缓存
 		jsonData, _ := json.Marshal(order)
 		database.SetToCache(rp, fmt.Sprintf("order_status_%d", order.OrderID), string(jsonData), time.Hour)
 
-		// 发布订单到消息队列
-		err = database.UserPlaceOrder(order.OrderID, order.UserID, order.ShopID, 0, []models.Product{}, rp)
+		// 创建支付单失败不影响订单，用户可以通过 /order/pay 重新发起支付
+		p, err := createPayment(db, &order)
 		if err != nil {
-			log.Printf("发布订单到消息队列失败: %v", err)
+			log.Printf("创建支付单失败: %v", err)
 		}
 
 		response.Created(w, map[string]interface{}{
-			"order_id":    order.OrderID,
-			"order_no":    order.OrderNo,
-			"total_price": order.TotalPrice,
-			"status":      order.OrderStatus,
+			"order_id":         order.OrderID,
+			"order_no":         order.OrderNo,
+			"fulfillment_type": order.FulfillmentType,
+			"pickup_code":      order.PickupCode,
+			"items":            order.Items,
+			"pricing":          breakdown,
+			"status":           order.OrderStatus,
+			"scheduled_at":     order.ScheduledAt,
+			"payment":          p,
 		}, "订单创建成功")
 	}
 }
 
-// 查询订单状态
+// 将下单事务的错误映射为统一响应，下单和跨店合并下单共用
+func writeInsertOrderError(w http.ResponseWriter, err error) {
+	var outOfStock *database.OutOfStockError
+	if errors.As(err, &outOfStock) {
+		response.ErrorWithDetails(w, "商品库存不足", http.StatusConflict, map[string]int{
+			"product_id": outOfStock.ProductID,
+			"requested":  outOfStock.Requested,
+			"available":  outOfStock.Available,
+		}, "OUT_OF_STOCK")
+	} else if errors.Is(err, database.ErrProductNotFound) {
+		response.NotFound(w, err.Error())
+	} else if errors.Is(err, database.ErrCouponUnavailable) {
+		writeCouponError(w, err)
+	} else if errors.Is(err, database.ErrDeliverySlotFull) {
+		response.ErrorWithDetails(w, err.Error(), http.StatusConflict, nil, "DELIVERY_SLOT_FULL")
+	} else if errors.Is(err, database.ErrDeliverySlotNotFound) {
+		response.ValidationError(w, err.Error(), "scheduled_at")
+	} else if errors.Is(err, orderno.ErrNoInstance) {
+		response.Error(w, "暂时无法生成订单号，请稍后重试", http.StatusServiceUnavailable)
+	} else {
+		response.ServerError(w, err)
+	}
+}
+
+// 查询订单状态，附带状态变更时间线
 func HandleOrderStatus(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		orderIDStr := r.URL.Query().Get("order_id")
-		orderID, err := strconv.Atoi(orderIDStr)
-		if err != nil {
-			response.ValidationError(w, "订单ID格式错误", "order_id")
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		orderID, ok := parseOrderRefQuery(w, r, db)
+		if !ok {
 			return
 		}
 
+		var order *models.Order
 		cacheKey := fmt.Sprintf("order_status_%d", orderID)
 		data, err := database.GetFromCache(rp, cacheKey)
 		if err == nil {
-			var order models.Order
-			if err := json.Unmarshal([]byte(data), &order); err == nil {
-				response.Success(w, order, "获取订单状态成功")
+			var cached models.Order
+			if err := json.Unmarshal([]byte(data), &cached); err == nil {
+				order = &cached
+			}
+		}
+
+		if order == nil {
+			// 缓存未命中，从数据库查询订单状态
+			order, err = database.QueryOrderStatus(db, orderID)
+			if err != nil {
+				response.NotFound(w, "订单不存在")
 				return
 			}
+
+			// 更新缓存
+			jsonData, err := json.Marshal(order)
+			if err == nil {
+				database.SetToCache(rp, cacheKey, string(jsonData), time.Hour)
+			}
+		}
+
+		if order.UserID != userID {
+			response.Forbidden(w, "无权查看该订单")
+			return
+		}
+
+		// 时间线和退款进度不走缓存，保证客服和用户看到的是最新记录
+		order.Timeline, err = database.QueryOrderEvents(db, orderID)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		order.Refunds, err = database.QueryOrderRefunds(db, orderID)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+
+		response.Success(w, order, "获取订单状态成功")
+	}
+}
+
+// 商家或骑手查询订单状态变更时间线
+func HandleOrderTimeline(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID, ok := parseOrderRefQuery(w, r, db)
+		if !ok {
+			return
 		}
 
-		// 缓存未命中，从数据库查询订单状态
 		order, err := database.QueryOrderStatus(db, orderID)
 		if err != nil {
 			response.NotFound(w, "订单不存在")
 			return
 		}
 
-		// 更新缓存
-		jsonData, err := json.Marshal(order)
-		if err == nil {
-			database.SetToCache(rp, cacheKey, string(jsonData), time.Hour)
+		// 商家只能查看本店订单，骑手只能查看自己配送的订单
+		shopID, _ := r.Context().Value("shopID").(int)
+		riderID, _ := r.Context().Value("riderID").(int)
+		switch {
+		case shopID != 0 && order.ShopID == shopID:
+		case riderID != 0 && order.RiderID == riderID:
+		default:
+			response.Forbidden(w, "无权查看该订单")
+			return
 		}
 
-		response.Success(w, order, "获取订单状态成功")
+		events, err := database.QueryOrderEvents(db, orderID)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+
+		response.Success(w, map[string]interface{}{
+			"order_id":     order.OrderID,
+			"order_no":     order.OrderNo,
+			"order_status": order.OrderStatus,
+			"timeline":     events,
+		}, "获取订单时间线成功")
 	}
 }
 
@@ -169,7 +266,7 @@ func HandleAcceptOrder(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 
 		// 定义请求体结构
 		var acceptRequest struct {
-			OrderID int `json:"order_id"`
+			orderRef
 		}
 
 		// 解析请求体
@@ -178,28 +275,24 @@ func HandleAcceptOrder(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 			return
 		}
 
-		if acceptRequest.OrderID == 0 {
-			response.ValidationError(w, "订单ID不能为空", "order_id")
+		if !resolveOrderRef(w, db, &acceptRequest.orderRef) {
 			return
 		}
 
 		// 检查订单是否属于该店铺
-		var currentShopID int
-		if err := db.QueryRow("SELECT shop_id FROM orders WHERE order_id = ?", acceptRequest.OrderID).Scan(&currentShopID); err != nil {
-			response.NotFound(w, "订单不存在")
-			return
-		}
-		if currentShopID != shopID {
-			response.Forbidden(w, "该订单不属于您的店铺")
+		if !checkOrderShop(w, db, acceptRequest.OrderID, shopID) {
 			return
 		}
 
 		// 更新订单状态为 "商家已接单"
-		err := database.UpdateOrderStatus(db, acceptRequest.OrderID, "商家已接单")
+		shop := models.OrderActor{Role: models.RoleShop, ID: shopID}
+		err := database.UpdateOrderStatus(db, acceptRequest.OrderID, models.OrderStatusConfirmed, shop, "")
 		if err != nil {
-			response.ServerError(w, err)
+			writeOrderError(w, err)
 			return
 		}
+		invalidateOrderCache(rp, acceptRequest.OrderID)
+		database.RemoveOrderDeadline(rp, database.DeadlineShopAccept, acceptRequest.OrderID)
 
 		// 查询订单状态
 		order, err := database.QueryOrderStatus(db, acceptRequest.OrderID)
@@ -214,12 +307,7 @@ func HandleAcceptOrder(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 			response.ServerError(w, err)
 			return
 		}
-		err = database.CreateGroup(map[string]interface{}{
-			"order_id": order.OrderID,
-			"user_id":  order.UserID,
-			"shop_id":  order.ShopID,
-			"rider_id": order.RiderID,
-		}, rp, db, tx)
+		err = database.CreateGroup(order, rp, db, tx)
 		if err != nil {
 			tx.Rollback()
 			response.ServerError(w, err)
@@ -229,6 +317,7 @@ func HandleAcceptOrder(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 
 		response.Success(w, map[string]interface{}{
 			"order_id": order.OrderID,
+			"order_no": order.OrderNo,
 			"status":   order.OrderStatus,
 		}, "订单已成功接单")
 	}
@@ -239,233 +328,340 @@ func HandlePublishDeliveryOrder(db *sql.DB, rp *database.RedisPool) http.Handler
 	return func(w http.ResponseWriter, r *http.Request) {
 		// 检查请求方法是否为 POST
 		if r.Method != http.MethodPost {
-			http.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
 			return
 		}
 
 		// 定义请求体结构
 		var publishRequest struct {
-			OrderID int `json:"order_id"`
+			orderRef
 		}
 
 		// 解析请求体
 		if err := json.NewDecoder(r.Body).Decode(&publishRequest); err != nil {
-			http.Error(w, "请求体解析错误", http.StatusBadRequest)
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+
+		if !resolveOrderRef(w, db, &publishRequest.orderRef) {
+			return
+		}
+
+		if !checkOrderShop(w, db, publishRequest.OrderID, shopID) {
 			return
 		}
 
 		// 更新订单状态为 "已发布跑腿订单"
-		err := database.UpdateOrderStatus(db, publishRequest.OrderID, "已发布跑腿订单")
+		shop := models.OrderActor{Role: models.RoleShop, ID: shopID}
+		err := database.UpdateOrderStatus(db, publishRequest.OrderID, models.OrderStatusPublished, shop, "")
 		if err != nil {
-			http.Error(w, fmt.Sprintf("更新订单状态失败: %v", err), http.StatusInternalServerError)
+			writeOrderError(w, err)
 			return
 		}
-		// 将订单发布到公共大厅队列供骑手抢单
-		rdb := rp.GetClient()
-		defer rp.PutClient(rdb)
-		orderInfo := map[string]interface{}{
-			"order_id":     publishRequest.OrderID,
-			"order_status": "已发布跑腿订单",
-			"order_time":   time.Now().Unix(),
-		}
-		orderJSON, _ := json.Marshal(orderInfo)
-		monitoring.RecordRedisTime("Publish", func() error {
-			return rdb.Publish(context.Background(), "public_hall", orderJSON).Err()
-		})
+		invalidateOrderCache(rp, publishRequest.OrderID)
+		// 按骑手得分依次派单，均未接单时进入公共大厅供骑手抢单
+		startDispatch(db, rp, publishRequest.OrderID)
 
 		// 返回成功响应
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "跑腿订单已发布"})
+		response.Success(w, map[string]interface{}{
+			"order_id": publishRequest.OrderID,
+			"status":   models.OrderStatusPublished,
+		}, "跑腿订单已发布")
 	}
 }
 
-// 随机选择一个骑手并通知新订单
-func HandNotifyNearbyRider(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+// 用户取消订单，骑手取货后不允许取消
+func HandleCancelOrder(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// 解析请求参数（假设请求体中有订单的经纬度信息）
-		var order map[string]interface{}
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&order); err != nil {
-			http.Error(w, "Invalid input", http.StatusBadRequest)
-			return
-		}
-
-		// 获取订单的经纬度信息
-		orderLat := order["latitude"].(float64)
-		orderLon := order["longitude"].(float64)
-		maxDistance := 5000 // 最大距离 5 公里，单位米
-
-		// 获取 Redis 客户端
-		rdb := rp.GetClient()
-		defer rp.PutClient(rdb)
-
-		// 查询数据库获取附近的骑手ID（登录状态）
-		query := `
-        SELECT rider_id
-        FROM riders
-        WHERE rider_status = "online"
-        AND ST_Distance_Sphere(point(rider_longitude, rider_latitude), point(?, ?)) < ?
-    `
-	
-rows, err := db.Query(query, orderLon, orderLat, maxDistance)
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var cancelRequest struct {
+			orderRef
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&cancelRequest); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if !resolveOrderRef(w, db, &cancelRequest.orderRef) {
+			return
+		}
+
+		order, err := database.QueryOrderStatus(db, cancelRequest.OrderID)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("获取附近骑手列表失败: %v", err), http.StatusInternalServerError)
+			response.NotFound(w, "订单不存在")
+			return
+		}
+		if order.UserID != userID {
+			response.Forbidden(w, "无权取消该订单")
 			return
 		}
-		defer rows.Close()
 
-		// 收集附近的骑手ID
-		var riderIDs []int
-		for rows.Next() {
-			var riderID int
-			if err := rows.Scan(&riderID); err == nil {
-				riderIDs = append(riderIDs, riderID)
-			}
+		user := models.OrderActor{Role: models.RoleUser, ID: userID}
+		order, err = cancelOrder(db, rp, cancelRequest.OrderID, "", user, cancelRequest.Reason)
+		if err != nil {
+			writeOrderError(w, err)
+			return
 		}
-		if len(riderIDs) == 0 {
-			http.Error(w, "没有找到附近的骑手", http.StatusNotFound)
+
+		response.Success(w, map[string]interface{}{
+			"order_id": order.OrderID,
+			"order_no": order.OrderNo,
+			"status":   order.OrderStatus,
+		}, "订单已取消")
+	}
+}
+
+// 商家拒绝新订单，只能拒绝尚未接单的订单
+func HandleRejectOrder(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// 随机选择一名骑手
-		rand.Seed(time.Now().UnixNano())
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
+			return
+		}
 
-		for len(riderIDs) > 0 {
-			riderIndex := rand.Intn(len(riderIDs))
-			selectedRiderID := riderIDs[riderIndex]
+		var rejectRequest struct {
+			orderRef
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&rejectRequest); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if !resolveOrderRef(w, db, &rejectRequest.orderRef) {
+			return
+		}
+		if rejectRequest.Reason == "" {
+			response.ValidationError(w, "拒单原因不能为空", "reason")
+			return
+		}
 
-			// 通知骑手新订单
-			notifyChannel := fmt.Sprintf("rider_%d", selectedRiderID)
-			orderJSON, _ := json.Marshal(order)
-			err := monitoring.RecordRedisTime("Publish", func() error {
-				return rdb.Publish(context.Background(), notifyChannel, orderJSON).Err()
-			})
-			if err != nil {
-				fmt.Printf("通知骑手失败: %v\n", err)
-				continue
-			}
+		if !checkOrderShop(w, db, rejectRequest.OrderID, shopID) {
+			return
+		}
 
-			// 等待骑手响应
-			response, err := waitForRiderResponse(selectedRiderID)
-			if err != nil || response != "accept" {
-				// 若骑手拒绝接单，继续通知下一个骑手
-				fmt.Printf("骑手 %d 拒绝订单，转派其他骑手\n", selectedRiderID)
-				// 移除已通知的骑手
-				riderIDs = append(riderIDs[:riderIndex], riderIDs[riderIndex+1:]...)
-			} else {
-				fmt.Printf("骑手 %d 接受订单\n", selectedRiderID)
-				// 返回成功响应
-				w.WriteHeader(http.StatusOK)
-				fmt.Fprintf(w, "骑手 %d 接受订单", selectedRiderID)
-				return
-			}
+		shop := models.OrderActor{Role: models.RoleShop, ID: shopID}
+		order, err := cancelOrder(db, rp, rejectRequest.OrderID, "", shop, rejectRequest.Reason)
+		if err != nil {
+			writeOrderError(w, err)
+			return
 		}
 
-		// 如果没有骑手接受订单
-		http.Error(w, "所有骑手拒绝订单", http.StatusServiceUnavailable)
+		response.Success(w, map[string]interface{}{
+			"order_id": order.OrderID,
+			"order_no": order.OrderNo,
+			"status":   order.OrderStatus,
+		}, "已拒绝订单")
 	}
 }
 
-// 模拟等待骑手响应接单请求
-func waitForRiderResponse(riderID int) (string, error) {
-	// 假设客户端通过某个途径返回接受或拒绝的状态
-	// 为简单起见，这里模拟等待响应并返回随机状态
-	time.Sleep(2 * time.Second) // 等待时间
-	responseOptions := []string{"accept", "reject"}
-	return responseOptions[rand.Intn(len(responseOptions))], nil
+// 取消订单并释放预占的库存，随后清除订单缓存、通知用户、商家和骑手，并执行自动批准的退款
+// status 不为空时仅取消仍处于该状态的订单；合并订单的子订单未支付时，其余未支付的子订单一起取消
+func cancelOrder(db *sql.DB, rp *database.RedisPool, orderID int, status string, actor models.OrderActor, reason string) (*models.Order, error) {
+	order, err := cancelOneOrder(db, rp, orderID, status, actor, reason)
+	if err != nil {
+		return nil, err
+	}
+	cancelUnpaidSiblings(db, rp, order, actor, reason)
+	return order, nil
 }
 
-// 获取订单列表供骑手选择
-func GetOrderListFromMQ(rp *database.RedisPool) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// 获取 Redis 客户端
-		rdb := rp.GetClient()
-		defer rp.PutClient(rdb)
-
-		// 消费 MQ 获取订单列表
-		var orderList []map[string]interface{}
-
-		for i := 0; i < 10; i++ { // 假设每次获取最多 10 个订单
-			var orderJSON string
-			var err error
-			monitoring.RecordRedisTime("LPop", func() error {
-				orderJSON, err = rdb.LPop(context.Background(), "public_hall").Result()
-				return err
-			})
-			if err == redis.Nil {
-				break // 没有更多订单
-			} else if err != nil {
-				http.Error(w, fmt.Sprintf("订单获取失败: %v", err), http.StatusInternalServerError)
-				return
-			}
-
-			var order map[string]interface{}
-			if err := json.Unmarshal([]byte(orderJSON), &order); err != nil {
-				http.Error(w, fmt.Sprintf("订单解析失败: %v", err), http.StatusInternalServerError)
-				return
-			}
-			orderList = append(orderList, order)
-		}
-
-		// 返回订单列表
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(orderList)
+func cancelOneOrder(db *sql.DB, rp *database.RedisPool, orderID int, status string, actor models.OrderActor, reason string) (*models.Order, error) {
+	order, err := database.CancelOrderIfStatus(db, orderID, status, actor, reason)
+	if err != nil {
+		return nil, err
 	}
+	invalidateOrderCache(rp, orderID)
+	database.SyncProductStockCache(rp, db, order.Items)
+	database.RemoveOrderDeadline(rp, database.DeadlinePayment, orderID)
+	database.RemoveOrderDeadline(rp, database.DeadlineShopAccept, orderID)
+	database.RemoveOrderDeadline(rp, database.DeadlineScheduledRelease, orderID)
+	removeFromHall(rp, orderID)
+	withdrawDispatch(db, rp, orderID)
+	database.NotifyOrderCancelled(rp, order, actor, reason)
+	// 商家接单前取消、商家或系统取消的退款已自动批准，立即原路退回
+	processApprovedRefunds(db, rp, orderID)
+	return order, nil
 }
 
-// 处理骑手抢单请求，保证事务处理
+// 抢单锁的有效期：抢单成功后不释放，有效期内随后的抢单请求无需访问数据库即可得知订单已被抢走
+const orderGrabLockTTL = 10 * time.Second
+
+// 处理骑手抢单请求：骑手身份取自 Token，骑手需在线且配送中的订单未达上限
+// 先以 Redis 抢单锁快速裁决并发抢单，未抢到锁的骑手立即得到 409 ORDER_TAKEN；抢到锁后在事务中锁定订单行完成接单，以数据库为最终裁决
 func HandleRiderGrabOrder(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Only supports POST method", http.StatusMethodNotAllowed)
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var requestData struct {
-			OrderID int `json:"order_id"`
-			RiderID int `json:"rider_id"`
+		riderID, ok := r.Context().Value("riderID").(int)
+		if !ok || riderID == 0 {
+			response.Unauthorized(w, "无效的骑手身份")
+			return
 		}
+
+		var requestData orderRef
 		if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if !resolveOrderRef(w, db, &requestData) {
 			return
 		}
+		orderID := requestData.OrderID
 
-		err := database.AcceptOrderTx(db, requestData.OrderID, requestData.RiderID)
+		start := time.Now()
+		owner := strconv.Itoa(riderID)
+		locked, err := database.TryLockOrderGrab(rp, orderID, owner, orderGrabLockTTL)
+		if err == nil && !locked {
+			recordGrab(start, "lock_contended")
+			writeOrderError(w, database.ErrOrderTaken)
+			return
+		}
+		// Redis 不可用时跳过抢单锁，仍由订单行锁裁决
+
+		err = database.AcceptOrderTx(db, orderID, riderID, riderMaxActiveOrders)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			if locked {
+				database.UnlockOrderGrab(rp, orderID, owner)
+			}
+			switch {
+			case errors.Is(err, database.ErrOrderTaken):
+				recordGrab(start, "taken")
+			case errors.Is(err, database.ErrRiderUnavailable):
+				recordGrab(start, "rider_unavailable")
+			default:
+				recordGrab(start, "failed")
+			}
+			writeOrderError(w, err)
 			return
 		}
+		recordGrab(start, "won")
+		invalidateOrderCache(rp, orderID)
+		removeFromHall(rp, orderID)
+		withdrawDispatch(db, rp, orderID)
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "Order accepted successfully"})
+		response.Success(w, map[string]interface{}{
+			"order_id": orderID,
+			"rider_id": riderID,
+			"status":   models.OrderStatusDelivering,
+		}, "抢单成功")
 	}
 }
 
+func recordGrab(start time.Time, outcome string) {
+	monitoring.OrderGrabsTotal.WithLabelValues(outcome).Inc()
+	monitoring.OrderGrabDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
+
 // 处理骑手完成订单的请求
-func HandleCompleteOrder(db *sql.DB) http.HandlerFunc {
+func HandleCompleteOrder(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		riderID, ok := r.Context().Value("riderID").(int)
+		if !ok || riderID == 0 {
+			response.Unauthorized(w, "无效的骑手身份")
 			return
 		}
 
 		var completeRequest struct {
-			OrderID int `json:"order_id"`
-			RiderID int `json:"rider_id"`
+			orderRef
 		}
 		if err := json.NewDecoder(r.Body).Decode(&completeRequest); err != nil {
-			http.Error(w, "请求体解析错误", http.StatusBadRequest)
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if !resolveOrderRef(w, db, &completeRequest.orderRef) {
 			return
 		}
 
 		// 更新订单状态为 "已完成"
-		err := database.CompleteOrderTx(db, completeRequest.OrderID, completeRequest.RiderID)
+		err := database.CompleteOrderTx(db, completeRequest.OrderID, riderID, riderMaxActiveOrders)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("更新订单状态失败: %v", err), http.StatusInternalServerError)
+			writeOrderError(w, err)
 			return
 		}
+		invalidateOrderCache(rp, completeRequest.OrderID)
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "订单已完成"})
+		response.Success(w, map[string]interface{}{
+			"order_id": completeRequest.OrderID,
+			"status":   models.OrderStatusCompleted,
+		}, "订单已完成")
 	}
-}
\ No newline at end of file
+}
+
+// 检查订单是否属于该店铺，不属于时直接写入错误响应
+func checkOrderShop(w http.ResponseWriter, db *sql.DB, orderID, shopID int) bool {
+	if orderID == 0 {
+		response.ValidationError(w, "订单ID不能为空", "order_id")
+		return false
+	}
+	var currentShopID int
+	if err := db.QueryRow("SELECT shopid FROM orders WHERE orderid = $1", orderID).Scan(&currentShopID); err != nil {
+		response.NotFound(w, "订单不存在")
+		return false
+	}
+	if currentShopID != shopID {
+		response.Forbidden(w, "该订单不属于您的店铺")
+		return false
+	}
+	return true
+}
+
+// 订单状态变更后清除订单状态缓存
+func invalidateOrderCache(rp *database.RedisPool, orderID int) {
+	if err := database.DeleteFromCache(rp, fmt.Sprintf("order_status_%d", orderID)); err != nil {
+		log.Printf("清除订单缓存失败: %v", err)
+	}
+}
+
+// 将订单状态变更的错误映射为统一响应，非法的状态流转和履约方式不支持的状态返回 409
+func writeOrderError(w http.ResponseWriter, err error) {
+	var transitionErr *models.TransitionError
+	var fulfillmentErr *models.FulfillmentError
+	switch {
+	case errors.As(err, &transitionErr):
+		response.Conflict(w, transitionErr.Error())
+	case errors.As(err, &fulfillmentErr):
+		response.Conflict(w, fulfillmentErr.Error())
+	case errors.Is(err, database.ErrOrderNotFound):
+		response.NotFound(w, err.Error())
+	case errors.Is(err, database.ErrOrderNotAssigned):
+		response.Forbidden(w, err.Error())
+	case errors.Is(err, database.ErrRiderNotFound):
+		response.NotFound(w, err.Error())
+	case errors.Is(err, database.ErrOrderTaken):
+		response.ErrorWithDetails(w, err.Error(), http.StatusConflict, nil, "ORDER_TAKEN")
+	case errors.Is(err, database.ErrRiderUnavailable):
+		response.Conflict(w, err.Error())
+	default:
+		response.ServerError(w, err)
+	}
+}
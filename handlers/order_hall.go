@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"take-out/database"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"take-out/response"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 订单在大厅中停留的时长，每次重新广播时顺延，由 LoadConfig 读取
+var orderHallTTL time.Duration
+
+const orderHallMaxLimit = 50
+
+// 将跑腿订单放入公共大厅（以商家位置索引），并通过 public_hall 频道通知订阅的骑手
+// 订单已在大厅中时更新摘要并顺延过期时间
+func publishToHall(db *sql.DB, rp *database.RedisPool, order *models.Order) error {
+	shop, err := database.QueryShopDeliveryInfo(db, order.ShopID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	hallOrder := &models.HallOrder{
+		OrderID:           order.OrderID,
+		OrderNo:           order.OrderNo,
+		ShopID:            shop.ShopID,
+		ShopName:          shop.ShopName,
+		ShopLatitude:      shop.ShopLatitude,
+		ShopLongitude:     shop.ShopLongitude,
+		DeliveryAddress:   order.DeliveryAddress,
+		DeliveryLatitude:  order.DeliveryLatitude,
+		DeliveryLongitude: order.DeliveryLongitude,
+		DistanceKm:        order.DistanceKm,
+		DeliveryFee:       order.DeliveryFee,
+		ScheduledAt:       order.ScheduledAt,
+		PublishedAt:       now,
+		ExpiresAt:         now.Add(orderHallTTL),
+	}
+	if err := database.AddToOrderHall(rp, hallOrder); err != nil {
+		return err
+	}
+
+	notification, _ := json.Marshal(map[string]interface{}{
+		"type":      "hall_order",
+		"order":     hallOrder,
+		"timestamp": now.Unix(),
+	})
+	if err := database.PublishMessage(rp, "public_hall", string(notification)); err != nil {
+		logging.Warn("Failed to notify riders of hall order", logrus.Fields{"error": err, "orderID": order.OrderID})
+	}
+	return nil
+}
+
+// 订单离开公共大厅（已被接单或已取消）：移出大厅，并移除抢单超时任务和重新广播计数
+func removeFromHall(rp *database.RedisPool, orderID int) {
+	database.RemoveFromOrderHall(rp, orderID)
+	database.RemoveOrderDeadline(rp, database.DeadlineRiderGrab, orderID)
+	database.ClearDeadlineAttempts(rp, database.DeadlineRiderGrab, orderID)
+}
+
+// 骑手浏览附近商家的大厅订单，按骑手到商家的距离从近到远，浏览不会取走订单
+// 默认以骑手最近上报的位置为中心，也可以传 latitude/longitude 指定
+// GET /api/rider/hall?radius_km=3&limit=20
+func HandleOrderHall(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		riderID, ok := r.Context().Value("riderID").(int)
+		if !ok || riderID == 0 {
+			response.Unauthorized(w, "无效的骑手身份")
+			return
+		}
+
+		query := r.URL.Query()
+		lat, latErr := strconv.ParseFloat(query.Get("latitude"), 64)
+		lon, lonErr := strconv.ParseFloat(query.Get("longitude"), 64)
+		if latErr != nil || lonErr != nil {
+			location, err := database.QueryRiderLocation(rp, riderID)
+			if err != nil {
+				response.ServerError(w, err)
+				return
+			}
+			if location == nil {
+				response.ValidationError(w, "没有骑手的实时位置，请先上报定位或传入经纬度", "latitude")
+				return
+			}
+			lat, lon = location.Latitude, location.Longitude
+		} else if !validCoordinate(lat, lon) {
+			response.ValidationError(w, "经纬度超出范围", "latitude")
+			return
+		}
+
+		radiusKm := dispatchEngine.RadiusKm
+		if v, err := strconv.ParseFloat(query.Get("radius_km"), 64); err == nil && v > 0 {
+			radiusKm = math.Min(v, dispatchEngine.RadiusKm)
+		}
+		limit := orderHallMaxLimit
+		if v, err := strconv.Atoi(query.Get("limit")); err == nil && v > 0 && v < limit {
+			limit = v
+		}
+
+		orders, err := database.SearchOrderHall(rp, lat, lon, radiusKm, limit)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+
+		// 以数据库为准：接单后移出大厅失败、或已取消的订单不返回，并顺带移出大厅
+		orderIDs := make([]int, len(orders))
+		for i, order := range orders {
+			orderIDs[i] = order.OrderID
+		}
+		grabbable, err := database.QueryGrabbableOrderIDs(db, orderIDs)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		open := make([]models.HallOrder, 0, len(orders))
+		var stale []int
+		for _, order := range orders {
+			if grabbable[order.OrderID] {
+				open = append(open, order)
+			} else {
+				stale = append(stale, order.OrderID)
+			}
+		}
+		database.RemoveFromOrderHall(rp, stale...)
+
+		response.Success(w, map[string]interface{}{
+			"latitude":  lat,
+			"longitude": lon,
+			"radius_km": radiusKm,
+			"orders":    open,
+		}, "获取公共大厅订单成功")
+	}
+}
+
+// 大厅订单过期：移出大厅，仍未被接单的订单通知商家和运营人员介入
+func handleExpiredHallOrders(db *sql.DB, rp *database.RedisPool) {
+	orderIDs, err := database.ClaimExpiredHallOrders(rp, time.Now(), orderTimeoutBatchLimit)
+	if err != nil || len(orderIDs) == 0 {
+		return
+	}
+	grabbable, err := database.QueryGrabbableOrderIDs(db, orderIDs)
+	if err != nil {
+		return
+	}
+	for _, orderID := range orderIDs {
+		if !grabbable[orderID] {
+			monitoring.OrderTimeoutsTotal.WithLabelValues("order_hall", "skipped").Inc()
+			continue
+		}
+		order, err := database.QueryOrderStatus(db, orderID)
+		if err != nil {
+			continue
+		}
+		database.RemoveOrderDeadline(rp, database.DeadlineRiderGrab, orderID)
+		database.ClearDeadlineAttempts(rp, database.DeadlineRiderGrab, orderID)
+		escalateUngrabbedOrder(rp, order, "order_hall_expired", int64(orderGrabMaxRebroadcasts))
+		monitoring.OrderTimeoutsTotal.WithLabelValues("order_hall", "expired").Inc()
+		logging.Info("Order expired from public hall", logrus.Fields{"orderID": orderID})
+	}
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"take-out/config"
+	"take-out/database"
+	"take-out/models"
+	"take-out/orderno"
+	"take-out/response"
+	"time"
+)
+
+const (
+	defaultOrderPageSize = 20
+	maxOrderPageSize     = 100
+)
+
+// 用户查询自己的历史订单，最新的在前，支持按状态、下单日期过滤和游标分页
+// GET /api/user/orders?status=completed,cancelled&from=2024-01-01&to=2024-01-31&cursor=123&limit=20
+// 传 order_no 时按订单号查找
+func HandleUserOrders(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.Error(w, "只支持 GET 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		filter, ok := parseOrderFilter(w, r)
+		if !ok {
+			return
+		}
+		filter.UserID = userID
+
+		page, err := queryOrderPage(db, filter)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+
+		response.Success(w, page, "获取订单列表成功")
+	}
+}
+
+// 商家订单看板：按生命周期分组（new/scheduled/accepted/awaiting_rider/delivering/done）查询本店订单，附带各分组数量和用户备注
+// 待支付的订单不返回，也不计入分组数量
+// GET /api/shop/orders?group=new&from=2024-01-01&to=2024-01-31&cursor=123&limit=20
+// 传 order_no 时按订单号查找，用于用户报出订单号时定位订单
+func HandleShopOrders(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			response.Error(w, "只支持 GET 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
+			return
+		}
+
+		filter, ok := parseOrderFilter(w, r)
+		if !ok {
+			return
+		}
+		filter.ShopID = shopID
+		for _, status := range filter.Statuses {
+			if status == models.OrderStatusAwaitingPayment {
+				response.ValidationError(w, "商家不能查询待支付的订单", "status")
+				return
+			}
+		}
+
+		group := r.URL.Query().Get("group")
+		if group != "" {
+			if len(filter.Statuses) > 0 {
+				response.ValidationError(w, "group 与 status 不能同时指定", "group")
+				return
+			}
+			statuses, ok := models.ShopBoardStatuses(group)
+			if !ok {
+				response.ValidationError(w, "看板分组无效: "+group, "group")
+				return
+			}
+			filter.Statuses = statuses
+		}
+
+		page, err := queryOrderPage(db, filter)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+
+		// 分组计数只受时间范围影响，不受分组和分页影响
+		statusCounts, err := database.CountShopOrdersByStatus(db, shopID, filter.From, filter.To)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		counts := make(map[string]int, len(models.ShopBoardGroups))
+		for _, g := range models.ShopBoardGroups {
+			counts[g] = 0
+		}
+		for status, count := range statusCounts {
+			if g := models.ShopBoardGroup(status); g != "" {
+				counts[g] += count
+			}
+		}
+		page["counts"] = counts
+		page["group"] = group
+
+		response.Success(w, page, "获取店铺订单成功")
+	}
+}
+
+// 解析订单列表的公共查询参数，参数错误时直接写入错误响应
+func parseOrderFilter(w http.ResponseWriter, r *http.Request) (models.OrderFilter, bool) {
+	query := r.URL.Query()
+	filter := models.OrderFilter{Limit: defaultOrderPageSize}
+
+	if status := query.Get("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			s = strings.TrimSpace(s)
+			if !models.IsValidOrderStatus(s) {
+				response.ValidationError(w, "订单状态无效: "+s, "status")
+				return filter, false
+			}
+			filter.Statuses = append(filter.Statuses, s)
+		}
+	}
+
+	if orderNo := strings.TrimSpace(query.Get("order_no")); orderNo != "" {
+		if err := orderno.Valid(orderNo); err != nil {
+			response.ValidationError(w, "订单号格式错误，请核对后重新输入", "order_no")
+			return filter, false
+		}
+		filter.OrderNo = orderNo
+	}
+
+	var err error
+	if from := query.Get("from"); from != "" {
+		if filter.From, _, err = parseOrderDate(from); err != nil {
+			response.ValidationError(w, "开始日期格式错误，应为 YYYY-MM-DD 或 RFC3339", "from")
+			return filter, false
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		var dateOnly bool
+		if filter.To, dateOnly, err = parseOrderDate(to); err != nil {
+			response.ValidationError(w, "结束日期格式错误，应为 YYYY-MM-DD 或 RFC3339", "to")
+			return filter, false
+		}
+		// 只给日期时包含当天全天
+		if dateOnly {
+			filter.To = filter.To.AddDate(0, 0, 1)
+		}
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		if filter.Cursor, err = strconv.Atoi(cursor); err != nil || filter.Cursor <= 0 {
+			response.ValidationError(w, "分页游标格式错误", "cursor")
+			return filter, false
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit <= 0 {
+			response.ValidationError(w, "每页数量必须为正整数", "limit")
+			return filter, false
+		}
+		if filter.Limit > maxOrderPageSize {
+			filter.Limit = maxOrderPageSize
+		}
+	}
+	return filter, true
+}
+
+// 解析 YYYY-MM-DD（按业务时区的零点）或 RFC3339 格式的日期，dateOnly 表示只给了日期
+func parseOrderDate(value string) (t time.Time, dateOnly bool, err error) {
+	if t, err = time.ParseInLocation("2006-01-02", value, config.Location); err == nil {
+		return t, true, nil
+	}
+	t, err = time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// 按游标查询一页订单，多取一条用于判断是否还有下一页
+func queryOrderPage(db *sql.DB, filter models.OrderFilter) (map[string]interface{}, error) {
+	limit := filter.Limit
+	filter.Limit++
+	orders, err := database.QueryOrderSummaries(db, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := map[string]interface{}{
+		"has_more": false,
+	}
+	if len(orders) > limit {
+		orders = orders[:limit]
+		page["has_more"] = true
+		page["next_cursor"] = orders[limit-1].OrderID
+	}
+	page["list"] = orders
+	return page, nil
+}
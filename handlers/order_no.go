@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"take-out/database"
+	"take-out/logging"
+	"take-out/orderno"
+	"take-out/response"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 实例编号租约有效期，每三分之一有效期续期一次
+var instanceLeaseTTL time.Duration
+
+// 订单号生成器，实例编号由 InitOrderNumbers 确定；没有实例编号时拒绝生成订单号
+var orderNumbers = orderno.NewGenerator()
+
+// 订单号重复时重新生成的次数上限
+const maxOrderNoAttempts = 3
+
+// InitOrderNumbers 确定本实例的订单号实例编号，失败时返回错误，调用方应终止启动
+// 配置了 ORDER_NO_INSTANCE_ID 时直接使用（由部署方保证各实例不同）；否则在 Redis 中申请编号租约并在后台续期
+func InitOrderNumbers(rp *database.RedisPool) error {
+	if value := os.Getenv("ORDER_NO_INSTANCE_ID"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("ORDER_NO_INSTANCE_ID 不是整数: %s", value)
+		}
+		if err := orderNumbers.SetInstanceID(id); err != nil {
+			return fmt.Errorf("ORDER_NO_INSTANCE_ID 配置错误: %v", err)
+		}
+		logging.Info("Using configured order number instance id", logrus.Fields{"instanceID": id})
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano())
+	id, err := database.ClaimInstanceID(rp, owner, orderno.MaxInstanceID, instanceLeaseTTL)
+	if err != nil {
+		return fmt.Errorf("申请订单号实例编号失败: %v", err)
+	}
+	if err := orderNumbers.SetInstanceID(id); err != nil {
+		return err
+	}
+	logging.Info("Claimed order number instance id", logrus.Fields{"instanceID": id})
+	go keepInstanceLease(rp, owner, id)
+	return nil
+}
+
+// 定期续期实例编号租约；租约丢失（如 Redis 长时间不可用后被其他实例占用）时立即停止生成订单号并重新申请编号，
+// 重新申请成功之前下单接口返回 503
+func keepInstanceLease(rp *database.RedisPool, owner string, id int) {
+	ticker := time.NewTicker(instanceLeaseTTL / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		if id < 0 {
+			claimed, err := database.ClaimInstanceID(rp, owner, orderno.MaxInstanceID, instanceLeaseTTL)
+			if err != nil {
+				logging.Warn("Failed to reclaim instance id", logrus.Fields{"error": err})
+				continue
+			}
+			if err := orderNumbers.SetInstanceID(claimed); err != nil {
+				logging.Error("Claimed invalid instance id", logrus.Fields{"error": err, "instanceID": claimed})
+				continue
+			}
+			id = claimed
+			logging.Info("Reclaimed order number instance id", logrus.Fields{"instanceID": id})
+			continue
+		}
+		renewed, err := database.RenewInstanceID(rp, id, owner, instanceLeaseTTL)
+		if err != nil {
+			logging.Warn("Failed to renew instance id lease", logrus.Fields{"error": err, "instanceID": id})
+			continue
+		}
+		if !renewed {
+			logging.Error("Instance id lease lost, claiming a new one", logrus.Fields{"instanceID": id})
+			orderNumbers.ClearInstanceID()
+			id = -1
+		}
+	}
+}
+
+// 订单标识，订单相关接口可以传订单ID或订单号，二者传其一即可
+type orderRef struct {
+	OrderID int    `json:"order_id"`
+	OrderNo string `json:"order_no"`
+}
+
+// 把订单号解析为订单ID并写回 OrderID，参数错误或订单不存在时直接写入错误响应
+func resolveOrderRef(w http.ResponseWriter, db *sql.DB, ref *orderRef) bool {
+	ref.OrderNo = strings.TrimSpace(ref.OrderNo)
+	if ref.OrderNo == "" {
+		if ref.OrderID <= 0 {
+			response.ValidationError(w, "订单ID或订单号不能为空", "order_id")
+			return false
+		}
+		return true
+	}
+	if err := orderno.Valid(ref.OrderNo); err != nil {
+		response.ValidationError(w, "订单号格式错误，请核对后重新输入", "order_no")
+		return false
+	}
+	orderID, err := database.QueryOrderIDByNo(db, ref.OrderNo)
+	if err != nil {
+		writeOrderError(w, err)
+		return false
+	}
+	if ref.OrderID != 0 && ref.OrderID != orderID {
+		response.ValidationError(w, "订单ID与订单号不是同一订单", "order_no")
+		return false
+	}
+	ref.OrderID = orderID
+	return true
+}
+
+// 从查询参数 order_id 或 order_no 中解析订单ID
+func parseOrderRefQuery(w http.ResponseWriter, r *http.Request, db *sql.DB) (int, bool) {
+	query := r.URL.Query()
+	ref := orderRef{OrderNo: query.Get("order_no")}
+	if value := query.Get("order_id"); value != "" {
+		orderID, err := strconv.Atoi(value)
+		if err != nil {
+			response.ValidationError(w, "订单ID格式错误", "order_id")
+			return 0, false
+		}
+		ref.OrderID = orderID
+	}
+	if !resolveOrderRef(w, db, &ref) {
+		return 0, false
+	}
+	return ref.OrderID, true
+}
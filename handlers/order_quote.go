@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"take-out/database"
+	"take-out/models"
+	"take-out/pricing"
+	"take-out/response"
+	"time"
+)
+
+// 计价引擎，由 LoadConfig 从环境变量读取计价规则
+var pricingEngine pricing.Engine
+
+// 下单前试算：返回商品明细和价格明细（商品小计、打包费、配送费、优惠、服务费、应付金额），不创建订单
+func HandleOrderQuote(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var order models.Order
+		if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		order.UserID = userID
+
+		breakdown, ok := quoteOrder(w, db, &order)
+		if !ok {
+			return
+		}
+
+		response.Success(w, map[string]interface{}{
+			"shop_id":          order.ShopID,
+			"fulfillment_type": order.FulfillmentType,
+			"items":            order.Items,
+			"user_coupon_id":   order.UserCouponID,
+			"pricing":          breakdown,
+		}, "订单试算成功")
+	}
+}
+
+// 校验订单明细并调用计价引擎生成价格明细，结果写回 order
+// 下单和试算共用，保证试算金额与实际下单金额一致；出错时直接写入错误响应
+func quoteOrder(w http.ResponseWriter, db *sql.DB, order *models.Order) (*models.PriceBreakdown, bool) {
+	if len(order.Items) == 0 {
+		response.ValidationError(w, "订单商品不能为空", "items")
+		return nil, false
+	}
+	for _, item := range order.Items {
+		if item.ProductID == 0 {
+			response.ValidationError(w, "商品ID不能为空", "items.product_id")
+			return nil, false
+		}
+		if item.Quantity <= 0 {
+			response.ValidationError(w, "商品数量必须大于0", "items.quantity")
+			return nil, false
+		}
+	}
+
+	// 查询商品价格，生成明细小计和订单总价
+	if err := database.PriceOrderItems(db, order); err != nil {
+		if errors.Is(err, database.ErrProductNotFound) {
+			response.NotFound(w, err.Error())
+		} else if errors.Is(err, database.ErrMixedShopItems) {
+			response.ValidationError(w, err.Error(), "items")
+		} else {
+			response.ServerError(w, err)
+		}
+		return nil, false
+	}
+
+	if order.FulfillmentType == "" {
+		order.FulfillmentType = models.FulfillmentDelivery
+	}
+	if !models.IsValidFulfillmentType(order.FulfillmentType) {
+		response.ValidationError(w, "履约方式只能是 delivery 或 pickup", "fulfillment_type")
+		return nil, false
+	}
+	pickup := order.FulfillmentType == models.FulfillmentPickup
+	if pickup {
+		// 自取订单没有收货地址，也不支持预约送达
+		if order.ScheduledAt != nil && !order.ScheduledAt.IsZero() {
+			response.ValidationError(w, "自取订单不支持预约送达", "scheduled_at")
+			return nil, false
+		}
+		order.DeliveryAddress = ""
+		order.DeliveryLatitude, order.DeliveryLongitude = 0, 0
+	} else if order.DeliveryLatitude == 0 && order.DeliveryLongitude == 0 {
+		// 未指定收货坐标时使用用户的默认地址
+		address, lat, lon, ok, err := database.QueryUserLocation(db, order.UserID)
+		if err != nil {
+			response.ServerError(w, err)
+			return nil, false
+		}
+		if !ok {
+			response.ValidationError(w, "请提供收货坐标", "delivery_latitude")
+			return nil, false
+		}
+		order.DeliveryLatitude, order.DeliveryLongitude = lat, lon
+		if order.DeliveryAddress == "" {
+			order.DeliveryAddress = address
+		}
+	}
+
+	shop, err := database.QueryShopDeliveryInfo(db, order.ShopID)
+	if err != nil {
+		if errors.Is(err, database.ErrShopNotFound) {
+			response.NotFound(w, err.Error())
+		} else {
+			response.ServerError(w, err)
+		}
+		return nil, false
+	}
+
+	// 预约单校验预约时间并匹配商家的配送时段
+	if !resolveScheduledDelivery(w, db, order) {
+		return nil, false
+	}
+
+	// 优惠券只在这里校验归属和状态，实际核销在下单事务中进行
+	var coupon *models.Coupon
+	if order.UserCouponID != 0 {
+		userCoupon, err := database.QueryUserCoupon(db, order.UserID, order.UserCouponID)
+		if err != nil {
+			writeCouponError(w, err)
+			return nil, false
+		}
+		if userCoupon.Status != models.UserCouponAvailable {
+			writeCouponError(w, database.ErrCouponUnavailable)
+			return nil, false
+		}
+		coupon = &userCoupon.Coupon
+	}
+
+	var deliveryAt time.Time
+	if order.ScheduledAt != nil {
+		deliveryAt = *order.ScheduledAt
+	}
+	var distanceKm float64
+	if !pickup {
+		distanceKm = pricing.DistanceKm(shop.ShopLatitude, shop.ShopLongitude, order.DeliveryLatitude, order.DeliveryLongitude)
+	}
+	breakdown, err := pricingEngine.Price(pricing.Input{
+		ShopID:     order.ShopID,
+		Items:      order.Items,
+		DistanceKm: distanceKm,
+		RadiusKm:   shop.DeliveryRadiusKm,
+		Coupon:     coupon,
+		At:         time.Now(),
+		DeliveryAt: deliveryAt,
+		Pickup:     pickup,
+	})
+	if err != nil {
+		var outOfRange *pricing.OutOfRangeError
+		var couponErr *pricing.CouponError
+		if errors.As(err, &outOfRange) {
+			response.ErrorWithDetails(w, outOfRange.Error(), http.StatusUnprocessableEntity, map[string]float64{
+				"distance_km": outOfRange.DistanceKm,
+				"radius_km":   outOfRange.RadiusKm,
+			}, "OUT_OF_DELIVERY_RANGE")
+		} else if errors.As(err, &couponErr) {
+			writeCouponError(w, err)
+		} else {
+			response.ServerError(w, err)
+		}
+		return nil, false
+	}
+
+	order.ApplyBreakdown(breakdown)
+	return breakdown, true
+}
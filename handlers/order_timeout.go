@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"take-out/database"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 订单超时配置，由 LoadConfig 从环境变量读取
+var (
+	paymentTimeout           time.Duration // 用户支付时限
+	orderAcceptTimeout       time.Duration // 商家接单时限
+	orderGrabTimeout         time.Duration // 跑腿订单每轮等待抢单时限
+	orderGrabMaxRebroadcasts int           // 无人抢单时最多重新广播次数
+	orderTimeoutPollInterval time.Duration
+
+	scheduledOrderLeadTime          time.Duration // 预约单提前多久通知商家备餐
+	scheduledOrderMaxDays           int           // 最多提前几天预约
+	scheduledOrderReconcileInterval time.Duration // 从数据库重建预约单调度任务的间隔
+)
+
+const (
+	orderTimeoutLease      = time.Minute // 领取超时任务后的租约，处理失败时租约到期自动重试
+	orderTimeoutBatchLimit = 100
+)
+
+// StartOrderTimeoutWorker 在服务启动时运行，定期处理超时未支付、商家超时未接单、派单答复超时、跑腿订单无人抢单、大厅订单过期以及预约单到达备餐时间
+// 截止时间保存在 Redis 有序集合中，服务重启不丢失，多实例同时运行时同一订单只会被一个实例处理
+// 预约单的通知时间同时保存在数据库中，定期据此补齐 Redis 中缺失的调度任务（如 Redis 数据丢失）
+func StartOrderTimeoutWorker(db *sql.DB, rp *database.RedisPool) {
+	ticker := time.NewTicker(orderTimeoutPollInterval)
+	defer ticker.Stop()
+	reconcile := time.NewTicker(scheduledOrderReconcileInterval)
+	defer reconcile.Stop()
+
+	reconcileScheduledOrders(db, rp)
+	for {
+		select {
+		case <-ticker.C:
+			handleCancelTimeouts(db, rp, database.DeadlinePayment, models.OrderStatusAwaitingPayment, "订单超时未支付")
+			handleCancelTimeouts(db, rp, database.DeadlineShopAccept, models.OrderStatusPending, "商家超时未接单")
+			handleDispatchTimeouts(db, rp)
+			handleRiderGrabTimeouts(db, rp)
+			handleExpiredHallOrders(db, rp)
+			handleScheduledReleases(db, rp)
+		case <-reconcile.C:
+			reconcileScheduledOrders(db, rp)
+		}
+	}
+}
+
+// 超时未支付、商家超时未接单：由系统取消订单，恢复库存并退回优惠券
+// 超时任务只取消仍处于 status 状态的订单，订单已推进到下一状态时超时任务作废
+func handleCancelTimeouts(db *sql.DB, rp *database.RedisPool, kind, status, reason string) {
+	orderIDs, err := database.ClaimDueOrderDeadlines(rp, kind, time.Now(), orderTimeoutLease, orderTimeoutBatchLimit)
+	if err != nil {
+		logging.Error("Failed to claim order timeouts", logrus.Fields{"error": err, "kind": kind})
+		return
+	}
+
+	system := models.OrderActor{Role: models.RoleSystem}
+	for _, orderID := range orderIDs {
+		_, err := cancelOrder(db, rp, orderID, status, system, reason)
+		var transitionErr *models.TransitionError
+		switch {
+		case err == nil:
+			monitoring.OrderTimeoutsTotal.WithLabelValues(kind, "cancelled").Inc()
+			logging.Info("Order cancelled after timeout", logrus.Fields{"orderID": orderID, "kind": kind})
+		case errors.As(err, &transitionErr), errors.Is(err, database.ErrOrderNotFound):
+			database.RemoveOrderDeadline(rp, kind, orderID)
+			monitoring.OrderTimeoutsTotal.WithLabelValues(kind, "skipped").Inc()
+		default:
+			logging.Error("Failed to cancel timed out order", logrus.Fields{"error": err, "orderID": orderID, "kind": kind})
+		}
+	}
+}
+
+// 跑腿订单无人抢单：重新广播到公共大厅并顺延大厅过期时间，超过最大次数后通知商家和运营人员介入
+func handleRiderGrabTimeouts(db *sql.DB, rp *database.RedisPool) {
+	orderIDs, err := database.ClaimDueOrderDeadlines(rp, database.DeadlineRiderGrab, time.Now(), orderTimeoutLease, orderTimeoutBatchLimit)
+	if err != nil {
+		logging.Error("Failed to claim rider grab timeouts", logrus.Fields{"error": err})
+		return
+	}
+
+	for _, orderID := range orderIDs {
+		order, err := database.QueryOrderStatus(db, orderID)
+		if err != nil {
+			if errors.Is(err, database.ErrOrderNotFound) {
+				removeFromHall(rp, orderID)
+			}
+			logging.Error("Failed to query timed out order", logrus.Fields{"error": err, "orderID": orderID})
+			continue
+		}
+		if order.OrderStatus != models.OrderStatusPublished {
+			// 已有骑手接单或订单已取消
+			removeFromHall(rp, orderID)
+			monitoring.OrderTimeoutsTotal.WithLabelValues(database.DeadlineRiderGrab, "skipped").Inc()
+			continue
+		}
+
+		attempts, err := database.IncrDeadlineAttempts(rp, database.DeadlineRiderGrab, orderID)
+		if err != nil {
+			logging.Error("Failed to count rider grab timeouts", logrus.Fields{"error": err, "orderID": orderID})
+			continue
+		}
+
+		if attempts > int64(orderGrabMaxRebroadcasts) {
+			escalateUngrabbedOrder(rp, order, "order_ungrabbed", attempts-1)
+			// 订单留在大厅中，直到被抢走、取消或过期
+			database.RemoveOrderDeadline(rp, database.DeadlineRiderGrab, orderID)
+			database.ClearDeadlineAttempts(rp, database.DeadlineRiderGrab, orderID)
+			monitoring.OrderTimeoutsTotal.WithLabelValues(database.DeadlineRiderGrab, "escalated").Inc()
+			continue
+		}
+
+		if err := publishToHall(db, rp, order); err != nil {
+			logging.Error("Failed to rebroadcast order", logrus.Fields{"error": err, "orderID": orderID})
+			continue
+		}
+		database.ScheduleOrderDeadline(rp, database.DeadlineRiderGrab, orderID, time.Now().Add(orderGrabTimeout))
+		monitoring.OrderTimeoutsTotal.WithLabelValues(database.DeadlineRiderGrab, "rebroadcast").Inc()
+		logging.Info("Order rebroadcast to public hall", logrus.Fields{"orderID": orderID, "attempt": attempts})
+	}
+}
+
+// 预约单到达备餐时间：订单由 scheduled 进入商家待确认，之后与普通订单一样通知商家、计时接单
+func handleScheduledReleases(db *sql.DB, rp *database.RedisPool) {
+	kind := database.DeadlineScheduledRelease
+	orderIDs, err := database.ClaimDueOrderDeadlines(rp, kind, time.Now(), orderTimeoutLease, orderTimeoutBatchLimit)
+	if err != nil {
+		logging.Error("Failed to claim scheduled order releases", logrus.Fields{"error": err})
+		return
+	}
+
+	system := models.OrderActor{Role: models.RoleSystem}
+	for _, orderID := range orderIDs {
+		err := database.UpdateOrderStatus(db, orderID, models.OrderStatusPending, system, "预约单到达备餐时间")
+		var transitionErr *models.TransitionError
+		switch {
+		case err == nil:
+			database.RemoveOrderDeadline(rp, kind, orderID)
+			invalidateOrderCache(rp, orderID)
+			notifyShopNewOrder(db, rp, orderID)
+			monitoring.OrderTimeoutsTotal.WithLabelValues(kind, "released").Inc()
+			logging.Info("Scheduled order released to shop", logrus.Fields{"orderID": orderID})
+		case errors.As(err, &transitionErr), errors.Is(err, database.ErrOrderNotFound):
+			// 预约单已取消
+			database.RemoveOrderDeadline(rp, kind, orderID)
+			monitoring.OrderTimeoutsTotal.WithLabelValues(kind, "skipped").Inc()
+		default:
+			logging.Error("Failed to release scheduled order", logrus.Fields{"error": err, "orderID": orderID})
+		}
+	}
+}
+
+// 以数据库中 scheduled 状态的预约单为准，补齐 Redis 中缺失的通知任务，已有的任务不受影响
+func reconcileScheduledOrders(db *sql.DB, rp *database.RedisPool) {
+	releases, err := database.QueryScheduledOrderReleases(db)
+	if err != nil {
+		logging.Error("Failed to reconcile scheduled orders", logrus.Fields{"error": err})
+		return
+	}
+	for orderID, releaseAt := range releases {
+		if err := database.EnsureOrderDeadline(rp, database.DeadlineScheduledRelease, orderID, releaseAt); err != nil {
+			logging.Error("Failed to restore scheduled order release", logrus.Fields{"error": err, "orderID": orderID})
+			return
+		}
+	}
+}
+
+// 多次广播仍无人抢单（kind 为 order_ungrabbed）或订单已移出大厅（kind 为 order_hall_expired），通知商家和运营频道
+func escalateUngrabbedOrder(rp *database.RedisPool, order *models.Order, kind string, rebroadcasts int64) {
+	notification := map[string]interface{}{
+		"type":         kind,
+		"order_id":     order.OrderID,
+		"shop_id":      order.ShopID,
+		"rebroadcasts": rebroadcasts,
+		"timestamp":    time.Now().Unix(),
+	}
+	notifJSON, _ := json.Marshal(notification)
+	for _, channel := range []string{fmt.Sprintf("shop_%d", order.ShopID), "ops_alerts"} {
+		if err := database.PublishMessage(rp, channel, string(notifJSON)); err != nil {
+			logging.Warn("Failed to escalate ungrabbed order", logrus.Fields{"error": err, "channel": channel, "orderID": order.OrderID})
+		}
+	}
+}
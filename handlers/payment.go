@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"take-out/database"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"take-out/payment"
+	"take-out/response"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 支付渠道，由 main 在加载配置后通过 SetPaymentProvider 设置
+var paymentProvider payment.Provider
+
+// SetPaymentProvider 设置支付和退款使用的支付渠道，需在注册路由之前调用
+func SetPaymentProvider(provider payment.Provider) {
+	paymentProvider = provider
+}
+
+// 用户为待支付订单发起支付：已有未完成的支付单时直接返回，上一次支付失败时创建新的支付单
+func HandleOrderPay(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		var payRequest struct {
+			orderRef
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payRequest); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if !resolveOrderRef(w, db, &payRequest.orderRef) {
+			return
+		}
+
+		order, err := database.QueryOrderStatus(db, payRequest.OrderID)
+		if err != nil {
+			writeOrderError(w, err)
+			return
+		}
+		if order.UserID != userID {
+			response.Forbidden(w, "无权支付该订单")
+			return
+		}
+		if order.ParentID != 0 {
+			response.Conflict(w, "该订单属于跨店合并订单，请支付合并订单")
+			return
+		}
+		if order.OrderStatus != models.OrderStatusAwaitingPayment {
+			response.Conflict(w, "订单当前状态无需支付")
+			return
+		}
+
+		latest, err := database.QueryLatestPayment(db, order.OrderID)
+		if err != nil && !errors.Is(err, database.ErrPaymentNotFound) {
+			response.ServerError(w, err)
+			return
+		}
+		if latest != nil && latest.Status == models.PaymentPending {
+			response.Success(w, latest, "支付单已创建")
+			return
+		}
+
+		p, err := createPayment(db, order)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		response.Created(w, p, "支付单已创建")
+	}
+}
+
+// 支付渠道异步回调，无需用户认证，由渠道签名保证来源可信
+// 渠道会重试未成功确认的回调，重复回调不会重复通知商家
+func HandlePaymentCallback(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			response.BadRequest(w, "请求格式错误", "读取回调内容失败")
+			return
+		}
+		event, err := paymentProvider.ParseCallback(r.Header, body)
+		if err != nil {
+			if errors.Is(err, payment.ErrInvalidSignature) {
+				monitoring.PaymentCallbacksTotal.WithLabelValues(paymentProvider.Name(), "invalid_signature").Inc()
+				logging.Warn("Payment callback signature rejected", logrus.Fields{"remoteAddr": r.RemoteAddr})
+				response.Unauthorized(w, err.Error())
+			} else {
+				response.BadRequest(w, "回调格式错误", err.Error())
+			}
+			return
+		}
+
+		if event.Result == payment.ResultFailed {
+			_, err := database.FailPayment(db, event.ProviderRef, event.Reason)
+			if err != nil && !errors.Is(err, database.ErrPaymentClosed) {
+				response.ServerError(w, err)
+				return
+			}
+			monitoring.PaymentCallbacksTotal.WithLabelValues(paymentProvider.Name(), "failed").Inc()
+			response.Success(w, nil, "已处理支付失败通知")
+			return
+		}
+
+		p, changed, err := database.ConfirmPayment(db, event.ProviderRef, event.Amount)
+		switch {
+		case errors.Is(err, database.ErrPaymentOrderClosed):
+			// 款项已到账但订单不再需要支付，向渠道确认收到回调，并原路退回本次款项
+			monitoring.PaymentCallbacksTotal.WithLabelValues(paymentProvider.Name(), "order_closed").Inc()
+			for _, orderID := range paymentOrderIDs(db, p) {
+				processApprovedRefunds(db, rp, orderID)
+			}
+			response.Success(w, nil, "订单已关闭，款项将退回")
+			return
+		case errors.Is(err, database.ErrPaymentNotFound):
+			response.NotFound(w, err.Error())
+			return
+		case errors.Is(err, database.ErrPaymentAmountMismatch):
+			monitoring.PaymentCallbacksTotal.WithLabelValues(paymentProvider.Name(), "amount_mismatch").Inc()
+			response.ValidationError(w, err.Error(), "amount")
+			return
+		case err != nil:
+			response.ServerError(w, err)
+			return
+		}
+
+		if changed {
+			for _, orderID := range paymentOrderIDs(db, p) {
+				onOrderPaid(db, rp, orderID)
+			}
+			monitoring.PaymentCallbacksTotal.WithLabelValues(paymentProvider.Name(), "paid").Inc()
+		} else {
+			monitoring.PaymentCallbacksTotal.WithLabelValues(paymentProvider.Name(), "duplicate").Inc()
+		}
+		response.Success(w, map[string]interface{}{
+			"order_id":   p.OrderID,
+			"parent_id":  p.ParentID,
+			"payment_id": p.PaymentID,
+			"status":     p.Status,
+		}, "已处理支付成功通知")
+	}
+}
+
+// 在支付渠道创建支付单并保存，金额为订单应付金额
+func createPayment(db *sql.DB, order *models.Order) (*models.Payment, error) {
+	p := &models.Payment{
+		OrderID: order.OrderID,
+		UserID:  order.UserID,
+		Amount:  order.PayableAmount,
+	}
+	if err := savePaymentIntent(db, p, fmt.Sprintf("外卖订单 %s", order.OrderNo)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// 为跨店合并订单创建一笔支付单，金额为各子订单应付金额之和
+func createParentPayment(db *sql.DB, parent *models.ParentOrder) (*models.Payment, error) {
+	p := &models.Payment{
+		ParentID: parent.ParentID,
+		UserID:   parent.UserID,
+		Amount:   parent.PayableAmount,
+	}
+	if err := savePaymentIntent(db, p, fmt.Sprintf("外卖合并订单 %s", parent.ParentNo)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func savePaymentIntent(db *sql.DB, p *models.Payment, subject string) error {
+	intent, err := paymentProvider.CreateIntent(payment.IntentRequest{
+		OrderID:  p.OrderID,
+		ParentID: p.ParentID,
+		UserID:   p.UserID,
+		Amount:   p.Amount,
+		Subject:  subject,
+	})
+	if err != nil {
+		logging.Error("Failed to create payment intent", logrus.Fields{"error": err, "orderID": p.OrderID, "parentID": p.ParentID})
+		return fmt.Errorf("创建支付单失败: %v", err)
+	}
+	p.Provider = paymentProvider.Name()
+	p.ProviderRef = intent.ProviderRef
+	p.PayURL = intent.PayURL
+	return database.CreatePayment(db, p)
+}
+
+// 支付记录覆盖的订单：普通订单为订单本身，合并订单为全部子订单
+func paymentOrderIDs(db *sql.DB, p *models.Payment) []int {
+	if p.ParentID == 0 {
+		return []int{p.OrderID}
+	}
+	orderIDs, err := database.QueryChildOrderIDs(db, p.ParentID)
+	if err != nil {
+		logging.Error("Failed to load child orders of payment", logrus.Fields{"error": err, "parentID": p.ParentID})
+	}
+	return orderIDs
+}
+
+// 订单支付成功：取消支付超时，通知商家有新订单；未到备餐时间的预约单等到通知时间再通知商家
+func onOrderPaid(db *sql.DB, rp *database.RedisPool, orderID int) {
+	database.RemoveOrderDeadline(rp, database.DeadlinePayment, orderID)
+	invalidateOrderCache(rp, orderID)
+
+	order, err := database.QueryOrderStatus(db, orderID)
+	if err != nil {
+		logging.Error("Failed to load paid order", logrus.Fields{"error": err, "orderID": orderID})
+		return
+	}
+	if order.OrderStatus == models.OrderStatusScheduled && order.ReleaseAt != nil {
+		database.ScheduleOrderDeadline(rp, database.DeadlineScheduledRelease, orderID, *order.ReleaseAt)
+		return
+	}
+	notifyShopNewOrder(db, rp, orderID)
+}
+
+// 订单进入商家待确认：开始商家接单计时，发布新订单消息并通知商家
+func notifyShopNewOrder(db *sql.DB, rp *database.RedisPool, orderID int) {
+	database.ScheduleOrderDeadline(rp, database.DeadlineShopAccept, orderID, time.Now().Add(orderAcceptTimeout))
+
+	order, err := database.QueryOrderStatus(db, orderID)
+	if err != nil {
+		logging.Error("Failed to load order for shop notification", logrus.Fields{"error": err, "orderID": orderID})
+		return
+	}
+	if err := database.UserPlaceOrder(order.OrderID, order.UserID, order.ShopID, 0, order.Items, rp); err != nil {
+		logging.Error("Failed to publish new order", logrus.Fields{"error": err, "orderID": orderID})
+	}
+	if err := database.NotifyShop(db, rp, orderID); err != nil {
+		logging.Error("Failed to notify shop of new order", logrus.Fields{"error": err, "orderID": orderID})
+	}
+}
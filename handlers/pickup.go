@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"take-out/database"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/response"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 取餐码位数
+const pickupCodeLength = 6
+
+// 生成自取订单的取餐码，使用 crypto/rand 避免被他人猜中冒领
+func newPickupCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", fmt.Errorf("生成取餐码失败: %v", err)
+	}
+	return fmt.Sprintf("%0*d", pickupCodeLength, n.Int64()), nil
+}
+
+// 商家备餐完成，通知自取订单的顾客到店取餐：已接单 -> 待取餐
+// POST /api/shop/order/ready {"order_id": 1} 或 {"order_no": "..."}
+func HandleReadyForPickup(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
+			return
+		}
+
+		var req struct {
+			orderRef
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if !resolveOrderRef(w, db, &req.orderRef) {
+			return
+		}
+		if !checkOrderShop(w, db, req.OrderID, shopID) {
+			return
+		}
+
+		// 配送订单由状态机返回 *models.FulfillmentError
+		shop := models.OrderActor{Role: models.RoleShop, ID: shopID}
+		if err := database.UpdateOrderStatus(db, req.OrderID, models.OrderStatusReadyForPickup, shop, ""); err != nil {
+			writeOrderError(w, err)
+			return
+		}
+		invalidateOrderCache(rp, req.OrderID)
+
+		order, err := database.QueryOrderStatus(db, req.OrderID)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		notification := map[string]interface{}{
+			"type":      "order_ready_for_pickup",
+			"order_id":  order.OrderID,
+			"order_no":  order.OrderNo,
+			"timestamp": time.Now().Unix(),
+		}
+		notifJSON, _ := json.Marshal(notification)
+		if err := database.PublishMessage(rp, fmt.Sprintf("user_%d", order.UserID), string(notifJSON)); err != nil {
+			logging.Warn("Failed to notify user of pickup", logrus.Fields{"error": err, "orderID": order.OrderID})
+		}
+
+		response.Success(w, map[string]interface{}{
+			"order_id": order.OrderID,
+			"order_no": order.OrderNo,
+			"status":   order.OrderStatus,
+		}, "已通知顾客到店取餐")
+	}
+}
+
+// 顾客到店后商家核对取餐码，确认自取订单已取餐：待取餐 -> 已完成
+// POST /api/shop/order/picked_up {"order_id": 1, "pickup_code": "123456"}
+func HandlePickedUp(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
+			return
+		}
+
+		var req struct {
+			orderRef
+			PickupCode string `json:"pickup_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		req.PickupCode = strings.TrimSpace(req.PickupCode)
+		if req.PickupCode == "" {
+			response.ValidationError(w, "取餐码不能为空", "pickup_code")
+			return
+		}
+		if !resolveOrderRef(w, db, &req.orderRef) {
+			return
+		}
+		if !checkOrderShop(w, db, req.OrderID, shopID) {
+			return
+		}
+
+		if err := database.CompletePickupTx(db, req.OrderID, shopID, req.PickupCode); err != nil {
+			if errors.Is(err, database.ErrPickupCodeMismatch) {
+				response.ValidationError(w, err.Error(), "pickup_code")
+			} else {
+				writeOrderError(w, err)
+			}
+			return
+		}
+		invalidateOrderCache(rp, req.OrderID)
+
+		response.Success(w, map[string]interface{}{
+			"order_id": req.OrderID,
+			"status":   models.OrderStatusCompleted,
+		}, "顾客已取餐，订单完成")
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"take-out/database"
 	"take-out/models"
@@ -37,7 +38,7 @@ func HandleAddProduct(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 			response.ValidationError(w, "商品名称不能为空", "product_name")
 			return
 		}
-		if product.Price <= 0 {
+		if !product.Price.IsPositive() {
 			response.ValidationError(w, "商品价格必须大于0", "price")
 			return
 		}
@@ -45,6 +46,10 @@ func HandleAddProduct(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 			response.ValidationError(w, "商品库存不能为负数", "stock")
 			return
 		}
+		if product.PackagingFee.IsNegative() {
+			response.ValidationError(w, "打包费不能为负数", "packaging_fee")
+			return
+		}
 
 		// 将从上下文中获取的 shopID 赋值给 product
 		product.ShopID = shopID
@@ -57,12 +62,13 @@ func HandleAddProduct(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 		}
 
 		//返回新商品的ID和信息
-		product.ProductID = ProductID
+		product.ProductID = int(ProductID)
 		response.Created(w, map[string]int64{"product_id": ProductID}, "商品添加成功")
 	}
 }
 
 //HTTP处理函数：更新商品库存
+//传 stock 直接设置库存；传 delta 按增量调整，与下单预占并发时不会覆盖对方的修改
 func HandleUpdateProductStock(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		//验证 HTTP 方法
@@ -71,10 +77,17 @@ func HandleUpdateProductStock(db *sql.DB, rp *database.RedisPool) http.HandlerFu
 			return
 		}
 
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的商店ID或权限不足")
+			return
+		}
+
 		//解析请求体中的 JSON 数据
 		var product struct {
-			ProductID int `json:"product_id"`
-			Stock     int `json:"stock"`
+			ProductID int  `json:"product_id"`
+			Stock     int  `json:"stock"`
+			Delta     *int `json:"delta"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
 			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
@@ -86,19 +99,44 @@ func HandleUpdateProductStock(db *sql.DB, rp *database.RedisPool) http.HandlerFu
 			response.ValidationError(w, "商品ID不能为空", "product_id")
 			return
 		}
+
+		//按增量调整库存
+		if product.Delta != nil {
+			stock, err := database.AdjustProductStock(rp, db, shopID, product.ProductID, *product.Delta)
+			if err != nil {
+				writeStockError(w, err)
+				return
+			}
+			response.Success(w, map[string]int{"product_id": product.ProductID, "stock": stock}, "库存更新成功")
+			return
+		}
+
 		if product.Stock < 0 {
 			response.ValidationError(w, "库存不能为负数", "stock")
 			return
 		}
 
 		//更新商品库存
-		err := database.UpdateProductStock(rp, db, product.ProductID, product.Stock)
+		err := database.UpdateProductStock(rp, db, shopID, product.ProductID, product.Stock)
 		if err != nil {
-			response.ServerError(w, err)
+			writeStockError(w, err)
 			return
 		}
 
 		//返回成功信息
-		response.Success(w, nil, "库存更新成功")
+		response.Success(w, map[string]int{"product_id": product.ProductID, "stock": product.Stock}, "库存更新成功")
 	}
-}
\ No newline at end of file
+}
+
+// 库存不足返回 409，商品不存在或不属于本店返回 404
+func writeStockError(w http.ResponseWriter, err error) {
+	var outOfStock *database.OutOfStockError
+	switch {
+	case errors.As(err, &outOfStock):
+		response.Conflict(w, outOfStock.Error())
+	case errors.Is(err, database.ErrProductNotFound):
+		response.NotFound(w, err.Error())
+	default:
+		response.ServerError(w, err)
+	}
+}
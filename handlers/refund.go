@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"take-out/database"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"take-out/payment"
+	"take-out/response"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 退款重试配置，由 LoadConfig 从环境变量读取
+var (
+	refundRetryAfter        time.Duration // 批准后超过该时长仍未完成的退款单重新执行
+	refundRetryPollInterval time.Duration
+)
+
+const refundRetryBatchLimit = 50
+
+// 退款申请，Items 为空且 Amount 为 0 时退回订单全部可退金额
+type refundRequest struct {
+	orderRef
+	Items      []models.RefundItem `json:"items"`
+	Amount     models.Money        `json:"amount"`
+	ReasonCode string              `json:"reason_code"`
+	Reason     string              `json:"reason"`
+}
+
+// 用户按商品明细申请部分退款（如漏送、质量问题），需商家审核
+func HandleApplyRefund(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+
+		req, ok := decodeRefundRequest(w, r, db)
+		if !ok {
+			return
+		}
+		if len(req.Items) == 0 {
+			response.ValidationError(w, "请选择需要退款的商品", "items")
+			return
+		}
+
+		order, err := database.QueryOrderStatus(db, req.OrderID)
+		if err != nil {
+			writeOrderError(w, err)
+			return
+		}
+		if order.UserID != userID {
+			response.Forbidden(w, "无权为该订单申请退款")
+			return
+		}
+
+		refund := &models.Refund{
+			OrderID:     req.OrderID,
+			Items:       req.Items,
+			ReasonCode:  req.ReasonCode,
+			Reason:      req.Reason,
+			RequestedBy: models.OrderActor{Role: models.RoleUser, ID: userID},
+		}
+		if err := database.CreateRefund(db, refund); err != nil {
+			writeRefundError(w, err)
+			return
+		}
+		response.Created(w, refund, "退款申请已提交，等待商家审核")
+	}
+}
+
+// 商家主动为本店订单退款（如漏送商品），商家即审核方，创建后立即通过支付渠道退款
+func HandleShopCreateRefund(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
+			return
+		}
+
+		req, ok := decodeRefundRequest(w, r, db)
+		if !ok {
+			return
+		}
+		if req.Amount.IsNegative() {
+			response.ValidationError(w, "退款金额不能为负数", "amount")
+			return
+		}
+		if !checkOrderShop(w, db, req.OrderID, shopID) {
+			return
+		}
+
+		refund := &models.Refund{
+			OrderID:     req.OrderID,
+			Items:       req.Items,
+			Amount:      req.Amount,
+			ReasonCode:  req.ReasonCode,
+			Reason:      req.Reason,
+			Status:      models.RefundApproved,
+			RequestedBy: models.OrderActor{Role: models.RoleShop, ID: shopID},
+		}
+		if err := database.CreateRefund(db, refund); err != nil {
+			writeRefundError(w, err)
+			return
+		}
+
+		refund = executeRefund(db, rp, refund)
+		response.Created(w, refund, "退款已提交")
+	}
+}
+
+// 商家查询本店订单的退款单，可按 status 过滤，如 status=pending 查看待审核的退款
+func HandleShopRefunds(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
+			return
+		}
+
+		refunds, err := database.QueryShopRefunds(db, shopID, r.URL.Query().Get("status"))
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		response.Success(w, refunds, "获取退款单成功")
+	}
+}
+
+// 商家审核退款单，批准后立即通过支付渠道退款；渠道失败的退款单可以重新批准重试
+func HandleReviewRefund(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
+			return
+		}
+
+		var reviewRequest struct {
+			RefundID int    `json:"refund_id"`
+			Approve  bool   `json:"approve"`
+			Note     string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reviewRequest); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		if !reviewRequest.Approve && reviewRequest.Note == "" {
+			response.ValidationError(w, "拒绝退款需填写原因", "note")
+			return
+		}
+
+		shop := models.OrderActor{Role: models.RoleShop, ID: shopID}
+		refund, err := database.ReviewRefund(db, reviewRequest.RefundID, shop, reviewRequest.Approve, reviewRequest.Note)
+		if err != nil {
+			writeRefundError(w, err)
+			return
+		}
+
+		if refund.Status == models.RefundApproved {
+			refund = executeRefund(db, rp, refund)
+		} else {
+			notifyRefundUpdate(db, rp, refund)
+		}
+		response.Success(w, refund, "退款单已审核")
+	}
+}
+
+func decodeRefundRequest(w http.ResponseWriter, r *http.Request, db *sql.DB) (refundRequest, bool) {
+	var req refundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+		return req, false
+	}
+	if !resolveOrderRef(w, db, &req.orderRef) {
+		return req, false
+	}
+	if !models.IsValidRefundReason(req.ReasonCode) {
+		response.ValidationError(w, "退款原因无效", "reason_code")
+		return req, false
+	}
+	for _, item := range req.Items {
+		if item.OrderItemID == 0 || item.Quantity <= 0 {
+			response.ValidationError(w, "退款商品明细和数量不能为空", "items")
+			return req, false
+		}
+	}
+	return req, true
+}
+
+// 执行订单所有已批准但尚未退款的退款单，取消订单或重复支付后调用
+func processApprovedRefunds(db *sql.DB, rp *database.RedisPool, orderID int) {
+	refunds, err := database.QueryOrderRefunds(db, orderID)
+	if err != nil {
+		logging.Error("Failed to load approved refunds", logrus.Fields{"error": err, "orderID": orderID})
+		return
+	}
+	for i := range refunds {
+		if refunds[i].Status == models.RefundApproved {
+			executeRefund(db, rp, &refunds[i])
+		}
+	}
+}
+
+// StartRefundRetryWorker 在服务启动时运行，定期重新执行批准后超过 REFUND_RETRY_AFTER 仍未完成的退款单
+// 退款单批准后由请求或取消流程立即执行，进程在此期间崩溃、或渠道已退款但更新状态失败时退款单停留在 approved，由该任务兜底
+// 同一退款单的渠道退款单号不变，渠道据此去重，重复执行不会重复退款
+func StartRefundRetryWorker(db *sql.DB, rp *database.RedisPool) {
+	ticker := time.NewTicker(refundRetryPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		refundIDs, err := database.ClaimStaleRefunds(db, time.Now().Add(-refundRetryAfter), refundRetryBatchLimit)
+		if err != nil {
+			continue
+		}
+		for _, refundID := range refundIDs {
+			refund, err := database.QueryRefund(db, refundID)
+			if err != nil || refund.Status != models.RefundApproved {
+				continue
+			}
+			logging.Info("Retrying approved refund", logrus.Fields{"refundID": refundID, "orderID": refund.OrderID})
+			executeRefund(db, rp, refund)
+		}
+	}
+}
+
+// 通过支付渠道原路退款并记录结果，返回最新的退款单；渠道失败时退款单标记为失败，等待商家重试
+func executeRefund(db *sql.DB, rp *database.RedisPool, refund *models.Refund) *models.Refund {
+	p, err := database.QueryPayment(db, refund.PaymentID)
+	if err == nil {
+		var result *payment.RefundResult
+		result, err = paymentProvider.Refund(payment.RefundRequest{
+			ProviderRef: p.ProviderRef,
+			RefundNo:    fmt.Sprintf("refund_%d", refund.RefundID),
+			Amount:      refund.Amount,
+			Reason:      refund.ReasonCode,
+		})
+		if err == nil {
+			err = database.CompleteRefund(db, refund.RefundID, result.ProviderRefundRef)
+			if err == nil {
+				monitoring.RefundsTotal.WithLabelValues(refund.ReasonCode, "succeeded").Inc()
+			}
+		} else {
+			logging.Warn("Provider refund failed", logrus.Fields{"error": err, "refundID": refund.RefundID})
+			monitoring.RefundsTotal.WithLabelValues(refund.ReasonCode, "failed").Inc()
+			database.FailRefund(db, refund.RefundID, err.Error())
+		}
+	}
+	if err != nil {
+		logging.Error("Failed to execute refund", logrus.Fields{"error": err, "refundID": refund.RefundID})
+	}
+
+	latest, qerr := database.QueryRefund(db, refund.RefundID)
+	if qerr != nil {
+		return refund
+	}
+	invalidateOrderCache(rp, latest.OrderID)
+	notifyRefundUpdate(db, rp, latest)
+	return latest
+}
+
+// 通知用户退款进度
+func notifyRefundUpdate(db *sql.DB, rp *database.RedisPool, refund *models.Refund) {
+	order, err := database.QueryOrderStatus(db, refund.OrderID)
+	if err != nil {
+		return
+	}
+	notification := map[string]interface{}{
+		"type":      "refund_update",
+		"order_id":  refund.OrderID,
+		"refund_id": refund.RefundID,
+		"amount":    refund.Amount,
+		"status":    refund.Status,
+		"timestamp": time.Now().Unix(),
+	}
+	notifJSON, _ := json.Marshal(notification)
+	if err := database.PublishMessage(rp, fmt.Sprintf("user_%d", order.UserID), string(notifJSON)); err != nil {
+		logging.Warn("Failed to notify refund update", logrus.Fields{"error": err, "refundID": refund.RefundID})
+	}
+}
+
+// 将退款相关错误映射为统一响应
+func writeRefundError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrRefundNotFound), errors.Is(err, database.ErrRefundItemNotFound):
+		response.NotFound(w, err.Error())
+	case errors.Is(err, database.ErrRefundNotPaid),
+		errors.Is(err, database.ErrRefundExceedsPaid),
+		errors.Is(err, database.ErrRefundItemExceeds),
+		errors.Is(err, database.ErrRefundNotReviewable):
+		response.Conflict(w, err.Error())
+	default:
+		response.ServerError(w, err)
+	}
+}
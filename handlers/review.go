@@ -3,6 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"take-out/database"
@@ -28,17 +29,42 @@ func CreateReview(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
 			return
 		}
 
-		var review models.Review
-		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		// 与其他订单接口一致，可以传 order_id 或 order_no
+		var reviewRequest struct {
+			models.Review
+			OrderNo string `json:"order_no"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reviewRequest); err != nil {
 			http.Error(w, "请求体解析错误", http.StatusBadRequest)
 			return
 		}
+		ref := orderRef{OrderID: reviewRequest.OrderID, OrderNo: reviewRequest.OrderNo}
+		if !resolveOrderRef(w, db, &ref) {
+			return
+		}
+		review := reviewRequest.Review
+		review.OrderID = ref.OrderID
 
 		// TODO: 在这里添加验证逻辑
 		// 1. 验证订单是否存在且状态为 'completed'
 		// 2. 验证发起请求的用户是否就是下单的用户
 		// 3. 验证订单是否已经评价过
 
+		// 自取订单没有骑手，不评价骑手维度
+		order, err := database.QueryOrderStatus(db, review.OrderID)
+		if err != nil {
+			if errors.Is(err, database.ErrOrderNotFound) {
+				http.Error(w, "订单不存在", http.StatusNotFound)
+			} else {
+				log.Printf("查询订单失败: %v", err)
+				http.Error(w, "评价创建失败", http.StatusInternalServerError)
+			}
+			return
+		}
+		if order.FulfillmentType == models.FulfillmentPickup {
+			review.RiderID = nil
+		}
+
 		reviewID, err := database.InsertReview(db, &review)
 		if err != nil {
 			log.Printf("评价创建失败: %v", err)
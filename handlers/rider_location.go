@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"take-out/database"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/response"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 骑手位置配置，由 LoadConfig 从环境变量读取
+var (
+	riderLocationStaleAfter       time.Duration // 超过该时长未上报定位的骑手移出位置索引
+	riderLocationSnapshotInterval time.Duration // 把实时位置快照写入数据库的间隔
+	riderTrackLength              int           // 每位骑手保留的最近定位点数
+)
+
+const (
+	riderLocationMaxBatch   = 100 // 单次最多上报的定位点数
+	riderLocationSweepLimit = 500 // 每次最多剔除的骑手数
+	nearbyRidersMaxLimit    = 50
+)
+
+// 骑手上报定位：可以只传一个点，也可以把网络断开期间缓存的定位点批量上报
+// 只接收在线骑手的定位，上报定位同时视为心跳；骑手已离线时返回 409
+// POST /api/rider/location {"latitude": 31.23, "longitude": 121.47}
+// POST /api/rider/location {"points": [{"latitude": 31.23, "longitude": 121.47, "recorded_at": "2024-01-01T12:00:00Z"}, ...]}
+func HandleUpdateRiderLocation(rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+
+		riderID, ok := r.Context().Value("riderID").(int)
+		if !ok || riderID == 0 {
+			response.Unauthorized(w, "无效的骑手身份")
+			return
+		}
+
+		var req struct {
+			models.LocationPoint
+			Points []models.LocationPoint `json:"points"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			response.BadRequest(w, "请求格式错误", "无效的JSON格式")
+			return
+		}
+		points := req.Points
+		if len(points) == 0 {
+			points = []models.LocationPoint{req.LocationPoint}
+		}
+		if len(points) > riderLocationMaxBatch {
+			response.ValidationError(w, "单次最多上报 100 个定位点", "points")
+			return
+		}
+
+		now := time.Now()
+		for i := range points {
+			if !validCoordinate(points[i].Latitude, points[i].Longitude) {
+				response.ValidationError(w, "经纬度超出范围", "points")
+				return
+			}
+			// 未传定位时间时按收到的时间，客户端时钟超前时不超过收到的时间
+			if points[i].RecordedAt.IsZero() || points[i].RecordedAt.After(now) {
+				points[i].RecordedAt = now
+			}
+		}
+		// 批量上报的点可能乱序，按定位时间升序排列
+		sort.SliceStable(points, func(i, j int) bool { return points[i].RecordedAt.Before(points[j].RecordedAt) })
+		latest := points[len(points)-1]
+		if !latest.RecordedAt.After(now.Add(-riderLocationStaleAfter)) {
+			// 整批都是过期的定位，不再更新当前位置
+			response.ValidationError(w, "定位点已过期", "recorded_at")
+			return
+		}
+
+		online, err := database.TouchRiderHeartbeat(rp, riderID, now)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		if !online {
+			response.Conflict(w, "骑手已离线，请重新上线")
+			return
+		}
+		// 比已记录位置更早的批次只追加到轨迹，current 为 false
+		current, err := database.UpdateRiderLocation(rp, riderID, points, riderTrackLength, riderLocationStaleAfter)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		response.Success(w, map[string]interface{}{
+			"accepted":    len(points),
+			"current":     current,
+			"latitude":    latest.Latitude,
+			"longitude":   latest.Longitude,
+			"recorded_at": latest.RecordedAt,
+		}, "位置已更新")
+	}
+}
+
+// 商家查看附近的在线骑手，按距离从近到远
+// GET /api/shop/nearby_riders?radius_km=3&limit=20
+func HandleShopNearbyRiders(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shopID, ok := r.Context().Value("shopID").(int)
+		if !ok || shopID == 0 {
+			response.Unauthorized(w, "无效的店铺身份")
+			return
+		}
+
+		radiusKm := dispatchEngine.RadiusKm
+		if v, err := strconv.ParseFloat(r.URL.Query().Get("radius_km"), 64); err == nil && v > 0 {
+			radiusKm = math.Min(v, dispatchEngine.RadiusKm)
+		}
+		limit := nearbyRidersMaxLimit
+		if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v < limit {
+			limit = v
+		}
+
+		shop, err := database.QueryShopDeliveryInfo(db, shopID)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		if shop.ShopLatitude == 0 && shop.ShopLongitude == 0 {
+			response.BadRequest(w, "店铺未设置位置", nil)
+			return
+		}
+
+		riders, err := database.NearbyRiders(rp, shop.ShopLatitude, shop.ShopLongitude, radiusKm, limit, time.Now().Add(-riderLocationStaleAfter))
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		if riders == nil {
+			riders = []models.RiderLocation{}
+		}
+		response.Success(w, map[string]interface{}{
+			"radius_km": radiusKm,
+			"riders":    riders,
+		}, "获取附近骑手成功")
+	}
+}
+
+// 用户查看配送中订单的骑手位置和最近轨迹
+// GET /api/user/order/rider_location?order_id=1
+func HandleOrderRiderLocation(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value("userID").(int)
+		if !ok || userID == 0 {
+			response.Unauthorized(w, "无效的用户身份")
+			return
+		}
+		orderID, ok := parseOrderRefQuery(w, r, db)
+		if !ok {
+			return
+		}
+
+		order, err := database.QueryOrderStatus(db, orderID)
+		if err != nil || order.UserID != userID {
+			response.NotFound(w, "订单不存在")
+			return
+		}
+		if order.OrderStatus != models.OrderStatusDelivering || order.RiderID == 0 {
+			response.Conflict(w, "订单不在配送中")
+			return
+		}
+
+		location, err := database.QueryRiderLocation(rp, order.RiderID)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		track, err := database.QueryRiderTrack(rp, order.RiderID)
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		response.Success(w, map[string]interface{}{
+			"order_id": order.OrderID,
+			"rider_id": order.RiderID,
+			"location": location,
+			"track":    track,
+		}, "获取骑手位置成功")
+	}
+}
+
+// StartRiderLocationWorker 在服务启动时运行，定期把骑手的实时位置快照写入数据库，并把长时间未上报定位的骑手移出位置索引
+func StartRiderLocationWorker(db *sql.DB, rp *database.RedisPool) {
+	ticker := time.NewTicker(riderLocationSnapshotInterval)
+	defer ticker.Stop()
+
+	since := time.Now().Add(-riderLocationStaleAfter)
+	for range ticker.C {
+		now := time.Now()
+		locations, err := database.RiderLocationsSince(rp, since)
+		if err == nil {
+			if _, err := database.SaveRiderLocationSnapshots(db, locations); err == nil {
+				// 写入失败时下一轮重新写入这段时间内的位置
+				since = now.Add(-time.Second)
+			}
+		}
+
+		removed, err := database.SweepStaleRiderLocations(rp, now.Add(-riderLocationStaleAfter), riderLocationSweepLimit)
+		if err == nil && removed > 0 {
+			logging.Info("Stale rider locations removed", logrus.Fields{"count": removed})
+		}
+	}
+}
+
+func validCoordinate(lat, lon float64) bool {
+	// Redis GEO 支持的纬度范围为 ±85.05112878
+	return lat >= -85.05112878 && lat <= 85.05112878 && lon >= -180 && lon <= 180 && !(lat == 0 && lon == 0)
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"take-out/database"
+	"take-out/logging"
+	"take-out/models"
+	"take-out/monitoring"
+	"take-out/response"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 骑手在线状态配置，由 LoadConfig 从环境变量读取
+var (
+	riderMaxActiveOrders      int           // 同时配送的订单上限，达到上限时自动变为忙碌
+	riderHeartbeatTimeout     time.Duration // 超过该时长没有心跳的骑手标记为离线
+	riderPresencePollInterval time.Duration // 检查心跳超时的间隔
+)
+
+const (
+	riderPresenceReconcileInterval = time.Minute // 核对数据库中在线骑手与心跳记录的间隔
+	riderPresenceBatchLimit        = 500
+)
+
+// 骑手上线，配送中的订单已达上限时直接进入忙碌；上线后需定期调用 /heartbeat（上报定位也视为心跳）
+// POST /api/rider/online
+func HandleRiderOnline(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+		riderID, ok := r.Context().Value("riderID").(int)
+		if !ok || riderID == 0 {
+			response.Unauthorized(w, "无效的骑手身份")
+			return
+		}
+
+		// 先记录心跳再更新数据库：核对任务只会把数据库中在线但没有心跳的骑手标记为离线
+		if err := database.RegisterRiderHeartbeat(rp, riderID, time.Now()); err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		if _, err := database.SetRiderOnline(db, riderID, riderMaxActiveOrders); err != nil {
+			writeRiderStatusError(w, err)
+			return
+		}
+		logging.Info("Rider online", logrus.Fields{"riderID": riderID})
+		writeRiderAvailability(w, db, riderID, "已上线")
+	}
+}
+
+// 骑手下线，还有配送中的订单时返回 409；下线后移出位置索引，待答复的派单转给下一位骑手
+// POST /api/rider/offline
+func HandleRiderOffline(db *sql.DB, rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+		riderID, ok := r.Context().Value("riderID").(int)
+		if !ok || riderID == 0 {
+			response.Unauthorized(w, "无效的骑手身份")
+			return
+		}
+
+		if err := database.SetRiderOffline(db, riderID); err != nil {
+			writeRiderStatusError(w, err)
+			return
+		}
+		// 心跳记录移除失败时由心跳超时任务兜底
+		database.RemoveRiderHeartbeat(rp, riderID)
+		releaseRiderOffers(db, rp, riderID)
+		logging.Info("Rider offline", logrus.Fields{"riderID": riderID})
+		writeRiderAvailability(w, db, riderID, "已下线")
+	}
+}
+
+// 在线骑手的心跳，骑手已离线（心跳超时被下线）时返回 409，需重新上线
+// POST /api/rider/heartbeat
+func HandleRiderHeartbeat(rp *database.RedisPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			response.Error(w, "只支持 POST 请求", http.StatusMethodNotAllowed)
+			return
+		}
+		riderID, ok := r.Context().Value("riderID").(int)
+		if !ok || riderID == 0 {
+			response.Unauthorized(w, "无效的骑手身份")
+			return
+		}
+
+		online, err := database.TouchRiderHeartbeat(rp, riderID, time.Now())
+		if err != nil {
+			response.ServerError(w, err)
+			return
+		}
+		if !online {
+			response.Conflict(w, "骑手已离线，请重新上线")
+			return
+		}
+		response.Success(w, map[string]interface{}{
+			"rider_id":        riderID,
+			"timeout_seconds": int(riderHeartbeatTimeout.Seconds()),
+		}, "心跳已记录")
+	}
+}
+
+// 查询骑手当前的接单状态
+// GET /api/rider/status
+func HandleRiderStatus(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		riderID, ok := r.Context().Value("riderID").(int)
+		if !ok || riderID == 0 {
+			response.Unauthorized(w, "无效的骑手身份")
+			return
+		}
+		writeRiderAvailability(w, db, riderID, "获取骑手状态成功")
+	}
+}
+
+func writeRiderAvailability(w http.ResponseWriter, db *sql.DB, riderID int, message string) {
+	availability, err := database.QueryRiderAvailability(db, riderID)
+	if err != nil {
+		writeRiderStatusError(w, err)
+		return
+	}
+	availability.MaxActiveOrders = riderMaxActiveOrders
+	response.Success(w, availability, message)
+}
+
+func writeRiderStatusError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrRiderNotFound):
+		response.NotFound(w, err.Error())
+	case errors.Is(err, database.ErrRiderHasActiveOrders):
+		response.Conflict(w, err.Error())
+	default:
+		response.ServerError(w, err)
+	}
+}
+
+// 骑手下线后撤回其待答复的派单，并立即把订单派给下一位骑手
+func releaseRiderOffers(db *sql.DB, rp *database.RedisPool, riderID int) {
+	offers, err := database.WithdrawRiderDispatchOffers(db, riderID)
+	if err != nil {
+		return
+	}
+	for _, offer := range offers {
+		notifyRiderOffer(rp, "dispatch_offer_withdrawn", &offer)
+		monitoring.DispatchOffersTotal.WithLabelValues(models.OfferWithdrawn).Inc()
+		go advanceDispatch(db, rp, offer.OrderID)
+	}
+}
+
+// StartRiderPresenceWorker 在服务启动时运行，把心跳超时的骑手标记为离线，并定期更新各状态的骑手数量指标
+// 心跳保存在 Redis 中，数据库中在线但没有心跳记录的骑手（如 Redis 数据丢失）在核对时同样标记为离线
+func StartRiderPresenceWorker(db *sql.DB, rp *database.RedisPool) {
+	ticker := time.NewTicker(riderPresencePollInterval)
+	defer ticker.Stop()
+	reconcile := time.NewTicker(riderPresenceReconcileInterval)
+	defer reconcile.Stop()
+
+	reconcileRiderPresence(db, rp)
+	for {
+		select {
+		case <-ticker.C:
+			riderIDs, err := database.ClaimSilentRiders(rp, time.Now().Add(-riderHeartbeatTimeout), riderPresenceBatchLimit)
+			if err == nil {
+				markRidersOffline(db, rp, riderIDs)
+			}
+			updateRiderStatusGauges(db)
+		case <-reconcile.C:
+			reconcileRiderPresence(db, rp)
+		}
+	}
+}
+
+func reconcileRiderPresence(db *sql.DB, rp *database.RedisPool) {
+	available, err := database.QueryAvailableRiderIDs(db)
+	if err != nil {
+		logging.Error("Failed to query available riders", logrus.Fields{"error": err})
+		return
+	}
+	markRidersOffline(db, rp, available)
+}
+
+// 把没有心跳记录的骑手标记为离线、移出位置索引，并转出其待答复的派单；配送中的订单仍由该骑手完成
+// 标记前再核对一次心跳，跳过刚刚重新上线的骑手
+func markRidersOffline(db *sql.DB, rp *database.RedisPool, riderIDs []int) {
+	missing, err := database.RidersWithoutHeartbeat(rp, riderIDs)
+	if err != nil {
+		logging.Error("Failed to check rider heartbeats", logrus.Fields{"error": err})
+		return
+	}
+	changed, err := database.MarkRidersOffline(db, missing)
+	if err != nil {
+		return
+	}
+	for _, riderID := range changed {
+		database.RemoveRiderHeartbeat(rp, riderID)
+		releaseRiderOffers(db, rp, riderID)
+		monitoring.RidersTimedOutTotal.Inc()
+		logging.Info("Rider marked offline after heartbeat timeout", logrus.Fields{"riderID": riderID})
+	}
+}
+
+func updateRiderStatusGauges(db *sql.DB) {
+	counts, err := database.CountRidersByStatus(db)
+	if err != nil {
+		logging.Error("Failed to count riders by status", logrus.Fields{"error": err})
+		return
+	}
+	for _, status := range models.RiderStatuses {
+		monitoring.RidersByStatus.WithLabelValues(status).Set(float64(counts[status]))
+	}
+}
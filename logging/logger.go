@@ -103,3 +103,12 @@ func Warn(message string, fields logrus.Fields) {
 func Error(message string, fields logrus.Fields) {
 	Log(logrus.ErrorLevel, message, fields)
 }
+
+// Fatal 同步写入日志后退出进程，用于启动时无法继续运行的配置错误
+func Fatal(message string, fields logrus.Fields) {
+	if logger == nil {
+		fmt.Printf("logger not initialized: %s\n", message)
+		os.Exit(1)
+	}
+	logger.WithFields(fields).Fatal(message)
+}
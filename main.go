@@ -4,10 +4,12 @@ package main
 import (
 	"database/sql"
 	"net/http"
+	"take-out/config"
 	"take-out/database"
 	"take-out/handlers"
 	"take-out/logging"
 	"take-out/monitoring"
+	"take-out/payment"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -23,6 +25,18 @@ func main() {
 	// 初始化日志
 	logging.Init()
 
+	// 先加载 config.env，再读取各模块的配置
+	config.Load()
+	handlers.LoadConfig()
+
+	// 支付渠道必须显式配置，配置错误时拒绝启动
+	provider, err := payment.LoadProvider()
+	if err != nil {
+		logging.Fatal("支付渠道配置错误", logrus.Fields{"error": err})
+	}
+	handlers.SetPaymentProvider(provider)
+	logging.Info("Using payment provider", logrus.Fields{"provider": provider.Name()})
+
 	// 初始化 Redis 连接池
 	rp, err = database.InitRedis()
 	if err != nil {
@@ -43,8 +57,17 @@ func main() {
 	//启动数据库监控
 	go database.StartDBMonitor(db, 5*time.Minute) // 每5分钟监控一次
 
+	// 确定订单号使用的实例编号，多实例部署时各实例互不相同；拿不到编号时不能保证订单号唯一，终止启动
+	if err := handlers.InitOrderNumbers(rp); err != nil {
+		logging.Fatal("订单号实例编号初始化失败", logrus.Fields{"error": err})
+	}
+
 	// 启动后台任务
 	go handlers.StartOrderConsumer(rp)
+	go handlers.StartOrderTimeoutWorker(db, rp)
+	go handlers.StartRefundRetryWorker(db, rp)
+	go handlers.StartRiderLocationWorker(db, rp)
+	go handlers.StartRiderPresenceWorker(db, rp)
 	go database.StartWeeklyCleanUpScheduler(db)
 
 	// 暴露 /metrics 接口
@@ -59,12 +82,35 @@ func main() {
 	http.Handle("/api/auth/rider/login", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleRiderLogin(db))))
 	http.Handle("/api/auth/refresh", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleRefreshToken(rp))))
 
+	// 支付渠道回调，由渠道签名校验来源，无需Token
+	http.Handle("/api/payment/callback", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandlePaymentCallback(db, rp))))
+
 	// 用户路由组 - 需要认证，使用精确路径避免与auth路由冲突
 	userRoutes := http.NewServeMux()
 	userRoutes.Handle("/shops", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleGetShops(db))))
 	userRoutes.Handle("/products", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleShopProducts(db, rp))))
-	userRoutes.Handle("/order", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleOrder(db, rp))))
+	userRoutes.Handle("/order", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.IdempotencyMiddleware(rp)(handlers.HandleOrder(db, rp)))))
+	userRoutes.Handle("/order/pay", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleOrderPay(db))))
+	userRoutes.Handle("/order/quote", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleOrderQuote(db))))
 	userRoutes.Handle("/order/status", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleOrderStatus(db, rp))))
+	userRoutes.Handle("/order/rider_location", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleOrderRiderLocation(db, rp))))
+	userRoutes.Handle("/orders", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleUserOrders(db))))
+	userRoutes.Handle("/order/cancel", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleCancelOrder(db, rp))))
+	userRoutes.Handle("/checkout", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.IdempotencyMiddleware(rp)(handlers.HandleCheckout(db, rp)))))
+	userRoutes.Handle("/checkout/pay", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleParentOrderPay(db))))
+	userRoutes.Handle("/checkout/status", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleParentOrderStatus(db))))
+	userRoutes.Handle("/checkout/cancel", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleCancelParentOrder(db, rp))))
+	userRoutes.Handle("/group_cart", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleCreateGroupCart(db))))
+	userRoutes.Handle("/group_cart/detail", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleGroupCartDetail(db))))
+	userRoutes.Handle("/group_cart/item", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleSetGroupCartItem(db))))
+	userRoutes.Handle("/group_cart/lock", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleLockGroupCart(db))))
+	userRoutes.Handle("/group_cart/cancel", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleCancelGroupCart(db))))
+	userRoutes.Handle("/group_cart/submit", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.IdempotencyMiddleware(rp)(handlers.HandleSubmitGroupCart(db, rp)))))
+	userRoutes.Handle("/refund/apply", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.IdempotencyMiddleware(rp)(handlers.HandleApplyRefund(db)))))
+	userRoutes.Handle("/coupons", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleUserCoupons(db))))
+	userRoutes.Handle("/coupons/available", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleClaimableCoupons(db))))
+	userRoutes.Handle("/coupons/claim", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleClaimCoupon(db))))
+	userRoutes.Handle("/delivery_slots", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleAvailableDeliverySlots(db))))
 	userRoutes.Handle("/nearby-shops", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleNearbyShops(db, rp))))
 	// IM 路由
 	userRoutes.Handle("/im/send", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleSendMessage(db, rp))))
@@ -78,8 +124,20 @@ func main() {
 	shopRoutes := http.NewServeMux()
 	shopRoutes.Handle("/add_product", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleAddProduct(db, rp))))
 	shopRoutes.Handle("/update_stock", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleUpdateProductStock(db, rp))))
-	shopRoutes.Handle("/accept_order", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleAcceptOrder(db, rp))))
-	shopRoutes.Handle("/publish_order", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandlePublishDeliveryOrder(db, rp))))
+	shopRoutes.Handle("/coupons", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleCreateCoupon(db))))
+	shopRoutes.Handle("/delivery_slots", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleShopDeliverySlots(db))))
+	shopRoutes.Handle("/delivery_slot", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleSaveDeliverySlot(db))))
+	shopRoutes.Handle("/nearby_riders", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleShopNearbyRiders(db, rp))))
+	shopRoutes.Handle("/orders", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleShopOrders(db))))
+	shopRoutes.Handle("/accept_order", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.IdempotencyMiddleware(rp)(handlers.HandleAcceptOrder(db, rp)))))
+	shopRoutes.Handle("/reject_order", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleRejectOrder(db, rp))))
+	shopRoutes.Handle("/publish_order", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.IdempotencyMiddleware(rp)(handlers.HandlePublishDeliveryOrder(db, rp)))))
+	shopRoutes.Handle("/order/ready", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleReadyForPickup(db, rp))))
+	shopRoutes.Handle("/order/picked_up", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.IdempotencyMiddleware(rp)(handlers.HandlePickedUp(db, rp)))))
+	shopRoutes.Handle("/order/timeline", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleOrderTimeline(db))))
+	shopRoutes.Handle("/refunds", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleShopRefunds(db))))
+	shopRoutes.Handle("/refund/create", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.IdempotencyMiddleware(rp)(handlers.HandleShopCreateRefund(db, rp)))))
+	shopRoutes.Handle("/refund/review", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleReviewRefund(db, rp))))
 	// 评价路由
 	shopRoutes.Handle("/reviews", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.GetShopReviews(db, rp))))
 	shopRoutes.Handle("/review/reply", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.ReplyToReview(db, rp))))
@@ -88,8 +146,16 @@ func main() {
 
 	// 骑手路由组 - 需要认证
 	riderRoutes := http.NewServeMux()
-	riderRoutes.Handle("/grab", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleRiderGrabOrder(db, rp))))
-	riderRoutes.Handle("/complete", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleCompleteOrder(db))))
+	riderRoutes.Handle("/hall", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleOrderHall(db, rp))))
+	riderRoutes.Handle("/grab", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.IdempotencyMiddleware(rp)(handlers.HandleRiderGrabOrder(db, rp)))))
+	riderRoutes.Handle("/online", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleRiderOnline(db, rp))))
+	riderRoutes.Handle("/offline", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleRiderOffline(db, rp))))
+	riderRoutes.Handle("/heartbeat", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleRiderHeartbeat(rp))))
+	riderRoutes.Handle("/status", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleRiderStatus(db))))
+	riderRoutes.Handle("/location", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleUpdateRiderLocation(rp))))
+	riderRoutes.Handle("/offer/respond", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleRespondDispatchOffer(db, rp))))
+	riderRoutes.Handle("/complete", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.IdempotencyMiddleware(rp)(handlers.HandleCompleteOrder(db, rp)))))
+	riderRoutes.Handle("/order/timeline", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.HandleOrderTimeline(db))))
 	// 评价路由
 	riderRoutes.Handle("/confirm_delivery", handlers.LoggingMiddleware(monitoring.PrometheusMiddleware(handlers.RiderConfirmDelivery(db, rp))))
 	http.Handle("/api/rider/", handlers.LoggingMiddleware(handlers.AuthenticateTokenRider(rp)(http.StripPrefix("/api/rider", riderRoutes))))
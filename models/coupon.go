@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// 优惠券类型
+const (
+	CouponTypeFixed     = "fixed"     // 无门槛立减 Amount
+	CouponTypePercent   = "percent"   // 按 PercentOff 打折，最多减 MaxDiscount
+	CouponTypeThreshold = "threshold" // 满 MinSpend 减 Amount
+)
+
+// 用户优惠券状态
+const (
+	UserCouponAvailable = "available"
+	UserCouponUsed      = "used"
+)
+
+// 优惠券模板，ShopID 为 0 表示平台券，可用于所有商家
+type Coupon struct {
+	CouponID      int       `json:"coupon_id"`
+	ShopID        int       `json:"shop_id"`
+	Title         string    `json:"title"`
+	CouponType    string    `json:"coupon_type"`
+	Amount        Money     `json:"amount"`
+	PercentOff    float64   `json:"percent_off"`  // 15 表示减免 15%
+	MaxDiscount   Money     `json:"max_discount"` // 折扣券最高减免金额，0 表示不限
+	MinSpend      Money     `json:"min_spend"`    // 适用商品金额门槛
+	ProductIDs    []int64   `json:"product_ids"`  // 限定商品，为空表示全部商品
+	ValidFrom     time.Time `json:"valid_from"`
+	ValidTo       time.Time `json:"valid_to"`
+	TotalLimit    int       `json:"total_limit"`    // 发放总量，0 表示不限
+	PerUserLimit  int       `json:"per_user_limit"` // 每个用户最多领取张数
+	ClaimedCount  int       `json:"claimed_count"`
+	RedeemedCount int       `json:"redeemed_count"`
+}
+
+// 用户领取的优惠券
+type UserCoupon struct {
+	UserCouponID int        `json:"user_coupon_id"`
+	UserID       int        `json:"user_id"`
+	Status       string     `json:"status"`
+	OrderID      int        `json:"order_id,omitempty"`
+	ClaimedAt    time.Time  `json:"claimed_at"`
+	UsedAt       *time.Time `json:"used_at,omitempty"`
+	Coupon       Coupon     `json:"coupon"`
+}
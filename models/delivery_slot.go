@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// DeliverySlot 商家声明的预约配送时段，每天重复，Capacity 为每天该时段最多接收的预约单数量
+type DeliverySlot struct {
+	SlotID    int    `json:"slot_id"`
+	ShopID    int    `json:"shop_id"`
+	StartTime string `json:"start_time"` // 时段开始时间，如 "11:30"
+	EndTime   string `json:"end_time"`   // 时段结束时间（不含），如 "12:00"
+	Capacity  int    `json:"capacity"`
+	IsActive  bool   `json:"is_active"` // 停用的时段不再接收新的预约单，已预约的订单不受影响
+}
+
+// AvailableSlot 某一天的预约时段及剩余名额，ScheduledAt 为该时段的开始时间，下单时原样传回即可
+type AvailableSlot struct {
+	DeliverySlot
+	Date        string    `json:"date"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+	Booked      int       `json:"booked"`
+	Remaining   int       `json:"remaining"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// 派单状态
+const (
+	OfferOffered   = "offered"   // 已派给骑手，等待答复
+	OfferAccepted  = "accepted"  // 骑手接受，订单进入配送中
+	OfferDeclined  = "declined"  // 骑手拒绝
+	OfferExpired   = "expired"   // 骑手未在截止时间前答复
+	OfferWithdrawn = "withdrawn" // 订单已被其他骑手抢走或已取消
+)
+
+// DispatchOffer 派给单个骑手的跑腿订单，骑手需在 ExpiresAt 前接受或拒绝
+type DispatchOffer struct {
+	OfferID     int        `json:"offer_id"`
+	OrderID     int        `json:"order_id"`
+	RiderID     int        `json:"rider_id"`
+	Score       float64    `json:"score"`
+	DistanceKm  float64    `json:"distance_km"` // 骑手到商家的距离
+	Status      string     `json:"status"`
+	OfferedAt   time.Time  `json:"offered_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	RespondedAt *time.Time `json:"responded_at,omitempty"`
+}
@@ -0,0 +1,124 @@
+package models
+
+import "time"
+
+// 拼单状态
+const (
+	GroupCartOpen      = "open"      // 加购中，参与者可以增减自己的商品
+	GroupCartLocked    = "locked"    // 发起人已锁定，不能再加购，等待提交
+	GroupCartSubmitted = "submitted" // 已提交为订单
+	GroupCartCancelled = "cancelled" // 发起人已取消
+)
+
+// GroupCart 拼单购物车：发起人为一个商家创建，参与者凭分享码用各自的账号加购，
+// 发起人锁定后提交为一个订单、一次配送，并保留每个人的分账明细
+// 与聊天群组 Group 无关
+type GroupCart struct {
+	CartID      int              `json:"cart_id"`
+	ShareCode   string           `json:"share_code"`
+	HostUserID  int              `json:"host_user_id"`
+	ShopID      int              `json:"shop_id"`
+	Status      string           `json:"status"`
+	OrderID     int              `json:"order_id,omitempty"` // 提交后生成的订单
+	CreatedAt   time.Time        `json:"created_at"`
+	LockedAt    *time.Time       `json:"locked_at,omitempty"`
+	SubmittedAt *time.Time       `json:"submitted_at,omitempty"`
+	Items       []GroupCartItem  `json:"items"`
+	Shares      []GroupCartShare `json:"shares"` // 每个参与者的分账，提交前只含商品金额
+}
+
+// GroupCartItem 参与者加购的一件商品，提交前按商品当前价格展示，提交后为下单时的快照
+type GroupCartItem struct {
+	ItemID       int    `json:"item_id"`
+	UserID       int    `json:"user_id"`
+	Username     string `json:"username"`
+	ProductID    int    `json:"product_id"`
+	ProductName  string `json:"product_name"`
+	Quantity     int    `json:"quantity"`
+	UnitPrice    Money  `json:"unit_price"`
+	PackagingFee Money  `json:"packaging_fee"` // 单件打包费
+	Subtotal     Money  `json:"subtotal"`      // 单价 * 数量
+}
+
+// GroupCartShare 一个参与者的分账
+// Payable = ItemSubtotal + PackagingFee + FeeShare，各参与者的 Payable 之和等于订单应付金额
+type GroupCartShare struct {
+	UserID       int    `json:"user_id"`
+	Username     string `json:"username"`
+	ItemSubtotal Money  `json:"item_subtotal"` // 本人商品小计
+	PackagingFee Money  `json:"packaging_fee"` // 本人商品的打包费
+	FeeShare     Money  `json:"fee_share"`     // 分摊的配送费、服务费减去优惠券减免
+	Payable      Money  `json:"payable"`       // 应分摊金额
+}
+
+// OrderItems 把全部参与者的商品按商品合并为订单明细，保持首次加购的顺序
+func (c *GroupCart) OrderItems() []OrderItem {
+	var items []OrderItem
+	index := make(map[int]int)
+	for _, item := range c.Items {
+		if i, ok := index[item.ProductID]; ok {
+			items[i].Quantity += item.Quantity
+			continue
+		}
+		index[item.ProductID] = len(items)
+		items = append(items, OrderItem{ProductID: item.ProductID, Quantity: item.Quantity})
+	}
+	return items
+}
+
+// SplitBill 按订单价格明细拆分每个参与者应分摊的金额
+// 商品小计和打包费按各自的商品计算；配送费、服务费和优惠券减免属于整单，按各参与者商品金额（含打包费）的比例分摊，
+// 按比例取整后剩余的零头逐分分给排在前面、商品金额不为 0 的参与者，保证合计与订单应付金额一致，
+// 且商品金额为 0 的参与者不会分到零头（优惠券减免时也不会出现负数）
+func SplitBill(items []GroupCartItem, b PriceBreakdown) []GroupCartShare {
+	var shares []GroupCartShare
+	index := make(map[int]int)
+	for _, item := range items {
+		i, ok := index[item.UserID]
+		if !ok {
+			i = len(shares)
+			index[item.UserID] = i
+			shares = append(shares, GroupCartShare{UserID: item.UserID, Username: item.Username})
+		}
+		shares[i].ItemSubtotal = shares[i].ItemSubtotal.Add(item.Subtotal)
+		shares[i].PackagingFee = shares[i].PackagingFee.Add(item.PackagingFee.Mul(item.Quantity))
+	}
+	if len(shares) == 0 {
+		return shares
+	}
+
+	// 以应付金额倒推整单费用，应付金额被优惠券减到 0 时也能对平
+	fee := b.Payable.Sub(b.ItemSubtotal).Sub(b.PackagingFee)
+	var weight int64
+	for _, share := range shares {
+		weight += share.ItemSubtotal.Add(share.PackagingFee).Cents
+	}
+	allocated := NewMoney(0)
+	for i := range shares {
+		var cents int64
+		if weight > 0 {
+			cents = fee.Cents * shares[i].ItemSubtotal.Add(shares[i].PackagingFee).Cents / weight
+		} else {
+			cents = fee.Cents / int64(len(shares))
+		}
+		shares[i].FeeShare = NewMoney(cents)
+		allocated = allocated.Add(shares[i].FeeShare)
+	}
+	remainder := fee.Sub(allocated).Cents
+	step := int64(1)
+	if remainder < 0 {
+		step = -1
+	}
+	for i := 0; remainder != 0; i = (i + 1) % len(shares) {
+		if weight > 0 && shares[i].ItemSubtotal.Add(shares[i].PackagingFee).IsZero() {
+			continue
+		}
+		shares[i].FeeShare = shares[i].FeeShare.Add(NewMoney(step))
+		remainder -= step
+	}
+
+	for i := range shares {
+		shares[i].Payable = shares[i].ItemSubtotal.Add(shares[i].PackagingFee).Add(shares[i].FeeShare)
+	}
+	return shares
+}
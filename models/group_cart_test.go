@@ -0,0 +1,128 @@
+package models
+
+import "testing"
+
+func cartItem(userID int, unitCents int64, quantity int, packagingCents int64) GroupCartItem {
+	return GroupCartItem{
+		UserID:       userID,
+		Quantity:     quantity,
+		UnitPrice:    NewMoney(unitCents),
+		PackagingFee: NewMoney(packagingCents),
+		Subtotal:     NewMoney(unitCents * int64(quantity)),
+	}
+}
+
+// 按 Payable = ItemSubtotal + PackagingFee + DeliveryFee + ServiceFee - Discount 组装价格明细
+func testBreakdown(items []GroupCartItem, deliveryCents, serviceCents, discountCents int64) PriceBreakdown {
+	b := PriceBreakdown{DeliveryFee: NewMoney(deliveryCents), ServiceFee: NewMoney(serviceCents), Discount: NewMoney(discountCents)}
+	for _, item := range items {
+		b.ItemSubtotal = b.ItemSubtotal.Add(item.Subtotal)
+		b.PackagingFee = b.PackagingFee.Add(item.PackagingFee.Mul(item.Quantity))
+	}
+	b.Payable = b.ItemSubtotal.Add(b.PackagingFee).Add(b.DeliveryFee).Add(b.ServiceFee).Sub(b.Discount)
+	return b
+}
+
+func TestSplitBill(t *testing.T) {
+	tests := []struct {
+		name     string
+		items    []GroupCartItem
+		delivery int64
+		service  int64
+		discount int64
+		want     []int64 // 各参与者的 Payable（分），nil 表示只校验合计
+	}{
+		{
+			name:     "fees split by share of items",
+			items:    []GroupCartItem{cartItem(1, 3000, 1, 0), cartItem(2, 1000, 1, 0)},
+			delivery: 400,
+			want:     []int64{3300, 1100},
+		},
+		{
+			name:     "positive remainder goes to the first participants",
+			items:    []GroupCartItem{cartItem(1, 1000, 1, 0), cartItem(2, 1000, 1, 0), cartItem(3, 1000, 1, 0)},
+			delivery: 500,
+			want:     []int64{1167, 1167, 1166},
+		},
+		{
+			name:     "same user items are merged",
+			items:    []GroupCartItem{cartItem(1, 1200, 1, 100), cartItem(2, 800, 2, 50), cartItem(1, 300, 1, 100)},
+			delivery: 600,
+			service:  99,
+		},
+		{
+			name:     "coupon larger than fees gives negative remainder",
+			items:    []GroupCartItem{cartItem(1, 1000, 1, 0), cartItem(2, 1000, 1, 0), cartItem(3, 1000, 1, 0)},
+			delivery: 300,
+			discount: 800,
+			want:     []int64{833, 833, 834},
+		},
+		{
+			name:     "coupon cuts payable below item total",
+			items:    []GroupCartItem{cartItem(1, 2999, 1, 100), cartItem(2, 1501, 1, 0), cartItem(3, 7, 3, 0)},
+			delivery: 500,
+			service:  45,
+			discount: 3000,
+		},
+		{
+			name:     "coupon cuts payable to zero",
+			items:    []GroupCartItem{cartItem(1, 999, 1, 0), cartItem(2, 1, 1, 0)},
+			discount: 1000,
+			want:     []int64{0, 0},
+		},
+		{
+			name:     "zero-weight participant with positive remainder",
+			items:    []GroupCartItem{cartItem(1, 0, 1, 0), cartItem(2, 1000, 1, 0), cartItem(3, 1000, 1, 0)},
+			delivery: 301,
+			want:     []int64{0, 1151, 1150},
+		},
+		{
+			name:     "zero-weight participant with negative remainder",
+			items:    []GroupCartItem{cartItem(1, 0, 1, 0), cartItem(2, 1000, 1, 0), cartItem(3, 1000, 1, 0)},
+			discount: 301,
+			want:     []int64{0, 849, 850},
+		},
+		{
+			name:     "all participants zero weight",
+			items:    []GroupCartItem{cartItem(1, 0, 1, 0), cartItem(2, 0, 1, 0), cartItem(3, 0, 2, 0)},
+			delivery: 500,
+			want:     []int64{167, 167, 166},
+		},
+	}
+	for _, tt := range tests {
+		b := testBreakdown(tt.items, tt.delivery, tt.service, tt.discount)
+		shares := SplitBill(tt.items, b)
+
+		total := NewMoney(0)
+		for _, share := range shares {
+			total = total.Add(share.Payable)
+			if share.Payable != share.ItemSubtotal.Add(share.PackagingFee).Add(share.FeeShare) {
+				t.Errorf("%s: user %d payable %v != items + packaging + fee share", tt.name, share.UserID, share.Payable)
+			}
+			if share.Payable.IsNegative() {
+				t.Errorf("%s: user %d payable %v is negative", tt.name, share.UserID, share.Payable)
+			}
+		}
+		if total.Cents != b.Payable.Cents {
+			t.Errorf("%s: shares sum to %v, want %v", tt.name, total, b.Payable)
+		}
+		if tt.want == nil {
+			continue
+		}
+		if len(shares) != len(tt.want) {
+			t.Errorf("%s: got %d shares, want %d", tt.name, len(shares), len(tt.want))
+			continue
+		}
+		for i, share := range shares {
+			if share.Payable.Cents != tt.want[i] {
+				t.Errorf("%s: user %d payable = %d, want %d", tt.name, share.UserID, share.Payable.Cents, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestSplitBillEmpty(t *testing.T) {
+	if shares := SplitBill(nil, PriceBreakdown{Payable: NewMoney(500)}); len(shares) != 0 {
+		t.Errorf("SplitBill(nil) = %v, want no shares", shares)
+	}
+}
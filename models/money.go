@@ -0,0 +1,217 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency 未指定币种时使用人民币，数据库中的金额列都按该币种存储
+const DefaultCurrency = "CNY"
+
+// Money 金额，以最小货币单位（分）的整数保存，避免浮点运算的舍入误差
+// JSON 编码为保留两位小数的数字（如 28.80），与原先的 float64 字段兼容；
+// 数据库中对应 DECIMAL(10,2) 列，读写都经过十进制字符串，不经过浮点数
+type Money struct {
+	Cents    int64
+	Currency string // ISO 4217 币种代码，为空表示 DefaultCurrency
+}
+
+// NewMoney 以分为单位创建人民币金额
+func NewMoney(cents int64) Money {
+	return Money{Cents: cents, Currency: DefaultCurrency}
+}
+
+// Yuan 以元为单位创建人民币金额，用于常量和配置，按四舍五入保留到分
+func Yuan(yuan float64) Money {
+	return NewMoney(int64(math.Round(yuan * 100)))
+}
+
+// ParseMoney 解析十进制金额字符串，如 "28.8"、"-3.05"
+// 请求和数据库中的金额必须无损：最多两位小数（多余的 0 除外），不接受科学计数法；需要舍入的配置金额使用 Yuan
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Money{}, fmt.Errorf("金额不能为空")
+	}
+	negative := strings.HasPrefix(s, "-")
+	whole, frac, _ := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if (whole == "" && frac == "") || !isDigits(whole) || !isDigits(frac) {
+		return Money{}, fmt.Errorf("金额格式错误: %s", s)
+	}
+	if len(frac) > 2 {
+		// 多余的 0 不影响金额（如 NUMERIC 运算结果 "28.800"）
+		if strings.TrimRight(frac[2:], "0") != "" {
+			return Money{}, fmt.Errorf("金额最多保留两位小数: %s", s)
+		}
+		frac = frac[:2]
+	}
+
+	var yuan int64
+	if whole != "" {
+		var err error
+		yuan, err = strconv.ParseInt(whole, 10, 64)
+		if err != nil || yuan > math.MaxInt64/100-1 {
+			return Money{}, fmt.Errorf("金额超出范围: %s", s)
+		}
+	}
+	var cents int64
+	if frac != "" {
+		cents, _ = strconv.ParseInt((frac + "0")[:2], 10, 64)
+	}
+	total := yuan*100 + cents
+	if negative {
+		total = -total
+	}
+	return NewMoney(total), nil
+}
+
+// 只包含 0-9，空字符串也视为合法
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// 零值金额的币种视为默认币种
+func (m Money) currency() string {
+	if m.Currency == "" {
+		return DefaultCurrency
+	}
+	return m.Currency
+}
+
+// 两个金额运算前检查币种，币种不同属于程序错误
+func (m Money) with(other Money, cents int64) Money {
+	if m.currency() != other.currency() {
+		panic(fmt.Sprintf("金额币种不一致: %s 与 %s", m.currency(), other.currency()))
+	}
+	return Money{Cents: cents, Currency: m.currency()}
+}
+
+func (m Money) Add(other Money) Money {
+	return m.with(other, m.Cents+other.Cents)
+}
+
+func (m Money) Sub(other Money) Money {
+	return m.with(other, m.Cents-other.Cents)
+}
+
+// Neg 取相反数，如退款流水记为负数
+func (m Money) Neg() Money {
+	return Money{Cents: -m.Cents, Currency: m.currency()}
+}
+
+// Mul 乘以数量，如单价乘以购买件数
+func (m Money) Mul(n int) Money {
+	return Money{Cents: m.Cents * int64(n), Currency: m.currency()}
+}
+
+// MulRate 乘以比例（如服务费费率、折扣），结果按四舍五入保留到分
+func (m Money) MulRate(rate float64) Money {
+	return Money{Cents: int64(math.Round(float64(m.Cents) * rate)), Currency: m.currency()}
+}
+
+// Cmp 比较两个金额，小于、等于、大于分别返回 -1、0、1
+func (m Money) Cmp(other Money) int {
+	m.with(other, 0)
+	switch {
+	case m.Cents < other.Cents:
+		return -1
+	case m.Cents > other.Cents:
+		return 1
+	}
+	return 0
+}
+
+func (m Money) Min(other Money) Money {
+	if m.Cmp(other) <= 0 {
+		return m
+	}
+	return other
+}
+
+func (m Money) Max(other Money) Money {
+	if m.Cmp(other) >= 0 {
+		return m
+	}
+	return other
+}
+
+func (m Money) IsZero() bool     { return m.Cents == 0 }
+func (m Money) IsPositive() bool { return m.Cents > 0 }
+func (m Money) IsNegative() bool { return m.Cents < 0 }
+
+// String 返回两位小数的十进制表示，如 "28.80"
+func (m Money) String() string {
+	sign := ""
+	cents := m.Cents
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// Float64 返回以元为单位的近似值，只用于展示和监控指标，不要参与金额计算
+func (m Money) Float64() float64 {
+	return float64(m.Cents) / 100
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON 接受数字（28.8）或字符串（"28.80"），null 视为零；超过两位小数或科学计数法返回错误
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		*m = Money{}
+		return nil
+	}
+	parsed, err := ParseMoney(strings.Trim(s, `"`))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Scan 读取 DECIMAL 列，lib/pq 以十进制文本返回 NUMERIC，NULL 视为零
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = NewMoney(0)
+		return nil
+	case []byte:
+		return m.scanString(string(v))
+	case string:
+		return m.scanString(v)
+	case int64:
+		*m = NewMoney(v * 100)
+		return nil
+	case float64:
+		*m = Yuan(v)
+		return nil
+	}
+	return fmt.Errorf("无法将 %T 转换为金额", src)
+}
+
+func (m *Money) scanString(s string) error {
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value 以十进制文本写入 DECIMAL 列
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
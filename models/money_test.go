@@ -0,0 +1,223 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		cents   int64
+		wantErr bool
+	}{
+		{in: "28.8", cents: 2880},
+		{in: "28.80", cents: 2880},
+		{in: "28", cents: 2800},
+		{in: "28.", cents: 2800},
+		{in: ".5", cents: 50},
+		{in: "0.05", cents: 5},
+		{in: "-3.05", cents: -305},
+		{in: "-0.5", cents: -50},
+		{in: " 12.30 ", cents: 1230},
+		{in: "28.800", cents: 2880},
+		{in: "28.999", wantErr: true},
+		{in: "0.001", wantErr: true},
+		{in: "1e3", wantErr: true},
+		{in: "2.5E1", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "-", wantErr: true},
+		{in: ".", wantErr: true},
+		{in: "+5", wantErr: true},
+		{in: "--5", wantErr: true},
+		{in: "-+5", wantErr: true},
+		{in: "1.2.3", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "92233720368547758", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseMoney(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseMoney(%q) unexpected error: %v", tt.in, err)
+			continue
+		}
+		if got.Cents != tt.cents || got.Currency != DefaultCurrency {
+			t.Errorf("ParseMoney(%q) = %d %s, want %d %s", tt.in, got.Cents, got.Currency, tt.cents, DefaultCurrency)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		cents int64
+		want  string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{2880, "28.80"},
+		{-5, "-0.05"},
+		{-305, "-3.05"},
+	}
+	for _, tt := range tests {
+		if got := NewMoney(tt.cents).String(); got != tt.want {
+			t.Errorf("NewMoney(%d).String() = %q, want %q", tt.cents, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyRounding(t *testing.T) {
+	tests := []struct {
+		name string
+		got  Money
+		want int64
+	}{
+		{"Yuan rounds half up", Yuan(28.995), 2900},
+		{"Yuan keeps cents", Yuan(0.1 + 0.2), 30},
+		{"Yuan negative", Yuan(-1.005), -100},
+		{"MulRate rounds", NewMoney(999).MulRate(0.05), 50},
+		{"MulRate zero rate", NewMoney(999).MulRate(0), 0},
+		{"Mul quantity", NewMoney(1250).Mul(3), 3750},
+		{"Add", NewMoney(1999).Add(NewMoney(1)), 2000},
+		{"Sub below zero", NewMoney(100).Sub(NewMoney(250)), -150},
+		{"Neg", NewMoney(305).Neg(), -305},
+		{"Min", NewMoney(305).Min(NewMoney(300)), 300},
+		{"Max", NewMoney(305).Max(NewMoney(300)), 305},
+	}
+	for _, tt := range tests {
+		if tt.got.Cents != tt.want {
+			t.Errorf("%s: got %d cents, want %d", tt.name, tt.got.Cents, tt.want)
+		}
+	}
+}
+
+func TestMoneySign(t *testing.T) {
+	tests := []struct {
+		m                        Money
+		zero, positive, negative bool
+	}{
+		{NewMoney(0), true, false, false},
+		{Money{}, true, false, false},
+		{NewMoney(1), false, true, false},
+		{NewMoney(-1), false, false, true},
+	}
+	for _, tt := range tests {
+		if tt.m.IsZero() != tt.zero || tt.m.IsPositive() != tt.positive || tt.m.IsNegative() != tt.negative {
+			t.Errorf("%v: IsZero/IsPositive/IsNegative = %v/%v/%v, want %v/%v/%v", tt.m,
+				tt.m.IsZero(), tt.m.IsPositive(), tt.m.IsNegative(), tt.zero, tt.positive, tt.negative)
+		}
+	}
+	if NewMoney(1).Cmp(Money{}) != 1 || (Money{}).Cmp(NewMoney(0)) != 0 || NewMoney(-1).Cmp(NewMoney(0)) != -1 {
+		t.Error("Cmp should treat the zero value as the default currency")
+	}
+}
+
+func TestMoneyCurrencyMismatchPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("adding different currencies should panic")
+		}
+	}()
+	NewMoney(100).Add(Money{Cents: 100, Currency: "USD"})
+}
+
+func TestMoneyScanValue(t *testing.T) {
+	tests := []struct {
+		src     interface{}
+		cents   int64
+		wantErr bool
+	}{
+		{src: []byte("28.80"), cents: 2880},
+		{src: "-3.05", cents: -305},
+		{src: int64(12), cents: 1200},
+		{src: float64(0.3), cents: 30},
+		{src: nil, cents: 0},
+		{src: []byte("1.234"), wantErr: true},
+		{src: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		var m Money
+		err := m.Scan(tt.src)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Scan(%#v) = %v, want error", tt.src, m)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Scan(%#v) unexpected error: %v", tt.src, err)
+			continue
+		}
+		if m.Cents != tt.cents {
+			t.Errorf("Scan(%#v) = %d cents, want %d", tt.src, m.Cents, tt.cents)
+		}
+
+		value, err := m.Value()
+		if err != nil {
+			t.Errorf("Value() unexpected error: %v", err)
+			continue
+		}
+		var back Money
+		if err := back.Scan(value); err != nil || back.Cents != m.Cents {
+			t.Errorf("Scan(Value()) = %d cents (err %v), want %d", back.Cents, err, m.Cents)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	type payload struct {
+		Amount Money `json:"amount"`
+	}
+	tests := []struct {
+		in      string
+		cents   int64
+		out     string
+		wantErr bool
+	}{
+		{in: `{"amount": 28.8}`, cents: 2880, out: `{"amount":28.80}`},
+		{in: `{"amount": "28.80"}`, cents: 2880, out: `{"amount":28.80}`},
+		{in: `{"amount": -0.05}`, cents: -5, out: `{"amount":-0.05}`},
+		{in: `{"amount": 0}`, cents: 0, out: `{"amount":0.00}`},
+		{in: `{"amount": null}`, cents: 0, out: `{"amount":0.00}`},
+		{in: `{}`, cents: 0, out: `{"amount":0.00}`},
+		{in: `{"amount": 28.999}`, wantErr: true},
+		{in: `{"amount": "28.999"}`, wantErr: true},
+		{in: `{"amount": 2.88e1}`, wantErr: true},
+		{in: `{"amount": "abc"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var p payload
+		err := json.Unmarshal([]byte(tt.in), &p)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Unmarshal(%s) = %v, want error", tt.in, p.Amount)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unmarshal(%s) unexpected error: %v", tt.in, err)
+			continue
+		}
+		if p.Amount.Cents != tt.cents {
+			t.Errorf("Unmarshal(%s) = %d cents, want %d", tt.in, p.Amount.Cents, tt.cents)
+		}
+
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Errorf("Marshal(%v) unexpected error: %v", p.Amount, err)
+			continue
+		}
+		if string(data) != tt.out {
+			t.Errorf("Marshal(%v) = %s, want %s", p.Amount, data, tt.out)
+		}
+		var back payload
+		if err := json.Unmarshal(data, &back); err != nil || back.Amount.Cents != p.Amount.Cents {
+			t.Errorf("round trip of %s = %d cents (err %v), want %d", data, back.Amount.Cents, err, p.Amount.Cents)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// HallOrder 公共大厅中等待骑手抢单的跑腿订单
+type HallOrder struct {
+	OrderID           int        `json:"order_id"`
+	OrderNo           string     `json:"order_no"`
+	ShopID            int        `json:"shop_id"`
+	ShopName          string     `json:"shop_name"`
+	ShopLatitude      float64    `json:"shop_latitude"`
+	ShopLongitude     float64    `json:"shop_longitude"`
+	DeliveryAddress   string     `json:"delivery_address"`
+	DeliveryLatitude  float64    `json:"delivery_latitude"`
+	DeliveryLongitude float64    `json:"delivery_longitude"`
+	DistanceKm        float64    `json:"distance_km"`                  // 商家到收货地址的距离
+	DeliveryFee       Money      `json:"delivery_fee"`                 // 配送费
+	PickupDistanceKm  float64    `json:"pickup_distance_km,omitempty"` // 骑手到商家的距离，浏览大厅时计算
+	ScheduledAt       *time.Time `json:"scheduled_at,omitempty"`       // 预约送达时间
+	PublishedAt       time.Time  `json:"published_at"`                 // 进入大厅的时间
+	ExpiresAt         time.Time  `json:"expires_at"`                   // 超过该时间仍无人抢单时移出大厅
+}
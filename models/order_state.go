@@ -0,0 +1,173 @@
+package models
+
+import "fmt"
+
+// 订单状态，与 init.sql 中 orders.orderstatus 的 CHECK 约束保持一致
+const (
+	OrderStatusAwaitingPayment = "awaiting_payment" // 待支付，支付成功后才通知商家
+	OrderStatusScheduled       = "scheduled"        // 预约单已支付，等待到达备餐时间后再通知商家
+	OrderStatusPending         = "pending"          // 商家待确认
+	OrderStatusConfirmed       = "confirmed"        // 商家已接单
+	OrderStatusPublished       = "published"        // 已发布跑腿订单，等待骑手接单
+	OrderStatusDelivering      = "delivering"       // 骑手配送中
+	OrderStatusReadyForPickup  = "ready_for_pickup" // 自取订单已备好，等待顾客到店取餐
+	OrderStatusCompleted       = "completed"        // 已完成
+	OrderStatusCancelled       = "cancelled"        // 已取消
+)
+
+// 订单履约方式，与 init.sql 中 orders.fulfillment_type 的 CHECK 约束保持一致
+const (
+	FulfillmentDelivery = "delivery" // 骑手配送
+	FulfillmentPickup   = "pickup"   // 顾客到店自取
+)
+
+// 触发订单状态流转的角色
+const (
+	RoleUser   = "user"
+	RoleShop   = "shop"
+	RoleRider  = "rider"
+	RoleSystem = "system"
+)
+
+// OrderActor 触发订单状态变更的操作者
+type OrderActor struct {
+	Role string `json:"role"`
+	ID   int    `json:"id"`
+}
+
+// 订单生命周期：当前状态 -> 目标状态 -> 允许触发该流转的角色
+var orderTransitions = map[string]map[string][]string{
+	OrderStatusAwaitingPayment: {
+		OrderStatusPending:   {RoleSystem},
+		OrderStatusScheduled: {RoleSystem},
+		OrderStatusCancelled: {RoleUser, RoleSystem},
+	},
+	OrderStatusScheduled: {
+		OrderStatusPending:   {RoleSystem},
+		OrderStatusCancelled: {RoleUser, RoleShop, RoleSystem},
+	},
+	OrderStatusPending: {
+		OrderStatusConfirmed: {RoleShop},
+		OrderStatusCancelled: {RoleUser, RoleShop, RoleSystem},
+	},
+	OrderStatusConfirmed: {
+		OrderStatusPublished:      {RoleShop},
+		OrderStatusReadyForPickup: {RoleShop},
+		OrderStatusCancelled:      {RoleUser, RoleSystem},
+	},
+	OrderStatusPublished: {
+		OrderStatusDelivering: {RoleRider},
+		OrderStatusCancelled:  {RoleUser, RoleSystem},
+	},
+	OrderStatusDelivering: {
+		OrderStatusCompleted: {RoleRider},
+	},
+	OrderStatusReadyForPickup: {
+		OrderStatusCompleted: {RoleShop},
+		OrderStatusCancelled: {RoleShop, RoleSystem},
+	},
+}
+
+// 只属于某一种履约方式的订单状态：自取订单不经过跑腿和配送，配送订单没有待取餐
+var fulfillmentOnlyStatuses = map[string]string{
+	OrderStatusPublished:      FulfillmentDelivery,
+	OrderStatusDelivering:     FulfillmentDelivery,
+	OrderStatusReadyForPickup: FulfillmentPickup,
+}
+
+// TransitionError 表示一次不被订单生命周期允许的状态流转
+type TransitionError struct {
+	From string
+	To   string
+	Role string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("订单状态不允许由 %s 从 %s 变更为 %s", e.Role, e.From, e.To)
+}
+
+// ValidateTransition 校验 role 能否将订单从 from 状态变更为 to 状态
+func ValidateTransition(from, to, role string) error {
+	for _, allowed := range orderTransitions[from][to] {
+		if allowed == role {
+			return nil
+		}
+	}
+	return &TransitionError{From: from, To: to, Role: role}
+}
+
+// FulfillmentError 表示订单的履约方式不允许进入目标状态
+type FulfillmentError struct {
+	FulfillmentType string
+	To              string
+}
+
+func (e *FulfillmentError) Error() string {
+	if e.FulfillmentType == FulfillmentPickup {
+		return fmt.Sprintf("自取订单不能变更为 %s", e.To)
+	}
+	return fmt.Sprintf("配送订单不能变更为 %s", e.To)
+}
+
+// ValidateFulfillment 校验履约方式为 fulfillmentType 的订单能否进入 to 状态
+func ValidateFulfillment(fulfillmentType, to string) error {
+	if only, ok := fulfillmentOnlyStatuses[to]; ok && only != fulfillmentType {
+		return &FulfillmentError{FulfillmentType: fulfillmentType, To: to}
+	}
+	return nil
+}
+
+// IsValidFulfillmentType 判断是否为已定义的履约方式
+func IsValidFulfillmentType(fulfillmentType string) bool {
+	return fulfillmentType == FulfillmentDelivery || fulfillmentType == FulfillmentPickup
+}
+
+// IsValidOrderStatus 判断是否为已定义的订单状态
+func IsValidOrderStatus(status string) bool {
+	if _, ok := orderTransitions[status]; ok {
+		return true
+	}
+	return status == OrderStatusCompleted || status == OrderStatusCancelled
+}
+
+// 商家订单看板分组，一个分组对应一个或多个订单状态
+const (
+	BoardNew            = "new"             // 待接单
+	BoardScheduled      = "scheduled"       // 预约单，尚未到备餐时间
+	BoardAccepted       = "accepted"        // 已接单，备餐中
+	BoardAwaitingRider  = "awaiting_rider"  // 已发布，等待骑手接单
+	BoardDelivering     = "delivering"      // 配送中
+	BoardAwaitingPickup = "awaiting_pickup" // 自取订单已备好，等待顾客取餐
+	BoardDone           = "done"            // 已完成或已取消
+)
+
+// ShopBoardGroups 看板分组的展示顺序
+var ShopBoardGroups = []string{BoardNew, BoardScheduled, BoardAccepted, BoardAwaitingRider, BoardDelivering, BoardAwaitingPickup, BoardDone}
+
+var shopBoardStatuses = map[string][]string{
+	BoardNew:            {OrderStatusPending},
+	BoardScheduled:      {OrderStatusScheduled},
+	BoardAccepted:       {OrderStatusConfirmed},
+	BoardAwaitingRider:  {OrderStatusPublished},
+	BoardDelivering:     {OrderStatusDelivering},
+	BoardAwaitingPickup: {OrderStatusReadyForPickup},
+	BoardDone:           {OrderStatusCompleted, OrderStatusCancelled},
+}
+
+// ShopBoardStatuses 返回看板分组包含的订单状态
+func ShopBoardStatuses(group string) ([]string, bool) {
+	statuses, ok := shopBoardStatuses[group]
+	return statuses, ok
+}
+
+// ShopBoardGroup 返回订单状态所属的看板分组
+func ShopBoardGroup(status string) string {
+	for group, statuses := range shopBoardStatuses {
+		for _, s := range statuses {
+			if s == status {
+				return group
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// 合并订单的汇总状态，由子订单状态计算，不单独保存
+const (
+	ParentStatusAwaitingPayment = "awaiting_payment" // 待支付，子订单统一支付
+	ParentStatusInProgress      = "in_progress"      // 已支付，仍有子订单在接单、备餐或配送中
+	ParentStatusCompleted       = "completed"        // 子订单均已结束，且至少一个已完成
+	ParentStatusCancelled       = "cancelled"        // 子订单全部取消
+)
+
+// ParentOrder 跨店合并下单生成的合并订单，每个商家一个子订单
+// 子订单各自接单、建群、配送，支付和退款以合并订单的支付记录为准
+type ParentOrder struct {
+	ParentID      int            `json:"parent_id"`
+	ParentNo      string         `json:"parent_no"`
+	UserID        int            `json:"user_id"`
+	PayableAmount Money          `json:"payable_amount"` // 各子订单应付金额之和
+	Status        string         `json:"status"`         // 汇总状态
+	StatusCounts  map[string]int `json:"status_counts"`  // 各状态的子订单数量
+	CreatedAt     time.Time      `json:"created_at"`
+	Orders        []Order        `json:"orders"`
+}
+
+// RollUp 按子订单状态计算合并订单的汇总状态
+// 子订单统一支付，任一子订单待支付即整体待支付；全部取消为已取消；全部结束为已完成；其余为进行中
+func (p *ParentOrder) RollUp() {
+	p.StatusCounts = make(map[string]int)
+	for _, order := range p.Orders {
+		p.StatusCounts[order.OrderStatus]++
+	}
+
+	finished := p.StatusCounts[OrderStatusCompleted] + p.StatusCounts[OrderStatusCancelled]
+	switch {
+	case p.StatusCounts[OrderStatusAwaitingPayment] > 0:
+		p.Status = ParentStatusAwaitingPayment
+	case p.StatusCounts[OrderStatusCancelled] == len(p.Orders):
+		p.Status = ParentStatusCancelled
+	case finished == len(p.Orders):
+		p.Status = ParentStatusCompleted
+	default:
+		p.Status = ParentStatusInProgress
+	}
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// 支付状态
+const (
+	PaymentPending  = "pending"  // 已创建支付单，等待渠道回调
+	PaymentPaid     = "paid"     // 支付成功
+	PaymentFailed   = "failed"   // 支付失败，或订单取消、超时后关闭
+	PaymentRefunded = "refunded" // 已退款
+)
+
+// Payment 订单的一次支付尝试，一个订单可以有多次尝试，最多一次支付成功
+// 合并订单的支付记录 OrderID 为 0，ParentID 为合并订单ID
+type Payment struct {
+	PaymentID      int        `json:"payment_id"`
+	OrderID        int        `json:"order_id"`
+	ParentID       int        `json:"parent_id,omitempty"`
+	UserID         int        `json:"user_id"`
+	Provider       string     `json:"provider"`
+	ProviderRef    string     `json:"provider_ref"` // 渠道支付单号，回调时据此找到支付记录
+	PayURL         string     `json:"pay_url"`      // 客户端拉起支付所需的地址或参数
+	Amount         Money      `json:"amount"`
+	RefundedAmount Money      `json:"refunded_amount"` // 已退款金额
+	Status         string     `json:"status"`
+	FailReason     string     `json:"fail_reason,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	PaidAt         *time.Time `json:"paid_at,omitempty"`
+}
@@ -0,0 +1,48 @@
+package models
+
+// 配送费报价及其组成
+type DeliveryQuote struct {
+	DistanceKm     float64 `json:"distance_km"`
+	BaseFee        Money   `json:"base_fee"`
+	DistanceFee    Money   `json:"distance_fee"`
+	NightSurcharge Money   `json:"night_surcharge"`
+	FreeDelivery   bool    `json:"free_delivery"`
+	DeliveryFee    Money   `json:"delivery_fee"`
+}
+
+// 订单价格明细，由 pricing 包计算，下单时保存到订单上
+// Payable = ItemSubtotal + PackagingFee + DeliveryFee + ServiceFee - Discount
+type PriceBreakdown struct {
+	ItemSubtotal Money          `json:"item_subtotal"` // 商品小计
+	PackagingFee Money          `json:"packaging_fee"` // 打包费
+	DeliveryFee  Money          `json:"delivery_fee"`  // 配送费
+	Delivery     *DeliveryQuote `json:"delivery,omitempty"`
+	Discount     Money          `json:"discount"`    // 优惠券减免
+	ServiceFee   Money          `json:"service_fee"` // 平台服务费
+	Payable      Money          `json:"payable"`     // 应付金额
+}
+
+// ApplyBreakdown 将价格明细写入订单的金额字段
+func (o *Order) ApplyBreakdown(b *PriceBreakdown) {
+	o.TotalPrice = b.ItemSubtotal
+	o.PackagingFee = b.PackagingFee
+	o.DeliveryFee = b.DeliveryFee
+	o.DiscountAmount = b.Discount
+	o.ServiceFee = b.ServiceFee
+	o.PayableAmount = b.Payable
+	if b.Delivery != nil {
+		o.DistanceKm = b.Delivery.DistanceKm
+	}
+}
+
+// Breakdown 由订单保存的金额字段还原价格明细
+func (o *Order) Breakdown() PriceBreakdown {
+	return PriceBreakdown{
+		ItemSubtotal: o.TotalPrice,
+		PackagingFee: o.PackagingFee,
+		DeliveryFee:  o.DeliveryFee,
+		Discount:     o.DiscountAmount,
+		ServiceFee:   o.ServiceFee,
+		Payable:      o.PayableAmount,
+	}
+}
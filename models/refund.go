@@ -0,0 +1,57 @@
+package models
+
+import "time"
+
+// 退款状态
+const (
+	RefundPending   = "pending"   // 待商家审核
+	RefundApproved  = "approved"  // 已批准，正在通过支付渠道退款
+	RefundSucceeded = "succeeded" // 退款成功
+	RefundFailed    = "failed"    // 渠道退款失败，可重新批准重试
+	RefundRejected  = "rejected"  // 商家拒绝
+)
+
+// 退款原因
+const (
+	RefundReasonOrderCancelled   = "order_cancelled"   // 支付后取消订单
+	RefundReasonMissingItem      = "missing_item"      // 漏送商品
+	RefundReasonQualityIssue     = "quality_issue"     // 商品质量问题
+	RefundReasonDuplicatePayment = "duplicate_payment" // 订单已关闭或已支付后再次付款
+	RefundReasonOther            = "other"
+)
+
+// IsValidRefundReason 判断是否为用户或商家可以选择的退款原因，duplicate_payment 仅由系统使用
+func IsValidRefundReason(code string) bool {
+	switch code {
+	case RefundReasonOrderCancelled, RefundReasonMissingItem, RefundReasonQualityIssue, RefundReasonOther:
+		return true
+	}
+	return false
+}
+
+// Refund 订单的一笔退款，Items 为空表示按金额退款（如取消订单全额退款）
+type Refund struct {
+	RefundID          int          `json:"refund_id"`
+	OrderID           int          `json:"order_id"`
+	PaymentID         int          `json:"payment_id"`
+	Amount            Money        `json:"amount"`
+	ReasonCode        string       `json:"reason_code"`
+	Reason            string       `json:"reason,omitempty"` // 补充说明
+	Status            string       `json:"status"`
+	RequestedBy       OrderActor   `json:"requested_by"`
+	ReviewedBy        *OrderActor  `json:"reviewed_by,omitempty"` // 自动批准时为 system
+	ReviewNote        string       `json:"review_note,omitempty"`
+	ProviderRefundRef string       `json:"provider_refund_ref,omitempty"` // 渠道退款单号
+	FailReason        string       `json:"fail_reason,omitempty"`
+	Items             []RefundItem `json:"items,omitempty"`
+	CreatedAt         time.Time    `json:"created_at"`
+	CompletedAt       *time.Time   `json:"completed_at,omitempty"`
+}
+
+// RefundItem 部分退款的商品明细，金额按下单时的单价和单件打包费计算
+type RefundItem struct {
+	OrderItemID int    `json:"order_item_id"`
+	ProductName string `json:"product_name,omitempty"`
+	Quantity    int    `json:"quantity"`
+	Amount      Money  `json:"amount"`
+}
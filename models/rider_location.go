@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// LocationPoint 骑手上报的一个定位点
+type LocationPoint struct {
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	RecordedAt time.Time `json:"recorded_at"` // 定位时间，未传时按服务端收到的时间
+}
+
+// RiderLocation 骑手的最新位置，DistanceKm 为按位置查询时到查询中心的距离
+type RiderLocation struct {
+	RiderID    int       `json:"rider_id"`
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	DistanceKm float64   `json:"distance_km,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
@@ -0,0 +1,19 @@
+package models
+
+// 骑手状态
+const (
+	RiderStatusOnline  = "online"  // 在线，可接单
+	RiderStatusBusy    = "busy"    // 在线，但配送中的订单已达上限，暂不接新单
+	RiderStatusOffline = "offline" // 离线，主动下线或心跳超时
+)
+
+// RiderStatuses 全部骑手状态，用于按状态统计
+var RiderStatuses = []string{RiderStatusOnline, RiderStatusBusy, RiderStatusOffline}
+
+// RiderAvailability 骑手的接单状态
+type RiderAvailability struct {
+	RiderID         int    `json:"rider_id"`
+	Status          string `json:"status"`
+	ActiveOrders    int    `json:"active_orders"`     // 配送中的订单数
+	MaxActiveOrders int    `json:"max_active_orders"` // 同时配送的订单上限，达到上限时自动变为忙碌
+}
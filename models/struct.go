@@ -16,16 +16,16 @@ type User struct {
 
 // 骑手的结构
 type Rider struct {
-	RiderID          int     `json:"rider_id"`      // 骑手ID，区分于 UserID
-	RiderName        string  `json:"rider_name"`    // 骑手名
-	RiderPassword    string  `json:"rider_password"`// 骑手密码
-	RiderRating      float64 `json:"rider_rating"`  // 骑手的评分
-	RiderPhone       string  `json:"rider_phone"`
-	VehicleType      string  `json:"vehicle_type"`   // 车辆类型
-	RiderStatus      string  `json:"rider_status"`   // 骑手状态（如在线、休息、离线）
-	RiderLatitude    float64 `json:"rider_latitude"` // 骑手的纬度
-	RiderLongitude   float64 `json:"rider_longitude"`// 骑手的经度
-	DeliveryFee      float64 `json:"delivery_fee"`   // 配送费
+	RiderID        int     `json:"rider_id"`       // 骑手ID，区分于 UserID
+	RiderName      string  `json:"rider_name"`     // 骑手名
+	RiderPassword  string  `json:"rider_password"` // 骑手密码
+	RiderRating    float64 `json:"rider_rating"`   // 骑手的评分
+	RiderPhone     string  `json:"rider_phone"`
+	VehicleType    string  `json:"vehicle_type"`    // 车辆类型
+	RiderStatus    string  `json:"rider_status"`    // 骑手状态（如在线、休息、离线）
+	RiderLatitude  float64 `json:"rider_latitude"`  // 骑手的纬度
+	RiderLongitude float64 `json:"rider_longitude"` // 骑手的经度
+	DeliveryFee    Money   `json:"delivery_fee"`    // 配送费
 }
 
 // 商家结构体
@@ -38,33 +38,111 @@ type Shop struct {
 	Description  string  `json:"description"`
 	ShopLatitude     float64 `json:"shop_latitude"`  // 商家的纬度
 	ShopLongitude    float64 `json:"shop_longitude"` // 商家的经度
+	DeliveryRadiusKm float64 `json:"delivery_radius_km"` // 最大配送半径（公里）
 }
 
 // 商品结构体
 type Product struct {
-	ProductID   int     `json:"product_id"`
-	ShopID      int     `json:"shop_id"`
-	ProductName string  `json:"product_name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Stock       int     `json:"stock"`
+	ProductID    int    `json:"product_id"`
+	ShopID       int    `json:"shop_id"`
+	ProductName  string `json:"product_name"`
+	Description  string `json:"description"`
+	Price        Money  `json:"price"`
+	PackagingFee Money  `json:"packaging_fee"` // 单件打包费
+	Stock        int    `json:"stock"`
 }
 
 // 订单结构体
 type Order struct {
-	OrderID     int       `json:"order_id"`
-	UserID      int       `json:"user_id"`
-	ShopID      int       `json:"shop_id"`
-	RiderID     int       `json:"rider_id"`
-	ProductID   int       `json:"product_id"`
-	OrderStatus string    `json:"order_status"`
-	Username    string    `json:"username"`
-	ShopName    string    `json:"shop_name"`
-	OrderTime   time.Time `json:"order_time"`
-	ProductName string    `json:"product_name"`
-	TotalPrice  float64   `json:"total_price"`
-	DeliveryFee float64   `json:"delivery_fee"` // 配送费
-	GroupID     int       `json:"group_id,omitempty"`
+	OrderID           int          `json:"order_id"`
+	OrderNo           string       `json:"order_no"` // 面向用户的订单号，用户联系客服或商家时使用
+	UserID            int          `json:"user_id"`
+	ShopID            int          `json:"shop_id"`
+	RiderID           int          `json:"rider_id"`
+	OrderStatus       string       `json:"order_status"`
+	FulfillmentType   string       `json:"fulfillment_type"`      // 履约方式：delivery 配送（默认）、pickup 到店自取
+	PickupCode        string       `json:"pickup_code,omitempty"` // 自取订单的取餐码，顾客到店取餐时出示
+	Username          string       `json:"username"`
+	ShopName          string       `json:"shop_name"`
+	OrderTime         time.Time    `json:"order_time"`
+	Items             []OrderItem  `json:"items"`        // 订单明细
+	TotalPrice        Money        `json:"total_price"`  // 商品小计（各明细小计之和）
+	DeliveryFee       Money        `json:"delivery_fee"` // 配送费
+	Notes             string       `json:"notes"`        // 用户备注
+	DeliveryAddress   string       `json:"delivery_address"`
+	DeliveryLatitude  float64      `json:"delivery_latitude"`          // 收货纬度，未传时使用用户默认坐标
+	DeliveryLongitude float64      `json:"delivery_longitude"`         // 收货经度
+	DistanceKm        float64      `json:"distance_km"`                // 商家到收货地址的距离
+	UserCouponID      int          `json:"user_coupon_id,omitempty"`   // 使用的用户优惠券
+	DiscountAmount    Money        `json:"discount_amount"`            // 优惠券减免金额
+	PackagingFee      Money        `json:"packaging_fee"`              // 打包费
+	ServiceFee        Money        `json:"service_fee"`                // 平台服务费
+	PayableAmount     Money        `json:"payable_amount"`             // 应付金额
+	ScheduledAt       *time.Time   `json:"scheduled_at,omitempty"`     // 预约送达时间，为空表示立即配送
+	DeliverySlotID    int          `json:"delivery_slot_id,omitempty"` // 预约送达时间所在的商家配送时段
+	ReleaseAt         *time.Time   `json:"release_at,omitempty"`       // 预约单通知商家备餐的时间
+	GroupID           int          `json:"group_id,omitempty"`
+	ParentID          int          `json:"parent_id,omitempty"` // 所属合并订单，跨店合并下单时由合并订单统一支付
+	Timeline          []OrderEvent `json:"timeline,omitempty"`  // 状态变更时间线
+	Refunds           []Refund     `json:"refunds,omitempty"`   // 退款记录
+}
+
+// 订单列表中的一行摘要，不含完整明细
+type OrderSummary struct {
+	OrderID         int       `json:"order_id"`
+	OrderNo         string    `json:"order_no"`
+	UserID          int       `json:"user_id"`
+	ShopID          int       `json:"shop_id"`
+	ShopName        string    `json:"shop_name"`
+	OrderStatus     string    `json:"order_status"`
+	FulfillmentType string    `json:"fulfillment_type"`
+	ParentID        int       `json:"parent_id,omitempty"`
+	OrderTime       time.Time `json:"order_time"`
+	ItemSummary     string    `json:"item_summary"` // 如 "宫保鸡丁 x2, 米饭 x1"
+	ItemCount       int       `json:"item_count"`
+	TotalPrice      Money     `json:"total_price"` // 商品小计
+	PackagingFee    Money     `json:"packaging_fee"`
+	DeliveryFee     Money     `json:"delivery_fee"`
+	ServiceFee      Money     `json:"service_fee"`
+	DiscountAmount  Money     `json:"discount_amount"`
+	PayableAmount   Money     `json:"payable_amount"` // 应付金额，与订单详情和支付金额一致
+	Notes           string    `json:"notes"`
+}
+
+// 订单列表查询条件，零值字段表示不过滤
+type OrderFilter struct {
+	UserID   int
+	ShopID   int
+	OrderNo  string // 按订单号精确查找
+	Statuses []string
+	From     time.Time // 下单时间 >= From
+	To       time.Time // 下单时间 < To
+	Cursor   int       // 只返回订单ID小于 Cursor 的订单
+	Limit    int
+}
+
+// 订单状态变更记录
+type OrderEvent struct {
+	EventID    int       `json:"event_id"`
+	OrderID    int       `json:"order_id"`
+	FromStatus string    `json:"from_status"` // 订单创建事件为空
+	ToStatus   string    `json:"to_status"`
+	ActorRole  string    `json:"actor_role"`
+	ActorID    int       `json:"actor_id"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// 订单明细结构体，单价为下单时的商品价格快照
+type OrderItem struct {
+	OrderItemID  int    `json:"order_item_id,omitempty"`
+	OrderID      int    `json:"order_id,omitempty"`
+	ProductID    int    `json:"product_id"`
+	ProductName  string `json:"product_name"`
+	Quantity     int    `json:"quantity"`
+	UnitPrice    Money  `json:"unit_price"`    // 下单时的单价
+	PackagingFee Money  `json:"packaging_fee"` // 下单时的单件打包费
+	Subtotal     Money  `json:"subtotal"`      // 单价 * 数量
 }
 
 // Group
@@ -40,6 +40,47 @@ var (
 		Name: "http_requests_total",
 		Help: "Total number of HTTP requests.",
 	}, []string{"path", "method", "code"})
+
+	OrderTimeoutsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "order_timeouts_total",
+		Help: "Total number of order timeouts handled, by kind and action.",
+	}, []string{"kind", "action"})
+
+	PaymentCallbacksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_callbacks_total",
+		Help: "Total number of payment provider callbacks, by provider and outcome.",
+	}, []string{"provider", "outcome"})
+
+	RefundsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "refunds_total",
+		Help: "Total number of refunds executed through the payment provider, by reason code and result.",
+	}, []string{"reason", "result"})
+
+	DispatchOffersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dispatch_offers_total",
+		Help: "Total number of rider dispatch events, by outcome (offered, accepted, declined, expired, withdrawn, hall).",
+	}, []string{"outcome"})
+
+	OrderGrabsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "order_grabs_total",
+		Help: "Total number of rider grab attempts, by outcome (won, lock_contended, taken, rider_unavailable, failed).",
+	}, []string{"outcome"})
+
+	OrderGrabDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "order_grab_duration_seconds",
+		Help:    "Duration of rider grab attempts, by outcome.",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"outcome"})
+
+	RidersByStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "riders_by_status",
+		Help: "Current number of riders, by availability status (online, busy, offline).",
+	}, []string{"status"})
+
+	RidersTimedOutTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "riders_heartbeat_timeouts_total",
+		Help: "Total number of riders marked offline after missing heartbeats.",
+	})
 )
 
 func RecordDBTime(operation string, f func() error) error {
@@ -0,0 +1,135 @@
+// Package orderno 生成面向用户的订单号，便于用户电话报给客服或商家
+//
+// 订单号为 20 位数字：12 位下单时间（yyMMddHHmmss，北京时间）+ 3 位实例编号 + 4 位秒内序号 + 1 位 Luhn 校验位，
+// 如 24101712305800100018。不同实例的实例编号不同，同一实例内由序号区分，因此多实例部署时不会重复；
+// 校验位用于在查询前识别报错、抄错的订单号。
+package orderno
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"take-out/config"
+	"time"
+)
+
+const (
+	// Length 订单号长度
+	Length = 20
+	// MaxInstanceID 实例编号上限，实例编号占 3 位
+	MaxInstanceID = 999
+
+	maxSequence = 9999
+	timeLayout  = "060102150405"
+)
+
+var (
+	// ErrInvalid 订单号长度、字符或校验位不正确
+	ErrInvalid = errors.New("订单号格式错误")
+	// ErrNoInstance 生成器没有实例编号（尚未设置或租约丢失后尚未重新申请到），此时生成的订单号可能与其他实例重复
+	ErrNoInstance = errors.New("订单号实例编号不可用，暂时无法下单")
+)
+
+// 没有实例编号
+const noInstance = -1
+
+// Generator 订单号生成器，并发安全
+type Generator struct {
+	mu         sync.Mutex
+	instanceID int
+	second     int64 // 最近一次生成使用的秒
+	sequence   int   // 该秒内已使用的序号
+	now        func() time.Time
+}
+
+// NewGenerator 创建生成器，设置实例编号之前 Next 返回 ErrNoInstance
+func NewGenerator() *Generator {
+	return &Generator{instanceID: noInstance, second: -1, now: time.Now}
+}
+
+func checkInstanceID(instanceID int) error {
+	if instanceID < 0 || instanceID > MaxInstanceID {
+		return fmt.Errorf("实例编号必须在 0 到 %d 之间: %d", MaxInstanceID, instanceID)
+	}
+	return nil
+}
+
+// InstanceID 当前使用的实例编号，没有实例编号时返回 -1
+func (g *Generator) InstanceID() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.instanceID
+}
+
+// SetInstanceID 更换实例编号，如实例编号租约丢失后重新申请到了新的编号
+func (g *Generator) SetInstanceID(instanceID int) error {
+	if err := checkInstanceID(instanceID); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.instanceID = instanceID
+	return nil
+}
+
+// ClearInstanceID 实例编号租约丢失时调用，重新设置实例编号之前 Next 返回 ErrNoInstance
+func (g *Generator) ClearInstanceID() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.instanceID = noInstance
+}
+
+// Next 生成下一个订单号，没有实例编号时返回 ErrNoInstance
+// 同一秒内序号用完时借用下一秒；系统时钟回拨时继续使用之前的秒，保证同一实例内不重复
+func (g *Generator) Next() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.instanceID == noInstance {
+		return "", ErrNoInstance
+	}
+
+	if now := g.now().Unix(); now > g.second {
+		g.second = now
+		g.sequence = 0
+	} else if g.sequence++; g.sequence > maxSequence {
+		g.second++
+		g.sequence = 0
+	}
+
+	payload := fmt.Sprintf("%s%03d%04d", time.Unix(g.second, 0).In(config.Location).Format(timeLayout), g.instanceID, g.sequence)
+	return payload + string(checkDigit(payload)), nil
+}
+
+// Valid 校验订单号的长度、字符和校验位
+func Valid(orderNo string) error {
+	if len(orderNo) != Length {
+		return ErrInvalid
+	}
+	for i := 0; i < len(orderNo); i++ {
+		if orderNo[i] < '0' || orderNo[i] > '9' {
+			return ErrInvalid
+		}
+	}
+	if checkDigit(orderNo[:Length-1]) != orderNo[Length-1] {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// 按 Luhn 算法计算校验位：从右往左，与校验位相邻的数字起每隔一位乘 2
+func checkDigit(payload string) byte {
+	sum := 0
+	double := true
+	for i := len(payload) - 1; i >= 0; i-- {
+		d := int(payload[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return byte('0' + (10-sum%10)%10)
+}
@@ -0,0 +1,156 @@
+package orderno
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// 北京时间 2024-10-17 12:30:58
+var testNow = time.Date(2024, 10, 17, 4, 30, 58, 0, time.UTC)
+
+// 返回使用可控时钟、实例编号为 instanceID 的生成器，修改 *clock 即可拨动时间
+func newTestGenerator(t *testing.T, instanceID int) (*Generator, *time.Time) {
+	t.Helper()
+	clock := testNow
+	g := NewGenerator()
+	g.now = func() time.Time { return clock }
+	if err := g.SetInstanceID(instanceID); err != nil {
+		t.Fatalf("SetInstanceID(%d) unexpected error: %v", instanceID, err)
+	}
+	return g, &clock
+}
+
+func mustNext(t *testing.T, g *Generator) string {
+	t.Helper()
+	orderNo, err := g.Next()
+	if err != nil {
+		t.Fatalf("Next() unexpected error: %v", err)
+	}
+	return orderNo
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name    string
+		advance time.Duration // 生成前拨动时钟
+		want    string        // 不含校验位
+	}{
+		{"first number", 0, "2410171230580070000"},
+		{"same second", 0, "2410171230580070001"},
+		{"sub-second tick stays in second", 500 * time.Millisecond, "2410171230580070002"},
+		{"next second resets sequence", 500 * time.Millisecond, "2410171230590070000"},
+		{"clock rollback keeps last second", -10 * time.Second, "2410171230590070001"},
+		{"still behind", time.Second, "2410171230590070002"},
+		{"clock catches up", 10 * time.Second, "2410171231000070000"},
+	}
+	g, clock := newTestGenerator(t, 7)
+	for _, tt := range tests {
+		*clock = clock.Add(tt.advance)
+		got := mustNext(t, g)
+		if got[:Length-1] != tt.want {
+			t.Errorf("%s: Next() = %s, want %s plus check digit", tt.name, got, tt.want)
+		}
+		if err := Valid(got); err != nil {
+			t.Errorf("%s: Valid(%s) = %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestNextSequenceOverflow(t *testing.T) {
+	g, _ := newTestGenerator(t, 42)
+	seen := make(map[string]bool)
+	var last string
+	for i := 0; i <= maxSequence+1; i++ {
+		last = mustNext(t, g)
+		if seen[last] {
+			t.Fatalf("duplicate order number %s after %d calls", last, i+1)
+		}
+		seen[last] = true
+	}
+	// 第 10001 个订单号借用下一秒，序号从 0 开始
+	if want := "2410171230590420000"; last[:Length-1] != want {
+		t.Errorf("overflow Next() = %s, want %s plus check digit", last, want)
+	}
+	// 时钟追上借用的秒之前继续使用该秒
+	if got, want := mustNext(t, g)[:Length-1], "2410171230590420001"; got != want {
+		t.Errorf("Next() after overflow = %s, want %s", got, want)
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	g := NewGenerator()
+	if _, err := g.Next(); !errors.Is(err, ErrNoInstance) {
+		t.Errorf("Next() without instance id = %v, want ErrNoInstance", err)
+	}
+	if g.InstanceID() != -1 {
+		t.Errorf("InstanceID() = %d, want -1", g.InstanceID())
+	}
+
+	for _, id := range []int{-1, MaxInstanceID + 1} {
+		if err := g.SetInstanceID(id); err == nil {
+			t.Errorf("SetInstanceID(%d) should fail", id)
+		}
+	}
+	for _, id := range []int{0, MaxInstanceID} {
+		if err := g.SetInstanceID(id); err != nil || g.InstanceID() != id {
+			t.Errorf("SetInstanceID(%d) = %v, InstanceID() = %d", id, err, g.InstanceID())
+		}
+	}
+	if _, err := g.Next(); err != nil {
+		t.Errorf("Next() with instance id unexpected error: %v", err)
+	}
+
+	g.ClearInstanceID()
+	if _, err := g.Next(); !errors.Is(err, ErrNoInstance) {
+		t.Errorf("Next() after ClearInstanceID = %v, want ErrNoInstance", err)
+	}
+	if err := g.SetInstanceID(5); err != nil {
+		t.Fatalf("SetInstanceID(5) unexpected error: %v", err)
+	}
+	if _, err := g.Next(); err != nil {
+		t.Errorf("Next() after reclaiming unexpected error: %v", err)
+	}
+}
+
+func TestCheckDigit(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    byte
+	}{
+		{"7992739871", '3'}, // Luhn 算法的标准示例
+		{"0", '0'},
+		{"1", '8'},
+		{"2410171230580070000", '7'},
+	}
+	for _, tt := range tests {
+		if got := checkDigit(tt.payload); got != tt.want {
+			t.Errorf("checkDigit(%q) = %c, want %c", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		orderNo string
+		valid   bool
+	}{
+		{"24101712305800700007", true},
+		{"24101712305800700008", false},  // 校验位错误
+		{"24101712305800700070", false},  // 相邻两位对调
+		{"34101712305800700007", false},  // 抄错一位
+		{"2410171230580070000", false},   // 少一位
+		{"241017123058007000077", false}, // 多一位
+		{"2410171230580070000A", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		err := Valid(tt.orderNo)
+		if tt.valid && err != nil {
+			t.Errorf("Valid(%q) unexpected error: %v", tt.orderNo, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalid) {
+			t.Errorf("Valid(%q) = %v, want ErrInvalid", tt.orderNo, err)
+		}
+	}
+}
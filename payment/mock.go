@@ -0,0 +1,78 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	MockProviderName = "mock"
+	// MockSignatureHeader 模拟渠道回调携带签名的请求头，签名为 HMAC-SHA256(secret, body) 的十六进制
+	MockSignatureHeader = "X-Mock-Signature"
+	// MockDevSecret 开发模式（PAYMENT_MOCK_DEV_MODE=true）下未配置 PAYMENT_MOCK_SECRET 时使用的公开密钥
+	MockDevSecret = "mock_payment_secret"
+)
+
+// MockProvider 本地模拟支付渠道，用于开发和测试：创建支付单不产生真实扣款，
+// 支付结果由调用方按约定签名后回调 /api/payment/callback 模拟
+type MockProvider struct {
+	secret []byte
+}
+
+// NewMockProvider 创建模拟渠道，secret 为回调签名密钥，由 LoadProvider 保证不为空
+func NewMockProvider(secret string) *MockProvider {
+	return &MockProvider{secret: []byte(secret)}
+}
+
+func (p *MockProvider) Name() string {
+	return MockProviderName
+}
+
+func (p *MockProvider) CreateIntent(req IntentRequest) (*Intent, error) {
+	ref := fmt.Sprintf("mock_%d_%d", req.OrderID, time.Now().UnixNano())
+	if req.ParentID != 0 {
+		ref = fmt.Sprintf("mock_p%d_%d", req.ParentID, time.Now().UnixNano())
+	}
+	return &Intent{ProviderRef: ref, PayURL: "mock://pay/" + ref}, nil
+}
+
+// Sign 计算回调签名
+func (p *MockProvider) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *MockProvider) ParseCallback(header http.Header, body []byte) (*CallbackEvent, error) {
+	signature, err := hex.DecodeString(header.Get(MockSignatureHeader))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidSignature
+	}
+
+	var event CallbackEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("支付回调格式错误: %v", err)
+	}
+	if event.ProviderRef == "" || (event.Result != ResultPaid && event.Result != ResultFailed) {
+		return nil, fmt.Errorf("支付回调缺少支付单号或支付结果无效")
+	}
+	return &event, nil
+}
+
+// Refund 模拟渠道直接退款成功，退款单号由商户退款单号派生，重复调用结果相同
+func (p *MockProvider) Refund(req RefundRequest) (*RefundResult, error) {
+	if req.ProviderRef == "" || !req.Amount.IsPositive() {
+		return nil, fmt.Errorf("退款参数无效")
+	}
+	return &RefundResult{ProviderRefundRef: "mock_refund_" + req.RefundNo}, nil
+}
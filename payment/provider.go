@@ -0,0 +1,87 @@
+// Package payment 支付渠道抽象：创建支付单、校验并解析渠道的异步回调，不依赖数据库和 Redis
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"take-out/models"
+)
+
+// 渠道回调中的支付结果
+const (
+	ResultPaid   = "paid"
+	ResultFailed = "failed"
+)
+
+// ErrInvalidSignature 回调签名校验失败
+var ErrInvalidSignature = errors.New("支付回调签名无效")
+
+// IntentRequest 创建支付单的参数
+type IntentRequest struct {
+	OrderID  int
+	ParentID int // 合并订单支付时为合并订单ID，OrderID 为 0
+	UserID   int
+	Amount   models.Money
+	Subject  string
+}
+
+// Intent 渠道创建的支付单
+type Intent struct {
+	ProviderRef string // 渠道支付单号
+	PayURL      string // 客户端拉起支付所需的地址或参数
+}
+
+// CallbackEvent 校验通过的渠道回调
+type CallbackEvent struct {
+	ProviderRef string       `json:"provider_ref"`
+	Result      string       `json:"result"` // paid 或 failed
+	Amount      models.Money `json:"amount"`
+	Reason      string       `json:"reason"` // 失败原因
+}
+
+// RefundRequest 原路退款的参数
+type RefundRequest struct {
+	ProviderRef string // 原支付单号
+	RefundNo    string // 商户退款单号，渠道据此去重，重试同一笔退款时保持不变
+	Amount      models.Money
+	Reason      string
+}
+
+// RefundResult 渠道受理的退款
+type RefundResult struct {
+	ProviderRefundRef string // 渠道退款单号
+}
+
+// Provider 支付渠道，接入新渠道时实现该接口并在 LoadProvider 中注册
+type Provider interface {
+	Name() string
+	// CreateIntent 在渠道侧创建支付单
+	CreateIntent(req IntentRequest) (*Intent, error)
+	// ParseCallback 校验回调签名并解析支付结果，签名无效时返回 ErrInvalidSignature
+	ParseCallback(header http.Header, body []byte) (*CallbackEvent, error)
+	// Refund 原路退回已支付的款项，同一 RefundNo 重复调用不会重复退款
+	Refund(req RefundRequest) (*RefundResult, error)
+}
+
+// LoadProvider 按 PAYMENT_PROVIDER 环境变量选择支付渠道，需在加载 config.env 之后调用
+// 未配置渠道、配置了不支持的渠道或模拟渠道缺少密钥都属于部署错误，返回错误由调用方阻止服务启动
+func LoadProvider() (Provider, error) {
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "":
+		return nil, errors.New("未配置支付渠道 PAYMENT_PROVIDER")
+	case MockProviderName:
+		secret := os.Getenv("PAYMENT_MOCK_SECRET")
+		if secret == "" {
+			// 任何人都能用公开的开发密钥伪造支付成功回调，只允许在明确开启开发模式时使用
+			if os.Getenv("PAYMENT_MOCK_DEV_MODE") != "true" {
+				return nil, errors.New("模拟支付渠道未配置 PAYMENT_MOCK_SECRET")
+			}
+			secret = MockDevSecret
+		}
+		return NewMockProvider(secret), nil
+	default:
+		return nil, fmt.Errorf("不支持的支付渠道: %s", name)
+	}
+}
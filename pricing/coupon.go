@@ -0,0 +1,102 @@
+package pricing
+
+import (
+	"fmt"
+	"take-out/models"
+	"time"
+)
+
+// CouponError 优惠券不满足使用条件
+type CouponError struct {
+	Reason string
+}
+
+func (e *CouponError) Error() string {
+	return "优惠券不可用: " + e.Reason
+}
+
+// ValidateCoupon 校验优惠券模板本身的配置是否合法，创建优惠券时调用
+func ValidateCoupon(c models.Coupon) error {
+	switch c.CouponType {
+	case models.CouponTypeFixed:
+		if !c.Amount.IsPositive() {
+			return &CouponError{Reason: "立减金额必须大于0"}
+		}
+	case models.CouponTypeThreshold:
+		if !c.Amount.IsPositive() || c.MinSpend.Cmp(c.Amount) <= 0 {
+			return &CouponError{Reason: "满减券的门槛必须大于减免金额"}
+		}
+	case models.CouponTypePercent:
+		if c.PercentOff <= 0 || c.PercentOff >= 100 {
+			return &CouponError{Reason: "折扣比例必须在 0 到 100 之间"}
+		}
+	default:
+		return &CouponError{Reason: fmt.Sprintf("未知的优惠券类型 %q", c.CouponType)}
+	}
+	if !c.ValidTo.After(c.ValidFrom) {
+		return &CouponError{Reason: "有效期结束时间必须晚于开始时间"}
+	}
+	if c.PerUserLimit <= 0 {
+		return &CouponError{Reason: "每人限领张数必须大于0"}
+	}
+	return nil
+}
+
+// CouponDiscount 计算优惠券对订单商品的减免金额
+// 门槛和折扣只按优惠券适用范围内的商品金额计算，减免金额不超过适用商品金额
+func CouponDiscount(c models.Coupon, shopID int, items []models.OrderItem, at time.Time) (models.Money, error) {
+	var none models.Money
+	if at.Before(c.ValidFrom) {
+		return none, &CouponError{Reason: "优惠券尚未生效"}
+	}
+	if !at.Before(c.ValidTo) {
+		return none, &CouponError{Reason: "优惠券已过期"}
+	}
+	if c.ShopID != 0 && c.ShopID != shopID {
+		return none, &CouponError{Reason: "优惠券不适用于该商家"}
+	}
+
+	eligible := eligibleSubtotal(c, items)
+	if !eligible.IsPositive() {
+		return none, &CouponError{Reason: "订单中没有适用该优惠券的商品"}
+	}
+	if eligible.Cmp(c.MinSpend) < 0 {
+		return none, &CouponError{Reason: fmt.Sprintf("适用商品金额未满 %s", c.MinSpend)}
+	}
+
+	var discount models.Money
+	switch c.CouponType {
+	case models.CouponTypeFixed, models.CouponTypeThreshold:
+		discount = c.Amount
+	case models.CouponTypePercent:
+		discount = eligible.MulRate(c.PercentOff / 100)
+		if c.MaxDiscount.IsPositive() {
+			discount = discount.Min(c.MaxDiscount)
+		}
+	default:
+		return none, &CouponError{Reason: "未知的优惠券类型"}
+	}
+	return discount.Min(eligible), nil
+}
+
+// 优惠券适用范围内的商品金额
+func eligibleSubtotal(c models.Coupon, items []models.OrderItem) models.Money {
+	if len(c.ProductIDs) == 0 {
+		var total models.Money
+		for _, item := range items {
+			total = total.Add(item.Subtotal)
+		}
+		return total
+	}
+	scoped := make(map[int]bool, len(c.ProductIDs))
+	for _, id := range c.ProductIDs {
+		scoped[int(id)] = true
+	}
+	var total models.Money
+	for _, item := range items {
+		if scoped[item.ProductID] {
+			total = total.Add(item.Subtotal)
+		}
+	}
+	return total
+}
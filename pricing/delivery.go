@@ -0,0 +1,106 @@
+// Package pricing 负责订单计价：配送费、优惠券减免等规则，不依赖数据库和 Redis
+package pricing
+
+import (
+	"fmt"
+	"math"
+	"take-out/config"
+	"take-out/models"
+	"time"
+)
+
+const earthRadiusKm = 6371.0
+
+// DistanceKm 使用 Haversine 公式计算两点间的球面距离（公里）
+func DistanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return earthRadiusKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// DeliveryFeeConfig 配送费规则
+type DeliveryFeeConfig struct {
+	BaseFee         models.Money // 起步价
+	BaseDistanceKm  float64      // 起步价包含的距离
+	PerKmFee        models.Money // 超出起步距离后每公里（不足一公里按一公里）的费用
+	NightSurcharge  models.Money // 夜间附加费
+	NightStartHour  int          // 夜间开始时间（含），业务时区的 0-23 点
+	NightEndHour    int          // 夜间结束时间（不含），业务时区的 0-23 点
+	FreeThreshold   models.Money // 商品金额达到该值免配送费，0 表示不免
+	DefaultRadiusKm float64      // 商家未设置配送半径时的默认值
+}
+
+// LoadDeliveryFeeConfig 从环境变量读取配送费规则，未配置的项使用默认值
+func LoadDeliveryFeeConfig() DeliveryFeeConfig {
+	return DeliveryFeeConfig{
+		BaseFee:         envMoney("DELIVERY_BASE_FEE", 5),
+		BaseDistanceKm:  config.Float("DELIVERY_BASE_DISTANCE_KM", 3),
+		PerKmFee:        envMoney("DELIVERY_PER_KM_FEE", 1),
+		NightSurcharge:  envMoney("DELIVERY_NIGHT_SURCHARGE", 3),
+		NightStartHour:  config.IntBetween("DELIVERY_NIGHT_START_HOUR", 22, 0, 23),
+		NightEndHour:    config.IntBetween("DELIVERY_NIGHT_END_HOUR", 6, 0, 23),
+		FreeThreshold:   envMoney("DELIVERY_FREE_THRESHOLD", 0),
+		DefaultRadiusKm: config.Float("DELIVERY_DEFAULT_RADIUS_KM", 5),
+	}
+}
+
+// OutOfRangeError 收货地址超出商家配送范围
+type OutOfRangeError struct {
+	DistanceKm float64
+	RadiusKm   float64
+}
+
+func (e *OutOfRangeError) Error() string {
+	return fmt.Sprintf("收货地址距商家 %.2f 公里，超出配送范围 %.2f 公里", e.DistanceKm, e.RadiusKm)
+}
+
+// Quote 根据配送距离、商品金额和下单时间计算配送费
+// radiusKm 为商家的最大配送半径，不大于 0 时使用默认半径
+func (c DeliveryFeeConfig) Quote(distanceKm, radiusKm float64, itemTotal models.Money, at time.Time) (*models.DeliveryQuote, error) {
+	if radiusKm <= 0 {
+		radiusKm = c.DefaultRadiusKm
+	}
+	distanceKm = round2(distanceKm)
+	if distanceKm > radiusKm {
+		return nil, &OutOfRangeError{DistanceKm: distanceKm, RadiusKm: radiusKm}
+	}
+
+	quote := &models.DeliveryQuote{DistanceKm: distanceKm, BaseFee: c.BaseFee}
+	if extra := distanceKm - c.BaseDistanceKm; extra > 0 {
+		quote.DistanceFee = c.PerKmFee.Mul(int(math.Ceil(extra)))
+	}
+	if c.isNight(at) {
+		quote.NightSurcharge = c.NightSurcharge
+	}
+
+	if c.FreeThreshold.IsPositive() && itemTotal.Cmp(c.FreeThreshold) >= 0 {
+		quote.FreeDelivery = true
+		return quote, nil
+	}
+	quote.DeliveryFee = quote.BaseFee.Add(quote.DistanceFee).Add(quote.NightSurcharge)
+	return quote, nil
+}
+
+// 夜间时段按业务时区的钟点判断，可以跨零点，如 22 点到次日 6 点
+func (c DeliveryFeeConfig) isNight(at time.Time) bool {
+	hour := at.In(config.Location).Hour()
+	if c.NightStartHour == c.NightEndHour {
+		return false
+	}
+	if c.NightStartHour < c.NightEndHour {
+		return hour >= c.NightStartHour && hour < c.NightEndHour
+	}
+	return hour >= c.NightStartHour || hour < c.NightEndHour
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// 金额配置以元为单位填写，如 DELIVERY_BASE_FEE=5.5
+func envMoney(key string, fallback float64) models.Money {
+	return models.Yuan(config.Float(key, fallback))
+}
@@ -0,0 +1,96 @@
+package pricing
+
+import (
+	"errors"
+	"take-out/models"
+	"testing"
+	"time"
+)
+
+func testDeliveryFeeConfig() DeliveryFeeConfig {
+	return DeliveryFeeConfig{
+		BaseFee:         models.Yuan(5),
+		BaseDistanceKm:  3,
+		PerKmFee:        models.Yuan(1),
+		NightSurcharge:  models.Yuan(3),
+		NightStartHour:  22,
+		NightEndHour:    6,
+		FreeThreshold:   models.Yuan(50),
+		DefaultRadiusKm: 5,
+	}
+}
+
+func TestIsNight(t *testing.T) {
+	beijing := time.FixedZone("UTC+8", 8*3600)
+	tests := []struct {
+		name       string
+		start, end int
+		at         time.Time
+		want       bool
+	}{
+		{"beijing 23:00", 22, 6, time.Date(2024, 10, 17, 23, 0, 0, 0, beijing), true},
+		{"beijing 05:59", 22, 6, time.Date(2024, 10, 17, 5, 59, 0, 0, beijing), true},
+		{"beijing 06:00", 22, 6, time.Date(2024, 10, 17, 6, 0, 0, 0, beijing), false},
+		{"beijing 21:59", 22, 6, time.Date(2024, 10, 17, 21, 59, 0, 0, beijing), false},
+		// 服务器时区为 UTC 时按北京时间判断：UTC 15:00 为北京 23:00，UTC 23:00 为北京 07:00
+		{"utc 15:00 is beijing 23:00", 22, 6, time.Date(2024, 10, 17, 15, 0, 0, 0, time.UTC), true},
+		{"utc 21:30 is beijing 05:30", 22, 6, time.Date(2024, 10, 17, 21, 30, 0, 0, time.UTC), true},
+		{"utc 23:00 is beijing 07:00", 22, 6, time.Date(2024, 10, 17, 23, 0, 0, 0, time.UTC), false},
+		{"utc 03:00 is beijing 11:00", 22, 6, time.Date(2024, 10, 17, 3, 0, 0, 0, time.UTC), false},
+		{"same-day window", 1, 5, time.Date(2024, 10, 17, 18, 0, 0, 0, time.UTC), true},
+		{"same-day window end", 1, 5, time.Date(2024, 10, 17, 21, 0, 0, 0, time.UTC), false},
+		{"start equals end disables", 22, 22, time.Date(2024, 10, 17, 14, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		c := testDeliveryFeeConfig()
+		c.NightStartHour, c.NightEndHour = tt.start, tt.end
+		if got := c.isNight(tt.at); got != tt.want {
+			t.Errorf("%s: isNight(%v) = %v, want %v", tt.name, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	day := time.Date(2024, 10, 17, 4, 0, 0, 0, time.UTC)    // 北京时间 12:00
+	night := time.Date(2024, 10, 17, 15, 0, 0, 0, time.UTC) // 北京时间 23:00
+	tests := []struct {
+		name       string
+		distanceKm float64
+		radiusKm   float64
+		itemTotal  models.Money
+		at         time.Time
+		fee        int64
+		distFee    int64
+		surcharge  int64
+		free       bool
+		outOfRange bool
+	}{
+		{name: "within base distance", distanceKm: 2.5, itemTotal: models.Yuan(20), at: day, fee: 500},
+		{name: "partial km rounds up", distanceKm: 3.2, itemTotal: models.Yuan(20), at: day, fee: 600, distFee: 100},
+		{name: "night surcharge in utc", distanceKm: 4.5, itemTotal: models.Yuan(20), at: night, fee: 1000, distFee: 200, surcharge: 300},
+		{name: "free above threshold", distanceKm: 4.5, itemTotal: models.Yuan(50), at: night, fee: 0, distFee: 200, surcharge: 300, free: true},
+		{name: "default radius", distanceKm: 5.01, itemTotal: models.Yuan(20), at: day, outOfRange: true},
+		{name: "shop radius", distanceKm: 5.01, radiusKm: 8, itemTotal: models.Yuan(20), at: day, fee: 800, distFee: 300},
+	}
+	c := testDeliveryFeeConfig()
+	for _, tt := range tests {
+		quote, err := c.Quote(tt.distanceKm, tt.radiusKm, tt.itemTotal, tt.at)
+		if tt.outOfRange {
+			var outOfRange *OutOfRangeError
+			if !errors.As(err, &outOfRange) {
+				t.Errorf("%s: err = %v, want OutOfRangeError", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if quote.DeliveryFee.Cents != tt.fee || quote.DistanceFee.Cents != tt.distFee ||
+			quote.NightSurcharge.Cents != tt.surcharge || quote.FreeDelivery != tt.free {
+			t.Errorf("%s: fee/distance/night/free = %d/%d/%d/%v, want %d/%d/%d/%v", tt.name,
+				quote.DeliveryFee.Cents, quote.DistanceFee.Cents, quote.NightSurcharge.Cents, quote.FreeDelivery,
+				tt.fee, tt.distFee, tt.surcharge, tt.free)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package pricing
+
+import (
+	"take-out/config"
+	"take-out/models"
+	"time"
+)
+
+// Engine 订单计价引擎，下单试算和正式下单使用同一个引擎，保证两者金额一致
+type Engine struct {
+	Delivery       DeliveryFeeConfig
+	ServiceFeeRate float64      // 平台服务费费率，按商品小计计算
+	ServiceFeeMax  models.Money // 平台服务费上限，0 表示不限
+}
+
+// LoadEngine 从环境变量读取计价规则
+func LoadEngine() Engine {
+	return Engine{
+		Delivery:       LoadDeliveryFeeConfig(),
+		ServiceFeeRate: config.Float("SERVICE_FEE_RATE", 0),
+		ServiceFeeMax:  envMoney("SERVICE_FEE_MAX", 0),
+	}
+}
+
+// Input 计价所需的订单信息，商品明细需已填好单价快照和小计
+type Input struct {
+	ShopID     int
+	Items      []models.OrderItem
+	DistanceKm float64
+	RadiusKm   float64        // 商家最大配送半径
+	Coupon     *models.Coupon // 使用的优惠券，可为空
+	At         time.Time      // 下单时间，用于判断夜间附加费和优惠券有效期
+	DeliveryAt time.Time      // 预约送达时间，不为零时按该时间判断夜间附加费
+	Pickup     bool           // 到店自取，不计算配送费，也不校验配送范围
+}
+
+// Price 计算订单价格明细
+func (e Engine) Price(in Input) (*models.PriceBreakdown, error) {
+	breakdown := &models.PriceBreakdown{}
+	for _, item := range in.Items {
+		breakdown.ItemSubtotal = breakdown.ItemSubtotal.Add(item.Subtotal)
+		breakdown.PackagingFee = breakdown.PackagingFee.Add(item.PackagingFee.Mul(item.Quantity))
+	}
+
+	if !in.Pickup {
+		deliveryAt := in.At
+		if !in.DeliveryAt.IsZero() {
+			deliveryAt = in.DeliveryAt
+		}
+		delivery, err := e.Delivery.Quote(in.DistanceKm, in.RadiusKm, breakdown.ItemSubtotal, deliveryAt)
+		if err != nil {
+			return nil, err
+		}
+		breakdown.Delivery = delivery
+		breakdown.DeliveryFee = delivery.DeliveryFee
+	}
+
+	if in.Coupon != nil {
+		var err error
+		breakdown.Discount, err = CouponDiscount(*in.Coupon, in.ShopID, in.Items, in.At)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	breakdown.ServiceFee = breakdown.ItemSubtotal.MulRate(e.ServiceFeeRate)
+	if e.ServiceFeeMax.IsPositive() {
+		breakdown.ServiceFee = breakdown.ServiceFee.Min(e.ServiceFeeMax)
+	}
+
+	payable := breakdown.ItemSubtotal.Add(breakdown.PackagingFee).Add(breakdown.DeliveryFee).Add(breakdown.ServiceFee).Sub(breakdown.Discount)
+	breakdown.Payable = payable.Max(models.NewMoney(0))
+	return breakdown, nil
+}
@@ -91,7 +91,7 @@ func GetRequestID(r *http.Request) string {
 }
 
 // responseWriter 包装http.ResponseWriter以捕获状态码
--type responseWriter struct {
+type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
 }
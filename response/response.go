@@ -63,6 +63,8 @@ func ErrorWithDetails(w http.ResponseWriter, message string, code int, details i
 			errType = "FORBIDDEN"
 		case http.StatusNotFound:
 			errType = "NOT_FOUND"
+		case http.StatusConflict:
+			errType = "CONFLICT"
 		case http.StatusUnprocessableEntity:
 			errType = "VALIDATION_ERROR"
 		case http.StatusInternalServerError:
@@ -150,6 +152,14 @@ func Forbidden(w http.ResponseWriter, message string) {
 	Error(w, message, http.StatusForbidden)
 }
 
+// Conflict 返回资源状态冲突响应
+func Conflict(w http.ResponseWriter, message string) {
+	if message == "" {
+		message = "资源状态冲突"
+	}
+	Error(w, message, http.StatusConflict)
+}
+
 // BadRequest 返回错误请求响应
 func BadRequest(w http.ResponseWriter, message string, details interface{}) {
 	ErrorWithDetails(w, message, http.StatusBadRequest, details, "BAD_REQUEST")